@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"backend/querybuilder"
+)
+
+// Minutes past the scheduled start / before the scheduled end that still
+// count as on time
+const defaultGraceMinutes = 5
+
+// Struct to hold each attendance report row
+type AttendanceReportItem struct {
+	StaffID         int     `json:"staff_id"`
+	StaffName       string  `json:"staff_name"`
+	RoleName        string  `json:"role_name"`
+	DepartmentName  string  `json:"department_name"`
+	ScheduledShifts int     `json:"scheduled_shifts" total:"sum"`
+	LateArrivals    int     `json:"late_arrivals" total:"sum"`
+	EarlyDepartures int     `json:"early_departures" total:"sum"`
+	NoShows         int     `json:"no_shows" total:"sum"`
+	AvgMinutesLate  float64 `json:"avg_minutes_late" total:"avg" weight:"late_arrivals"`
+}
+
+// Filters accepted by the attendance report
+type AttendanceFilter struct {
+	StartDate    time.Time
+	EndDate      time.Time
+	Roles        []string
+	Departments  []string
+	GraceMinutes int
+	// Sort and page, applied by the query
+	Paging reportPaging
+}
+
+// Conditions on the latest log of an assignment, $1 is the grace period
+const (
+	lateArrivalCond    = "sl.check_in > " + scheduledStartExpr + " + make_interval(mins => $1)"
+	earlyDepartureCond = checkOutExpr + " < " + scheduledEndExpr + " - make_interval(mins => $1)"
+	noShowCond         = "sl.check_in IS NULL AND " + scheduledEndExpr + " < LOCALTIMESTAMP"
+)
+
+func (s *PostgresReportStore) Attendance(ctx context.Context, filter AttendanceFilter) ReportRows[AttendanceReportItem] {
+	// Every assignment in the range with its latest log. The scheduled
+	// end wraps to the next day for overnight shift times, a missing
+	// check-in on a shift that already ended is a no-show.
+	qb := querybuilder.New(`
+        SELECT
+            s.id AS staff_id,
+            s.name AS staff_name,
+            r.name AS role_name,
+            d.name AS department_name,
+            COUNT(sa.id) AS scheduled_shifts,
+            COUNT(*) FILTER (WHERE `+lateArrivalCond+`) AS late_arrivals,
+            COUNT(*) FILTER (WHERE `+earlyDepartureCond+`) AS early_departures,
+            COUNT(*) FILTER (WHERE `+noShowCond+`) AS no_shows,
+            COALESCE(AVG(EXTRACT(EPOCH FROM sl.check_in - `+scheduledStartExpr+`) / 60)
+                FILTER (WHERE `+lateArrivalCond+`), 0) AS avg_minutes_late
+        FROM
+            shift_assignments sa
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+        JOIN
+            staff s ON sa.staff_id = s.id
+        JOIN
+            roles r ON s.role_id = r.id
+        JOIN
+            departments d ON sa.department_id = d.id
+        LEFT JOIN LATERAL (
+            SELECT check_in, check_out
+            FROM shift_logs
+            WHERE assignment_id = sa.id
+            ORDER BY id DESC
+            LIMIT 1
+        ) sl ON TRUE
+    `, filter.GraceMinutes)
+
+	qb.Where(querybuilder.Between("sh.date", filter.StartDate, filter.EndDate))
+	qb.Where(querybuilder.In("r.name", filter.Roles))
+	qb.Where(querybuilder.In("d.name", filter.Departments))
+	qb.GroupBy("s.id", "s.name", "r.name", "d.name")
+
+	return scanPage(ctx, s, qb, filter.Paging,
+		[]string{"staff_id", "staff_name", "role_name", "department_name", "scheduled_shifts", "late_arrivals", "early_departures", "no_shows", "avg_minutes_late"},
+		[]string{"late_arrivals DESC", "no_shows DESC", "staff_name", "staff_id", "department_name"},
+		func(row rowScanner, report *AttendanceReportItem) error {
+			return row.Scan(
+				&report.StaffID,
+				&report.StaffName,
+				&report.RoleName,
+				&report.DepartmentName,
+				&report.ScheduledShifts,
+				&report.LateArrivals,
+				&report.EarlyDepartures,
+				&report.NoShows,
+				&report.AvgMinutesLate,
+			)
+		})
+}
+
+func GetAttendanceReportHandler(store ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Collect the filters from the URL
+		queryParams := r.URL.Query()
+
+		// Required date range filter
+		startDate, endDate, err := requiredDateRange(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := AttendanceFilter{
+			StartDate:    startDate,
+			EndDate:      endDate,
+			Roles:        queryValues(queryParams, "role"),
+			Departments:  queryValues(queryParams, "department"),
+			GraceMinutes: defaultGraceMinutes,
+		}
+
+		// Optional grace period in minutes
+		grace, err := optionalInt(queryParams, "grace_minutes")
+		if err != nil || (grace != nil && *grace < 0) {
+			http.Error(w, "Invalid value for grace_minutes", http.StatusBadRequest)
+			return
+		}
+		if grace != nil {
+			filter.GraceMinutes = *grace
+		}
+
+		if filter.Paging, err = requestPaging[AttendanceReportItem](r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeReportRows(w, r, reportInfo{
+			Title:     "attendance report",
+			Slug:      "attendance",
+			StartDate: &startDate,
+			EndDate:   &endDate,
+		}, store.Attendance(r.Context(), filter))
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"backend/querybuilder"
+)
+
+// Audited actions
+const (
+	AuditCreate     = "create"
+	AuditUpdate     = "update"
+	AuditDelete     = "delete"
+	AuditDeactivate = "deactivate"
+	AuditApprove    = "approve"
+	AuditDeny       = "deny"
+	AuditCheckIn    = "check_in"
+	AuditCheckOut   = "check_out"
+	AuditClaim      = "claim"
+	AuditCancel     = "cancel"
+)
+
+// Audited entities, named after their tables
+const (
+	EntityStaff               = "staff"
+	EntityLeaveRequest        = "leave_requests"
+	EntityShiftLog            = "shift_logs"
+	EntityOvertime            = "overtimes"
+	EntityShiftAssignment     = "shift_assignments"
+	EntityCoverageRequirement = "coverage_requirements"
+	EntityRolePayRate         = "role_pay_rates"
+	EntityStaffPayRate        = "staff_pay_rates"
+	EntityPayMultipliers      = "pay_multipliers"
+	EntityHoliday             = "holidays"
+	EntityDepartmentBudget    = "department_budgets"
+	EntityShiftOffer          = "shift_offers"
+	EntityUser                = "users"
+)
+
+// A row of audit_events. OldData is null on creation, NewData on deletion.
+type AuditEvent struct {
+	ID         int             `json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	ActorID    *int            `json:"actor_id"`
+	ActorEmail string          `json:"actor_email"`
+	Action     string          `json:"action"`
+	Entity     string          `json:"entity"`
+	EntityID   int             `json:"entity_id"`
+	OldData    json.RawMessage `json:"old_data"`
+	NewData    json.RawMessage `json:"new_data"`
+}
+
+// Actor recorded for changes made outside a request, e.g. at startup
+const systemActor = "system"
+
+// Marshals a snapshot for the audit row, nil stays SQL NULL
+func auditJSON(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Records a change made by the caller of the request in ctx. q must be the
+// transaction making the change, so the event commits or rolls back with it.
+func recordAudit(ctx context.Context, q queryer, action, entity string, entityID int, before, after interface{}) error {
+	oldData, err := auditJSON(before)
+	if err != nil {
+		return err
+	}
+	newData, err := auditJSON(after)
+	if err != nil {
+		return err
+	}
+
+	var actorID *int
+	actorEmail := systemActor
+	if claims := claimsFrom(ctx); claims.Subject != 0 {
+		actorID = &claims.Subject
+		actorEmail = claims.Email
+	}
+	_, err = q.ExecContext(ctx, `
+        INSERT INTO audit_events (actor_id, actor_email, action, entity, entity_id, old_data, new_data)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `, actorID, actorEmail, action, entity, entityID, oldData, newData)
+	return err
+}
+
+// Records the create or update made by an upsert, before is nil when the
+// row didn't exist yet
+func recordUpsert[T any](ctx context.Context, q queryer, entity string, entityID int, before *T, after T) error {
+	if before == nil {
+		return recordAudit(ctx, q, AuditCreate, entity, entityID, nil, after)
+	}
+	return recordAudit(ctx, q, AuditUpdate, entity, entityID, before, after)
+}
+
+// Filters for the audit listing
+type AuditFilter struct {
+	Entities []string
+	EntityID *int
+	Actions  []string
+	Actors   []string
+	From     *time.Time
+	To       *time.Time
+	Limit    int
+	Offset   int
+}
+
+// One page of the audit listing, newest first
+type AuditPage struct {
+	Events []AuditEvent `json:"events"`
+	Total  int          `json:"total"`
+	Limit  int          `json:"limit"`
+	Offset int          `json:"offset"`
+}
+
+// AuditStore reads audit_events, rows are only ever written by
+// recordAudit
+type AuditStore interface {
+	ListAudit(ctx context.Context, filter AuditFilter) (AuditPage, error)
+}
+
+type PostgresAuditStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAuditStore(db *sql.DB) *PostgresAuditStore {
+	return &PostgresAuditStore{db: db}
+}
+
+func (s *PostgresAuditStore) ListAudit(ctx context.Context, filter AuditFilter) (AuditPage, error) {
+	page := AuditPage{Events: []AuditEvent{}, Limit: filter.Limit, Offset: filter.Offset}
+
+	qb := querybuilder.New(`
+        SELECT
+            id,
+            occurred_at,
+            actor_id,
+            actor_email,
+            action,
+            entity,
+            entity_id,
+            old_data,
+            new_data
+        FROM
+            audit_events
+    `)
+	qb.Where(querybuilder.In("entity", filter.Entities))
+	if filter.EntityID != nil {
+		qb.Where(querybuilder.Eq("entity_id", *filter.EntityID))
+	}
+	qb.Where(querybuilder.In("action", filter.Actions))
+	qb.Where(querybuilder.In("actor_email", filter.Actors))
+	if filter.From != nil {
+		qb.Where(querybuilder.Expr("occurred_at >= %s", *filter.From))
+	}
+	if filter.To != nil {
+		qb.Where(querybuilder.Expr("occurred_at < %s", *filter.To))
+	}
+
+	countQuery, countValues := qb.Count()
+	if err := s.db.QueryRowContext(ctx, countQuery, countValues...).Scan(&page.Total); err != nil {
+		return page, err
+	}
+
+	qb.OrderBy("occurred_at DESC", "id DESC")
+	qb.Page(filter.Limit, filter.Offset)
+	query, values := qb.Build()
+	rows, err := s.db.QueryContext(ctx, query, values...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event AuditEvent
+		var actorID sql.NullInt64
+		var oldData, newData []byte
+		err := rows.Scan(
+			&event.ID,
+			&event.OccurredAt,
+			&actorID,
+			&event.ActorEmail,
+			&event.Action,
+			&event.Entity,
+			&event.EntityID,
+			&oldData,
+			&newData,
+		)
+		if err != nil {
+			return page, err
+		}
+		if actorID.Valid {
+			id := int(actorID.Int64)
+			event.ActorID = &id
+		}
+		if oldData != nil {
+			event.OldData = oldData
+		}
+		if newData != nil {
+			event.NewData = newData
+		}
+		page.Events = append(page.Events, event)
+	}
+	return page, rows.Err()
+}
+
+// Parses a from / to bound, either a date or an RFC 3339 timestamp. A bare
+// date as the upper bound includes that whole day.
+func auditBound(queryParams url.Values, key string, upper bool) (*time.Time, error) {
+	raw := queryParams.Get(key)
+	if raw == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse(dateLayout, raw)
+	if err != nil {
+		return nil, errors.New("Invalid " + key + ", use YYYY-MM-DD or an RFC 3339 timestamp")
+	}
+	if upper {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+func ListAuditHandler(store AuditStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queryParams := r.URL.Query()
+
+		limit, offset, err := parsePage(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter := AuditFilter{
+			Entities: queryValues(queryParams, "entity"),
+			Actions:  queryValues(queryParams, "action"),
+			Actors:   queryValues(queryParams, "actor"),
+			Limit:    limit,
+			Offset:   offset,
+		}
+		if filter.EntityID, err = optionalInt(queryParams, "entity_id"); err != nil {
+			http.Error(w, "Invalid value for entity_id", http.StatusBadRequest)
+			return
+		}
+		if filter.From, err = auditBound(queryParams, "from", false); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filter.To, err = auditBound(queryParams, "to", true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		page, err := store.ListAudit(r.Context(), filter)
+		if err != nil {
+			log.Printf("Error listing audit events: %v", err)
+			http.Error(w, "Failed to fetch audit events", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, page)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// Application roles, mirror the CHECK on users.role
+const (
+	RoleAdmin          = "admin"
+	RoleDepartmentHead = "department_head"
+	RoleScheduler      = "scheduler"
+	RoleStaff          = "staff"
+)
+
+// How long a session token is valid, about one long shift
+const sessionTTL = 12 * time.Hour
+
+var (
+	ErrInvalidCredentials = errors.New("Invalid email or password")
+	ErrInvalidToken       = errors.New("Invalid or expired token")
+	ErrOutsideDepartments = errors.New("Forbidden: the staff member is not in one of your departments")
+)
+
+// A department a user is in charge of
+type UserDepartment struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// A login of the application. StaffID links staff users to their staff
+// row, Departments are the ones a department head runs.
+type User struct {
+	ID          int              `json:"id"`
+	Email       string           `json:"email"`
+	Role        string           `json:"role"`
+	StaffID     *int             `json:"staff_id"`
+	Departments []UserDepartment `json:"departments"`
+}
+
+// The session carried by the token, everything the middleware needs to
+// authorize a request without a database round trip
+type Claims struct {
+	Subject     int              `json:"sub"`
+	Email       string           `json:"email"`
+	Role        string           `json:"role"`
+	StaffID     *int             `json:"staff_id,omitempty"`
+	Departments []UserDepartment `json:"departments,omitempty"`
+	IssuedAt    int64            `json:"iat"`
+	ExpiresAt   int64            `json:"exp"`
+}
+
+func (c Claims) departmentNames() []string {
+	names := make([]string, len(c.Departments))
+	for i, d := range c.Departments {
+		names[i] = d.Name
+	}
+	return names
+}
+
+func (c Claims) headOf(departmentID int) bool {
+	return slices.ContainsFunc(c.Departments, func(d UserDepartment) bool { return d.ID == departmentID })
+}
+
+// Departments a request is limited to: the names of the ones a department
+// head runs, nil (no limit) for every other role
+func (c Claims) departmentScope() []string {
+	if c.Role != RoleDepartmentHead {
+		return nil
+	}
+	return c.departmentNames()
+}
+
+// Whether the claims belong to the staff member with the given id
+func (c Claims) isStaff(staffID int) bool {
+	return c.StaffID != nil && *c.StaffID == staffID
+}
+
+// Signs and verifies HS256 JSON Web Tokens
+type TokenSigner struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewTokenSigner(secret string) *TokenSigner {
+	return &TokenSigner{secret: []byte(secret), ttl: sessionTTL}
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (t *TokenSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issues a token for the user
+func (t *TokenSigner) Issue(user User, now time.Time) (string, Claims, error) {
+	claims := Claims{
+		Subject:     user.ID,
+		Email:       user.Email,
+		Role:        user.Role,
+		StaffID:     user.StaffID,
+		Departments: user.Departments,
+		IssuedAt:    now.Unix(),
+		ExpiresAt:   now.Add(t.ttl).Unix(),
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", claims, err
+	}
+	payload := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(body)
+	return payload + "." + t.sign(payload), claims, nil
+}
+
+// Checks the signature and expiry of a token. Only the header this service
+// issues is accepted, so a token can't pick its own algorithm.
+func (t *TokenSigner) Verify(token string, now time.Time) (Claims, error) {
+	var claims Claims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return claims, ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(t.sign(parts[0]+"."+parts[1]))) {
+		return claims, ErrInvalidToken
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(body, &claims) != nil {
+		return claims, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// PBKDF2-HMAC-SHA256 parameters of new password hashes, the iteration
+// count is stored with each hash so it can be raised later
+const (
+	passwordIterations = 310000
+	passwordSaltLen    = 16
+	passwordKeyLen     = 32
+)
+
+// Derives a key with PBKDF2 (RFC 8018) over HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := slices.Clone(u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// Hashes a password as pbkdf2-sha256$<iterations>$<salt>$<key>
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations, passwordKeyLen)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iterations, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// Compared against when the email doesn't exist, so a login takes as long
+// for unknown users as for a wrong password
+var dummyPasswordHash, _ = hashPassword("not a real password")
+
+// AuthStore checks credentials against the users table
+type AuthStore interface {
+	Authenticate(ctx context.Context, email, password string) (User, error)
+	// Creates the admin user when no admin exists yet
+	EnsureAdmin(ctx context.Context, email, password string) error
+}
+
+type PostgresAuthStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAuthStore(db *sql.DB) *PostgresAuthStore {
+	return &PostgresAuthStore{db: db}
+}
+
+func (s *PostgresAuthStore) Authenticate(ctx context.Context, email, password string) (User, error) {
+	var user User
+	var hash string
+	var staffID sql.NullInt64
+	var departmentIDs pq.Int64Array
+	var departmentNames pq.StringArray
+	err := s.db.QueryRowContext(ctx, `
+        SELECT
+            u.id,
+            u.email,
+            u.role,
+            u.staff_id,
+            u.password_hash,
+            COALESCE(ARRAY_AGG(d.id ORDER BY d.name) FILTER (WHERE d.id IS NOT NULL), '{}'),
+            COALESCE(ARRAY_AGG(d.name ORDER BY d.name) FILTER (WHERE d.id IS NOT NULL), '{}')
+        FROM
+            users u
+        LEFT JOIN
+            user_departments ud ON ud.user_id = u.id
+        LEFT JOIN
+            departments d ON ud.department_id = d.id
+        WHERE
+            LOWER(u.email) = LOWER($1) AND u.active
+        GROUP BY
+            u.id
+    `, email).Scan(&user.ID, &user.Email, &user.Role, &staffID, &hash, &departmentIDs, &departmentNames)
+	if errors.Is(err, sql.ErrNoRows) {
+		checkPassword(dummyPasswordHash, password)
+		return user, ErrInvalidCredentials
+	}
+	if err != nil {
+		return user, err
+	}
+	if !checkPassword(hash, password) {
+		return user, ErrInvalidCredentials
+	}
+
+	if staffID.Valid {
+		id := int(staffID.Int64)
+		user.StaffID = &id
+	}
+	user.Departments = []UserDepartment{}
+	for i, id := range departmentIDs {
+		user.Departments = append(user.Departments, UserDepartment{ID: int(id), Name: departmentNames[i]})
+	}
+	return user, nil
+}
+
+func (s *PostgresAuthStore) EnsureAdmin(ctx context.Context, email, password string) error {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE role = $1)", RoleAdmin).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+        INSERT INTO users (email, password_hash, role)
+        VALUES ($1, $2, $3)
+    `, email, hash, RoleAdmin)
+	return err
+}
+
+type claimsKey struct{}
+
+// Claims of the authenticated request, set by Authenticate
+func claimsFrom(ctx context.Context) Claims {
+	claims, _ := ctx.Value(claimsKey{}).(Claims)
+	return claims
+}
+
+// Requires a valid bearer token
+func Authenticate(signer *TokenSigner) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			claims, err := signer.Verify(strings.TrimSpace(token), time.Now())
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="hospital"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+		})
+	}
+}
+
+// Only lets the given roles through
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !slices.Contains(roles, claimsFrom(r.Context()).Role) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Lets the given roles through, and staff users when the {id} route
+// parameter is their own staff id
+func RequireSelfOrRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := claimsFrom(r.Context())
+			id, err := strconv.Atoi(chi.URLParam(r, "id"))
+			if !slices.Contains(roles, claims.Role) && (err != nil || !claims.isStaff(id)) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Limits department heads to their own departments. Handlers filter on the
+// department query parameter, so it is narrowed to the head's departments:
+// left empty it becomes all of them, naming another department is refused.
+// With a {id} department route parameter the department itself is checked.
+func ScopeDepartments(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFrom(r.Context())
+		if claims.Role != RoleDepartmentHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if raw := chi.URLParam(r, "id"); raw != "" {
+			if id, err := strconv.Atoi(raw); err != nil || !claims.headOf(id) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		own := claims.departmentNames()
+		queryParams := r.URL.Query()
+		requested := queryValues(queryParams, "department")
+		for _, department := range requested {
+			if !slices.Contains(own, department) {
+				http.Error(w, "Forbidden: "+department+" is not one of your departments", http.StatusForbidden)
+				return
+			}
+		}
+		if len(requested) == 0 {
+			if len(own) == 0 {
+				http.Error(w, "Forbidden: no departments assigned", http.StatusForbidden)
+				return
+			}
+			queryParams["department"] = own
+			r.URL.RawQuery = queryParams.Encode()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Payload of POST /auth/login
+type LoginInput struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// Response of POST /auth/login
+type LoginResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	User      User      `json:"user"`
+}
+
+func LoginHandler(store AuthStore, signer *TokenSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input LoginInput
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		user, err := store.Authenticate(r.Context(), strings.TrimSpace(input.Email), input.Password)
+		if errors.Is(err, ErrInvalidCredentials) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Error authenticating user: %v", err)
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return
+		}
+
+		token, claims, err := signer.Issue(user, time.Now())
+		if err != nil {
+			log.Printf("Error issuing token: %v", err)
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, LoginResponse{
+			Token:     token,
+			ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+			User:      user,
+		})
+	}
+}
+
+// Returns the session of the caller
+func MeHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, claimsFrom(r.Context()))
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/querybuilder"
+)
+
+// Default window of a feed around today. Calendar apps poll the same URL
+// forever, so the feed slides with the date unless a range is given.
+const (
+	calendarDaysBack    = 30
+	calendarDaysForward = 90
+)
+
+// Product identifier written in every feed
+const calendarProdID = "-//Hospital Staffing//Shift Calendar//EN"
+
+// A shift assignment as a calendar event
+type CalendarShift struct {
+	AssignmentID   int
+	StaffName      string
+	DepartmentName string
+	ShiftTime      string
+	ShiftType      string
+	Start          time.Time
+	End            time.Time
+}
+
+// An approved leave as an all-day event, End nil means indefinite
+type CalendarLeave struct {
+	LeaveID   int
+	StaffName string
+	StartDate time.Time
+	EndDate   *time.Time
+}
+
+type Calendar struct {
+	Name   string
+	Shifts []CalendarShift
+	Leaves []CalendarLeave
+}
+
+// CalendarStore loads the events of the iCalendar feeds
+type CalendarStore interface {
+	StaffCalendar(ctx context.Context, staffID int, start, end time.Time) (Calendar, error)
+	DepartmentCalendar(ctx context.Context, departmentID int, start, end time.Time) (Calendar, error)
+}
+
+type PostgresCalendarStore struct {
+	db *sql.DB
+}
+
+func NewPostgresCalendarStore(db *sql.DB) *PostgresCalendarStore {
+	return &PostgresCalendarStore{db: db}
+}
+
+func (s *PostgresCalendarStore) StaffCalendar(ctx context.Context, staffID int, start, end time.Time) (Calendar, error) {
+	var calendar Calendar
+	err := s.db.QueryRowContext(ctx, "SELECT name FROM staff WHERE id = $1", staffID).Scan(&calendar.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return calendar, ErrNotFound
+	}
+	if err != nil {
+		return calendar, err
+	}
+
+	if calendar.Shifts, err = s.shifts(ctx, querybuilder.Eq("sa.staff_id", staffID), start, end); err != nil {
+		return calendar, err
+	}
+	calendar.Leaves, err = s.leaves(ctx, querybuilder.Eq("lr.staff_id", staffID), start, end)
+	return calendar, err
+}
+
+// The department feed has everyone's shifts in the department and the
+// leaves of its members, who are the people missing from the rota
+func (s *PostgresCalendarStore) DepartmentCalendar(ctx context.Context, departmentID int, start, end time.Time) (Calendar, error) {
+	var calendar Calendar
+	err := s.db.QueryRowContext(ctx, "SELECT name FROM departments WHERE id = $1", departmentID).Scan(&calendar.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return calendar, ErrNotFound
+	}
+	if err != nil {
+		return calendar, err
+	}
+
+	if calendar.Shifts, err = s.shifts(ctx, querybuilder.Eq("sa.department_id", departmentID), start, end); err != nil {
+		return calendar, err
+	}
+	members := querybuilder.Expr(`EXISTS (
+            SELECT 1 FROM staff_departments sd
+            WHERE sd.staff_id = lr.staff_id
+            AND sd.department_id = %s
+            AND sd.start_date <= COALESCE(lr.end_date, %s)
+            AND (sd.end_date IS NULL OR sd.end_date >= lr.start_date)
+        )`, departmentID, end)
+	calendar.Leaves, err = s.leaves(ctx, members, start, end)
+	return calendar, err
+}
+
+func (s *PostgresCalendarStore) shifts(ctx context.Context, who querybuilder.Clause, start, end time.Time) ([]CalendarShift, error) {
+	qb := querybuilder.New(`
+        SELECT
+            sa.id,
+            s.name,
+            d.name,
+            st.name,
+            sa.shift_type,
+            sh.date,
+            st.start_time::text,
+            st.end_time::text
+        FROM
+            shift_assignments sa
+        JOIN
+            staff s ON sa.staff_id = s.id
+        JOIN
+            departments d ON sa.department_id = d.id
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+    `)
+	qb.Where(who)
+	qb.Where(querybuilder.Between("sh.date", start, end))
+	qb.OrderBy("sh.date", "st.start_time", "s.name")
+
+	query, values := qb.Build()
+	rows, err := s.db.QueryContext(ctx, query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shifts []CalendarShift
+	for rows.Next() {
+		var shift CalendarShift
+		var date time.Time
+		var startTime, endTime string
+		err := rows.Scan(
+			&shift.AssignmentID,
+			&shift.StaffName,
+			&shift.DepartmentName,
+			&shift.ShiftTime,
+			&shift.ShiftType,
+			&date,
+			&startTime,
+			&endTime,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if shift.Start, shift.End, err = shiftWindow(date, startTime, endTime); err != nil {
+			return nil, err
+		}
+		shifts = append(shifts, shift)
+	}
+	return shifts, rows.Err()
+}
+
+func (s *PostgresCalendarStore) leaves(ctx context.Context, who querybuilder.Clause, start, end time.Time) ([]CalendarLeave, error) {
+	qb := querybuilder.New(`
+        SELECT lr.id, s.name, lr.start_date, lr.end_date
+        FROM leave_requests lr
+        JOIN staff s ON lr.staff_id = s.id
+    `)
+	qb.Where(who)
+	qb.Where(querybuilder.Raw("lr.status = 'approved'"))
+	qb.Where(querybuilder.Expr("lr.start_date <= %s AND (lr.end_date IS NULL OR lr.end_date >= %s)", end, start))
+	qb.OrderBy("lr.start_date", "s.name")
+
+	query, values := qb.Build()
+	rows, err := s.db.QueryContext(ctx, query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var leaves []CalendarLeave
+	for rows.Next() {
+		var leave CalendarLeave
+		var endDate sql.NullTime
+		if err := rows.Scan(&leave.LeaveID, &leave.StaffName, &leave.StartDate, &endDate); err != nil {
+			return nil, err
+		}
+		if endDate.Valid {
+			leave.EndDate = &endDate.Time
+		}
+		leaves = append(leaves, leave)
+	}
+	return leaves, rows.Err()
+}
+
+// Writes an iCalendar (RFC 5545) document, CRLF terminated and folded at
+// 75 octets as the spec requires
+type icsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ics *icsWriter) line(name, value string) {
+	if ics.err != nil {
+		return
+	}
+	line := name + ":" + value
+	var b strings.Builder
+	// Continuation lines start with the folding space, which counts
+	// towards their 75 octets
+	limit := 75
+	for len(line) > limit {
+		// Don't split a multi-byte character
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+	_, ics.err = io.WriteString(ics.w, b.String())
+}
+
+// Escapes a TEXT value
+func icsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// Shift times are wall clock times of the server's zone, the feed carries
+// them as UTC so every client places them right
+func icsDateTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+func icsDate(t time.Time) string {
+	return t.Format("20060102")
+}
+
+// Renders the feed. withStaff puts the staff member's name in the summaries,
+// which the department feed needs and a personal feed doesn't. Indefinite
+// leaves are cut at the end of the window, the next poll extends them.
+func writeCalendar(w io.Writer, calendar Calendar, withStaff bool, host string, windowEnd time.Time) error {
+	now := icsDateTime(time.Now())
+	ics := &icsWriter{w: w}
+	ics.line("BEGIN", "VCALENDAR")
+	ics.line("VERSION", "2.0")
+	ics.line("PRODID", calendarProdID)
+	ics.line("CALSCALE", "GREGORIAN")
+	ics.line("METHOD", "PUBLISH")
+	ics.line("X-WR-CALNAME", icsText(calendar.Name+" shifts"))
+
+	for _, shift := range calendar.Shifts {
+		summary := shift.ShiftTime + " shift"
+		if shift.ShiftType == "on-call" {
+			summary += " (on-call)"
+		}
+		if withStaff {
+			summary = shift.StaffName + " - " + summary
+		}
+		ics.line("BEGIN", "VEVENT")
+		ics.line("UID", fmt.Sprintf("assignment-%d@%s", shift.AssignmentID, host))
+		ics.line("DTSTAMP", now)
+		ics.line("DTSTART", icsDateTime(shift.Start))
+		ics.line("DTEND", icsDateTime(shift.End))
+		ics.line("SUMMARY", icsText(summary))
+		ics.line("LOCATION", icsText(shift.DepartmentName))
+		ics.line("CATEGORIES", icsText(shift.ShiftType))
+		ics.line("TRANSP", "OPAQUE")
+		ics.line("END", "VEVENT")
+	}
+
+	for _, leave := range calendar.Leaves {
+		summary := "On leave"
+		if withStaff {
+			summary = leave.StaffName + " - " + summary
+		}
+		// All-day events end on the day after the last one
+		last := windowEnd
+		if leave.EndDate != nil {
+			last = *leave.EndDate
+		}
+		ics.line("BEGIN", "VEVENT")
+		ics.line("UID", fmt.Sprintf("leave-%d@%s", leave.LeaveID, host))
+		ics.line("DTSTAMP", now)
+		ics.line("DTSTART;VALUE=DATE", icsDate(leave.StartDate))
+		ics.line("DTEND;VALUE=DATE", icsDate(last.AddDate(0, 0, 1)))
+		ics.line("SUMMARY", icsText(summary))
+		ics.line("TRANSP", "OPAQUE")
+		ics.line("END", "VEVENT")
+	}
+
+	ics.line("END", "VCALENDAR")
+	return ics.err
+}
+
+// Parses the optional start_date / end_date of a feed, defaulting to the
+// sliding window around today
+func calendarWindow(r *http.Request) (time.Time, time.Time, error) {
+	queryParams := r.URL.Query()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	start, end := today.AddDate(0, 0, -calendarDaysBack), today.AddDate(0, 0, calendarDaysForward)
+
+	if v, err := optionalDate(queryParams, "start_date"); err != nil {
+		return start, end, errors.New("Invalid start date")
+	} else if v != nil {
+		start = *v
+	}
+	if v, err := optionalDate(queryParams, "end_date"); err != nil {
+		return start, end, errors.New("Invalid end date")
+	} else if v != nil {
+		end = *v
+	}
+	if end.Before(start) {
+		return start, end, errors.New("end_date must not be before start_date")
+	}
+	return start, end, nil
+}
+
+// Builds the feed handlers, load picks the staff member or department
+func CalendarHandler(load func(ctx context.Context, id int, start, end time.Time) (Calendar, error), withStaff bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+		start, end, err := calendarWindow(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		calendar, err := load(r.Context(), id, start, end)
+		if errors.Is(err, ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading calendar: %v", err)
+			http.Error(w, "Failed to fetch calendar", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Content-Disposition", `inline; filename="calendar.ics"`)
+		host, _, _ := strings.Cut(r.Host, ":")
+		if err := writeCalendar(w, calendar, withStaff, host, end); err != nil {
+			log.Printf("Error writing calendar: %v", err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestICSLineFolding(t *testing.T) {
+	tests := map[string]string{
+		"ascii":      strings.Repeat("a", 300),
+		"multi-byte": strings.Repeat("é", 150),
+		"exact":      strings.Repeat("b", 75-len("SUMMARY:")),
+	}
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			var b strings.Builder
+			ics := &icsWriter{w: &b}
+			ics.line("SUMMARY", value)
+			if ics.err != nil {
+				t.Fatal(ics.err)
+			}
+
+			out := b.String()
+			if !strings.HasSuffix(out, "\r\n") {
+				t.Fatalf("line isn't CRLF terminated: %q", out)
+			}
+			lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+			for i, line := range lines {
+				if len(line) > 75 {
+					t.Errorf("line %d is %d octets", i, len(line))
+				}
+				if i > 0 && !strings.HasPrefix(line, " ") {
+					t.Errorf("continuation line %d doesn't start with a space", i)
+				}
+			}
+
+			unfolded := strings.ReplaceAll(strings.TrimSuffix(out, "\r\n"), "\r\n ", "")
+			if unfolded != "SUMMARY:"+value {
+				t.Errorf("unfolded line doesn't round trip")
+			}
+		})
+	}
+}
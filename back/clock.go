@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"backend/querybuilder"
+)
+
+// How early before the scheduled start a check-in is accepted
+const checkInLeeway = 2 * time.Hour
+
+var (
+	ErrAlreadyCheckedIn  = errors.New("The assignment has already been checked in")
+	ErrNotCheckedIn      = errors.New("The assignment has not been checked in")
+	ErrAlreadyCheckedOut = errors.New("The assignment has already been checked out")
+)
+
+// Returned when a check-in happens too far from the scheduled shift
+type ShiftWindowError struct {
+	Start time.Time
+	End   time.Time
+}
+
+func (e *ShiftWindowError) Error() string {
+	return fmt.Sprintf("Check-in is only accepted between %s and %s",
+		e.Start.Add(-checkInLeeway).Format(time.DateTime), e.End.Format(time.DateTime))
+}
+
+// A shift_logs row with the schedule it is measured against
+type ShiftLog struct {
+	ID             int        `json:"id"`
+	AssignmentID   int        `json:"assignment_id"`
+	CheckIn        *time.Time `json:"check_in"`
+	CheckOut       *time.Time `json:"check_out"`
+	ScheduledStart time.Time  `json:"scheduled_start"`
+	ScheduledEnd   time.Time  `json:"scheduled_end"`
+}
+
+// Someone who checked in and hasn't checked out yet
+type OnShiftEntry struct {
+	AssignmentID   int       `json:"assignment_id"`
+	StaffID        int       `json:"staff_id"`
+	StaffName      string    `json:"staff_name"`
+	RoleName       string    `json:"role_name"`
+	ShiftTime      string    `json:"shift_time"`
+	ShiftType      string    `json:"shift_type"`
+	CheckIn        time.Time `json:"check_in"`
+	ScheduledStart time.Time `json:"scheduled_start"`
+	ScheduledEnd   time.Time `json:"scheduled_end"`
+}
+
+// The open roster of a department
+type DepartmentRoster struct {
+	DepartmentName string         `json:"department_name"`
+	OnShift        []OnShiftEntry `json:"on_shift"`
+}
+
+// ClockStore writes check-ins / check-outs to shift_logs and the overtime
+// recorded after them
+type ClockStore interface {
+	CheckIn(ctx context.Context, assignmentID int, at time.Time) (ShiftLog, error)
+	CheckOut(ctx context.Context, assignmentID int, at time.Time) (ShiftLog, error)
+	OnShift(ctx context.Context, departments []string) ([]DepartmentRoster, error)
+	AssignmentOwner(ctx context.Context, assignmentID int) (staffID, departmentID int, err error)
+	RecordOvertime(ctx context.Context, assignmentID int, duration time.Duration) (OvertimeEntry, error)
+}
+
+type PostgresClockStore struct {
+	db *sql.DB
+}
+
+func NewPostgresClockStore(db *sql.DB) *PostgresClockStore {
+	return &PostgresClockStore{db: db}
+}
+
+// Locks the assignment and loads its schedule and log (if any). Locking
+// the assignment serialises concurrent punches for the same shift.
+func lockAssignmentLog(ctx context.Context, tx *sql.Tx, assignmentID int) (ShiftLog, error) {
+	shiftLog := ShiftLog{AssignmentID: assignmentID}
+
+	var date time.Time
+	var startTime, endTime string
+	err := tx.QueryRowContext(ctx, `
+        SELECT sh.date, st.start_time::text, st.end_time::text
+        FROM shift_assignments sa
+        JOIN shifts sh ON sa.shift_id = sh.id
+        JOIN shift_times st ON sh.shift_time_id = st.id
+        WHERE sa.id = $1
+        FOR UPDATE OF sa
+    `, assignmentID).Scan(&date, &startTime, &endTime)
+	if errors.Is(err, sql.ErrNoRows) {
+		return shiftLog, ErrNotFound
+	}
+	if err != nil {
+		return shiftLog, err
+	}
+	if shiftLog.ScheduledStart, shiftLog.ScheduledEnd, err = shiftWindow(date, startTime, endTime); err != nil {
+		return shiftLog, err
+	}
+
+	var checkIn, checkOut sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+        SELECT id, check_in, check_out
+        FROM shift_logs
+        WHERE assignment_id = $1
+        ORDER BY id DESC
+        LIMIT 1
+    `, assignmentID).Scan(&shiftLog.ID, &checkIn, &checkOut)
+	if errors.Is(err, sql.ErrNoRows) {
+		return shiftLog, nil
+	}
+	if err != nil {
+		return shiftLog, err
+	}
+	if checkIn.Valid {
+		t := localWallClock(checkIn.Time)
+		shiftLog.CheckIn = &t
+	}
+	if checkOut.Valid {
+		t := localWallClock(checkOut.Time)
+		shiftLog.CheckOut = &t
+	}
+	return shiftLog, nil
+}
+
+func (s *PostgresClockStore) CheckIn(ctx context.Context, assignmentID int, at time.Time) (ShiftLog, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ShiftLog{}, err
+	}
+	defer tx.Rollback()
+
+	shiftLog, err := lockAssignmentLog(ctx, tx, assignmentID)
+	if err != nil {
+		return shiftLog, err
+	}
+	if shiftLog.CheckIn != nil {
+		return shiftLog, ErrAlreadyCheckedIn
+	}
+	if at.Before(shiftLog.ScheduledStart.Add(-checkInLeeway)) || at.After(shiftLog.ScheduledEnd) {
+		return shiftLog, &ShiftWindowError{Start: shiftLog.ScheduledStart, End: shiftLog.ScheduledEnd}
+	}
+
+	// A log may already exist without a check-in (recorded no-show)
+	before := shiftLog
+	if shiftLog.ID != 0 {
+		_, err = tx.ExecContext(ctx, "UPDATE shift_logs SET check_in = $1 WHERE id = $2", at, shiftLog.ID)
+	} else {
+		err = tx.QueryRowContext(ctx, `
+            INSERT INTO shift_logs (assignment_id, check_in)
+            VALUES ($1, $2)
+            RETURNING id
+        `, assignmentID, at).Scan(&shiftLog.ID)
+	}
+	if err != nil {
+		return shiftLog, err
+	}
+	shiftLog.CheckIn = &at
+	if before.ID == 0 {
+		err = recordAudit(ctx, tx, AuditCheckIn, EntityShiftLog, shiftLog.ID, nil, shiftLog)
+	} else {
+		err = recordAudit(ctx, tx, AuditCheckIn, EntityShiftLog, shiftLog.ID, before, shiftLog)
+	}
+	if err != nil {
+		return shiftLog, err
+	}
+	return shiftLog, tx.Commit()
+}
+
+func (s *PostgresClockStore) CheckOut(ctx context.Context, assignmentID int, at time.Time) (ShiftLog, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ShiftLog{}, err
+	}
+	defer tx.Rollback()
+
+	shiftLog, err := lockAssignmentLog(ctx, tx, assignmentID)
+	if err != nil {
+		return shiftLog, err
+	}
+	if shiftLog.CheckIn == nil {
+		return shiftLog, ErrNotCheckedIn
+	}
+	if shiftLog.CheckOut != nil {
+		return shiftLog, ErrAlreadyCheckedOut
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE shift_logs SET check_out = $1 WHERE id = $2", at, shiftLog.ID); err != nil {
+		return shiftLog, err
+	}
+	before := shiftLog
+	shiftLog.CheckOut = &at
+	if err := recordAudit(ctx, tx, AuditCheckOut, EntityShiftLog, shiftLog.ID, before, shiftLog); err != nil {
+		return shiftLog, err
+	}
+	return shiftLog, tx.Commit()
+}
+
+func (s *PostgresClockStore) OnShift(ctx context.Context, departments []string) ([]DepartmentRoster, error) {
+	qb := querybuilder.New(`
+        SELECT
+            d.name,
+            sa.id,
+            s.id,
+            s.name,
+            r.name,
+            st.name,
+            sa.shift_type,
+            sl.check_in,
+            sh.date,
+            st.start_time::text,
+            st.end_time::text
+        FROM
+            shift_logs sl
+        JOIN
+            shift_assignments sa ON sl.assignment_id = sa.id
+        JOIN
+            staff s ON sa.staff_id = s.id
+        JOIN
+            roles r ON s.role_id = r.id
+        JOIN
+            departments d ON sa.department_id = d.id
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+    `)
+	qb.Where(querybuilder.Raw("sl.check_in IS NOT NULL"))
+	qb.Where(querybuilder.Raw("sl.check_out IS NULL"))
+	qb.Where(querybuilder.In("d.name", departments))
+	qb.OrderBy("d.name", "s.name")
+
+	query, values := qb.Build()
+	rows, err := s.db.QueryContext(ctx, query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Rows arrive sorted by department, start a new roster on each change
+	rosters := []DepartmentRoster{}
+	for rows.Next() {
+		var department, startTime, endTime string
+		var date time.Time
+		var entry OnShiftEntry
+		err := rows.Scan(
+			&department,
+			&entry.AssignmentID,
+			&entry.StaffID,
+			&entry.StaffName,
+			&entry.RoleName,
+			&entry.ShiftTime,
+			&entry.ShiftType,
+			&entry.CheckIn,
+			&date,
+			&startTime,
+			&endTime,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if entry.ScheduledStart, entry.ScheduledEnd, err = shiftWindow(date, startTime, endTime); err != nil {
+			return nil, err
+		}
+		entry.CheckIn = localWallClock(entry.CheckIn)
+
+		if len(rosters) == 0 || rosters[len(rosters)-1].DepartmentName != department {
+			rosters = append(rosters, DepartmentRoster{DepartmentName: department})
+		}
+		last := &rosters[len(rosters)-1]
+		last.OnShift = append(last.OnShift, entry)
+	}
+	return rosters, rows.Err()
+}
+
+// The staff member an assignment belongs to and the department it's in
+func (s *PostgresClockStore) AssignmentOwner(ctx context.Context, assignmentID int) (staffID, departmentID int, err error) {
+	err = s.db.QueryRowContext(ctx, "SELECT staff_id, department_id FROM shift_assignments WHERE id = $1", assignmentID).Scan(&staffID, &departmentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, ErrNotFound
+	}
+	return staffID, departmentID, err
+}
+
+// Staff users may only punch their own assignments and department heads
+// those in their departments (or their own), schedulers and admins can
+// punch for anyone (e.g. fixing a forgotten check-out)
+func RequireOwnAssignment(store ClockStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := claimsFrom(r.Context())
+			if claims.Role == RoleStaff || claims.Role == RoleDepartmentHead {
+				id, err := urlParamID(r, "id")
+				if err != nil {
+					http.Error(w, "Invalid assignment id", http.StatusBadRequest)
+					return
+				}
+				staffID, departmentID, err := store.AssignmentOwner(r.Context(), id)
+				if err != nil {
+					writeClockError(w, err)
+					return
+				}
+				if claims.isStaff(staffID) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				if claims.Role == RoleStaff {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				if !claims.headOf(departmentID) {
+					http.Error(w, ErrOutsideDepartments.Error(), http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Maps clock errors to status codes
+func writeClockError(w http.ResponseWriter, err error) {
+	var windowErr *ShiftWindowError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "Assignment not found", http.StatusNotFound)
+	case errors.Is(err, ErrAlreadyCheckedIn), errors.Is(err, ErrNotCheckedIn),
+		errors.Is(err, ErrAlreadyCheckedOut), errors.As(err, &windowErr):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Error writing shift log: %v", err)
+		http.Error(w, "Failed to record shift log", http.StatusInternalServerError)
+	}
+}
+
+// Builds the check-in / check-out handlers, the timestamp is always the
+// server's clock so staff can't backdate a punch
+func ClockHandler(punch func(ctx context.Context, assignmentID int, at time.Time) (ShiftLog, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid assignment id", http.StatusBadRequest)
+			return
+		}
+
+		shiftLog, err := punch(r.Context(), id, time.Now().Truncate(time.Second))
+		if err != nil {
+			writeClockError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, shiftLog)
+	}
+}
+
+func OnShiftRosterHandler(store ClockStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rosters, err := store.OnShift(r.Context(), queryValues(r.URL.Query(), "department"))
+		if err != nil {
+			log.Printf("Error querying on shift roster: %v", err)
+			http.Error(w, "Failed to fetch on shift roster", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, rosters)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Clock store that only answers AssignmentOwner
+type fakeClockStore struct {
+	ClockStore
+	// assignment id -> staff id, department id
+	owners map[int][2]int
+}
+
+func (f fakeClockStore) AssignmentOwner(ctx context.Context, assignmentID int) (int, int, error) {
+	owner, ok := f.owners[assignmentID]
+	if !ok {
+		return 0, 0, ErrNotFound
+	}
+	return owner[0], owner[1], nil
+}
+
+func TestRequireOwnAssignment(t *testing.T) {
+	store := fakeClockStore{owners: map[int][2]int{
+		1: {10, 1}, // ER
+		2: {20, 2}, // ICU
+		3: {30, 2}, // the head's own, in ICU
+	}}
+	staffID, headStaffID := 10, 30
+	staff := Claims{Role: RoleStaff, StaffID: &staffID}
+	head := Claims{Role: RoleDepartmentHead, StaffID: &headStaffID, Departments: []UserDepartment{{ID: 1, Name: "ER"}}}
+	scheduler := Claims{Role: RoleScheduler}
+
+	tests := []struct {
+		name   string
+		claims Claims
+		id     string
+		status int
+	}{
+		{"staff, own assignment", staff, "1", http.StatusOK},
+		{"staff, someone else's", staff, "2", http.StatusForbidden},
+		{"head, own department", head, "1", http.StatusOK},
+		{"head, other department", head, "2", http.StatusForbidden},
+		{"head, own assignment", head, "3", http.StatusOK},
+		{"scheduler, any department", scheduler, "2", http.StatusOK},
+		{"unknown assignment", head, "9", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes := chi.NewRouter()
+			routes.With(RequireOwnAssignment(store)).Post("/assignments/{id}/check-in", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			req := httptest.NewRequest(http.MethodPost, "/assignments/"+tt.id+"/check-in", nil)
+			req = req.WithContext(context.WithValue(req.Context(), claimsKey{}, tt.claims))
+			rec := httptest.NewRecorder()
+			routes.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"iter"
+	"net/url"
+	"time"
+)
+
+// Windows a report can be compared with, from ?compare_to=
+const (
+	ComparePreviousPeriod = "previous_period"
+	ComparePreviousYear   = "previous_year"
+	CompareCustom         = "custom"
+)
+
+// Where a compared row was found
+const (
+	PresenceBoth         = "both"
+	PresenceCurrentOnly  = "current_only"
+	PresencePreviousOnly = "previous_only"
+)
+
+// The window a report is compared with
+type ComparisonWindow struct {
+	CompareTo string    `json:"compare_to"`
+	StartDate time.Time `json:"start_date"`
+	EndDate   time.Time `json:"end_date"`
+}
+
+// Parses compare_to for a report over start..end, nil when the report
+// isn't compared. previous_period is the window of the same length ending
+// the day before start, custom takes compare_start_date / compare_end_date.
+func parseComparison(queryParams url.Values, start, end time.Time) (*ComparisonWindow, error) {
+	window := &ComparisonWindow{CompareTo: queryParams.Get("compare_to")}
+	switch window.CompareTo {
+	case "":
+		return nil, nil
+	case ComparePreviousPeriod:
+		days := int(end.Sub(start).Hours()/24) + 1
+		window.StartDate = start.AddDate(0, 0, -days)
+		window.EndDate = start.AddDate(0, 0, -1)
+	case ComparePreviousYear:
+		window.StartDate = start.AddDate(-1, 0, 0)
+		window.EndDate = end.AddDate(-1, 0, 0)
+	case CompareCustom:
+		compareStart, err := optionalDate(queryParams, "compare_start_date")
+		if err != nil {
+			return nil, errors.New("Invalid compare_start_date")
+		}
+		compareEnd, err := optionalDate(queryParams, "compare_end_date")
+		if err != nil {
+			return nil, errors.New("Invalid compare_end_date")
+		}
+		if compareStart == nil || compareEnd == nil {
+			return nil, errors.New("compare_to=custom needs compare_start_date and compare_end_date")
+		}
+		if compareEnd.Before(*compareStart) {
+			return nil, errors.New("compare_end_date must not be before compare_start_date")
+		}
+		window.StartDate, window.EndDate = *compareStart, *compareEnd
+	default:
+		return nil, errors.New("compare_to must be previous_period, previous_year or custom")
+	}
+	return window, nil
+}
+
+// Pairs the rows of the current window with the rows of the comparison
+// window that have the same key. Rows found in only one window are compared
+// with nil; the current rows come first in their order, then the rows that
+// disappeared.
+func compareRows[T, C any](current, previous iter.Seq2[T, error], key func(T) string, compare func(current, previous *T) C) iter.Seq2[C, error] {
+	return func(yield func(C, error) bool) {
+		var none C
+		currentRows, err := collectRows(current)
+		if err != nil {
+			yield(none, err)
+			return
+		}
+		previousRows, err := collectRows(previous)
+		if err != nil {
+			yield(none, err)
+			return
+		}
+
+		byKey := make(map[string]*T, len(previousRows))
+		for i := range previousRows {
+			byKey[key(previousRows[i])] = &previousRows[i]
+		}
+		matched := make(map[string]bool, len(currentRows))
+		for i := range currentRows {
+			k := key(currentRows[i])
+			matched[k] = true
+			if !yield(compare(&currentRows[i], byKey[k]), nil) {
+				return
+			}
+		}
+		for i := range previousRows {
+			if matched[key(previousRows[i])] {
+				continue
+			}
+			if !yield(compare(nil, &previousRows[i]), nil) {
+				return
+			}
+		}
+	}
+}
+
+func presence[T any](current, previous *T) string {
+	switch {
+	case current == nil:
+		return PresencePreviousOnly
+	case previous == nil:
+		return PresenceCurrentOnly
+	default:
+		return PresenceBoth
+	}
+}
+
+// Change from previous to current in percent, nil when there was nothing
+// to compare with
+func percentageDelta(current, previous float64) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	delta := (current - previous) / previous * 100
+	return &delta
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"backend/querybuilder"
+)
+
+// A row of coverage_requirements
+type CoverageRequirement struct {
+	ID             int    `json:"id"`
+	DepartmentID   int    `json:"department_id"`
+	DepartmentName string `json:"department_name"`
+	ShiftTimeID    int    `json:"shift_time_id"`
+	ShiftTimeName  string `json:"shift_time_name"`
+	RoleID         int    `json:"role_id"`
+	RoleName       string `json:"role_name"`
+	Headcount      int    `json:"headcount"`
+}
+
+// Payload to set the headcount of a department / shift time / role
+type CoverageRequirementInput struct {
+	DepartmentID int `json:"department_id"`
+	ShiftTimeID  int `json:"shift_time_id"`
+	RoleID       int `json:"role_id"`
+	Headcount    int `json:"headcount"`
+}
+
+func (in CoverageRequirementInput) Validate() error {
+	if in.DepartmentID <= 0 || in.ShiftTimeID <= 0 || in.RoleID <= 0 {
+		return errors.New("department_id, shift_time_id and role_id are required")
+	}
+	if in.Headcount <= 0 {
+		return errors.New("headcount must be positive")
+	}
+	return nil
+}
+
+var ErrUnknownCoverageReference = errors.New("department_id, shift_time_id or role_id does not exist")
+
+// CoverageStore manages the coverage model
+type CoverageStore interface {
+	ListCoverageRequirements(ctx context.Context, departments []string) ([]CoverageRequirement, error)
+	SetCoverageRequirement(ctx context.Context, input CoverageRequirementInput) (CoverageRequirement, error)
+	DeleteCoverageRequirement(ctx context.Context, id int) error
+}
+
+type PostgresCoverageStore struct {
+	db *sql.DB
+}
+
+func NewPostgresCoverageStore(db *sql.DB) *PostgresCoverageStore {
+	return &PostgresCoverageStore{db: db}
+}
+
+const coverageRequirementSelect = `
+        SELECT
+            cr.id,
+            d.id,
+            d.name,
+            st.id,
+            st.name,
+            r.id,
+            r.name,
+            cr.headcount
+        FROM
+            coverage_requirements cr
+        JOIN
+            departments d ON cr.department_id = d.id
+        JOIN
+            shift_times st ON cr.shift_time_id = st.id
+        JOIN
+            roles r ON cr.role_id = r.id
+    `
+
+func scanCoverageRequirement(row rowScanner) (CoverageRequirement, error) {
+	var c CoverageRequirement
+	err := row.Scan(&c.ID, &c.DepartmentID, &c.DepartmentName, &c.ShiftTimeID, &c.ShiftTimeName, &c.RoleID, &c.RoleName, &c.Headcount)
+	return c, err
+}
+
+func (s *PostgresCoverageStore) ListCoverageRequirements(ctx context.Context, departments []string) ([]CoverageRequirement, error) {
+	qb := querybuilder.New(coverageRequirementSelect)
+	qb.Where(querybuilder.In("d.name", departments))
+	qb.OrderBy("d.name", "st.start_time", "r.name")
+
+	query, values := qb.Build()
+	rows, err := s.db.QueryContext(ctx, query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requirements := []CoverageRequirement{}
+	for rows.Next() {
+		c, err := scanCoverageRequirement(rows)
+		if err != nil {
+			return nil, err
+		}
+		requirements = append(requirements, c)
+	}
+	return requirements, rows.Err()
+}
+
+// Inserts the requirement or replaces the headcount of the existing one
+func (s *PostgresCoverageStore) SetCoverageRequirement(ctx context.Context, input CoverageRequirementInput) (CoverageRequirement, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return CoverageRequirement{}, err
+	}
+	defer tx.Rollback()
+
+	// The existing row, if any, is what the upsert replaces
+	var before *CoverageRequirement
+	existing, err := scanCoverageRequirement(tx.QueryRowContext(ctx, coverageRequirementSelect+`
+        WHERE cr.department_id = $1 AND cr.shift_time_id = $2 AND cr.role_id = $3
+        FOR UPDATE OF cr
+    `, input.DepartmentID, input.ShiftTimeID, input.RoleID))
+	if err == nil {
+		before = &existing
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return CoverageRequirement{}, err
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO coverage_requirements (department_id, shift_time_id, role_id, headcount)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (department_id, shift_time_id, role_id) DO UPDATE SET headcount = EXCLUDED.headcount
+        RETURNING id
+    `, input.DepartmentID, input.ShiftTimeID, input.RoleID, input.Headcount).Scan(&id)
+	if _, ok := pqViolation(err, "23503"); ok {
+		return CoverageRequirement{}, ErrUnknownCoverageReference
+	}
+	if err != nil {
+		return CoverageRequirement{}, err
+	}
+	requirement, err := scanCoverageRequirement(tx.QueryRowContext(ctx, coverageRequirementSelect+" WHERE cr.id = $1", id))
+	if err != nil {
+		return requirement, err
+	}
+
+	if before == nil {
+		err = recordAudit(ctx, tx, AuditCreate, EntityCoverageRequirement, id, nil, requirement)
+	} else {
+		err = recordAudit(ctx, tx, AuditUpdate, EntityCoverageRequirement, id, before, requirement)
+	}
+	if err != nil {
+		return requirement, err
+	}
+	return requirement, tx.Commit()
+}
+
+func (s *PostgresCoverageStore) DeleteCoverageRequirement(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := scanCoverageRequirement(tx.QueryRowContext(ctx, coverageRequirementSelect+" WHERE cr.id = $1 FOR UPDATE OF cr", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM coverage_requirements WHERE id = $1", id); err != nil {
+		return err
+	}
+	if err := recordAudit(ctx, tx, AuditDelete, EntityCoverageRequirement, id, before, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Shortfall of one role on an understaffed shift
+type RoleShortfall struct {
+	RoleName  string `json:"role_name"`
+	Required  int    `json:"required"`
+	Assigned  int    `json:"assigned"`
+	Shortfall int    `json:"shortfall"`
+}
+
+// e.g. "Nurse 1/2", for the exported role list
+func (r RoleShortfall) String() string {
+	return fmt.Sprintf("%s %d/%d", r.RoleName, r.Assigned, r.Required)
+}
+
+// A shift of a department below its coverage requirement
+type CoverageGap struct {
+	ShiftID        int             `json:"shift_id"`
+	Date           time.Time       `json:"date"`
+	Weekday        string          `json:"weekday"`
+	ShiftTime      string          `json:"shift_time"`
+	DepartmentName string          `json:"department_name"`
+	Required       int             `json:"required" total:"sum"`
+	Assigned       int             `json:"assigned" total:"sum"`
+	Shortfall      int             `json:"shortfall" total:"sum"`
+	Roles          []RoleShortfall `json:"roles"`
+}
+
+// Heat-map cell, how often a weekday / shift time combination runs short
+type CoverageHeatmapCell struct {
+	Weekday            string  `json:"weekday"`
+	WeekdayNumber      int     `json:"weekday_number"` // ISO, Monday = 1
+	ShiftTime          string  `json:"shift_time"`
+	UnderstaffedShifts int     `json:"understaffed_shifts"`
+	TotalShortfall     int     `json:"total_shortfall"`
+	AverageShortfall   float64 `json:"average_shortfall"`
+}
+
+type CoverageReport struct {
+	Gaps    []CoverageGap         `json:"gaps"`
+	Heatmap []CoverageHeatmapCell `json:"heatmap"`
+}
+
+// JSON response of the coverage report, a page of gaps plus the heat-map
+type CoverageReportPage struct {
+	ReportPage[CoverageGap]
+	Heatmap []CoverageHeatmapCell `json:"heatmap"`
+}
+
+// Filters accepted by the coverage report
+type CoverageFilter struct {
+	StartDate   time.Time
+	EndDate     time.Time
+	Roles       []string
+	Departments []string
+	ShiftTimes  []string
+}
+
+func (s *PostgresReportStore) Coverage(ctx context.Context, filter CoverageFilter) (CoverageReport, error) {
+	report := CoverageReport{Gaps: []CoverageGap{}, Heatmap: []CoverageHeatmapCell{}}
+
+	// Every shift in the range against each requirement of its shift time,
+	// assignments are matched on department and the staff member's role
+	qb := querybuilder.New(`
+        SELECT
+            sh.id,
+            sh.date,
+            EXTRACT(ISODOW FROM sh.date)::int AS weekday,
+            st.name AS shift_time,
+            d.name AS department_name,
+            r.name AS role_name,
+            cr.headcount,
+            COUNT(sa.id) AS assigned
+        FROM
+            shifts sh
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+        JOIN
+            coverage_requirements cr ON cr.shift_time_id = sh.shift_time_id
+        JOIN
+            departments d ON cr.department_id = d.id
+        JOIN
+            roles r ON cr.role_id = r.id
+        LEFT JOIN
+            (shift_assignments sa JOIN staff s ON sa.staff_id = s.id)
+            ON sa.shift_id = sh.id AND sa.department_id = cr.department_id AND s.role_id = cr.role_id
+    `)
+	qb.Where(querybuilder.Between("sh.date", filter.StartDate, filter.EndDate))
+	qb.Where(querybuilder.In("r.name", filter.Roles))
+	qb.Where(querybuilder.In("d.name", filter.Departments))
+	qb.Where(querybuilder.In("st.name", filter.ShiftTimes))
+	qb.GroupBy("sh.id", "sh.date", "st.name", "st.start_time", "d.name", "r.name", "cr.headcount")
+	qb.Having(querybuilder.Raw("COUNT(sa.id) < cr.headcount"))
+	// Shifts sharing a start time would interleave by department without
+	// sh.id, and the fold below relies on a shift's rows being adjacent
+	qb.OrderBy("sh.date", "st.start_time", "sh.id", "d.name", "r.name")
+
+	query, values := qb.Build()
+	rows, err := s.query(ctx, query, values)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	var shortfalls []coverageShortfall
+	for rows.Next() {
+		var row coverageShortfall
+		err := rows.Scan(
+			&row.ShiftID,
+			&row.Date,
+			&row.Weekday,
+			&row.ShiftTime,
+			&row.DepartmentName,
+			&row.Role.RoleName,
+			&row.Role.Required,
+			&row.Role.Assigned,
+		)
+		if err != nil {
+			return report, err
+		}
+		row.Role.Shortfall = row.Role.Required - row.Role.Assigned
+		shortfalls = append(shortfalls, row)
+	}
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+	return foldCoverage(shortfalls), nil
+}
+
+// One understaffed role of a shift / department, as the coverage query
+// returns it
+type coverageShortfall struct {
+	ShiftID        int
+	Date           time.Time
+	Weekday        int // ISO, Monday = 1
+	ShiftTime      string
+	DepartmentName string
+	Role           RoleShortfall
+}
+
+// Folds the roles of the same shift / department into one gap and counts
+// the gaps per weekday and shift time. Rows must come sorted by shift, then
+// department.
+func foldCoverage(shortfalls []coverageShortfall) CoverageReport {
+	report := CoverageReport{Gaps: []CoverageGap{}, Heatmap: []CoverageHeatmapCell{}}
+
+	type cellKey struct {
+		weekday   int
+		shiftTime string
+	}
+	cells := make(map[cellKey]*CoverageHeatmapCell)
+	var cellOrder []cellKey
+
+	for _, row := range shortfalls {
+		key := cellKey{row.Weekday, row.ShiftTime}
+		last := len(report.Gaps) - 1
+		if last < 0 || report.Gaps[last].ShiftID != row.ShiftID || report.Gaps[last].DepartmentName != row.DepartmentName {
+			report.Gaps = append(report.Gaps, CoverageGap{
+				ShiftID:        row.ShiftID,
+				Date:           row.Date,
+				Weekday:        time.Weekday(row.Weekday % 7).String(),
+				ShiftTime:      row.ShiftTime,
+				DepartmentName: row.DepartmentName,
+			})
+			last++
+
+			if cells[key] == nil {
+				cells[key] = &CoverageHeatmapCell{Weekday: report.Gaps[last].Weekday, WeekdayNumber: row.Weekday, ShiftTime: row.ShiftTime}
+				cellOrder = append(cellOrder, key)
+			}
+			cells[key].UnderstaffedShifts++
+		}
+		current := &report.Gaps[last]
+		current.Roles = append(current.Roles, row.Role)
+		current.Required += row.Role.Required
+		current.Assigned += row.Role.Assigned
+		current.Shortfall += row.Role.Shortfall
+		cells[key].TotalShortfall += row.Role.Shortfall
+	}
+
+	for _, key := range cellOrder {
+		cell := cells[key]
+		cell.AverageShortfall = float64(cell.TotalShortfall) / float64(cell.UnderstaffedShifts)
+		report.Heatmap = append(report.Heatmap, *cell)
+	}
+	sortHeatmap(report.Heatmap)
+	return report
+}
+
+// Orders the heat-map by weekday, then by shift time name
+func sortHeatmap(cells []CoverageHeatmapCell) {
+	slices.SortFunc(cells, func(a, b CoverageHeatmapCell) int {
+		if a.WeekdayNumber != b.WeekdayNumber {
+			return a.WeekdayNumber - b.WeekdayNumber
+		}
+		return strings.Compare(a.ShiftTime, b.ShiftTime)
+	})
+}
+
+func GetCoverageReportHandler(store ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Collect the filters from the URL
+		queryParams := r.URL.Query()
+
+		// Required date range filter
+		startDate, endDate, err := requiredDateRange(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		format, err := reportFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		paging, err := parseReportPaging(r, reflect.TypeFor[CoverageGap](), format == formatJSON)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		report, err := store.Coverage(r.Context(), CoverageFilter{
+			StartDate:   startDate,
+			EndDate:     endDate,
+			Roles:       queryValues(queryParams, "role"),
+			Departments: queryValues(queryParams, "department"),
+			ShiftTimes:  queryValues(queryParams, "shift_time"),
+		})
+		if err != nil {
+			log.Printf("Error querying coverage report: %v", err)
+			http.Error(w, "Failed to fetch coverage report", http.StatusInternalServerError)
+			return
+		}
+
+		// Pages cut the gaps, the heat-map always summarises all of them
+		page := pageReport(r, paging, report.Gaps)
+		if format != formatJSON {
+			exportRows(w, r, format, reportInfo{
+				Title:     "coverage report",
+				Slug:      "coverage",
+				StartDate: &startDate,
+				EndDate:   &endDate,
+			}, sliceRows(page.Rows, nil))
+			return
+		}
+		writeJSON(w, http.StatusOK, CoverageReportPage{ReportPage: page, Heatmap: report.Heatmap})
+	}
+}
+
+func ListCoverageRequirementsHandler(store CoverageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requirements, err := store.ListCoverageRequirements(r.Context(), queryValues(r.URL.Query(), "department"))
+		if err != nil {
+			log.Printf("Error listing coverage requirements: %v", err)
+			http.Error(w, "Failed to fetch coverage requirements", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, requirements)
+	}
+}
+
+func SetCoverageRequirementHandler(store CoverageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input CoverageRequirementInput
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := input.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		requirement, err := store.SetCoverageRequirement(r.Context(), input)
+		if errors.Is(err, ErrUnknownCoverageReference) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			log.Printf("Error saving coverage requirement: %v", err)
+			http.Error(w, "Failed to save coverage requirement", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, requirement)
+	}
+}
+
+func DeleteCoverageRequirementHandler(store CoverageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid coverage requirement id", http.StatusBadRequest)
+			return
+		}
+
+		err = store.DeleteCoverageRequirement(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Coverage requirement not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error deleting coverage requirement: %v", err)
+			http.Error(w, "Failed to delete coverage requirement", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Two shifts of the same day starting at 07:00, each short a doctor and a
+// nurse in Cardiology and Pediatrics, in the order the coverage query returns
+// them
+func sameStartShortfalls() []coverageShortfall {
+	var rows []coverageShortfall
+	for _, shiftID := range []int{11, 12} {
+		for _, department := range []string{"Cardiology", "Pediatrics"} {
+			for _, role := range []string{"Doctor", "Nurse"} {
+				rows = append(rows, coverageShortfall{
+					ShiftID:        shiftID,
+					Date:           date("2024-03-04"),
+					Weekday:        1,
+					ShiftTime:      "Morning",
+					DepartmentName: department,
+					Role:           RoleShortfall{RoleName: role, Required: 2, Assigned: 1, Shortfall: 1},
+				})
+			}
+		}
+	}
+	return rows
+}
+
+func TestFoldCoverageSharedStartTime(t *testing.T) {
+	report := foldCoverage(sameStartShortfalls())
+
+	type gapKey struct {
+		shiftID    int
+		department string
+	}
+	var got []gapKey
+	for _, gap := range report.Gaps {
+		got = append(got, gapKey{gap.ShiftID, gap.DepartmentName})
+		if len(gap.Roles) != 2 || gap.Required != 4 || gap.Assigned != 2 || gap.Shortfall != 2 {
+			t.Errorf("gap %d %s = %+v, want both roles 2 short of 4", gap.ShiftID, gap.DepartmentName, gap)
+		}
+		if gap.Weekday != "Monday" {
+			t.Errorf("gap %d weekday = %q, want Monday", gap.ShiftID, gap.Weekday)
+		}
+	}
+	want := []gapKey{{11, "Cardiology"}, {11, "Pediatrics"}, {12, "Cardiology"}, {12, "Pediatrics"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("gaps = %v, want %v", got, want)
+	}
+
+	wantHeatmap := []CoverageHeatmapCell{{
+		Weekday:            "Monday",
+		WeekdayNumber:      1,
+		ShiftTime:          "Morning",
+		UnderstaffedShifts: 4,
+		TotalShortfall:     8,
+		AverageShortfall:   2,
+	}}
+	if !reflect.DeepEqual(report.Heatmap, wantHeatmap) {
+		t.Errorf("heatmap = %+v, want %+v", report.Heatmap, wantHeatmap)
+	}
+}
+
+func TestCoverageOrdersByShiftBeforeDepartment(t *testing.T) {
+	recordingDB, err := sql.Open("recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recordingDB.Close()
+
+	recordedQueries = nil
+	filter := CoverageFilter{StartDate: date("2024-03-04"), EndDate: date("2024-03-10")}
+	if _, err := NewPostgresReportStore(recordingDB).Coverage(context.Background(), filter); err != nil {
+		t.Fatal(err)
+	}
+	if len(recordedQueries) != 1 {
+		t.Fatalf("sent %d queries, want 1", len(recordedQueries))
+	}
+	if query := normalizeSQL(recordedQueries[0].SQL); !strings.HasSuffix(query, "ORDER BY sh.date, st.start_time, sh.id, d.name, r.name") {
+		t.Errorf("query = %s, want shifts sharing a start time kept apart", query)
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"iter"
+	"log"
+	"maps"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats a report can be returned in, JSON unless the client asks
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+	formatXLSX = "xlsx"
+	formatPDF  = "pdf"
+)
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// Flush the response every so many rows so large exports start downloading
+// while the cursor is still being read
+const exportFlushRows = 500
+
+// Picks the response format, ?format= wins over the Accept header
+func reportFormat(r *http.Request) (string, error) {
+	switch format := strings.ToLower(r.URL.Query().Get("format")); format {
+	case "":
+	case formatJSON, formatCSV, formatXLSX, formatPDF:
+		return format, nil
+	default:
+		return "", fmt.Errorf("Unsupported format %q, use json, csv, xlsx or pdf", format)
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/csv":
+			return formatCSV, nil
+		case xlsxContentType:
+			return formatXLSX, nil
+		case "application/pdf":
+			return formatPDF, nil
+		case "application/json":
+			return formatJSON, nil
+		}
+	}
+	return formatJSON, nil
+}
+
+// Describes a report for logging and for the exported file name
+type reportInfo struct {
+	// Used in log and error messages, e.g. "hours worked report"
+	Title string
+	// File name prefix, the route name by convention
+	Slug      string
+	StartDate *time.Time
+	EndDate   *time.Time
+	// Window the rows are compared with, nil when they aren't
+	Comparison *ComparisonWindow
+}
+
+// File name of an export, e.g. work-hours_2024-01-01_2024-01-31.csv
+func (info reportInfo) filename(ext string) string {
+	name := info.Slug
+	switch {
+	case info.StartDate != nil && info.EndDate != nil:
+		name += "_" + info.StartDate.Format(dateLayout) + "_" + info.EndDate.Format(dateLayout)
+	case info.StartDate != nil:
+		name += "_from_" + info.StartDate.Format(dateLayout)
+	case info.EndDate != nil:
+		name += "_until_" + info.EndDate.Format(dateLayout)
+	}
+	return name + "." + ext
+}
+
+// Writes a whole report in the format the client asked for, see
+// writeReportRows
+func writeReport[T any](w http.ResponseWriter, r *http.Request, info reportInfo, rows iter.Seq2[T, error]) {
+	writeReportRows(w, r, info, ReportRows[T]{Rows: rows})
+}
+
+// Writes a report in the format the client asked for. JSON is a page of
+// rows in a ReportPage envelope. CSV and XLSX are streamed as downloads
+// straight off the cursor unless they ask for a page, or for a sort the
+// store didn't apply, which needs every row first, and PDF is rendered once
+// all rows are read.
+func writeReportRows[T any](w http.ResponseWriter, r *http.Request, info reportInfo, rows ReportRows[T]) {
+	format, err := reportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	paging, err := parseReportPaging(r, reflect.TypeFor[T](), format == formatJSON)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sorted := rows.Total != nil || len(paging.Sort) == 0
+	if format != formatJSON && !paging.Paged && sorted {
+		exportRows(w, r, format, info, rows.Rows)
+		return
+	}
+
+	reports, err := collectRows(rows.Rows)
+	total := len(reports)
+	if err == nil && rows.Total != nil {
+		total, err = rows.Total()
+	}
+	if err != nil {
+		log.Printf("Error querying %s: %v", info.Title, err)
+		http.Error(w, "Failed to fetch "+info.Title, http.StatusInternalServerError)
+		return
+	}
+	var page ReportPage[T]
+	if rows.Total != nil {
+		page = newReportPage(r, paging, reports, total)
+	} else {
+		page = pageReport(r, paging, reports)
+	}
+	page.Comparison = info.Comparison
+	if format == formatJSON {
+		writeJSON(w, http.StatusOK, page)
+		return
+	}
+	exportRows(w, r, format, info, sliceRows(page.Rows, nil))
+}
+
+// Streams rows as a file download. The headers are only sent with
+// the first row, so a failing query still gets a 500; a failure after that
+// aborts the connection rather than leave a truncated file looking complete.
+func exportRows[T any](w http.ResponseWriter, r *http.Request, format string, info reportInfo, rows iter.Seq2[T, error]) {
+	columns := reportColumns(reflect.TypeFor[T]())
+	controller := http.NewResponseController(w)
+
+	var table tableWriter
+	count := 0
+	for row, err := range rows {
+		if err != nil {
+			log.Printf("Error querying %s: %v", info.Title, err)
+			if table == nil {
+				http.Error(w, "Failed to fetch "+info.Title, http.StatusInternalServerError)
+				return
+			}
+			panic(http.ErrAbortHandler)
+		}
+		if table == nil {
+			table = startExport(w, r, format, info, columns)
+		}
+		if err := table.WriteRow(rowCells(reflect.ValueOf(row), columns)); err != nil {
+			log.Printf("Error writing %s export: %v", info.Title, err)
+			panic(http.ErrAbortHandler)
+		}
+		if count++; count%exportFlushRows == 0 {
+			table.Flush()
+			controller.Flush()
+		}
+	}
+	if table == nil {
+		table = startExport(w, r, format, info, columns)
+	}
+	if err := table.Close(); err != nil {
+		log.Printf("Error writing %s export: %v", info.Title, err)
+	}
+}
+
+// Sends the download headers and the column labels
+func startExport(w http.ResponseWriter, r *http.Request, format string, info reportInfo, columns []reportColumn) tableWriter {
+	var table tableWriter
+	switch format {
+	case formatXLSX:
+		w.Header().Set("Content-Type", xlsxContentType)
+		table = newXLSXWriter(w)
+	case formatPDF:
+		w.Header().Set("Content-Type", "application/pdf")
+		title := strings.ToUpper(info.Title[:1]) + info.Title[1:]
+		filters := appliedFilters(r)
+		if c := info.Comparison; c != nil {
+			filters = append(filters, "compared with: "+c.StartDate.Format(dateLayout)+" to "+c.EndDate.Format(dateLayout))
+		}
+		table = newPDFWriter(w, title, filters, columns)
+	default:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		table = newCSVWriter(w)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": info.filename(format),
+	}))
+	w.WriteHeader(http.StatusOK)
+
+	labels := make([]string, len(columns))
+	for i, c := range columns {
+		labels[i] = c.Label
+	}
+	table.WriteHeader(labels)
+	return table
+}
+
+// The query parameters of the request as "name: value, value" lines, for
+// documents that should say how they were filtered
+func appliedFilters(r *http.Request) []string {
+	queryParams := r.URL.Query()
+	keys := slices.Sorted(maps.Keys(queryParams))
+
+	var filters []string
+	for _, key := range keys {
+		values := queryValues(queryParams, key)
+		if key == "format" || (key != "sort" && slices.Contains(pagingParams, key)) || len(values) == 0 {
+			continue
+		}
+		filters = append(filters, key+": "+strings.Join(values, ", "))
+	}
+	return filters
+}
+
+// A report field exported as a column
+type reportColumn struct {
+	Label string
+	Index []int
+	// JSON name of the field
+	Name string
+	// "sum" or "avg" when the PDF totals row should aggregate the column,
+	// from the field's total tag. Averages are weighted by the column named
+	// in the weight tag, e.g. the rows' counts an average was taken over.
+	Total  string
+	Weight string
+}
+
+// Columns of a report row type, one per JSON field in declaration order.
+// The label is the JSON name in title case, total_hours_worked becomes
+// "Total Hours Worked".
+func reportColumns(t reflect.Type) []reportColumn {
+	var columns []reportColumn
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		words := strings.Split(name, "_")
+		for i, word := range words {
+			if word != "" {
+				words[i] = strings.ToUpper(word[:1]) + word[1:]
+			}
+		}
+		columns = append(columns, reportColumn{
+			Label:  strings.Join(words, " "),
+			Name:   name,
+			Index:  field.Index,
+			Total:  field.Tag.Get("total"),
+			Weight: field.Tag.Get("weight"),
+		})
+	}
+	return columns
+}
+
+// A formatted cell, numbers are kept apart so spreadsheets can sum them
+type cell struct {
+	Text    string
+	Numeric bool
+}
+
+func rowCells(row reflect.Value, columns []reportColumn) []cell {
+	cells := make([]cell, len(columns))
+	for i, c := range columns {
+		cells[i] = formatCell(row.FieldByIndex(c.Index))
+	}
+	return cells
+}
+
+// Formats a field for export: nil pointers are empty, dates without a time
+// of day drop it, floats are rounded to two decimals and lists are joined
+func formatCell(v reflect.Value) cell {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return cell{}
+		}
+		v = v.Elem()
+	}
+	if s, ok := v.Interface().(fmt.Stringer); ok {
+		if t, ok := s.(time.Time); ok {
+			if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+				return cell{Text: t.Format(dateLayout)}
+			}
+			return cell{Text: t.Format("2006-01-02 15:04")}
+		}
+		return cell{Text: s.String()}
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cell{Text: strconv.FormatInt(v.Int(), 10), Numeric: true}
+	case reflect.Float32, reflect.Float64:
+		return formatNumber(v.Float())
+	case reflect.Slice, reflect.Array:
+		parts := make([]string, v.Len())
+		for i := range parts {
+			parts[i] = formatCell(v.Index(i)).Text
+		}
+		return cell{Text: strings.Join(parts, "; ")}
+	default:
+		return cell{Text: fmt.Sprint(v.Interface())}
+	}
+}
+
+func formatNumber(v float64) cell {
+	return cell{Text: strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64), Numeric: true}
+}
+
+// Writes a table in one export format
+type tableWriter interface {
+	WriteHeader(labels []string) error
+	WriteRow(cells []cell) error
+	// Pushes buffered rows to the response
+	Flush()
+	// Finishes the file
+	Close() error
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (c *csvWriter) WriteHeader(labels []string) error {
+	return c.w.Write(labels)
+}
+
+func (c *csvWriter) WriteRow(cells []cell) error {
+	record := make([]string, len(cells))
+	for i, value := range cells {
+		record[i] = value.Text
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvWriter) Flush() {
+	c.w.Flush()
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// Writes a single sheet workbook. The sheet is the last part of the zip so
+// its rows can be streamed, the other parts are fixed.
+type xlsxWriter struct {
+	zip   *zip.Writer
+	sheet io.Writer
+	rows  int
+	err   error
+}
+
+var xlsxParts = []struct{ name, body string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Report" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`},
+	// Style 1 is the bold header row
+	{"xl/styles.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+		`</styleSheet>`},
+}
+
+func newXLSXWriter(w io.Writer) *xlsxWriter {
+	x := &xlsxWriter{zip: zip.NewWriter(w)}
+	for _, part := range xlsxParts {
+		if x.err = x.writePart(part.name, part.body); x.err != nil {
+			return x
+		}
+	}
+	x.sheet, x.err = x.zip.Create("xl/worksheets/sheet1.xml")
+	if x.err == nil {
+		_, x.err = io.WriteString(x.sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	}
+	return x
+}
+
+func (x *xlsxWriter) writePart(name, body string) error {
+	part, err := x.zip.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(part, body)
+	return err
+}
+
+func (x *xlsxWriter) WriteHeader(labels []string) error {
+	cells := make([]cell, len(labels))
+	for i, label := range labels {
+		cells[i] = cell{Text: label}
+	}
+	return x.writeRow(cells, ` s="1"`)
+}
+
+func (x *xlsxWriter) WriteRow(cells []cell) error {
+	return x.writeRow(cells, "")
+}
+
+func (x *xlsxWriter) writeRow(cells []cell, style string) error {
+	if x.err != nil {
+		return x.err
+	}
+	x.rows++
+	var b strings.Builder
+	fmt.Fprintf(&b, `<row r="%d">`, x.rows)
+	for i, c := range cells {
+		ref := columnName(i) + strconv.Itoa(x.rows)
+		switch {
+		case c.Text == "":
+			continue
+		case c.Numeric:
+			fmt.Fprintf(&b, `<c r="%s"%s><v>%s</v></c>`, ref, style, c.Text)
+		default:
+			fmt.Fprintf(&b, `<c r="%s"%s t="inlineStr"><is><t xml:space="preserve">`, ref, style)
+			xml.EscapeText(&b, []byte(c.Text))
+			b.WriteString(`</t></is></c>`)
+		}
+	}
+	b.WriteString(`</row>`)
+	_, x.err = io.WriteString(x.sheet, b.String())
+	return x.err
+}
+
+// The zip writer only buffers a few KB, nothing to push
+func (x *xlsxWriter) Flush() {}
+
+func (x *xlsxWriter) Close() error {
+	if x.err != nil {
+		return x.err
+	}
+	if _, err := io.WriteString(x.sheet, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
+
+// Spreadsheet column letters, 0 is A and 26 is AA
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
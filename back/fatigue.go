@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"iter"
+	"net/http"
+	"time"
+
+	"backend/querybuilder"
+)
+
+// Default fatigue rules, the rest gap is the scheduler's defaultMinRestHours
+// and 48 hours a week is the usual working time cap
+const (
+	defaultMaxConsecutiveDays = 6
+	defaultMaxWeeklyHours     = 48
+)
+
+// Reasons an assignment is flagged
+const (
+	FatigueShortRest       = "short_rest"
+	FatigueConsecutiveDays = "consecutive_days"
+	FatigueWeeklyHours     = "weekly_hours"
+)
+
+// Struct to hold each flagged assignment
+type FatigueReportItem struct {
+	AssignmentID   int       `json:"assignment_id"`
+	StaffID        int       `json:"staff_id"`
+	StaffName      string    `json:"staff_name"`
+	RoleName       string    `json:"role_name"`
+	DepartmentName string    `json:"department_name"`
+	Date           time.Time `json:"date"`
+	ShiftTime      string    `json:"shift_time"`
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	OvertimeHours  float64   `json:"overtime_hours" total:"sum"`
+	// Hours between the end of the previous shift and this one's start,
+	// nil for the first shift on record
+	RestHours       *float64 `json:"rest_hours"`
+	ConsecutiveDays int      `json:"consecutive_days"`
+	// Hours worked in the ISO week up to and including this assignment
+	WeeklyHours float64  `json:"weekly_hours"`
+	Flags       []string `json:"flags"`
+}
+
+// Filters and thresholds accepted by the fatigue report
+type FatigueFilter struct {
+	StartDate          time.Time
+	EndDate            time.Time
+	Roles              []string
+	Departments        []string
+	MinRestHours       float64
+	MaxConsecutiveDays int
+	MaxWeeklyHours     float64
+}
+
+// An assignment as worked: the logged check-in / check-out where present,
+// the schedule otherwise
+type workedShift struct {
+	FatigueReportItem
+	// Effective end, after any overtime
+	until time.Time
+}
+
+// The rules need each person's whole history in order, so unlike the other
+// reports the rows are only yielded once they have all been read
+func (s *PostgresReportStore) Fatigue(ctx context.Context, filter FatigueFilter) iter.Seq2[FatigueReportItem, error] {
+	return sliceRows(s.fatigue(ctx, filter))
+}
+
+func (s *PostgresReportStore) fatigue(ctx context.Context, filter FatigueFilter) ([]FatigueReportItem, error) {
+	// Streaks and weekly totals depend on earlier shifts, look back far
+	// enough to see the start of the first week and of the longest streak
+	lookback := max(7, filter.MaxConsecutiveDays+1)
+
+	// Every assignment of the matching staff, in any department since rest
+	// doesn't care where the previous shift was worked
+	qb := querybuilder.New(`
+        SELECT
+            sa.id,
+            s.id,
+            s.name,
+            r.name,
+            d.name,
+            sh.date,
+            st.name,
+            COALESCE(sl.check_in, ` + scheduledStartExpr + `) AS worked_start,
+            COALESCE(` + checkOutExpr + `, ` + scheduledEndExpr + `) AS worked_end,
+            COALESCE((
+                SELECT SUM(EXTRACT(EPOCH FROM o.duration)) / 3600
+                FROM overtimes o
+                WHERE o.shift_assignment_id = sa.id
+            ), 0) AS overtime_hours
+        FROM
+            shift_assignments sa
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+        JOIN
+            staff s ON sa.staff_id = s.id
+        JOIN
+            roles r ON s.role_id = r.id
+        JOIN
+            departments d ON sa.department_id = d.id
+        LEFT JOIN LATERAL (
+            SELECT check_in, check_out
+            FROM shift_logs
+            WHERE assignment_id = sa.id
+            ORDER BY id DESC
+            LIMIT 1
+        ) sl ON TRUE
+    `)
+
+	qb.Where(querybuilder.Between("sh.date", filter.StartDate.AddDate(0, 0, -lookback), filter.EndDate))
+	qb.Where(querybuilder.In("r.name", filter.Roles))
+	qb.OrderBy("s.id", "worked_start")
+
+	query, values := qb.Build()
+	rows, err := s.query(ctx, query, values)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shifts []workedShift
+	for rows.Next() {
+		var shift workedShift
+		err := rows.Scan(
+			&shift.AssignmentID,
+			&shift.StaffID,
+			&shift.StaffName,
+			&shift.RoleName,
+			&shift.DepartmentName,
+			&shift.Date,
+			&shift.ShiftTime,
+			&shift.Start,
+			&shift.End,
+			&shift.OvertimeHours,
+		)
+		if err != nil {
+			return nil, err
+		}
+		shift.Start = localWallClock(shift.Start)
+		shift.End = localWallClock(shift.End)
+		shifts = append(shifts, shift)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var reports []FatigueReportItem
+	for _, item := range flagFatigue(shifts, filter) {
+		if !item.Date.Before(filter.StartDate) && matches(filter.Departments, item.DepartmentName) {
+			reports = append(reports, item)
+		}
+	}
+	return reports, nil
+}
+
+// Walks each person's shifts in order and returns the ones breaking a rule.
+// shifts must be sorted by staff and start. Overtime is worked right after
+// check-out, so it pushes back the start of the rest period too.
+func flagFatigue(shifts []workedShift, filter FatigueFilter) []FatigueReportItem {
+	var flagged []FatigueReportItem
+	for i := range shifts {
+		shift := &shifts[i]
+		shift.until = shift.End.Add(time.Duration(shift.OvertimeHours * float64(time.Hour)))
+		hours := shift.End.Sub(shift.Start).Hours() + shift.OvertimeHours
+
+		shift.ConsecutiveDays = 1
+		shift.WeeklyHours = hours
+		var prev *workedShift
+		if i > 0 && shifts[i-1].StaffID == shift.StaffID {
+			prev = &shifts[i-1]
+		}
+		if prev != nil {
+			rest := shift.Start.Sub(prev.until).Hours()
+			shift.RestHours = &rest
+
+			switch prevDays := shift.Date.Sub(prev.Date).Hours() / 24; {
+			case prevDays == 0:
+				shift.ConsecutiveDays = prev.ConsecutiveDays
+			case prevDays == 1:
+				shift.ConsecutiveDays = prev.ConsecutiveDays + 1
+			}
+			if isoWeekStart(prev.Date).Equal(isoWeekStart(shift.Date)) {
+				shift.WeeklyHours += prev.WeeklyHours
+			}
+		}
+
+		var flags []string
+		if shift.RestHours != nil && *shift.RestHours < filter.MinRestHours {
+			flags = append(flags, FatigueShortRest)
+		}
+		if shift.ConsecutiveDays > filter.MaxConsecutiveDays {
+			flags = append(flags, FatigueConsecutiveDays)
+		}
+		if shift.WeeklyHours > filter.MaxWeeklyHours {
+			flags = append(flags, FatigueWeeklyHours)
+		}
+		if len(flags) > 0 {
+			item := shift.FatigueReportItem
+			item.Flags = flags
+			flagged = append(flagged, item)
+		}
+	}
+	return flagged
+}
+
+// Monday of the ISO week date falls in
+func isoWeekStart(date time.Time) time.Time {
+	offset := (int(date.Weekday()) + 6) % 7
+	return date.AddDate(0, 0, -offset)
+}
+
+func GetFatigueReportHandler(store ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Collect the filters from the URL
+		queryParams := r.URL.Query()
+
+		// Required date range filter
+		startDate, endDate, err := requiredDateRange(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := FatigueFilter{
+			StartDate:          startDate,
+			EndDate:            endDate,
+			Roles:              queryValues(queryParams, "role"),
+			Departments:        queryValues(queryParams, "department"),
+			MinRestHours:       defaultMinRestHours,
+			MaxConsecutiveDays: defaultMaxConsecutiveDays,
+			MaxWeeklyHours:     defaultMaxWeeklyHours,
+		}
+
+		// Optional thresholds
+		minRest, err := optionalFloat(queryParams, "min_rest_hours")
+		if err != nil || (minRest != nil && *minRest < 0) {
+			http.Error(w, "Invalid value for min_rest_hours", http.StatusBadRequest)
+			return
+		}
+		if minRest != nil {
+			filter.MinRestHours = *minRest
+		}
+		maxDays, err := optionalInt(queryParams, "max_consecutive_days")
+		if err != nil || (maxDays != nil && *maxDays < 1) {
+			http.Error(w, "Invalid value for max_consecutive_days", http.StatusBadRequest)
+			return
+		}
+		if maxDays != nil {
+			filter.MaxConsecutiveDays = *maxDays
+		}
+		maxWeekly, err := optionalFloat(queryParams, "max_weekly_hours")
+		if err != nil || (maxWeekly != nil && *maxWeekly <= 0) {
+			http.Error(w, "Invalid value for max_weekly_hours", http.StatusBadRequest)
+			return
+		}
+		if maxWeekly != nil {
+			filter.MaxWeeklyHours = *maxWeekly
+		}
+
+		writeReport(w, r, reportInfo{
+			Title:     "fatigue report",
+			Slug:      "fatigue",
+			StartDate: &startDate,
+			EndDate:   &endDate,
+		}, store.Fatigue(r.Context(), filter))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var fatigueRules = FatigueFilter{MinRestHours: defaultMinRestHours, MaxConsecutiveDays: defaultMaxConsecutiveDays, MaxWeeklyHours: defaultMaxWeeklyHours}
+
+// A shift of staff member 1 on day d from start to end, past midnight when
+// end isn't after start
+func fatigueShift(t *testing.T, id int, d, start, end string, overtimeHours float64) workedShift {
+	t.Helper()
+	s, e, err := shiftWindow(date(d), start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return workedShift{FatigueReportItem: FatigueReportItem{
+		AssignmentID:  id,
+		StaffID:       1,
+		Date:          date(d),
+		Start:         s,
+		End:           e,
+		OvertimeHours: overtimeHours,
+	}}
+}
+
+// Assignment id -> flags of the flagged shifts
+func fatigueFlags(items []FatigueReportItem) map[int][]string {
+	flags := map[int][]string{}
+	for _, item := range items {
+		flags[item.AssignmentID] = item.Flags
+	}
+	return flags
+}
+
+func TestFlagFatigueRest(t *testing.T) {
+	tests := []struct {
+		name   string
+		shifts func(t *testing.T) []workedShift
+		want   map[int][]string
+	}{
+		{
+			name: "rest exactly at the threshold",
+			shifts: func(t *testing.T) []workedShift {
+				return []workedShift{
+					fatigueShift(t, 1, "2024-03-04", "15:00:00", "23:00:00", 0),
+					fatigueShift(t, 2, "2024-03-05", "10:00:00", "18:00:00", 0),
+				}
+			},
+			want: map[int][]string{},
+		},
+		{
+			name: "rest a minute short",
+			shifts: func(t *testing.T) []workedShift {
+				return []workedShift{
+					fatigueShift(t, 1, "2024-03-04", "15:00:00", "23:00:00", 0),
+					fatigueShift(t, 2, "2024-03-05", "09:59:00", "18:00:00", 0),
+				}
+			},
+			want: map[int][]string{2: {FatigueShortRest}},
+		},
+		{
+			name: "overtime eats into the rest",
+			shifts: func(t *testing.T) []workedShift {
+				return []workedShift{
+					fatigueShift(t, 1, "2024-03-04", "15:00:00", "23:00:00", 1),
+					fatigueShift(t, 2, "2024-03-05", "10:00:00", "18:00:00", 0),
+				}
+			},
+			want: map[int][]string{2: {FatigueShortRest}},
+		},
+		{
+			name: "overnight then the next afternoon",
+			shifts: func(t *testing.T) []workedShift {
+				return []workedShift{
+					fatigueShift(t, 1, "2024-03-04", "23:00:00", "07:00:00", 0),
+					fatigueShift(t, 2, "2024-03-05", "15:00:00", "23:00:00", 0),
+				}
+			},
+			want: map[int][]string{2: {FatigueShortRest}},
+		},
+		{
+			name: "overnight on back to back nights",
+			shifts: func(t *testing.T) []workedShift {
+				return []workedShift{
+					fatigueShift(t, 1, "2024-03-04", "23:00:00", "07:00:00", 0),
+					fatigueShift(t, 2, "2024-03-05", "23:00:00", "07:00:00", 0),
+				}
+			},
+			want: map[int][]string{},
+		},
+		{
+			name: "overnight ending exactly 11 hours before the next",
+			shifts: func(t *testing.T) []workedShift {
+				return []workedShift{
+					fatigueShift(t, 1, "2024-03-04", "23:00:00", "07:00:00", 0),
+					fatigueShift(t, 2, "2024-03-05", "18:00:00", "23:00:00", 0),
+				}
+			},
+			want: map[int][]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fatigueFlags(flagFatigue(tt.shifts(t), fatigueRules)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flags = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlagFatigueOvernightStreak(t *testing.T) {
+	// Seven nights in a row, each counted on the date it starts
+	var shifts []workedShift
+	for i, d := range []string{"2024-03-04", "2024-03-05", "2024-03-06", "2024-03-07", "2024-03-08", "2024-03-09", "2024-03-10"} {
+		shifts = append(shifts, fatigueShift(t, i+1, d, "23:00:00", "07:00:00", 0))
+	}
+	flagged := flagFatigue(shifts, fatigueRules)
+
+	if got := fatigueFlags(flagged); !reflect.DeepEqual(got, map[int][]string{7: {FatigueConsecutiveDays, FatigueWeeklyHours}}) {
+		t.Fatalf("flags = %v, want only the seventh night over the streak and the weekly hours", got)
+	}
+	last := flagged[0]
+	if last.ConsecutiveDays != 7 || last.WeeklyHours != 56 {
+		t.Errorf("seventh night = %d days, %v weekly hours, want 7 and 56", last.ConsecutiveDays, last.WeeklyHours)
+	}
+	if last.RestHours == nil || *last.RestHours != 16 {
+		t.Errorf("seventh night rest = %v, want 16 hours", last.RestHours)
+	}
+}
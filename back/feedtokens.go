@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/lib/pq"
+)
+
+// Length in bytes of the random part of a feed token
+const feedTokenLen = 32
+
+// A calendar feed token of a user. The token itself is only returned once,
+// when it is created, the database keeps its hash.
+type FeedToken struct {
+	ID         int        `json:"id"`
+	Label      string     `json:"label"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// Payload of POST /auth/feed-tokens
+type FeedTokenInput struct {
+	Label string `json:"label"`
+}
+
+// Response of POST /auth/feed-tokens
+type CreatedFeedToken struct {
+	FeedToken
+	Token string `json:"token"`
+}
+
+// FeedTokenStore issues and checks the long-lived tokens calendar apps
+// subscribe with. They only open the calendar feeds, unlike sessions.
+type FeedTokenStore interface {
+	CreateFeedToken(ctx context.Context, userID int, label string) (CreatedFeedToken, error)
+	ListFeedTokens(ctx context.Context, userID int) ([]FeedToken, error)
+	RevokeFeedToken(ctx context.Context, userID, id int) error
+	// Claims of the user a live token belongs to, ErrInvalidToken otherwise
+	FeedTokenClaims(ctx context.Context, token string, now time.Time) (Claims, error)
+}
+
+type PostgresFeedTokenStore struct {
+	db *sql.DB
+}
+
+func NewPostgresFeedTokenStore(db *sql.DB) *PostgresFeedTokenStore {
+	return &PostgresFeedTokenStore{db: db}
+}
+
+func hashFeedToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *PostgresFeedTokenStore) CreateFeedToken(ctx context.Context, userID int, label string) (CreatedFeedToken, error) {
+	var created CreatedFeedToken
+	raw := make([]byte, feedTokenLen)
+	if _, err := rand.Read(raw); err != nil {
+		return created, err
+	}
+	created.Token = base64.RawURLEncoding.EncodeToString(raw)
+
+	err := s.db.QueryRowContext(ctx, `
+        INSERT INTO calendar_feed_tokens (user_id, token_hash, label)
+        VALUES ($1, $2, $3)
+        RETURNING id, label, created_at
+    `, userID, hashFeedToken(created.Token), label).Scan(&created.ID, &created.Label, &created.CreatedAt)
+	return created, err
+}
+
+func (s *PostgresFeedTokenStore) ListFeedTokens(ctx context.Context, userID int) ([]FeedToken, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT id, label, created_at, last_used_at, revoked_at
+        FROM calendar_feed_tokens
+        WHERE user_id = $1
+        ORDER BY created_at DESC, id DESC
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []FeedToken{}
+	for rows.Next() {
+		var token FeedToken
+		if err := rows.Scan(&token.ID, &token.Label, &token.CreatedAt, &token.LastUsedAt, &token.RevokedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *PostgresFeedTokenStore) RevokeFeedToken(ctx context.Context, userID, id int) error {
+	result, err := s.db.ExecContext(ctx, `
+        UPDATE calendar_feed_tokens
+        SET revoked_at = now()
+        WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+    `, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// The claims are read from the user at every request, so deactivating a
+// user or changing their role or departments applies to their feeds too
+func (s *PostgresFeedTokenStore) FeedTokenClaims(ctx context.Context, token string, now time.Time) (Claims, error) {
+	var claims Claims
+	var createdAt time.Time
+	var staffID sql.NullInt64
+	var departmentIDs pq.Int64Array
+	var departmentNames pq.StringArray
+	err := s.db.QueryRowContext(ctx, `
+        UPDATE calendar_feed_tokens ft
+        SET last_used_at = $2
+        FROM users u
+        WHERE ft.user_id = u.id
+          AND ft.token_hash = $1
+          AND ft.revoked_at IS NULL
+          AND u.active
+        RETURNING
+            u.id,
+            u.email,
+            u.role,
+            u.staff_id,
+            ft.created_at,
+            (SELECT COALESCE(ARRAY_AGG(d.id ORDER BY d.name), '{}')
+             FROM user_departments ud JOIN departments d ON ud.department_id = d.id
+             WHERE ud.user_id = u.id),
+            (SELECT COALESCE(ARRAY_AGG(d.name ORDER BY d.name), '{}')
+             FROM user_departments ud JOIN departments d ON ud.department_id = d.id
+             WHERE ud.user_id = u.id)
+    `, hashFeedToken(token), now).Scan(&claims.Subject, &claims.Email, &claims.Role, &staffID, &createdAt, &departmentIDs, &departmentNames)
+	if errors.Is(err, sql.ErrNoRows) {
+		return claims, ErrInvalidToken
+	}
+	if err != nil {
+		return claims, err
+	}
+
+	if staffID.Valid {
+		id := int(staffID.Int64)
+		claims.StaffID = &id
+	}
+	for i, id := range departmentIDs {
+		claims.Departments = append(claims.Departments, UserDepartment{ID: int(id), Name: departmentNames[i]})
+	}
+	claims.IssuedAt = createdAt.Unix()
+	return claims, nil
+}
+
+// Authenticates the calendar feeds. The app itself sends its session as a
+// bearer token; calendar apps subscribe to a bare URL, so ?token= is
+// accepted too, but only a feed token, never a session.
+func AuthenticateFeed(signer *TokenSigner, store FeedTokenStore) func(http.Handler) http.Handler {
+	session := Authenticate(signer)
+	return func(next http.Handler) http.Handler {
+		withSession := session(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.URL.Query().Get("token")
+			if r.Header.Get("Authorization") != "" || token == "" {
+				withSession.ServeHTTP(w, r)
+				return
+			}
+
+			claims, err := store.FeedTokenClaims(r.Context(), token, time.Now())
+			if errors.Is(err, ErrInvalidToken) {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				log.Printf("Error checking feed token: %v", err)
+				http.Error(w, "Failed to check token", http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+		})
+	}
+}
+
+// Logs requests like middleware.Logger, with the value of a ?token= query
+// parameter masked so feed tokens don't end up in the logs
+type redactingLogFormatter struct {
+	middleware.LogFormatter
+}
+
+func (f redactingLogFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	queryParams := r.URL.Query()
+	if !queryParams.Has("token") {
+		return f.LogFormatter.NewLogEntry(r)
+	}
+	queryParams.Set("token", "REDACTED")
+	redactedURL := *r.URL
+	redactedURL.RawQuery = queryParams.Encode()
+	redacted := *r
+	redacted.URL = &redactedURL
+	redacted.RequestURI = redactedURL.RequestURI()
+	return f.LogFormatter.NewLogEntry(&redacted)
+}
+
+// Request logger of the router, middleware.Logger with tokens redacted
+func requestLogger() func(http.Handler) http.Handler {
+	return middleware.RequestLogger(redactingLogFormatter{
+		&middleware.DefaultLogFormatter{Logger: log.New(os.Stdout, "", log.LstdFlags)},
+	})
+}
+
+func ListFeedTokensHandler(store FeedTokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokens, err := store.ListFeedTokens(r.Context(), claimsFrom(r.Context()).Subject)
+		if err != nil {
+			log.Printf("Error listing feed tokens: %v", err)
+			http.Error(w, "Failed to fetch feed tokens", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, tokens)
+	}
+}
+
+func CreateFeedTokenHandler(store FeedTokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input FeedTokenInput
+		if r.ContentLength != 0 {
+			if err := decodeJSON(r, &input); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		token, err := store.CreateFeedToken(r.Context(), claimsFrom(r.Context()).Subject, strings.TrimSpace(input.Label))
+		if err != nil {
+			log.Printf("Error creating feed token: %v", err)
+			http.Error(w, "Failed to create feed token", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, token)
+	}
+}
+
+func RevokeFeedTokenHandler(store FeedTokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid feed token id", http.StatusBadRequest)
+			return
+		}
+
+		err = store.RevokeFeedToken(r.Context(), claimsFrom(r.Context()).Subject, id)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Feed token not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error revoking feed token: %v", err)
+			http.Error(w, "Failed to revoke feed token", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
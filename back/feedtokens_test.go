@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Feed token store holding a single live token
+type fakeFeedTokens struct {
+	token  string
+	claims Claims
+}
+
+func (f fakeFeedTokens) CreateFeedToken(ctx context.Context, userID int, label string) (CreatedFeedToken, error) {
+	return CreatedFeedToken{}, nil
+}
+
+func (f fakeFeedTokens) ListFeedTokens(ctx context.Context, userID int) ([]FeedToken, error) {
+	return nil, nil
+}
+
+func (f fakeFeedTokens) RevokeFeedToken(ctx context.Context, userID, id int) error {
+	return nil
+}
+
+func (f fakeFeedTokens) FeedTokenClaims(ctx context.Context, token string, now time.Time) (Claims, error) {
+	if token != f.token {
+		return Claims{}, ErrInvalidToken
+	}
+	return f.claims, nil
+}
+
+func TestAuthenticateFeed(t *testing.T) {
+	signer := NewTokenSigner(strings.Repeat("s", 32))
+	session, _, err := signer.Issue(User{ID: 1, Email: "admin@example.com", Role: RoleAdmin}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := fakeFeedTokens{token: "feed-token", claims: Claims{Subject: 2, Role: RoleScheduler}}
+	handler := AuthenticateFeed(signer, feeds)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(claimsFrom(r.Context()).Role))
+	}))
+
+	tests := []struct {
+		name   string
+		query  string
+		bearer string
+		status int
+		role   string
+	}{
+		{"feed token", "?token=feed-token", "", http.StatusOK, RoleScheduler},
+		{"session header", "", session, http.StatusOK, RoleAdmin},
+		{"session as query token", "?token=" + session, "", http.StatusUnauthorized, ""},
+		{"unknown feed token", "?token=revoked", "", http.StatusUnauthorized, ""},
+		{"no token", "", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/staff/1/calendar.ics"+tt.query, nil)
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusOK && rec.Body.String() != tt.role {
+				t.Errorf("role = %q, want %q", rec.Body, tt.role)
+			}
+		})
+	}
+}
+
+func TestRequestLoggerRedactsToken(t *testing.T) {
+	var logged bytes.Buffer
+	var seen string
+	handler := middleware.RequestLogger(redactingLogFormatter{
+		&middleware.DefaultLogFormatter{Logger: log.New(&logged, "", 0), NoColor: true},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.Query().Get("token")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/departments/3/calendar.ics?start=2024-01-01&token=secret", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if seen != "secret" {
+		t.Errorf("handler saw token %q, want the original", seen)
+	}
+	if strings.Contains(logged.String(), "secret") {
+		t.Errorf("token logged: %s", logged.String())
+	}
+	if !strings.Contains(logged.String(), "start=2024-01-01&token=REDACTED") {
+		t.Errorf("log line lost the query: %s", logged.String())
+	}
+}
@@ -1,274 +1,184 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
-	"fmt"
-	"log"
 	"net/http"
-	"strconv"
-	"strings"
 	"time" // Import time for date formatting
 
-	_ "github.com/lib/pq" // Import the PostgreSQL driver
+	"backend/querybuilder"
+
+	"github.com/lib/pq"
 )
 
-// Struct to hold Leave Analysis Report data
+// Struct to hold Leave Analysis Report data, one row per leave request.
+// Departments are those the staff member belonged to during the leave.
+// Durations only count the days inside the requested window, both ends
+// included; working days leave out weekends and holidays.
 type LeaveAnalysisReportItem struct {
+	LeaveRequestID int        `json:"leave_request_id"`
 	StaffName      string     `json:"staff_name"`
 	RoleName       string     `json:"role_name"`
-	DepartmentName string     `json:"department_name"` // Note: This will show one row per department if staff is in multiple
+	Departments    []string   `json:"departments"`
 	StartDate      time.Time  `json:"start_date"`
 	EndDate        *time.Time `json:"end_date"` // Use pointer for nullable end_date
 	Status         string     `json:"status"`
+	DurationDays   int        `json:"duration_days" total:"sum"`
+	WorkingDays    int        `json:"working_days" total:"sum"`
 }
 
-// Assuming 'db' is a globally accessible *sql.DB variable in the 'main' package.
-// You must ensure this 'db' is successfully initialized before this handler is called.
-// var db *sql.DB // This should be declared at the package level in your main.go
+// Filters accepted by the leave analysis report, unlike the other reports
+// both ends of the date range are optional
+type LeaveAnalysisFilter struct {
+	StartDate   *time.Time
+	EndDate     *time.Time
+	Departments []string
+	Statuses    []string
+	Roles       []string
+	MinDuration *int
+	MaxDuration *int
+	// Sort and page, applied by the query
+	Paging reportPaging
+}
 
-func GetLeaveAnalysisReportHandler(w http.ResponseWriter, r *http.Request) {
-	// Build the base query with a subquery to calculate duration
-	query := `
-        SELECT 
-            staff_name,
-            role_name,
-            department_name,
-            start_date,
-            end_date,
-            status,
-            leave_duration_days
-        FROM (
+// Calendar days of a leave inside the window, w holds its clipped first
+// and last day. Open ended leaves count up to today.
+const leaveDurationExpr = "GREATEST(w.last - w.first + 1, 0)"
+
+// Days of the clipped leave that aren't weekends or holidays
+const leaveWorkingDaysExpr = `(
+                SELECT COUNT(*)
+                FROM generate_series(w.first, w.last, INTERVAL '1 day') AS days(day)
+                WHERE EXTRACT(ISODOW FROM days.day) < 6
+                  AND NOT EXISTS (SELECT 1 FROM holidays h WHERE h.date = days.day::date)
+            )`
+
+func (s *PostgresReportStore) LeaveAnalysis(ctx context.Context, filter LeaveAnalysisFilter) ReportRows[LeaveAnalysisReportItem] {
+	// $1 and $2 are the window, either may be NULL: GREATEST and LEAST
+	// ignore it, so the leave isn't clipped on that side
+	qb := querybuilder.New(`
+        SELECT
+            lr.id AS leave_request_id,
+            s.name AS staff_name,
+            r.name AS role_name,
+            ARRAY(
+                SELECT DISTINCT d.name
+                FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = lr.staff_id
+                  AND sd.start_date <= COALESCE(lr.end_date, CURRENT_DATE)
+                  AND (sd.end_date IS NULL OR sd.end_date >= lr.start_date)
+                ORDER BY d.name
+            ) AS departments,
+            lr.start_date,
+            lr.end_date,
+            lr.status,
+            `+leaveDurationExpr+` AS duration_days,
+            `+leaveWorkingDaysExpr+` AS working_days
+        FROM
+            leave_requests lr
+        JOIN
+            staff s ON lr.staff_id = s.id
+        JOIN
+            roles r ON s.role_id = r.id
+        CROSS JOIN LATERAL (
             SELECT
-                s.name AS staff_name,
-                r.name AS role_name,
-                d.name AS department_name,
-                lr.start_date,
-                lr.end_date,
-                lr.status,
-                CASE
-                    WHEN lr.end_date IS NULL THEN EXTRACT(DAY FROM age(CURRENT_DATE, lr.start_date))
-                    ELSE EXTRACT(DAY FROM age(lr.end_date, lr.start_date))
-                END AS leave_duration_days
-            FROM
-                leave_requests lr
-            JOIN
-                staff s ON lr.staff_id = s.id
-            JOIN
-                roles r ON s.role_id = r.id
-            JOIN
-                staff_departments sd ON s.id = sd.staff_id
-            JOIN
-                departments d ON sd.department_id = d.id
-            WHERE 1=1
-    `
-
-	// Collect the filters from the URL query parameters
-	queryParams := r.URL.Query()
-
-	// Build the WHERE clause dynamically
-	var conditions []string
-	var values []interface{}
-	argCount := 1 // Parameter counter for parameterized queries
-
-	// Date Range filter (using overlap logic)
-	startDateStr := queryParams.Get("start_date")
-	endDateStr := queryParams.Get("end_date")
-
-	if startDateStr != "" && endDateStr != "" {
-		conditions = append(conditions, fmt.Sprintf("(lr.start_date <= $%d AND (lr.end_date IS NULL OR lr.end_date >= $%d))",
-			argCount, argCount+1))
-		values = append(values, endDateStr, startDateStr)
-		argCount += 2
-
-		// Staff department validity check
-		conditions = append(conditions, fmt.Sprintf("(sd.start_date IS NULL OR sd.start_date <= $%d)", argCount))
-		values = append(values, endDateStr)
-		argCount++
-
-		conditions = append(conditions, fmt.Sprintf("(sd.end_date IS NULL OR sd.end_date >= $%d)", argCount))
-		values = append(values, startDateStr)
-		argCount++
-	} else if startDateStr != "" {
-		conditions = append(conditions, fmt.Sprintf("lr.start_date >= $%d", argCount))
-		values = append(values, startDateStr)
-		argCount++
-
-		conditions = append(conditions, fmt.Sprintf("(sd.end_date IS NULL OR sd.end_date >= $%d)", argCount))
-		values = append(values, startDateStr)
-		argCount++
-	} else if endDateStr != "" {
-		conditions = append(conditions, fmt.Sprintf("(lr.end_date IS NULL OR lr.end_date <= $%d)", argCount))
-		values = append(values, endDateStr)
-		argCount++
-
-		conditions = append(conditions, fmt.Sprintf("(sd.start_date IS NULL OR sd.start_date <= $%d)", argCount))
-		values = append(values, endDateStr)
-		argCount++
-	}
-
-	// Department filter (Handling multiple departments)
-	departments := queryParams["department"]
-	if len(departments) > 0 {
-		placeholders := make([]string, len(departments))
-		for i := range departments {
-			placeholders[i] = fmt.Sprintf("$%d", argCount)
-			values = append(values, departments[i])
-			argCount++
-		}
-		conditions = append(conditions, fmt.Sprintf("d.name IN (%s)", strings.Join(placeholders, ", ")))
+                GREATEST(lr.start_date, $1::date) AS first,
+                LEAST(COALESCE(lr.end_date, CURRENT_DATE), $2::date) AS last
+        ) w
+    `, filter.StartDate, filter.EndDate)
+
+	// Leaves overlapping the window
+	if filter.EndDate != nil {
+		qb.Where(querybuilder.Raw("lr.start_date <= $2"))
 	}
-
-	// Status filter
-	statuses := queryParams["status"]
-	if len(statuses) > 0 {
-		placeholders := make([]string, len(statuses))
-		for i := range statuses {
-			placeholders[i] = fmt.Sprintf("$%d", argCount)
-			values = append(values, statuses[i])
-			argCount++
-		}
-		conditions = append(conditions, fmt.Sprintf("lr.status IN (%s)", strings.Join(placeholders, ", ")))
+	if filter.StartDate != nil {
+		qb.Where(querybuilder.Raw("lr.end_date IS NULL OR lr.end_date >= $1"))
 	}
 
-	// Role filter
-	roles := queryParams["role"]
-	if len(roles) > 0 {
-		placeholders := make([]string, len(roles))
-		for i := range roles {
-			placeholders[i] = fmt.Sprintf("$%d", argCount)
-			values = append(values, roles[i])
-			argCount++
-		}
-		conditions = append(conditions, fmt.Sprintf("r.name IN (%s)", strings.Join(placeholders, ", ")))
-	}
-
-	// Combine the WHERE clause conditions
-	if len(conditions) > 0 {
-		query += " AND " + strings.Join(conditions, " AND ")
+	// Staff belonging to one of the departments during the leave
+	if len(filter.Departments) > 0 {
+		qb.Where(func(args *querybuilder.Args) string {
+			return `EXISTS (
+                SELECT 1 FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = lr.staff_id
+                  AND sd.start_date <= COALESCE(lr.end_date, CURRENT_DATE)
+                  AND (sd.end_date IS NULL OR sd.end_date >= lr.start_date)
+                  AND ` + querybuilder.In("d.name", filter.Departments)(args) + `)`
+		})
 	}
+	qb.Where(querybuilder.In("lr.status", filter.Statuses))
+	qb.Where(querybuilder.In("r.name", filter.Roles))
+	qb.Where(querybuilder.Range(leaveDurationExpr, filter.MinDuration, filter.MaxDuration))
+
+	return scanPage(ctx, s, qb, filter.Paging,
+		[]string{"leave_request_id", "staff_name", "role_name", "start_date", "end_date", "status", "duration_days", "working_days"},
+		[]string{"lr.start_date", "lr.id"},
+		func(row rowScanner, report *LeaveAnalysisReportItem) error {
+			var departments pq.StringArray
+			var endDate sql.NullTime
+
+			err := row.Scan(
+				&report.LeaveRequestID,
+				&report.StaffName,
+				&report.RoleName,
+				&departments,
+				&report.StartDate,
+				&endDate,
+				&report.Status,
+				&report.DurationDays,
+				&report.WorkingDays,
+			)
+			report.Departments = departments
+			if endDate.Valid {
+				report.EndDate = &endDate.Time
+			}
+			return err
+		})
+}
 
-	// Close the subquery
-	query += `) AS leave_data`
+func GetLeaveAnalysisReportHandler(store ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Collect the filters from the URL query parameters
+		queryParams := r.URL.Query()
 
-	// Add WHERE clause for duration filters to the outer query
-	var outerConditions []string
+		filter := LeaveAnalysisFilter{
+			Departments: queryValues(queryParams, "department"),
+			Statuses:    queryValues(queryParams, "status"),
+			Roles:       queryValues(queryParams, "role"),
+		}
 
-	// Minimum Duration filter
-	minDurationStr := queryParams.Get("min_duration")
-	if minDurationStr != "" {
-		minDuration, err := strconv.Atoi(minDurationStr)
-		if err != nil {
-			http.Error(w, "Invalid minimum duration parameter", http.StatusBadRequest)
+		// Optional date range
+		var err error
+		if filter.StartDate, err = optionalDate(queryParams, "start_date"); err != nil {
+			http.Error(w, "Invalid start date", http.StatusBadRequest)
 			return
 		}
-
-		outerConditions = append(outerConditions, fmt.Sprintf("leave_duration_days >= $%d", argCount))
-		values = append(values, minDuration)
-		argCount++
-	}
-
-	// Maximum Duration filter
-	maxDurationStr := queryParams.Get("max_duration")
-	if maxDurationStr != "" {
-		maxDuration, err := strconv.Atoi(maxDurationStr)
-		if err != nil {
-			http.Error(w, "Invalid maximum duration parameter", http.StatusBadRequest)
+		if filter.EndDate, err = optionalDate(queryParams, "end_date"); err != nil {
+			http.Error(w, "Invalid end date", http.StatusBadRequest)
 			return
 		}
 
-		outerConditions = append(outerConditions, fmt.Sprintf("leave_duration_days <= $%d", argCount))
-		values = append(values, maxDuration)
-		argCount++
-	}
-
-	// Add outer WHERE clause if duration filters exist
-	if len(outerConditions) > 0 {
-		query += " WHERE " + strings.Join(outerConditions, " AND ")
-	}
-
-	// Order by
-	query += " ORDER BY start_date"
-
-	// Log the final query (for debugging)
-	log.Println("Executing query:", query)
-	log.Println("With values:", values)
-
-	// Execute the query
-	rows, err := db.Query(query, values...)
-	if err != nil {
-		log.Printf("Error querying leave analysis report: %v", err)
-		http.Error(w, "Failed to fetch leave analysis report", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	// Update struct to include duration
-	type LeaveAnalysisReportWithDuration struct {
-		LeaveAnalysisReportItem
-		DurationDays float64 `json:"duration_days"`
-	}
-
-	// Process the results
-	var reports []LeaveAnalysisReportWithDuration
-	rowCount := 0
-
-	for rows.Next() {
-		rowCount++
-		var report LeaveAnalysisReportWithDuration
-		var startDate, endDate sql.NullTime
-
-		err := rows.Scan(
-			&report.StaffName,
-			&report.RoleName,
-			&report.DepartmentName,
-			&startDate,
-			&endDate,
-			&report.Status,
-			&report.DurationDays,
-		)
-		if err != nil {
-			log.Printf("Error scanning leave analysis report row: %v", err)
-			http.Error(w, "Failed to process leave analysis report data", http.StatusInternalServerError)
+		// Minimum / Maximum Duration filters
+		if filter.MinDuration, err = optionalInt(queryParams, "min_duration"); err != nil {
+			http.Error(w, "Invalid minimum duration parameter", http.StatusBadRequest)
 			return
 		}
-
-		if startDate.Valid {
-			report.StartDate = startDate.Time
-		} else {
-			log.Printf("Warning: Null start_date encountered for staff %s", report.StaffName)
+		if filter.MaxDuration, err = optionalInt(queryParams, "max_duration"); err != nil {
+			http.Error(w, "Invalid maximum duration parameter", http.StatusBadRequest)
+			return
 		}
 
-		if endDate.Valid {
-			report.EndDate = &endDate.Time
-		} else {
-			report.EndDate = nil
+		if filter.Paging, err = requestPaging[LeaveAnalysisReportItem](r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-
-		reports = append(reports, report)
-	}
-
-	log.Printf("Query returned %d rows", rowCount)
-
-	if err := rows.Err(); err != nil {
-		log.Printf("Error iterating over leave analysis report rows: %v", err)
-		http.Error(w, "Failed to retrieve all leave analysis reports", http.StatusInternalServerError)
-		return
-	}
-
-	// Set Content-Type header and encode as JSON
-	w.Header().Set("Content-Type", "application/json")
-
-	jsonBytes, err := json.MarshalIndent(reports, "", "  ")
-	if err != nil {
-		log.Printf("Error marshaling JSON: %v", err)
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
-		return
+		writeReportRows(w, r, reportInfo{
+			Title:     "leave analysis report",
+			Slug:      "leave-analysis",
+			StartDate: filter.StartDate,
+			EndDate:   filter.EndDate,
+		}, store.LeaveAnalysis(r.Context(), filter))
 	}
-
-	// Log the actual JSON being sent
-	log.Printf("Sending JSON response of %d bytes: %s", len(jsonBytes), string(jsonBytes))
-
-	// Write the response
-	w.Write(jsonBytes)
 }
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"backend/querybuilder"
+
+	"github.com/lib/pq"
+)
+
+// Statuses of a leave request, mirror the CHECK on leave_requests.status
+const (
+	LeavePending  = "pending"
+	LeaveApproved = "approved"
+	LeaveDenied   = "denied"
+)
+
+// Allowed status changes, decisions are final so only pending requests move
+var leaveTransitions = map[string][]string{
+	LeavePending: {LeaveApproved, LeaveDenied},
+}
+
+// Returned when a decision doesn't follow leaveTransitions
+type IllegalTransitionError struct {
+	From string
+	To   string
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("Cannot move a leave request from %s to %s", e.From, e.To)
+}
+
+// Checks a status change against the state machine
+func checkLeaveTransition(from, to string) error {
+	if !slices.Contains(leaveTransitions[from], to) {
+		return &IllegalTransitionError{From: from, To: to}
+	}
+	return nil
+}
+
+var (
+	ErrUnknownStaff  = errors.New("staff_id does not match any staff member")
+	ErrOverlapLeave  = errors.New("The staff member already has a pending or approved leave in this period")
+	ErrInactiveStaff = errors.New("Inactive staff members cannot request leave")
+)
+
+// A row of leave_requests with the staff member's current departments
+type LeaveRequest struct {
+	ID          int        `json:"id"`
+	StaffID     int        `json:"staff_id"`
+	StaffName   string     `json:"staff_name"`
+	Departments []string   `json:"departments"`
+	StartDate   time.Time  `json:"start_date"`
+	EndDate     *time.Time `json:"end_date"`
+	Status      string     `json:"status"`
+}
+
+// Payload to submit a leave, end_date may be omitted for indefinite leaves
+type LeaveRequestInput struct {
+	StaffID   int    `json:"staff_id"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+}
+
+// Parsed and validated LeaveRequestInput
+type NewLeaveRequest struct {
+	StaffID   int
+	StartDate time.Time
+	EndDate   *time.Time
+}
+
+func (in LeaveRequestInput) Validate() (NewLeaveRequest, error) {
+	var leave NewLeaveRequest
+	if in.StaffID <= 0 {
+		return leave, errors.New("staff_id is required")
+	}
+	start, err := time.Parse(dateLayout, in.StartDate)
+	if err != nil {
+		return leave, errors.New("start_date must be a YYYY-MM-DD date")
+	}
+	leave.StaffID = in.StaffID
+	leave.StartDate = start
+
+	if in.EndDate != "" {
+		end, err := time.Parse(dateLayout, in.EndDate)
+		if err != nil {
+			return leave, errors.New("end_date must be a YYYY-MM-DD date")
+		}
+		if end.Before(start) {
+			return leave, errors.New("end_date cannot be before start_date")
+		}
+		leave.EndDate = &end
+	}
+	return leave, nil
+}
+
+// An existing assignment falling inside an approved leave, the scheduler
+// has to hand it to someone else
+type ShiftConflict struct {
+	AssignmentID   int       `json:"assignment_id"`
+	ShiftID        int       `json:"shift_id"`
+	Date           time.Time `json:"date"`
+	ShiftTime      string    `json:"shift_time"`
+	DepartmentName string    `json:"department_name"`
+	ShiftType      string    `json:"shift_type"`
+}
+
+// Result of approving / denying a request
+type LeaveDecision struct {
+	Request   LeaveRequest    `json:"request"`
+	Conflicts []ShiftConflict `json:"conflicts"`
+}
+
+// LeaveStore manages the leave request workflow
+type LeaveStore interface {
+	// departments, when not nil, limits the submission to staff currently
+	// in one of them
+	SubmitLeave(ctx context.Context, leave NewLeaveRequest, departments []string) (LeaveRequest, error)
+	PendingLeaves(ctx context.Context, departments []string) ([]LeaveRequest, error)
+	// departments, when not nil, limits the decision to requests of staff
+	// currently in one of them
+	DecideLeave(ctx context.Context, id int, status string, departments []string) (LeaveDecision, error)
+}
+
+type PostgresLeaveStore struct {
+	db *sql.DB
+}
+
+func NewPostgresLeaveStore(db *sql.DB) *PostgresLeaveStore {
+	return &PostgresLeaveStore{db: db}
+}
+
+// Request plus the departments its staff member currently belongs to
+const leaveRequestSelect = `
+        SELECT
+            lr.id,
+            lr.staff_id,
+            s.name,
+            ARRAY(
+                SELECT d.name
+                FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = lr.staff_id
+                  AND sd.start_date <= CURRENT_DATE
+                  AND (sd.end_date IS NULL OR sd.end_date >= CURRENT_DATE)
+                ORDER BY d.name
+            ) AS departments,
+            lr.start_date,
+            lr.end_date,
+            lr.status
+        FROM
+            leave_requests lr
+        JOIN
+            staff s ON lr.staff_id = s.id
+    `
+
+func (s *PostgresLeaveStore) SubmitLeave(ctx context.Context, leave NewLeaveRequest, departments []string) (LeaveRequest, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return LeaveRequest{}, err
+	}
+	defer tx.Rollback()
+
+	// Lock the staff row so two overlapping submissions can't both pass
+	var active bool
+	err = tx.QueryRowContext(ctx, "SELECT active FROM staff WHERE id = $1 FOR UPDATE", leave.StaffID).Scan(&active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LeaveRequest{}, ErrUnknownStaff
+	}
+	if err != nil {
+		return LeaveRequest{}, err
+	}
+	if !active {
+		return LeaveRequest{}, ErrInactiveStaff
+	}
+	if departments != nil {
+		var inScope bool
+		err = tx.QueryRowContext(ctx, `
+            SELECT EXISTS (
+                SELECT 1
+                FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = $1
+                  AND d.name = ANY($2)
+                  AND sd.start_date <= CURRENT_DATE
+                  AND (sd.end_date IS NULL OR sd.end_date >= CURRENT_DATE)
+            )
+        `, leave.StaffID, pq.Array(departments)).Scan(&inScope)
+		if err != nil {
+			return LeaveRequest{}, err
+		}
+		if !inScope {
+			return LeaveRequest{}, ErrOutsideDepartments
+		}
+	}
+
+	var overlaps bool
+	err = tx.QueryRowContext(ctx, `
+        SELECT EXISTS (
+            SELECT 1 FROM leave_requests
+            WHERE staff_id = $1
+              AND status IN ('pending', 'approved')
+              AND (end_date IS NULL OR end_date >= $2)
+              AND ($3::date IS NULL OR start_date <= $3::date)
+        )
+    `, leave.StaffID, leave.StartDate, leave.EndDate).Scan(&overlaps)
+	if err != nil {
+		return LeaveRequest{}, err
+	}
+	if overlaps {
+		return LeaveRequest{}, ErrOverlapLeave
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO leave_requests (staff_id, start_date, end_date, status)
+        VALUES ($1, $2, $3, 'pending')
+        RETURNING id
+    `, leave.StaffID, leave.StartDate, leave.EndDate).Scan(&id)
+	if err != nil {
+		return LeaveRequest{}, err
+	}
+
+	request, err := getLeaveRequest(ctx, tx, id)
+	if err != nil {
+		return LeaveRequest{}, err
+	}
+	if err := recordAudit(ctx, tx, AuditCreate, EntityLeaveRequest, id, nil, request); err != nil {
+		return LeaveRequest{}, err
+	}
+	return request, tx.Commit()
+}
+
+func (s *PostgresLeaveStore) PendingLeaves(ctx context.Context, departments []string) ([]LeaveRequest, error) {
+	qb := querybuilder.New(leaveRequestSelect)
+	qb.Where(querybuilder.Eq("lr.status", LeavePending))
+	if len(departments) > 0 {
+		qb.Where(func(args *querybuilder.Args) string {
+			return `EXISTS (
+                SELECT 1 FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = lr.staff_id
+                  AND sd.start_date <= CURRENT_DATE
+                  AND (sd.end_date IS NULL OR sd.end_date >= CURRENT_DATE)
+                  AND ` + querybuilder.In("d.name", departments)(args) + `)`
+		})
+	}
+	qb.OrderBy("lr.start_date", "lr.id")
+
+	query, values := qb.Build()
+	rows, err := s.db.QueryContext(ctx, query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []LeaveRequest{}
+	for rows.Next() {
+		request, err := scanLeaveRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+func (s *PostgresLeaveStore) DecideLeave(ctx context.Context, id int, status string, departments []string) (LeaveDecision, error) {
+	decision := LeaveDecision{Conflicts: []ShiftConflict{}}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return decision, err
+	}
+	defer tx.Rollback()
+
+	// Lock the request so concurrent decisions are serialised
+	var current string
+	err = tx.QueryRowContext(ctx, "SELECT status FROM leave_requests WHERE id = $1 FOR UPDATE", id).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return decision, ErrNotFound
+	}
+	if err != nil {
+		return decision, err
+	}
+	if err := checkLeaveTransition(current, status); err != nil {
+		return decision, err
+	}
+	before, err := getLeaveRequest(ctx, tx, id)
+	if err != nil {
+		return decision, err
+	}
+	if departments != nil && !slices.ContainsFunc(before.Departments, func(d string) bool {
+		return slices.Contains(departments, d)
+	}) {
+		return decision, ErrOutsideDepartments
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE leave_requests SET status = $1 WHERE id = $2", status, id); err != nil {
+		return decision, err
+	}
+
+	if decision.Request, err = getLeaveRequest(ctx, tx, id); err != nil {
+		return decision, err
+	}
+	action := AuditApprove
+	if status == LeaveDenied {
+		action = AuditDeny
+	}
+	if err := recordAudit(ctx, tx, action, EntityLeaveRequest, id, before, decision.Request); err != nil {
+		return decision, err
+	}
+	if status == LeaveApproved {
+		if decision.Conflicts, err = leaveConflicts(ctx, tx, decision.Request); err != nil {
+			return decision, err
+		}
+	}
+	return decision, tx.Commit()
+}
+
+// Assignments of the staff member that fall inside the leave. The
+// check_leave_conflict trigger only guards new writes, these already exist.
+func leaveConflicts(ctx context.Context, q queryer, leave LeaveRequest) ([]ShiftConflict, error) {
+	rows, err := q.QueryContext(ctx, `
+        SELECT
+            sa.id,
+            sh.id,
+            sh.date,
+            st.name,
+            d.name,
+            sa.shift_type
+        FROM
+            shift_assignments sa
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+        JOIN
+            departments d ON sa.department_id = d.id
+        WHERE
+            sa.staff_id = $1
+            AND sh.date >= $2
+            AND ($3::date IS NULL OR sh.date <= $3::date)
+        ORDER BY
+            sh.date, st.start_time
+    `, leave.StaffID, leave.StartDate, leave.EndDate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conflicts := []ShiftConflict{}
+	for rows.Next() {
+		var c ShiftConflict
+		if err := rows.Scan(&c.AssignmentID, &c.ShiftID, &c.Date, &c.ShiftTime, &c.DepartmentName, &c.ShiftType); err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, rows.Err()
+}
+
+func getLeaveRequest(ctx context.Context, q queryer, id int) (LeaveRequest, error) {
+	request, err := scanLeaveRequest(q.QueryRowContext(ctx, leaveRequestSelect+" WHERE lr.id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return request, ErrNotFound
+	}
+	return request, err
+}
+
+func scanLeaveRequest(row rowScanner) (LeaveRequest, error) {
+	var request LeaveRequest
+	var departments pq.StringArray
+	var endDate sql.NullTime
+	err := row.Scan(
+		&request.ID,
+		&request.StaffID,
+		&request.StaffName,
+		&departments,
+		&request.StartDate,
+		&endDate,
+		&request.Status,
+	)
+	request.Departments = []string(departments)
+	if request.Departments == nil {
+		request.Departments = []string{}
+	}
+	if endDate.Valid {
+		request.EndDate = &endDate.Time
+	}
+	return request, err
+}
+
+// Maps leave workflow errors to status codes
+func writeLeaveError(w http.ResponseWriter, err error) {
+	var transitionErr *IllegalTransitionError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "Leave request not found", http.StatusNotFound)
+	case errors.Is(err, ErrOutsideDepartments):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.As(err, &transitionErr), errors.Is(err, ErrOverlapLeave):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrUnknownStaff), errors.Is(err, ErrInactiveStaff):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		log.Printf("Error processing leave request: %v", err)
+		http.Error(w, "Failed to process leave request", http.StatusInternalServerError)
+	}
+}
+
+func SubmitLeaveHandler(store LeaveStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input LeaveRequestInput
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		leave, err := input.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Staff can only ask leave for themselves, department heads for
+		// themselves and their departments' staff
+		claims := claimsFrom(r.Context())
+		if claims.Role == RoleStaff && !claims.isStaff(leave.StaffID) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var scope []string
+		if !claims.isStaff(leave.StaffID) {
+			scope = claims.departmentScope()
+		}
+
+		request, err := store.SubmitLeave(r.Context(), leave, scope)
+		if err != nil {
+			writeLeaveError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, request)
+	}
+}
+
+func ListPendingLeavesHandler(store LeaveStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requests, err := store.PendingLeaves(r.Context(), queryValues(r.URL.Query(), "department"))
+		if err != nil {
+			writeLeaveError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, requests)
+	}
+}
+
+// Builds the approve / deny handlers, they only differ in the target status
+func DecideLeaveHandler(store LeaveStore, status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid leave request id", http.StatusBadRequest)
+			return
+		}
+
+		// Department heads only decide for their own departments
+		decision, err := store.DecideLeave(r.Context(), id, status, claimsFrom(r.Context()).departmentScope())
+		if err != nil {
+			writeLeaveError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, decision)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckLeaveTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		allowed  bool
+	}{
+		{LeavePending, LeaveApproved, true},
+		{LeavePending, LeaveDenied, true},
+		{LeavePending, LeavePending, false},
+		{LeaveApproved, LeaveDenied, false},
+		{LeaveApproved, LeavePending, false},
+		{LeaveApproved, LeaveApproved, false},
+		{LeaveDenied, LeaveApproved, false},
+		{LeaveDenied, LeavePending, false},
+		{LeaveDenied, LeaveDenied, false},
+	}
+	for _, tt := range tests {
+		err := checkLeaveTransition(tt.from, tt.to)
+		if tt.allowed && err != nil {
+			t.Errorf("%s -> %s: %v, want allowed", tt.from, tt.to, err)
+		}
+		var transitionErr *IllegalTransitionError
+		if !tt.allowed && (!errors.As(err, &transitionErr) || transitionErr.From != tt.from || transitionErr.To != tt.to) {
+			t.Errorf("%s -> %s: %v, want an IllegalTransitionError", tt.from, tt.to, err)
+		}
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+
+	"backend/migrations"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -13,8 +18,6 @@ import (
 	_ "github.com/lib/pq"
 )
 
-var db *sql.DB
-
 func main() {
 	// DB conn URL
 	dbURL := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
@@ -24,10 +27,8 @@ func main() {
 		os.Getenv("POSTGRES_PASSWORD"),
 		os.Getenv("POSTGRES_DB"))
 
-	var err error
-
 	// Open DB conn
-	db, err = sql.Open("postgres", dbURL)
+	db, err := sql.Open("postgres", dbURL)
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
@@ -41,12 +42,51 @@ func main() {
 
 	log.Println("Successfully connected to the database!")
 
+	// `backend migrate up|down|status` manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrateCommand(context.Background(), db, os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
+	// Serving on an outdated schema would fail at the first query touching
+	// the missing parts, refuse to start instead
+	pending, err := migrations.Pending(context.Background(), db)
+	if err != nil {
+		log.Fatalf("Failed to check migrations: %v", err)
+	}
+	if len(pending) > 0 {
+		log.Fatalf("%d migration(s) pending, starting with %04d_%s, run `backend migrate up` first",
+			len(pending), pending[0].Version, pending[0].Name)
+	}
+
+	// Token signing key, sessions can't be trusted without one
+	secret := os.Getenv("JWT_SECRET")
+	if len(secret) < 32 {
+		log.Fatal("JWT_SECRET must be set to at least 32 characters")
+	}
+	signer := NewTokenSigner(secret)
+
+	// First admin, only created while the users table has none
+	auth := NewPostgresAuthStore(db)
+	if email, password := os.Getenv("ADMIN_EMAIL"), os.Getenv("ADMIN_PASSWORD"); email != "" && password != "" {
+		if err := auth.EnsureAdmin(context.Background(), email, password); err != nil {
+			log.Fatalf("Failed to create admin user: %v", err)
+		}
+	}
+
 	// Chi router
 	r := chi.NewRouter()
 
-	// Allow frontend requests
+	// Allow frontend requests, CORS_ALLOWED_ORIGINS is a comma separated
+	// list for deployments outside localhost
+	allowedOrigins := []string{"http://localhost:5173"}
+	if origins := os.Getenv("CORS_ALLOWED_ORIGINS"); origins != "" {
+		allowedOrigins = strings.Split(origins, ",")
+	}
 	corsMiddleware := cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:5173"},
+		AllowedOrigins:   allowedOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
 		ExposedHeaders:   []string{"*"},
@@ -56,16 +96,146 @@ func main() {
 
 	// Middleware
 	r.Use(corsMiddleware.Handler)
-	r.Use(middleware.Logger)
+	r.Use(requestLogger())
 	r.Use(middleware.Recoverer)
 
-	// Report routes
-	r.Get("/reports/leave-analysis", GetLeaveAnalysisReportHandler)
-	r.Get("/reports/oncall-analysis", GetStaffWorkloadAnalysisHandler)
-	r.Get("/reports/overtime", GetOvertimeAnalysisReportHandler)
-	r.Get("/reports/shift-preference", GetStaffPreferenceAnalysisReportHandler)
-	r.Get("/reports/work-hours", GetHoursWorkedReportHandler)
-	r.Get("/reports/monthly-shifts", GetMonthlyShiftsHandler)
+	// Stores handed to the handlers
+	reports := NewPostgresReportStore(db)
+	staff := NewPostgresStaffStore(db)
+	leaves := NewPostgresLeaveStore(db)
+	var clock ClockStore = NewPostgresClockStore(db)
+	schedules := NewPostgresScheduleStore(db)
+	coverage := NewPostgresCoverageStore(db)
+	var calendars CalendarStore = NewPostgresCalendarStore(db)
+	audit := NewPostgresAuditStore(db)
+	payRules := NewPostgresPayRuleStore(db)
+	offers := NewPostgresShiftOfferStore(db)
+	feedTokens := NewPostgresFeedTokenStore(db)
+	users := NewPostgresUserStore(db)
+
+	// Sessions, every route but login needs a token. Calendar feeds also
+	// take a feed token as ?token= since calendar apps subscribe to a bare
+	// URL, see AuthenticateFeed.
+	requireAuth := Authenticate(signer)
+	requireFeedAuth := AuthenticateFeed(signer, feedTokens)
+	managers := []string{RoleAdmin, RoleDepartmentHead, RoleScheduler}
+
+	r.Post("/auth/login", LoginHandler(auth, signer))
+	r.With(requireAuth).Get("/auth/me", MeHandler)
+	r.Route("/auth/feed-tokens", func(r chi.Router) {
+		r.Use(requireAuth)
+		r.Get("/", ListFeedTokensHandler(feedTokens))
+		r.Post("/", CreateFeedTokenHandler(feedTokens))
+		r.Delete("/{id}", RevokeFeedTokenHandler(feedTokens))
+	})
+
+	// Logins and the departments each head runs, admins only
+	r.Route("/users", func(r chi.Router) {
+		r.Use(requireAuth, RequireRole(RoleAdmin))
+		r.Get("/", ListUsersHandler(users))
+		r.Post("/", CreateUserHandler(users))
+		r.Put("/{id}/departments", SetUserDepartmentsHandler(users))
+	})
+
+	// Report routes, department heads only get rows of their departments
+	r.Route("/reports", func(r chi.Router) {
+		r.Use(requireAuth, RequireRole(managers...), ScopeDepartments)
+		r.Get("/leave-analysis", GetLeaveAnalysisReportHandler(reports))
+		r.Get("/oncall-analysis", GetStaffWorkloadAnalysisHandler(reports))
+		r.Get("/oncall-fairness", GetOnCallFairnessReportHandler(reports))
+		r.Get("/overtime", GetOvertimeAnalysisReportHandler(reports))
+		r.Get("/overtime-cost", GetOvertimeCostReportHandler(reports))
+		r.Get("/overtime-violations", GetOvertimeViolationsReportHandler(reports))
+		r.Get("/shift-preference", GetStaffPreferenceAnalysisReportHandler(reports))
+		r.Get("/work-hours", GetHoursWorkedReportHandler(reports))
+		r.Get("/monthly-shifts", GetMonthlyShiftsHandler(reports))
+		r.Get("/attendance", GetAttendanceReportHandler(reports))
+		r.Get("/coverage", GetCoverageReportHandler(reports))
+		r.Get("/fatigue", GetFatigueReportHandler(reports))
+	})
+
+	// Staff routes, staff users can only read their own record and feed
+	r.Route("/staff", func(r chi.Router) {
+		r.With(requireFeedAuth, RequireSelfOrRole(managers...)).Get("/{id}/calendar.ics", CalendarHandler(calendars.StaffCalendar, false))
+
+		r.Group(func(r chi.Router) {
+			r.Use(requireAuth)
+			r.With(RequireRole(managers...), ScopeDepartments).Get("/", ListStaffHandler(staff))
+			r.With(RequireRole(RoleAdmin)).Post("/", CreateStaffHandler(staff))
+			r.With(RequireSelfOrRole(managers...)).Get("/{id}", GetStaffHandler(staff))
+			r.With(RequireRole(RoleAdmin)).Put("/{id}", UpdateStaffHandler(staff))
+			r.With(RequireRole(RoleAdmin)).Post("/{id}/deactivate", DeactivateStaffHandler(staff))
+		})
+	})
+
+	// Department feeds
+	r.With(requireFeedAuth, RequireRole(managers...), ScopeDepartments).Get("/departments/{id}/calendar.ics", CalendarHandler(calendars.DepartmentCalendar, true))
+
+	// Leave request workflow routes, anyone can ask leave for themselves
+	r.Route("/leave-requests", func(r chi.Router) {
+		r.Use(requireAuth)
+		r.Post("/", SubmitLeaveHandler(leaves))
+		r.With(RequireRole(managers...), ScopeDepartments).Get("/pending", ListPendingLeavesHandler(leaves))
+		r.With(RequireRole(RoleAdmin, RoleDepartmentHead)).Post("/{id}/approve", DecideLeaveHandler(leaves, LeaveApproved))
+		r.With(RequireRole(RoleAdmin, RoleDepartmentHead)).Post("/{id}/deny", DecideLeaveHandler(leaves, LeaveDenied))
+	})
+
+	// Shift clock routes
+	r.Route("/assignments", func(r chi.Router) {
+		r.Use(requireAuth)
+		r.With(RequireRole(managers...), ScopeDepartments).Get("/on-shift", OnShiftRosterHandler(clock))
+		r.With(RequireOwnAssignment(clock)).Post("/{id}/check-in", ClockHandler(clock.CheckIn))
+		r.With(RequireOwnAssignment(clock)).Post("/{id}/check-out", ClockHandler(clock.CheckOut))
+		r.With(RequireOwnAssignment(clock)).Post("/{id}/overtime", RecordOvertimeHandler(clock))
+	})
+
+	// Shift marketplace, staff offer and claim shifts, schedulers approve the
+	// trade
+	r.Route("/shift-offers", func(r chi.Router) {
+		r.Use(requireAuth)
+		r.With(ScopeDepartments).Get("/", ListShiftOffersHandler(offers))
+		r.Post("/", CreateShiftOfferHandler(offers))
+		r.Post("/{id}/claim", ClaimShiftOfferHandler(offers))
+		r.Post("/{id}/cancel", CancelShiftOfferHandler(offers))
+		r.With(RequireRole(RoleAdmin, RoleScheduler)).Post("/{id}/approve", DecideShiftOfferHandler(offers, OfferApproved))
+		r.With(RequireRole(RoleAdmin, RoleScheduler)).Post("/{id}/reject", DecideShiftOfferHandler(offers, OfferRejected))
+	})
+
+	// Coverage model, required headcount per department / shift time / role
+	r.Route("/coverage-requirements", func(r chi.Router) {
+		r.Use(requireAuth)
+		r.With(RequireRole(managers...), ScopeDepartments).Get("/", ListCoverageRequirementsHandler(coverage))
+		r.With(RequireRole(RoleAdmin, RoleScheduler)).Put("/", SetCoverageRequirementHandler(coverage))
+		r.With(RequireRole(RoleAdmin, RoleScheduler)).Delete("/{id}", DeleteCoverageRequirementHandler(coverage))
+	})
+
+	// Pay rules priced by the overtime cost report
+	r.Route("/pay-rules", func(r chi.Router) {
+		r.Use(requireAuth, RequireRole(RoleAdmin))
+		r.Get("/", GetPayRulesHandler(payRules))
+		r.Put("/roles/{id}", SetRolePayRateHandler(payRules))
+		r.Put("/staff/{id}", SetStaffPayRateHandler(payRules))
+		r.Delete("/staff/{id}", DeleteStaffPayRateHandler(payRules))
+		r.Put("/multipliers", SetPayMultipliersHandler(payRules))
+	})
+	r.Route("/holidays", func(r chi.Router) {
+		r.Use(requireAuth)
+		r.Get("/", ListHolidaysHandler(payRules))
+		r.With(RequireRole(RoleAdmin)).Put("/", SetHolidayHandler(payRules))
+		r.With(RequireRole(RoleAdmin)).Delete("/{id}", DeleteHolidayHandler(payRules))
+	})
+	r.Route("/budgets", func(r chi.Router) {
+		r.Use(requireAuth)
+		r.With(RequireRole(RoleAdmin, RoleDepartmentHead), ScopeDepartments).Get("/", ListBudgetsHandler(payRules))
+		r.With(RequireRole(RoleAdmin)).Put("/", SetBudgetHandler(payRules))
+	})
+
+	// Roster generation
+	r.With(requireAuth, RequireRole(RoleAdmin, RoleScheduler)).Post("/schedules/generate", GenerateScheduleHandler(schedules))
+	r.With(requireAuth, RequireRole(RoleAdmin, RoleScheduler)).Post("/schedules/on-call-rotation", GenerateRotationHandler(schedules))
+
+	// Audit trail of every change made through the API
+	r.With(requireAuth, RequireRole(RoleAdmin)).Get("/audit", ListAuditHandler(audit))
 
 	// Start the server
 	port := os.Getenv("PORT")
@@ -77,3 +247,48 @@ func main() {
 	log.Printf("Starting server on port %s", port)
 	log.Fatal(http.ListenAndServe(":"+port, r))
 }
+
+// Runs a migrate subcommand, printing what it did
+func migrateCommand(ctx context.Context, db *sql.DB, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: backend migrate up|down|status")
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := migrations.Up(ctx, db)
+		for _, m := range done {
+			log.Printf("Applied %04d_%s", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			log.Println("Schema is up to date")
+		}
+		return err
+	case "down":
+		reverted, err := migrations.Down(ctx, db)
+		if reverted != nil {
+			log.Printf("Reverted %04d_%s", reverted.Version, reverted.Name)
+		} else if err == nil {
+			log.Println("No migration to revert")
+		}
+		return err
+	case "status":
+		states, err := migrations.Status(ctx, db)
+		if err != nil {
+			return err
+		}
+		for _, state := range states {
+			status := "pending"
+			if state.AppliedAt != nil {
+				status = "applied " + state.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if state.Unknown {
+				status += " (not in this binary)"
+			}
+			fmt.Printf("%04d_%-30s %s\n", state.Version, state.Name, status)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q, use up, down or status", args[0])
+	}
+}
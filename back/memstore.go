@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"iter"
+	"slices"
+	"strings"
+)
+
+// MemoryReportStore is an in-memory ReportStore. It serves canned rows and
+// applies the role / department / range filters the rows can answer, and
+// the sort and page where the queries do, which is enough to exercise the
+// handlers without Postgres. Setting Err makes every report fail with it.
+type MemoryReportStore struct {
+	HoursWorkedRows         []HoursWorkedReport
+	HoursWorkedSeriesRows   []HoursWorkedSeriesPoint
+	OvertimeRows            []OvertimeReport
+	OvertimeSeriesRows      []OvertimeSeriesPoint
+	OvertimeCostRows        []OvertimeCostReportItem
+	OvertimeViolationRows   []OvertimeViolation
+	StaffWorkloadRows       []StaffWorkloadReportItem
+	StaffWorkloadSeriesRows []StaffWorkloadSeriesPoint
+	OnCallFairnessRows      []OnCallFairnessReportItem
+	LeaveAnalysisRows       []LeaveAnalysisReportItem
+	StaffPreferenceRows     []StaffPreferenceReport
+	MonthlyShiftsRows       []MonthlyShiftAssignmentItem
+	AttendanceRows          []AttendanceReportItem
+	CoverageReport          CoverageReport
+	FatigueRows             []FatigueReportItem
+	Err                     error
+}
+
+// Keeps the rows matching keep
+func filterRows[T any](rows []T, keep func(T) bool) []T {
+	var out []T
+	for _, row := range rows {
+		if keep(row) {
+			out = append(out, row)
+		}
+	}
+	return out
+}
+
+// Sorts and pages the matching rows like the report queries do
+func pageRows[T any](rows []T, err error, paging reportPaging) ReportRows[T] {
+	if err != nil {
+		return ReportRows[T]{Rows: sliceRows[T](nil, err)}
+	}
+	sortRows(paging, rows)
+	return ReportRows[T]{
+		Rows:  sliceRows(cutPage(paging, rows), nil),
+		Total: func() (int, error) { return len(rows), nil },
+	}
+}
+
+// An empty filter list matches everything, like querybuilder.In
+func matches(values []string, v string) bool {
+	return len(values) == 0 || slices.Contains(values, v)
+}
+
+// Whether a row belonging to several values (departments) has one of the
+// filter values, an empty filter list matches everything
+func matchesAny(values, rowValues []string) bool {
+	return len(values) == 0 || slices.ContainsFunc(rowValues, func(v string) bool {
+		return slices.Contains(values, v)
+	})
+}
+
+// Splits a ", " joined list as STRING_AGG builds them, nil is no values
+func splitList(list *string) []string {
+	if list == nil {
+		return nil
+	}
+	return strings.Split(*list, ", ")
+}
+
+// Same semantics as querybuilder.Range
+func inRange[T int | float64](v T, min, max *T) bool {
+	return (min == nil || v >= *min) && (max == nil || v <= *max)
+}
+
+func (m *MemoryReportStore) HoursWorked(ctx context.Context, filter HoursWorkedFilter) ReportRows[HoursWorkedReport] {
+	return pageRows(filterRows(m.HoursWorkedRows, func(row HoursWorkedReport) bool {
+		return matches(filter.Roles, row.RoleName) &&
+			matches(filter.Departments, row.DepartmentName) &&
+			inRange(row.TotalHoursWorked, filter.MinHours, filter.MaxHours)
+	}), m.Err, filter.Paging)
+}
+
+// The canned points are taken as already bucketed, only the role and
+// department filters apply
+func (m *MemoryReportStore) HoursWorkedSeries(ctx context.Context, filter HoursWorkedFilter, series SeriesFilter) iter.Seq2[HoursWorkedSeriesPoint, error] {
+	return sliceRows(filterRows(m.HoursWorkedSeriesRows, func(row HoursWorkedSeriesPoint) bool {
+		return matches(filter.Roles, row.RoleName) && matches(filter.Departments, row.DepartmentName)
+	}), m.Err)
+}
+
+func (m *MemoryReportStore) OvertimeAnalysis(ctx context.Context, filter OvertimeFilter) ReportRows[OvertimeReport] {
+	return pageRows(filterRows(m.OvertimeRows, func(row OvertimeReport) bool {
+		return matches(filter.Roles, row.RoleName) &&
+			matches(filter.Departments, row.DepartmentName) &&
+			inRange(row.TotalOvertime, filter.MinOvertimeHours, filter.MaxOvertimeHours)
+	}), m.Err, filter.Paging)
+}
+
+func (m *MemoryReportStore) OvertimeSeries(ctx context.Context, filter OvertimeFilter, series SeriesFilter) iter.Seq2[OvertimeSeriesPoint, error] {
+	return sliceRows(filterRows(m.OvertimeSeriesRows, func(row OvertimeSeriesPoint) bool {
+		return matches(filter.Roles, row.RoleName) && matches(filter.Departments, row.DepartmentName)
+	}), m.Err)
+}
+
+// Rows are per department and month, the role filter can't apply
+func (m *MemoryReportStore) OvertimeCost(ctx context.Context, filter OvertimeCostFilter) ReportRows[OvertimeCostReportItem] {
+	first := filter.StartDate.Format("2006-01")
+	last := filter.EndDate.Format("2006-01")
+	return pageRows(filterRows(m.OvertimeCostRows, func(row OvertimeCostReportItem) bool {
+		return matches(filter.Departments, row.DepartmentName) &&
+			row.Month >= first && row.Month <= last
+	}), m.Err, filter.Paging)
+}
+
+func (m *MemoryReportStore) OvertimeViolations(ctx context.Context, filter OvertimeViolationFilter) ReportRows[OvertimeViolation] {
+	return pageRows(filterRows(m.OvertimeViolationRows, func(row OvertimeViolation) bool {
+		return matches(filter.Roles, row.RoleName) &&
+			matches(filter.Departments, row.DepartmentName) &&
+			matchesAny(filter.Violations, row.Violations)
+	}), m.Err, filter.Paging)
+}
+
+func (m *MemoryReportStore) StaffWorkload(ctx context.Context, filter StaffWorkloadFilter) ReportRows[StaffWorkloadReportItem] {
+	return pageRows(filterRows(m.StaffWorkloadRows, func(row StaffWorkloadReportItem) bool {
+		return matches(filter.Roles, row.RoleName) &&
+			matchesAny(filter.Departments, splitList(row.Departments)) &&
+			inRange(row.TotalShiftsAssigned, filter.MinTotalShifts, filter.MaxTotalShifts) &&
+			inRange(row.OnCallShiftsAssigned, filter.MinOnCallShifts, filter.MaxOnCallShifts) &&
+			(!filter.HasAssignments || row.TotalShiftsAssigned > 0)
+	}), m.Err, filter.Paging)
+}
+
+func (m *MemoryReportStore) StaffWorkloadSeries(ctx context.Context, filter StaffWorkloadFilter, series SeriesFilter) iter.Seq2[StaffWorkloadSeriesPoint, error] {
+	return sliceRows(filterRows(m.StaffWorkloadSeriesRows, func(row StaffWorkloadSeriesPoint) bool {
+		return matches(filter.Roles, row.RoleName) && matches(filter.Departments, row.DepartmentName)
+	}), m.Err)
+}
+
+// Rows are per department, the role filter can't apply
+func (m *MemoryReportStore) OnCallFairness(ctx context.Context, filter OnCallFairnessFilter) iter.Seq2[OnCallFairnessReportItem, error] {
+	return sliceRows(filterRows(m.OnCallFairnessRows, func(row OnCallFairnessReportItem) bool {
+		return matches(filter.Departments, row.DepartmentName)
+	}), m.Err)
+}
+
+func (m *MemoryReportStore) LeaveAnalysis(ctx context.Context, filter LeaveAnalysisFilter) ReportRows[LeaveAnalysisReportItem] {
+	return pageRows(filterRows(m.LeaveAnalysisRows, func(row LeaveAnalysisReportItem) bool {
+		if filter.EndDate != nil && row.StartDate.After(*filter.EndDate) {
+			return false
+		}
+		if filter.StartDate != nil && row.EndDate != nil && row.EndDate.Before(*filter.StartDate) {
+			return false
+		}
+		return matches(filter.Roles, row.RoleName) &&
+			matchesAny(filter.Departments, row.Departments) &&
+			matches(filter.Statuses, row.Status) &&
+			inRange(row.DurationDays, filter.MinDuration, filter.MaxDuration)
+	}), m.Err, filter.Paging)
+}
+
+func (m *MemoryReportStore) StaffPreference(ctx context.Context, filter StaffPreferenceFilter) ReportRows[StaffPreferenceReport] {
+	return pageRows(filterRows(m.StaffPreferenceRows, func(row StaffPreferenceReport) bool {
+		return matches(filter.Roles, row.RoleName) &&
+			matchesAny(filter.Departments, splitList(row.Departments)) &&
+			(len(filter.PreferredShiftTimes) == 0 || slices.ContainsFunc(row.Preferences, func(p PreferenceFulfillment) bool {
+				return slices.Contains(filter.PreferredShiftTimes, p.ShiftTime)
+			})) &&
+			(!filter.HasAssignments || row.TotalAssignmentsCount > 0)
+	}), m.Err, filter.Paging)
+}
+
+func (m *MemoryReportStore) MonthlyShifts(ctx context.Context, filter MonthlyShiftsFilter) ReportRows[MonthlyShiftAssignmentItem] {
+	first := filter.StartDate.Format("2006-01")
+	last := filter.EndDate.Format("2006-01")
+	return pageRows(filterRows(m.MonthlyShiftsRows, func(row MonthlyShiftAssignmentItem) bool {
+		return row.AssignmentMonthYear >= first && row.AssignmentMonthYear <= last
+	}), m.Err, filter.Paging)
+}
+
+func (m *MemoryReportStore) Attendance(ctx context.Context, filter AttendanceFilter) ReportRows[AttendanceReportItem] {
+	return pageRows(filterRows(m.AttendanceRows, func(row AttendanceReportItem) bool {
+		return matches(filter.Roles, row.RoleName) &&
+			matches(filter.Departments, row.DepartmentName)
+	}), m.Err, filter.Paging)
+}
+
+func (m *MemoryReportStore) Coverage(ctx context.Context, filter CoverageFilter) (CoverageReport, error) {
+	if m.Err != nil {
+		return CoverageReport{}, m.Err
+	}
+	gaps := filterRows(m.CoverageReport.Gaps, func(row CoverageGap) bool {
+		return matches(filter.Departments, row.DepartmentName) &&
+			matches(filter.ShiftTimes, row.ShiftTime)
+	})
+	if len(filter.Departments) == 0 {
+		return CoverageReport{
+			Gaps: gaps,
+			Heatmap: filterRows(m.CoverageReport.Heatmap, func(row CoverageHeatmapCell) bool {
+				return matches(filter.ShiftTimes, row.ShiftTime)
+			}),
+		}, nil
+	}
+
+	// Heat-map cells don't say which departments they count, so they are
+	// recounted from the department's gaps like the query does
+	shortfalls := make([]coverageShortfall, len(gaps))
+	for i, gap := range gaps {
+		shortfalls[i] = coverageShortfall{
+			ShiftID:        gap.ShiftID,
+			Date:           gap.Date,
+			Weekday:        (int(gap.Date.Weekday())+6)%7 + 1,
+			ShiftTime:      gap.ShiftTime,
+			DepartmentName: gap.DepartmentName,
+			Role:           RoleShortfall{Required: gap.Required, Assigned: gap.Assigned, Shortfall: gap.Shortfall},
+		}
+	}
+	return CoverageReport{Gaps: gaps, Heatmap: foldCoverage(shortfalls).Heatmap}, nil
+}
+
+func (m *MemoryReportStore) Fatigue(ctx context.Context, filter FatigueFilter) iter.Seq2[FatigueReportItem, error] {
+	return sliceRows(filterRows(m.FatigueRows, func(row FatigueReportItem) bool {
+		return matches(filter.Roles, row.RoleName) &&
+			matches(filter.Departments, row.DepartmentName)
+	}), m.Err)
+}
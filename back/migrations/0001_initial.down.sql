@@ -0,0 +1,17 @@
+-- Deshace el esquema inicial, borra todos los datos.
+DROP TRIGGER IF EXISTS validate_on_call_assignment ON shift_assignments;
+DROP FUNCTION IF EXISTS validate_on_call_assignment();
+DROP TRIGGER IF EXISTS prevent_leave_conflict ON shift_assignments;
+DROP FUNCTION IF EXISTS check_leave_conflict();
+
+DROP TABLE IF EXISTS overtimes;
+DROP TABLE IF EXISTS shift_logs;
+DROP TABLE IF EXISTS shift_assignments;
+DROP TABLE IF EXISTS staff_departments;
+DROP TABLE IF EXISTS departments;
+DROP TABLE IF EXISTS shifts;
+DROP TABLE IF EXISTS staff_shift_preferences;
+DROP TABLE IF EXISTS shift_times;
+DROP TABLE IF EXISTS leave_requests;
+DROP TABLE IF EXISTS staff;
+DROP TABLE IF EXISTS roles;
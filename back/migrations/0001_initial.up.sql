@@ -1,3 +1,8 @@
+-- Esquema inicial, el db/ddl.sql con el que se crearon las bases antes de
+-- las migraciones. Es idempotente (IF NOT EXISTS / OR REPLACE) para poder
+-- aplicarlo sobre esas bases, los cambios posteriores van en sus propias
+-- migraciones.
+
 -- Tabla de roles, define si algunos roles pueden hacer tiempo extra
 -- o estar en un turno tipo 'on-call' donde unicamente llegan si es
 -- necesario.
@@ -135,7 +140,7 @@ BEGIN
 END;
 $$ LANGUAGE plpgsql;
 
-CREATE TRIGGER prevent_leave_conflict
+CREATE OR REPLACE TRIGGER prevent_leave_conflict
 BEFORE INSERT OR UPDATE ON shift_assignments
 FOR EACH ROW EXECUTE FUNCTION check_leave_conflict();
 
@@ -155,6 +160,6 @@ BEGIN
 END;
 $$ LANGUAGE plpgsql;
 
-CREATE TRIGGER validate_on_call_assignment
+CREATE OR REPLACE TRIGGER validate_on_call_assignment
 BEFORE INSERT OR UPDATE ON shift_assignments
 FOR EACH ROW EXECUTE FUNCTION validate_on_call_assignment();
@@ -0,0 +1,2 @@
+-- Quita la baja de personal, las personas dadas de baja vuelven a estar activas.
+ALTER TABLE staff DROP COLUMN IF EXISTS active;
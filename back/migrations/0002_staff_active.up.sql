@@ -0,0 +1,2 @@
+-- Active permite dar de baja al personal sin perder su historial de turnos.
+ALTER TABLE staff ADD COLUMN IF NOT EXISTS active BOOL NOT NULL DEFAULT TRUE;
@@ -0,0 +1,2 @@
+-- Quita los requerimientos de cobertura.
+DROP TABLE IF EXISTS coverage_requirements;
@@ -0,0 +1,25 @@
+-- Requerimientos de cobertura, cuantas personas de cada rol necesita un
+-- departamento en cada shift time. Con esto podemos saber que turnos quedaron
+-- cortos de personal comparando contra shift_assignments.
+CREATE TABLE IF NOT EXISTS coverage_requirements (
+  id SERIAL PRIMARY KEY,
+  department_id INT NOT NULL REFERENCES departments(id),
+  shift_time_id INT NOT NULL REFERENCES shift_times(id),
+  role_id INT NOT NULL REFERENCES roles(id),
+  headcount INT NOT NULL CHECK (headcount > 0),
+  UNIQUE (department_id, shift_time_id, role_id)
+);
+
+-- Requerimientos iniciales para los departamentos con mas movimiento, un
+-- doctor y dos enfermeros en cada turno de 8 horas. Va en la migracion y no
+-- en db/data.sql porque la tabla no existe cuando Docker carga los datos;
+-- sin esos departamentos / turnos / roles no inserta nada.
+INSERT INTO coverage_requirements (department_id, shift_time_id, role_id, headcount)
+SELECT d.id, st.id, r.id, CASE WHEN r.name = 'Nurse' THEN 2 ELSE 1 END
+FROM departments d
+CROSS JOIN shift_times st
+CROSS JOIN roles r
+WHERE d.name IN ('Emergency Medicine', 'Internal Medicine', 'Cardiology', 'Pediatrics')
+  AND st.name IN ('Morning', 'Afternoon', 'Overnight')
+  AND r.name IN ('Doctor', 'Nurse')
+ON CONFLICT (department_id, shift_time_id, role_id) DO NOTHING;
@@ -0,0 +1,3 @@
+-- Quita los usuarios de la aplicacion y los departamentos a su cargo.
+DROP TABLE IF EXISTS user_departments;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,20 @@
+-- Usuarios de la aplicacion, cada uno con un rol. Los de staff se ligan a
+-- su registro en staff para ver unicamente su informacion, el password se
+-- guarda como hash (pbkdf2) nunca en texto plano.
+CREATE TABLE IF NOT EXISTS users (
+  id SERIAL PRIMARY KEY,
+  email VARCHAR UNIQUE NOT NULL,
+  password_hash VARCHAR NOT NULL,
+  role VARCHAR NOT NULL CHECK (role in ('admin', 'department_head', 'scheduler', 'staff')),
+  staff_id INT REFERENCES staff(id),
+  active BOOL NOT NULL DEFAULT TRUE,
+  CHECK (role <> 'staff' OR staff_id IS NOT NULL)
+);
+
+-- Departamentos a cargo de cada jefe de departamento, limitan los reportes
+-- que puede ver.
+CREATE TABLE IF NOT EXISTS user_departments (
+  user_id INT NOT NULL REFERENCES users(id),
+  department_id INT NOT NULL REFERENCES departments(id),
+  PRIMARY KEY (user_id, department_id)
+);
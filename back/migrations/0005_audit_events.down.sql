@@ -0,0 +1,4 @@
+-- Quita el registro de auditoria, borra todos los eventos.
+DROP TRIGGER IF EXISTS prevent_audit_change ON audit_events;
+DROP FUNCTION IF EXISTS prevent_audit_change();
+DROP TABLE IF EXISTS audit_events;
@@ -0,0 +1,29 @@
+-- Registro de auditoria de cada cambio hecho desde el backend, se escribe en
+-- la misma transaccion que el cambio. actor_id queda nulo para los cambios
+-- del sistema, actor_email guarda el correo que tenia el usuario entonces.
+CREATE TABLE IF NOT EXISTS audit_events (
+  id BIGSERIAL PRIMARY KEY,
+  occurred_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  actor_id INT REFERENCES users(id),
+  actor_email VARCHAR NOT NULL,
+  action VARCHAR NOT NULL,
+  entity VARCHAR NOT NULL,
+  entity_id INT NOT NULL,
+  old_data JSONB,
+  new_data JSONB
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_entity_idx ON audit_events (entity, entity_id);
+CREATE INDEX IF NOT EXISTS audit_events_occurred_at_idx ON audit_events (occurred_at);
+
+-- Trigger para que el registro de auditoria no se pueda modificar ni borrar
+CREATE OR REPLACE FUNCTION prevent_audit_change()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'Audit events are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER prevent_audit_change
+BEFORE UPDATE OR DELETE ON audit_events
+FOR EACH ROW EXECUTE FUNCTION prevent_audit_change();
@@ -0,0 +1,6 @@
+-- Deshace las reglas de pago, borra tarifas, feriados y presupuestos.
+DROP TABLE IF EXISTS department_budgets;
+DROP TABLE IF EXISTS holidays;
+DROP TABLE IF EXISTS pay_multipliers;
+DROP TABLE IF EXISTS staff_pay_rates;
+DROP TABLE IF EXISTS role_pay_rates;
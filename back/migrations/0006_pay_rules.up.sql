@@ -0,0 +1,47 @@
+-- Reglas de pago para el reporte de costo de tiempo extra: tarifas por hora,
+-- multiplicadores, feriados y presupuesto mensual de cada departamento.
+
+-- Tarifa por hora de cada rol, es la que aplica a todo su personal salvo
+-- que tenga una tarifa propia en staff_pay_rates.
+CREATE TABLE IF NOT EXISTS role_pay_rates (
+  role_id INT PRIMARY KEY REFERENCES roles(id),
+  hourly_rate NUMERIC(10, 2) NOT NULL CHECK (hourly_rate >= 0)
+);
+
+-- Tarifas propias de algunas personas (antiguedad, contratos especiales),
+-- reemplazan la tarifa de su rol.
+CREATE TABLE IF NOT EXISTS staff_pay_rates (
+  staff_id INT PRIMARY KEY REFERENCES staff(id),
+  hourly_rate NUMERIC(10, 2) NOT NULL CHECK (hourly_rate >= 0)
+);
+
+-- Multiplicadores de la tarifa, una sola fila. Overtime aplica a las horas
+-- de la tabla overtimes; night a los turnos que cruzan la medianoche,
+-- weekend a sabado / domingo y holiday a los feriados. Si un turno cae en
+-- varios (un feriado en domingo) se usa el mayor, no se acumulan.
+CREATE TABLE IF NOT EXISTS pay_multipliers (
+  id INT PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+  overtime NUMERIC(4, 2) NOT NULL DEFAULT 1.5 CHECK (overtime >= 1),
+  night NUMERIC(4, 2) NOT NULL DEFAULT 1.25 CHECK (night >= 1),
+  weekend NUMERIC(4, 2) NOT NULL DEFAULT 1.5 CHECK (weekend >= 1),
+  holiday NUMERIC(4, 2) NOT NULL DEFAULT 2 CHECK (holiday >= 1)
+);
+
+INSERT INTO pay_multipliers DEFAULT VALUES ON CONFLICT (id) DO NOTHING;
+
+-- Feriados, un nombre por fecha
+CREATE TABLE IF NOT EXISTS holidays (
+  id SERIAL PRIMARY KEY,
+  date DATE UNIQUE NOT NULL,
+  name VARCHAR NOT NULL
+);
+
+-- Presupuesto de personal de cada departamento por mes, month es siempre
+-- el primer dia del mes.
+CREATE TABLE IF NOT EXISTS department_budgets (
+  id SERIAL PRIMARY KEY,
+  department_id INT NOT NULL REFERENCES departments(id),
+  month DATE NOT NULL CHECK (EXTRACT(DAY FROM month) = 1),
+  amount NUMERIC(12, 2) NOT NULL CHECK (amount >= 0),
+  UNIQUE (department_id, month)
+);
@@ -0,0 +1,3 @@
+-- Quita la validacion de tiempo extra por rol.
+DROP TRIGGER IF EXISTS validate_overtime_entry ON overtimes;
+DROP FUNCTION IF EXISTS validate_overtime_entry();
@@ -0,0 +1,22 @@
+-- Trigger para verificar que el rol de la persona permita tiempo extra, los
+-- residentes por ley no pueden. Solo valida filas nuevas o modificadas, las
+-- que ya existian sin cumplir aparecen en /reports/overtime-violations.
+CREATE OR REPLACE FUNCTION validate_overtime_entry()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM shift_assignments sa
+        JOIN staff s ON sa.staff_id = s.id
+        JOIN roles r ON s.role_id = r.id
+        WHERE sa.id = NEW.shift_assignment_id
+        AND r.overtime_allowed = TRUE
+    ) THEN
+        RAISE EXCEPTION 'Staff member''s role does not permit overtime';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER validate_overtime_entry
+BEFORE INSERT OR UPDATE ON overtimes
+FOR EACH ROW EXECUTE FUNCTION validate_overtime_entry();
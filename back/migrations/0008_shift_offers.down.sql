@@ -0,0 +1,4 @@
+-- Quita el mercado de turnos, las asignaciones ya cambiadas se quedan.
+DROP TRIGGER IF EXISTS validate_live_shift_offer ON shift_offers;
+DROP FUNCTION IF EXISTS validate_live_shift_offer();
+DROP TABLE IF EXISTS shift_offers;
@@ -0,0 +1,59 @@
+-- Mercado de turnos. Alguien ofrece uno de sus turnos, un colega elegible
+-- lo reclama (opcionalmente dando uno suyo a cambio, swap_assignment_id) y
+-- un scheduler aprueba. Las asignaciones solo cambian al aprobar, asi los
+-- triggers de shift_assignments validan cada cambio.
+CREATE TABLE IF NOT EXISTS shift_offers (
+  id SERIAL PRIMARY KEY,
+  assignment_id INT NOT NULL REFERENCES shift_assignments(id),
+  offered_by INT NOT NULL REFERENCES staff(id),
+  note VARCHAR NOT NULL DEFAULT '',
+  status VARCHAR NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'claimed', 'approved', 'rejected', 'cancelled')),
+  claimed_by INT REFERENCES staff(id),
+  swap_assignment_id INT REFERENCES shift_assignments(id),
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  claimed_at TIMESTAMPTZ,
+  decided_at TIMESTAMPTZ,
+  CHECK (status IN ('open', 'cancelled') OR claimed_by IS NOT NULL)
+);
+
+-- Un turno solo puede estar en una oferta viva a la vez, ya sea como el
+-- turno ofrecido o como el que se da a cambio. Los indices unicos cubren
+-- cada columna por separado, el trigger cruza las dos: bloquea las
+-- asignaciones involucradas (en orden, para no tener deadlocks) para que
+-- dos ofertas o reclamos concurrentes del mismo turno se serialicen, y usa
+-- el codigo unique_violation como los indices.
+CREATE UNIQUE INDEX IF NOT EXISTS shift_offers_live_assignment
+  ON shift_offers (assignment_id) WHERE status IN ('open', 'claimed');
+CREATE UNIQUE INDEX IF NOT EXISTS shift_offers_live_swap
+  ON shift_offers (swap_assignment_id) WHERE status = 'claimed';
+
+CREATE OR REPLACE FUNCTION validate_live_shift_offer()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.status NOT IN ('open', 'claimed') THEN
+        RETURN NEW;
+    END IF;
+    PERFORM 1 FROM shift_assignments
+    WHERE id IN (NEW.assignment_id, NEW.swap_assignment_id)
+    ORDER BY id
+    FOR UPDATE;
+    IF EXISTS (
+        SELECT 1 FROM shift_offers so
+        WHERE so.id <> NEW.id
+        AND (
+            (so.status IN ('open', 'claimed')
+             AND so.assignment_id IN (NEW.assignment_id, NEW.swap_assignment_id))
+            OR (so.status = 'claimed'
+             AND so.swap_assignment_id IN (NEW.assignment_id, NEW.swap_assignment_id))
+        )
+    ) THEN
+        RAISE EXCEPTION 'The shift is already part of a live offer'
+            USING ERRCODE = 'unique_violation';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER validate_live_shift_offer
+BEFORE INSERT OR UPDATE ON shift_offers
+FOR EACH ROW EXECUTE FUNCTION validate_live_shift_offer();
@@ -0,0 +1,3 @@
+-- Quita los tokens de las suscripciones de calendario, las suscripciones
+-- existentes dejan de funcionar.
+DROP TABLE IF EXISTS calendar_feed_tokens;
@@ -0,0 +1,16 @@
+-- Tokens de las suscripciones de calendario. Las apps de calendario solo
+-- aceptan una URL, asi que el token va en ?token= y queda en su
+-- configuracion por meses: por eso no se usa el token de sesion, estos
+-- solo abren los feeds, no caducan y se revocan uno a uno. Se guarda el
+-- sha256 del token, nunca el token.
+CREATE TABLE IF NOT EXISTS calendar_feed_tokens (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  token_hash VARCHAR UNIQUE NOT NULL,
+  label VARCHAR NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_used_at TIMESTAMPTZ,
+  revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS calendar_feed_tokens_user_idx ON calendar_feed_tokens (user_id);
@@ -0,0 +1,307 @@
+// Package migrations versions the database schema. Migrations are SQL files
+// embedded in the binary, named NNNN_description.up.sql with a matching
+// NNNN_description.down.sql, and are applied in version order. Each one runs
+// in its own transaction together with its schema_migrations row, so a
+// failing migration leaves no trace.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// Key of the advisory lock held while migrating, so two instances starting
+// together don't apply the same migration twice.
+const lockKey = 72_946_015
+
+var fileName = regexp.MustCompile(`^(\d{4})_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is one schema version and the SQL to apply and revert it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// State is a migration known to the binary or recorded in the database.
+// AppliedAt is nil while pending, Unknown marks versions the database has
+// but this binary doesn't ship, i.e. it is older than the schema.
+type State struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	Unknown   bool
+}
+
+// Load returns the embedded migrations in version order.
+func Load() ([]Migration, error) {
+	return parse(files)
+}
+
+func parse(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		if path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		m := fileName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_description.up.sql", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != m[2] {
+			return nil, fmt.Errorf("migration %04d has two names, %s and %s", version, migration.Name, m[2])
+		}
+		if m[3] == "up" {
+			migration.Up = string(body)
+		} else {
+			migration.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// queryer is satisfied by *sql.DB, *sql.Conn and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func ensureTable(ctx context.Context, q queryer) error {
+	_, err := q.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INT PRIMARY KEY,
+            name VARCHAR NOT NULL,
+            applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `)
+	return err
+}
+
+// applied returns the recorded migrations by version.
+func applied(ctx context.Context, q queryer) (map[int]State, error) {
+	rows, err := q.QueryContext(ctx, "SELECT version, name, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := map[int]State{}
+	for rows.Next() {
+		var state State
+		var appliedAt time.Time
+		if err := rows.Scan(&state.Version, &state.Name, &appliedAt); err != nil {
+			return nil, err
+		}
+		state.AppliedAt = &appliedAt
+		states[state.Version] = state
+	}
+	return states, rows.Err()
+}
+
+// appliedIfAny is applied for the read-only checks, which must not create
+// schema_migrations: a database without it has applied nothing yet.
+func appliedIfAny(ctx context.Context, db *sql.DB) (map[int]State, error) {
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return map[int]State{}, nil
+	}
+	return applied(ctx, db)
+}
+
+// Status lists every migration, embedded or recorded, in version order.
+func Status(ctx context.Context, db *sql.DB) ([]State, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := appliedIfAny(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []State
+	for _, migration := range migrations {
+		state := State{Version: migration.Version, Name: migration.Name}
+		if r, ok := recorded[migration.Version]; ok {
+			state.AppliedAt = r.AppliedAt
+			delete(recorded, migration.Version)
+		}
+		states = append(states, state)
+	}
+	for _, r := range recorded {
+		r.Unknown = true
+		states = append(states, r)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Version < states[j].Version
+	})
+	return states, nil
+}
+
+// Pending returns the embedded migrations the database hasn't applied yet.
+func Pending(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := appliedIfAny(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return pending(migrations, recorded), nil
+}
+
+func pending(migrations []Migration, recorded map[int]State) []Migration {
+	var out []Migration
+	for _, migration := range migrations {
+		if _, ok := recorded[migration.Version]; !ok {
+			out = append(out, migration)
+		}
+	}
+	return out
+}
+
+// locked runs fn on a single connection holding the migration lock.
+func locked(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+
+	if err := ensureTable(ctx, conn); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// run executes one migration step and its bookkeeping in a transaction.
+func run(ctx context.Context, conn *sql.Conn, body, bookkeeping string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, bookkeeping, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Up applies every pending migration in order and returns the ones it
+// applied. It stops at the first failure, earlier migrations stay applied.
+func Up(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	err = locked(ctx, db, func(conn *sql.Conn) error {
+		recorded, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range pending(migrations, recorded) {
+			err := run(ctx, conn, migration.Up,
+				"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+				migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the latest applied migration and returns it, nil when
+// nothing is applied.
+func Down(ctx context.Context, db *sql.DB) (*Migration, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted *Migration
+	err = locked(ctx, db, func(conn *sql.Conn) error {
+		recorded, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		latest := -1
+		for version := range recorded {
+			latest = max(latest, version)
+		}
+		if latest < 0 {
+			return nil
+		}
+
+		for i := range migrations {
+			if migrations[i].Version != latest {
+				continue
+			}
+			migration := migrations[i]
+			err := run(ctx, conn, migration.Down,
+				"DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			reverted = &migration
+			return nil
+		}
+		return fmt.Errorf("migration %04d is applied but not shipped in this binary, it can't be reverted", latest)
+	})
+	return reverted, err
+}
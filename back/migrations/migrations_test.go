@@ -0,0 +1,113 @@
+package migrations
+
+import (
+	"os"
+	"regexp"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 || migrations[0].Name != "initial" {
+		t.Fatalf("first migration is %+v, want 0001_initial", migrations)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %04d_%s is number %d, versions must have no gaps", m.Version, m.Name, i+1)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	migrations, err := parse(fstest.MapFS{
+		"0002_second.up.sql":   {Data: []byte("up 2")},
+		"0002_second.down.sql": {Data: []byte("down 2")},
+		"0001_first.up.sql":    {Data: []byte("up 1")},
+		"0001_first.down.sql":  {Data: []byte("down 1")},
+		"migrations.go":        {Data: []byte("package migrations")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Migration{
+		{Version: 1, Name: "first", Up: "up 1", Down: "down 1"},
+		{Version: 2, Name: "second", Up: "up 2", Down: "down 2"},
+	}
+	if len(migrations) != len(want) {
+		t.Fatalf("got %+v, want %+v", migrations, want)
+	}
+	for i := range want {
+		if migrations[i] != want[i] {
+			t.Errorf("migration %d = %+v, want %+v", i, migrations[i], want[i])
+		}
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"missing down": {"0001_first.up.sql": {Data: []byte("up")}},
+		"bad name":     {"first.up.sql": {Data: []byte("up")}},
+		"two names": {
+			"0001_first.up.sql":   {Data: []byte("up")},
+			"0001_other.down.sql": {Data: []byte("down")},
+		},
+	} {
+		if _, err := parse(fsys); err == nil {
+			t.Errorf("%s: parse succeeded, want an error", name)
+		}
+	}
+}
+
+func TestPending(t *testing.T) {
+	migrations := []Migration{{Version: 1}, {Version: 2}, {Version: 3}}
+	got := pending(migrations, map[int]State{1: {Version: 1}, 3: {Version: 3}})
+	if len(got) != 1 || got[0].Version != 2 {
+		t.Errorf("pending = %+v, want only version 2", got)
+	}
+	if got := pending(migrations, map[int]State{}); len(got) != 3 {
+		t.Errorf("pending on an empty database = %d migrations, want 3", len(got))
+	}
+}
+
+var createTable = regexp.MustCompile(`(?i)CREATE TABLE (IF NOT EXISTS )?(\w+)`)
+
+// Every migration can run against a database that already has its tables,
+// like 0001 against a database created from db/ddl.sql
+func TestCreateTableIfNotExists(t *testing.T) {
+	migrations, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		for _, match := range createTable.FindAllStringSubmatch(m.Up, -1) {
+			if match[1] == "" {
+				t.Errorf("%04d_%s creates %s without IF NOT EXISTS", m.Version, m.Name, match[2])
+			}
+		}
+	}
+}
+
+// Docker loads db/data.sql right after 0001, before the backend applies
+// the other migrations, so the demo data can only fill 0001's tables
+func TestSeedDataNeedsOnlyInitialSchema(t *testing.T) {
+	migrations, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := make(map[string]bool)
+	for _, match := range createTable.FindAllStringSubmatch(migrations[0].Up, -1) {
+		initial[match[2]] = true
+	}
+
+	data, err := os.ReadFile("../../db/data.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range regexp.MustCompile(`(?i)INSERT INTO (\w+)`).FindAllStringSubmatch(string(data), -1) {
+		if !initial[match[1]] {
+			t.Errorf("db/data.sql fills %s, which 0001_initial doesn't create", match[1])
+		}
+	}
+}
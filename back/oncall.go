@@ -1,15 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"log"
+	"iter"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"backend/querybuilder"
 )
 
 // Struct to hold Staff Workload Report data
@@ -18,215 +19,289 @@ type StaffWorkloadReportItem struct {
 	StaffName            string  `json:"staff_name"`
 	RoleName             string  `json:"role_name"`
 	Departments          *string `json:"departments"`
-	TotalShiftsAssigned  int     `json:"total_shifts_assigned"`
-	OnCallShiftsAssigned int     `json:"on_call_shifts_assigned"`
+	TotalShiftsAssigned  int     `json:"total_shifts_assigned" total:"sum"`
+	OnCallShiftsAssigned int     `json:"on_call_shifts_assigned" total:"sum"`
 	OnCallPercentage     float64 `json:"on_call_percentage"`
 }
 
-func GetStaffWorkloadAnalysisHandler(w http.ResponseWriter, r *http.Request) {
-	// Build the base query (SELECT, FROM, JOINs)
-	query := `
+// A workload row next to the same staff member in the comparison window,
+// counts are 0 in the window they are missing from. The on-call share
+// delta is in percentage points.
+type StaffWorkloadComparison struct {
+	StaffID                     int      `json:"staff_id"`
+	StaffName                   string   `json:"staff_name"`
+	RoleName                    string   `json:"role_name"`
+	Departments                 *string  `json:"departments"`
+	CurrentTotalShifts          int      `json:"current_total_shifts" total:"sum"`
+	PreviousTotalShifts         int      `json:"previous_total_shifts" total:"sum"`
+	DeltaTotalShifts            int      `json:"delta_total_shifts" total:"sum"`
+	DeltaTotalShiftsPercentage  *float64 `json:"delta_total_shifts_percentage"`
+	CurrentOnCallShifts         int      `json:"current_on_call_shifts" total:"sum"`
+	PreviousOnCallShifts        int      `json:"previous_on_call_shifts" total:"sum"`
+	DeltaOnCallShifts           int      `json:"delta_on_call_shifts" total:"sum"`
+	DeltaOnCallShiftsPercentage *float64 `json:"delta_on_call_shifts_percentage"`
+	CurrentOnCallPercentage     float64  `json:"current_on_call_percentage"`
+	PreviousOnCallPercentage    float64  `json:"previous_on_call_percentage"`
+	DeltaOnCallPercentage       float64  `json:"delta_on_call_percentage"`
+	Presence                    string   `json:"presence"`
+}
+
+// A bucket of a workload series
+type StaffWorkloadSeriesPoint struct {
+	SeriesPoint
+	TotalShiftsAssigned  int     `json:"total_shifts_assigned" total:"sum"`
+	OnCallShiftsAssigned int     `json:"on_call_shifts_assigned" total:"sum"`
+	OnCallPercentage     float64 `json:"on_call_percentage"`
+}
+
+func staffWorkloadKey(row StaffWorkloadReportItem) string {
+	return strconv.Itoa(row.StaffID)
+}
+
+func compareStaffWorkload(current, previous *StaffWorkloadReportItem) StaffWorkloadComparison {
+	row := StaffWorkloadComparison{Presence: presence(current, previous)}
+	for _, r := range []*StaffWorkloadReportItem{previous, current} {
+		if r != nil {
+			row.StaffID, row.StaffName, row.RoleName, row.Departments = r.StaffID, r.StaffName, r.RoleName, r.Departments
+		}
+	}
+	if current != nil {
+		row.CurrentTotalShifts = current.TotalShiftsAssigned
+		row.CurrentOnCallShifts = current.OnCallShiftsAssigned
+		row.CurrentOnCallPercentage = current.OnCallPercentage
+	}
+	if previous != nil {
+		row.PreviousTotalShifts = previous.TotalShiftsAssigned
+		row.PreviousOnCallShifts = previous.OnCallShiftsAssigned
+		row.PreviousOnCallPercentage = previous.OnCallPercentage
+	}
+	row.DeltaTotalShifts = row.CurrentTotalShifts - row.PreviousTotalShifts
+	row.DeltaTotalShiftsPercentage = percentageDelta(float64(row.CurrentTotalShifts), float64(row.PreviousTotalShifts))
+	row.DeltaOnCallShifts = row.CurrentOnCallShifts - row.PreviousOnCallShifts
+	row.DeltaOnCallShiftsPercentage = percentageDelta(float64(row.CurrentOnCallShifts), float64(row.PreviousOnCallShifts))
+	row.DeltaOnCallPercentage = row.CurrentOnCallPercentage - row.PreviousOnCallPercentage
+	return row
+}
+
+// Filters accepted by the on-call / workload report
+type StaffWorkloadFilter struct {
+	StartDate       time.Time
+	EndDate         time.Time
+	Roles           []string
+	Departments     []string
+	MinTotalShifts  *int
+	MaxTotalShifts  *int
+	MinOnCallShifts *int
+	MaxOnCallShifts *int
+	HasAssignments  bool
+	// Sort and page, applied by the query
+	Paging reportPaging
+}
+
+// Number of on-call assignments in a group
+const onCallCountExpr = "COUNT(CASE WHEN sa.shift_type = 'on-call' THEN sa.id ELSE NULL END)"
+
+func (s *PostgresReportStore) StaffWorkload(ctx context.Context, filter StaffWorkloadFilter) ReportRows[StaffWorkloadReportItem] {
+	// Assignments of each staff member in the window (and departments)
+	assigned := querybuilder.New(`
+        SELECT
+            sa.staff_id,
+            STRING_AGG(DISTINCT d.name, ', ') AS departments,
+            COUNT(sa.id) AS total_shifts,
+            ` + onCallCountExpr + ` AS on_call_shifts
+        FROM
+            shift_assignments sa
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            departments d ON sa.department_id = d.id
+    `)
+	assigned.Where(querybuilder.Between("sh.date", filter.StartDate, filter.EndDate))
+	assigned.Where(querybuilder.In("d.name", filter.Departments))
+	assigned.GroupBy("sa.staff_id")
+	assignedQuery, values := assigned.Build()
+
+	// Everyone whose role can be on-call, with 0 shifts when they had none.
+	// Staff without shifts are listed while active and, with a department
+	// filter, while they belong to one of the departments in the window.
+	qb := querybuilder.New(fmt.Sprintf(`
         SELECT
             s.id AS staff_id,
             s.name AS staff_name,
             r.name AS role_name,
-            STRING_AGG(DISTINCT d.name, ', ') AS departments,
-            COUNT(sa.id) AS total_shifts_assigned,
-            COUNT(CASE WHEN sa.shift_type = 'on-call' THEN sa.id ELSE NULL END) AS on_call_shifts_assigned,
+            a.departments,
+            COALESCE(a.total_shifts, 0) AS total_shifts_assigned,
+            COALESCE(a.on_call_shifts, 0) AS on_call_shifts_assigned,
             CASE
-                WHEN COUNT(sa.id) > 0 THEN CAST(COUNT(CASE WHEN sa.shift_type = 'on-call' THEN sa.id ELSE NULL END) AS DECIMAL) / COUNT(sa.id) * 100
+                WHEN a.total_shifts > 0 THEN CAST(a.on_call_shifts AS DECIMAL) / a.total_shifts * 100
                 ELSE 0
             END AS on_call_percentage
         FROM
             staff s
         JOIN
             roles r ON s.role_id = r.id
-        LEFT JOIN
-            shift_assignments sa ON s.id = sa.staff_id
-        LEFT JOIN
-            departments d ON sa.department_id = d.id
-        LEFT JOIN
-            shifts sh ON sa.shift_id = sh.id
-  			WHERE
-  					sh.date BETWEEN $1 AND $2
-  					AND r.name = 'Doctor'
-    `
-
-	// Collect the filters from the URL query parameters
-	queryParams := r.URL.Query()
-
-	// Build the WHERE and HAVING clauses dynamically
-	var conditions []string
-	var havingConditions []string
-	var values []interface{}
-	argCount := 1 // Parameter counter for parameterized queries
-
-	// Required date range filter
-	startDate := queryParams.Get("start_date")
-	endDate := queryParams.Get("end_date")
-
-	if startDate == "" || endDate == "" {
-		http.Error(w, "Start date and end date are required", http.StatusBadRequest)
-		return
+        LEFT JOIN (
+            %s
+        ) a ON a.staff_id = s.id
+    `, assignedQuery), values...)
+	qb.Where(querybuilder.Raw("r.on_call_allowed"))
+	qb.Where(querybuilder.In("r.name", filter.Roles))
+	qb.Where(querybuilder.Or(
+		querybuilder.Raw("a.staff_id IS NOT NULL"),
+		func(args *querybuilder.Args) string {
+			if len(filter.Departments) == 0 {
+				return "s.active"
+			}
+			return `s.active AND EXISTS (
+                SELECT 1 FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = s.id
+                  AND sd.start_date <= ` + args.Add(filter.EndDate) + `
+                  AND (sd.end_date IS NULL OR sd.end_date >= ` + args.Add(filter.StartDate) + `)
+                  AND ` + querybuilder.In("d.name", filter.Departments)(args) + `)`
+		},
+	))
+
+	// Optional bounds on the counts
+	qb.Where(querybuilder.Range("COALESCE(a.total_shifts, 0)", filter.MinTotalShifts, filter.MaxTotalShifts))
+	qb.Where(querybuilder.Range("COALESCE(a.on_call_shifts, 0)", filter.MinOnCallShifts, filter.MaxOnCallShifts))
+	if filter.HasAssignments {
+		qb.Where(querybuilder.Raw("a.staff_id IS NOT NULL"))
 	}
 
-	// Add the mandatory date range condition
-	conditions = append(conditions, fmt.Sprintf("(sh.date IS NULL OR (sh.date BETWEEN $%d AND $%d))", argCount, argCount+1))
-	values = append(values, startDate, endDate)
-	argCount += 2
+	return scanPage(ctx, s, qb, filter.Paging,
+		[]string{"staff_id", "staff_name", "role_name", "departments", "total_shifts_assigned", "on_call_shifts_assigned", "on_call_percentage"},
+		[]string{"on_call_percentage DESC", "staff_name", "staff_id"},
+		func(row rowScanner, report *StaffWorkloadReportItem) error {
+			var departments sql.NullString
 
-	roles := queryParams["role"]
-	if len(roles) > 0 {
-		placeholders := make([]string, len(roles))
-		for i := range roles {
-			placeholders[i] = fmt.Sprintf("$%d", argCount+i)
-		}
-		conditions = append(conditions, fmt.Sprintf("r.name IN (%s)", strings.Join(placeholders, ", ")))
-		for _, role := range roles {
-			values = append(values, role)
-		}
-		argCount += len(roles)
-	}
+			err := row.Scan(
+				&report.StaffID,
+				&report.StaffName,
+				&report.RoleName,
+				&departments,
+				&report.TotalShiftsAssigned,
+				&report.OnCallShiftsAssigned,
+				&report.OnCallPercentage,
+			)
+			if departments.Valid {
+				report.Departments = &departments.String
+			}
+			return err
+		})
+}
 
-	// Department Filter (Handling multiple departments)
-	departments := queryParams["department"]
-	if len(departments) > 0 {
-		placeholders := make([]string, len(departments))
-		for i := range departments {
-			placeholders[i] = fmt.Sprintf("$%d", argCount+i)
-		}
-		conditions = append(conditions, fmt.Sprintf("d.name IN (%s)", strings.Join(placeholders, ", ")))
-		for _, dept := range departments {
-			values = append(values, dept)
+// Assignments and on-call assignments per bucket, the shift count bounds
+// apply to each series' totals
+func (s *PostgresReportStore) StaffWorkloadSeries(ctx context.Context, filter StaffWorkloadFilter, series SeriesFilter) iter.Seq2[StaffWorkloadSeriesPoint, error] {
+	dimensions, groupBy := seriesDimensions(series.By)
+	totals := querybuilder.New(`
+        SELECT
+            ` + dimensions + `,
+            ` + bucketExpr(series.Granularity, "sh.date") + ` AS bucket,
+            COUNT(sa.id) AS v0,
+            ` + onCallCountExpr + ` AS v1
+        FROM
+            shift_assignments sa
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            staff s ON sa.staff_id = s.id
+        JOIN
+            roles r ON s.role_id = r.id
+        JOIN
+            departments d ON sa.department_id = d.id
+    `)
+	totals.Where(querybuilder.Between("sh.date", filter.StartDate, filter.EndDate))
+	totals.Where(querybuilder.Raw("r.on_call_allowed"))
+	totals.Where(querybuilder.In("r.name", filter.Roles))
+	totals.Where(querybuilder.In("d.name", filter.Departments))
+	totals.GroupBy(append(groupBy, "bucket")...)
+
+	qb := seriesQuery(totals, 2, series.Granularity, filter.StartDate, filter.EndDate)
+	qb.Where(querybuilder.Range("series.t0", filter.MinTotalShifts, filter.MaxTotalShifts))
+	qb.Where(querybuilder.Range("series.t1", filter.MinOnCallShifts, filter.MaxOnCallShifts))
+
+	query, values := qb.Build()
+	return scanRows(ctx, s, query, values, func(row rowScanner, point *StaffWorkloadSeriesPoint) error {
+		err := scanSeriesPoint(row, series.Granularity, &point.SeriesPoint, &point.TotalShiftsAssigned, &point.OnCallShiftsAssigned)
+		if point.TotalShiftsAssigned > 0 {
+			point.OnCallPercentage = float64(point.OnCallShiftsAssigned) / float64(point.TotalShiftsAssigned) * 100
 		}
-		argCount += len(departments)
-	}
+		return err
+	})
+}
 
-	// Combine the WHERE clause conditions correctly
-	if len(conditions) > 0 {
-		query += " AND " + strings.Join(conditions, " AND ")
-	}
+func GetStaffWorkloadAnalysisHandler(store ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Collect the filters from the URL query parameters
+		queryParams := r.URL.Query()
 
-	// Optional Filters for HAVING clause (based on aggregated counts)
-	// Minimum Total Shifts
-	minTotalShiftsStr := queryParams.Get("min_total_shifts")
-	if minTotalShiftsStr != "" {
-		minTotalShifts, err := strconv.Atoi(minTotalShiftsStr)
+		// Required date range filter
+		startDate, endDate, err := requiredDateRange(queryParams)
 		if err != nil {
-			http.Error(w, "Invalid value for min_total_shifts", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		havingConditions = append(havingConditions, fmt.Sprintf("COUNT(sa.id) >= $%d", argCount))
-		values = append(values, minTotalShifts)
-		argCount++
-	}
 
-	// Maximum Total Shifts
-	maxTotalShiftsStr := queryParams.Get("max_total_shifts")
-	if maxTotalShiftsStr != "" {
-		maxTotalShifts, err := strconv.Atoi(maxTotalShiftsStr)
-		if err != nil {
+		filter := StaffWorkloadFilter{
+			StartDate:      startDate,
+			EndDate:        endDate,
+			Roles:          queryValues(queryParams, "role"),
+			Departments:    queryValues(queryParams, "department"),
+			HasAssignments: strings.ToLower(queryParams.Get("has_assignments")) == "true",
+		}
+
+		// Optional shift count bounds
+		if filter.MinTotalShifts, err = optionalInt(queryParams, "min_total_shifts"); err != nil {
+			http.Error(w, "Invalid value for min_total_shifts", http.StatusBadRequest)
+			return
+		}
+		if filter.MaxTotalShifts, err = optionalInt(queryParams, "max_total_shifts"); err != nil {
 			http.Error(w, "Invalid value for max_total_shifts", http.StatusBadRequest)
 			return
 		}
-		havingConditions = append(havingConditions, fmt.Sprintf("COUNT(sa.id) <= $%d", argCount))
-		values = append(values, maxTotalShifts)
-		argCount++
-	}
-
-	// Minimum On-Call Shifts
-	minOnCallShiftsStr := queryParams.Get("min_on_call_shifts")
-	if minOnCallShiftsStr != "" {
-		minOnCallShifts, err := strconv.Atoi(minOnCallShiftsStr)
-		if err != nil {
+		if filter.MinOnCallShifts, err = optionalInt(queryParams, "min_on_call_shifts"); err != nil {
 			http.Error(w, "Invalid value for min_on_call_shifts", http.StatusBadRequest)
 			return
 		}
-		havingConditions = append(havingConditions, fmt.Sprintf("COUNT(CASE WHEN sa.shift_type = 'on-call' THEN sa.id ELSE NULL END) >= $%d", argCount))
-		values = append(values, minOnCallShifts)
-		argCount++
-	}
-
-	// Maximum On-Call Shifts
-	maxOnCallShiftsStr := queryParams.Get("max_on_call_shifts")
-	if maxOnCallShiftsStr != "" {
-		maxOnCallShifts, err := strconv.Atoi(maxOnCallShiftsStr)
-		if err != nil {
+		if filter.MaxOnCallShifts, err = optionalInt(queryParams, "max_on_call_shifts"); err != nil {
 			http.Error(w, "Invalid value for max_on_call_shifts", http.StatusBadRequest)
 			return
 		}
-		havingConditions = append(havingConditions, fmt.Sprintf("COUNT(CASE WHEN sa.shift_type = 'on-call' THEN sa.id ELSE NULL END) <= $%d", argCount))
-		values = append(values, maxOnCallShifts)
-		argCount++
-	}
-
-	hasAssignments := queryParams.Get("has_assignments")
-	if strings.ToLower(hasAssignments) == "true" {
-		havingConditions = append(havingConditions, "COUNT(sa.id) > 0")
-	}
-	// Add GROUP BY
-	query += `
-    GROUP BY
-        s.id, s.name, r.name
-    `
-	// Combine the HAVING clause conditions
-	if len(havingConditions) > 0 {
-		query += " HAVING " + strings.Join(havingConditions, " AND ")
-	}
-
-	// Add ORDER BY
-	query += " ORDER BY on_call_percentage DESC"
-
-	// Log the final query (for debugging)
-	log.Println("Executing query:", query)
-	log.Println("With values:", values)
 
-	// Execute the query
-	rows, err := db.Query(query, values...)
-	if err != nil {
-		log.Printf("Error querying staff workload analysis report: %v", err)
-		http.Error(w, "Failed to fetch staff workload analysis report", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	// Process the results
-	var reports []StaffWorkloadReportItem
-	for rows.Next() {
-		var report StaffWorkloadReportItem
-		var departments sql.NullString
-
-		err := rows.Scan(
-			&report.StaffID,
-			&report.StaffName,
-			&report.RoleName,
-			&departments,
-			&report.TotalShiftsAssigned,
-			&report.OnCallShiftsAssigned,
-			&report.OnCallPercentage,
-		)
+		// Optional comparison window or time series, not both
+		comparison, series, err := parseComparisonOrSeries(queryParams, startDate, endDate)
 		if err != nil {
-			log.Printf("Error scanning staff workload report row: %v", err)
-			http.Error(w, "Failed to process report data", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if departments.Valid {
-			report.Departments = &departments.String
-		} else {
-			report.Departments = nil
+		info := reportInfo{
+			Title:      "staff workload analysis report",
+			Slug:       "oncall-analysis",
+			StartDate:  &startDate,
+			EndDate:    &endDate,
+			Comparison: comparison,
 		}
-
-		reports = append(reports, report)
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Printf("Error iterating over staff workload report rows: %v", err)
-		http.Error(w, "Failed to retrieve staff workload reports", http.StatusInternalServerError)
-		return
+		if series != nil {
+			writeReport(w, r, info, store.StaffWorkloadSeries(r.Context(), filter, *series))
+			return
+		}
+		if comparison == nil {
+			if filter.Paging, err = requestPaging[StaffWorkloadReportItem](r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeReportRows(w, r, info, store.StaffWorkload(r.Context(), filter))
+			return
+		}
+		previous := filter
+		previous.StartDate, previous.EndDate = comparison.StartDate, comparison.EndDate
+		writeReport(w, r, info, compareRows(
+			store.StaffWorkload(r.Context(), filter).Rows,
+			store.StaffWorkload(r.Context(), previous).Rows,
+			staffWorkloadKey, compareStaffWorkload,
+		))
 	}
-
-	// Set Content-Type header and encode as JSON
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(reports)
 }
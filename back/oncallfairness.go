@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"iter"
+	"net/http"
+	"slices"
+	"time"
+
+	"backend/querybuilder"
+
+	"github.com/lib/pq"
+)
+
+// How evenly a department's on-call load is spread among the staff who
+// could take it: on-call allowed staff belonging to the department at some
+// point of the window, including those who got none. Gini is 0 when
+// everyone has the same load and approaches 1 when one person carries it
+// all; spread is the max - min gap in shifts. Neither adds up across
+// departments, so the PDF totals row leaves them blank.
+type OnCallFairnessReportItem struct {
+	DepartmentName string  `json:"department_name"`
+	EligibleStaff  int     `json:"eligible_staff" total:"sum"`
+	OnCallShifts   int     `json:"on_call_shifts" total:"sum"`
+	MeanShifts     float64 `json:"mean_shifts"`
+	MinShifts      int     `json:"min_shifts"`
+	MaxShifts      int     `json:"max_shifts"`
+	Spread         int     `json:"spread"`
+	Gini           float64 `json:"gini"`
+	WeekendShifts  int     `json:"weekend_shifts" total:"sum"`
+	WeekendSpread  int     `json:"weekend_spread"`
+	WeekendGini    float64 `json:"weekend_gini"`
+	NightShifts    int     `json:"night_shifts" total:"sum"`
+	NightSpread    int     `json:"night_spread"`
+	NightGini      float64 `json:"night_gini"`
+}
+
+// Filters accepted by the on-call fairness report
+type OnCallFairnessFilter struct {
+	StartDate   time.Time
+	EndDate     time.Time
+	Roles       []string
+	Departments []string
+}
+
+// Gini coefficient of a load distribution, 0 when nobody has any
+func gini(loads []int64) float64 {
+	sorted := slices.Sorted(slices.Values(loads))
+	var sum, weighted int64
+	for i, load := range sorted {
+		sum += load
+		weighted += int64(2*(i+1)-len(sorted)-1) * load
+	}
+	if sum == 0 {
+		return 0
+	}
+	return float64(weighted) / float64(int64(len(sorted))*sum)
+}
+
+// Total, lowest and highest load of a distribution, all 0 when it's empty
+func loadSpread(loads []int64) (total, lowest, highest int) {
+	for i, load := range loads {
+		total += int(load)
+		if i == 0 || int(load) < lowest {
+			lowest = int(load)
+		}
+		if i == 0 || int(load) > highest {
+			highest = int(load)
+		}
+	}
+	return total, lowest, highest
+}
+
+// Average load of n staff members, 0 when there are none
+func meanLoad(total, n int) float64 {
+	if n == 0 {
+		return 0
+	}
+	return float64(total) / float64(n)
+}
+
+func (s *PostgresReportStore) OnCallFairness(ctx context.Context, filter OnCallFairnessFilter) iter.Seq2[OnCallFairnessReportItem, error] {
+	// One load per eligible staff member and department, in staff order so
+	// the three arrays line up
+	qb := querybuilder.New(`
+        SELECT
+            d.name AS department_name,
+            ARRAY_AGG(COALESCE(c.total, 0) ORDER BY s.id),
+            ARRAY_AGG(COALESCE(c.weekends, 0) ORDER BY s.id),
+            ARRAY_AGG(COALESCE(c.nights, 0) ORDER BY s.id)
+        FROM
+            departments d
+        CROSS JOIN
+            staff s
+        JOIN
+            roles r ON s.role_id = r.id
+        LEFT JOIN LATERAL (
+            SELECT
+                COUNT(*) AS total,
+                COUNT(*) FILTER (WHERE EXTRACT(ISODOW FROM sh.date) >= 6) AS weekends,
+                COUNT(*) FILTER (WHERE st.end_time <= st.start_time) AS nights
+            FROM
+                shift_assignments sa
+            JOIN
+                shifts sh ON sa.shift_id = sh.id
+            JOIN
+                shift_times st ON sh.shift_time_id = st.id
+            WHERE
+                sa.staff_id = s.id
+                AND sa.department_id = d.id
+                AND sa.shift_type = 'on-call'
+                AND sh.date BETWEEN $1 AND $2
+        ) c ON TRUE
+    `, filter.StartDate, filter.EndDate)
+	qb.Where(querybuilder.Raw("r.on_call_allowed"))
+	qb.Where(querybuilder.Raw(`EXISTS (
+            SELECT 1 FROM staff_departments sd
+            WHERE sd.staff_id = s.id
+              AND sd.department_id = d.id
+              AND sd.start_date <= $2
+              AND (sd.end_date IS NULL OR sd.end_date >= $1)
+        )`))
+	qb.Where(querybuilder.In("r.name", filter.Roles))
+	qb.Where(querybuilder.In("d.name", filter.Departments))
+	qb.GroupBy("d.name")
+	qb.OrderBy("department_name")
+
+	query, values := qb.Build()
+	return scanRows(ctx, s, query, values, func(row rowScanner, report *OnCallFairnessReportItem) error {
+		var totals, weekends, nights pq.Int64Array
+		if err := row.Scan(&report.DepartmentName, &totals, &weekends, &nights); err != nil {
+			return err
+		}
+		report.EligibleStaff = len(totals)
+		report.OnCallShifts, report.MinShifts, report.MaxShifts = loadSpread(totals)
+		report.Spread = report.MaxShifts - report.MinShifts
+		report.MeanShifts = meanLoad(report.OnCallShifts, report.EligibleStaff)
+		report.Gini = gini(totals)
+
+		var lowest, highest int
+		report.WeekendShifts, lowest, highest = loadSpread(weekends)
+		report.WeekendSpread = highest - lowest
+		report.WeekendGini = gini(weekends)
+		report.NightShifts, lowest, highest = loadSpread(nights)
+		report.NightSpread = highest - lowest
+		report.NightGini = gini(nights)
+		return nil
+	})
+}
+
+// Handler for the on-call fairness report
+func GetOnCallFairnessReportHandler(store ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Collect the filters from URL
+		queryParams := r.URL.Query()
+
+		// Required date range filter
+		startDate, endDate, err := requiredDateRange(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := OnCallFairnessFilter{
+			StartDate:   startDate,
+			EndDate:     endDate,
+			Roles:       queryValues(queryParams, "role"),
+			Departments: queryValues(queryParams, "department"),
+		}
+
+		writeReport(w, r, reportInfo{
+			Title:     "on-call fairness report",
+			Slug:      "oncall-fairness",
+			StartDate: &startDate,
+			EndDate:   &endDate,
+		}, store.OnCallFairness(r.Context(), filter))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGini(t *testing.T) {
+	tests := []struct {
+		name  string
+		loads []int64
+		want  float64
+	}{
+		{"empty", nil, 0},
+		{"all zeros", []int64{0, 0, 0, 0}, 0},
+		{"equal loads", []int64{3, 3, 3, 3}, 0},
+		{"single staff member", []int64{5}, 0},
+		{"one carries everything, 4 staff", []int64{0, 8, 0, 0}, 0.75},
+		{"one carries everything, 5 staff", []int64{0, 0, 0, 0, 2}, 0.8},
+		{"uneven", []int64{1, 2, 3, 4}, 0.25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := gini(tt.loads); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("gini(%v) = %v, want %v", tt.loads, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSpread(t *testing.T) {
+	tests := []struct {
+		name                   string
+		loads                  []int64
+		total, lowest, highest int
+	}{
+		{"empty", nil, 0, 0, 0},
+		{"single", []int64{4}, 4, 4, 4},
+		{"mixed", []int64{3, 0, 7, 2}, 12, 0, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, lowest, highest := loadSpread(tt.loads)
+			if total != tt.total || lowest != tt.lowest || highest != tt.highest {
+				t.Errorf("loadSpread(%v) = %d, %d, %d, want %d, %d, %d", tt.loads, total, lowest, highest, tt.total, tt.lowest, tt.highest)
+			}
+		})
+	}
+}
+
+func TestMeanLoad(t *testing.T) {
+	if got := meanLoad(0, 0); got != 0 {
+		t.Errorf("meanLoad(0, 0) = %v, want 0", got)
+	}
+	if got := meanLoad(12, 4); got != 3 {
+		t.Errorf("meanLoad(12, 4) = %v, want 3", got)
+	}
+}
@@ -1,14 +1,12 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
+	"context"
+	"iter"
 	"net/http"
-	"strconv"
-	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"backend/querybuilder"
 )
 
 // Struct for each line of the response
@@ -16,19 +14,67 @@ type OvertimeReport struct {
 	StaffName      string  `json:"staff_name"`
 	RoleName       string  `json:"role_name"`
 	DepartmentName string  `json:"department_name"`
-	TotalOvertime  float64 `json:"total_overtime"`
+	TotalOvertime  float64 `json:"total_overtime" total:"sum"`
 }
 
-// Handler for overtime analysis
-func GetOvertimeAnalysisReportHandler(w http.ResponseWriter, r *http.Request) {
-	// Base query, selects information & joins basic tables & starts
-	// a WHERE 1 = 1 so we can dynamically add the filters from our frontend
-	query := `
-        SELECT
-            s.name AS staff_name,
-            r.name AS role_name,
-            d.name AS department_name,
-            SUM(EXTRACT(EPOCH FROM o.duration)) / 3600 AS total_overtime_hours
+// An overtime row next to the same staff member, role and department in
+// the comparison window, hours are 0 in the window they are missing from
+type OvertimeComparison struct {
+	StaffName        string   `json:"staff_name"`
+	RoleName         string   `json:"role_name"`
+	DepartmentName   string   `json:"department_name"`
+	CurrentOvertime  float64  `json:"current_overtime" total:"sum"`
+	PreviousOvertime float64  `json:"previous_overtime" total:"sum"`
+	DeltaOvertime    float64  `json:"delta_overtime" total:"sum"`
+	DeltaPercentage  *float64 `json:"delta_percentage"`
+	Presence         string   `json:"presence"`
+}
+
+// A bucket of an overtime series
+type OvertimeSeriesPoint struct {
+	SeriesPoint
+	TotalOvertime float64 `json:"total_overtime" total:"sum"`
+}
+
+func overtimeKey(row OvertimeReport) string {
+	return row.StaffName + "\x00" + row.RoleName + "\x00" + row.DepartmentName
+}
+
+func compareOvertime(current, previous *OvertimeReport) OvertimeComparison {
+	row := OvertimeComparison{Presence: presence(current, previous)}
+	for _, r := range []*OvertimeReport{previous, current} {
+		if r != nil {
+			row.StaffName, row.RoleName, row.DepartmentName = r.StaffName, r.RoleName, r.DepartmentName
+		}
+	}
+	if current != nil {
+		row.CurrentOvertime = current.TotalOvertime
+	}
+	if previous != nil {
+		row.PreviousOvertime = previous.TotalOvertime
+	}
+	row.DeltaOvertime = row.CurrentOvertime - row.PreviousOvertime
+	row.DeltaPercentage = percentageDelta(row.CurrentOvertime, row.PreviousOvertime)
+	return row
+}
+
+// Filters accepted by the overtime report
+type OvertimeFilter struct {
+	StartDate        time.Time
+	EndDate          time.Time
+	Roles            []string
+	Departments      []string
+	MinOvertimeHours *float64
+	MaxOvertimeHours *float64
+	// Sort and page, applied by the query
+	Paging reportPaging
+}
+
+// Total overtime of a group in hours
+const overtimeHoursExpr = "SUM(EXTRACT(EPOCH FROM o.duration)) / 3600"
+
+// Overtime with its assignment, staff member and shift
+const overtimeFrom = `
         FROM
             overtimes o
         JOIN
@@ -41,134 +87,125 @@ func GetOvertimeAnalysisReportHandler(w http.ResponseWriter, r *http.Request) {
             departments d ON sa.department_id = d.id
         JOIN
             shifts sh ON sa.shift_id = sh.id
-        WHERE 1=1
     `
 
-	// Collect the filters from URL
-	queryParams := r.URL.Query()
-
-	// Build the WHERE clause dynamically
-	var conditions []string
-	var values []interface{}
-	argCount := 1 // Used to dynamically build queries with the PSQL driver, where placeholders are numbers.
-
-	// Required date range filter,
-	// builds query & increments argCount
-	startDate := queryParams.Get("start_date")
-	endDate := queryParams.Get("end_date")
-	if startDate != "" && endDate != "" {
-		conditions = append(conditions, fmt.Sprintf("sh.date >= $%d AND sh.date <= $%d", argCount, argCount+1))
-		values = append(values, startDate, endDate)
-		argCount += 2
-	} else {
-		http.Error(w, "Start date and end date are required", http.StatusBadRequest)
-		return
-	}
+func overtimeWhere(qb *querybuilder.Builder, filter OvertimeFilter) {
+	qb.Where(querybuilder.Between("sh.date", filter.StartDate, filter.EndDate))
+	qb.Where(querybuilder.In("r.name", filter.Roles))
+	qb.Where(querybuilder.In("d.name", filter.Departments))
+}
 
-	// Role filter, adds a where clause & increments argCount if needed
-	role := queryParams.Get("role")
-	if role != "" {
-		conditions = append(conditions, fmt.Sprintf("r.name = $%d", argCount))
-		values = append(values, role)
-		argCount++
-	}
+func (s *PostgresReportStore) OvertimeAnalysis(ctx context.Context, filter OvertimeFilter) ReportRows[OvertimeReport] {
+	// Base query, selects information & joins basic tables, the filters
+	// from our frontend are added by the query builder
+	qb := querybuilder.New(`
+        SELECT
+            s.name AS staff_name,
+            r.name AS role_name,
+            d.name AS department_name,
+            ` + overtimeHoursExpr + ` AS total_overtime
+        ` + overtimeFrom)
+
+	overtimeWhere(qb, filter)
+	qb.GroupBy("s.name", "r.name", "d.name")
+	qb.Having(querybuilder.Range(overtimeHoursExpr, filter.MinOvertimeHours, filter.MaxOvertimeHours))
+
+	return scanPage(ctx, s, qb, filter.Paging,
+		[]string{"staff_name", "role_name", "department_name", "total_overtime"},
+		[]string{"total_overtime DESC", "staff_name", "role_name", "department_name"},
+		func(row rowScanner, report *OvertimeReport) error {
+			return row.Scan(
+				&report.StaffName,
+				&report.RoleName,
+				&report.DepartmentName,
+				&report.TotalOvertime,
+			)
+		})
+}
 
-	// Department filter, adds a where clause & increments argCount if needed
-	department := queryParams.Get("department")
-	if department != "" {
-		conditions = append(conditions, fmt.Sprintf("d.name = $%d", argCount))
-		values = append(values, department)
-		argCount++
-	}
+// Overtime hours per bucket, min / max hours apply to each series' total
+func (s *PostgresReportStore) OvertimeSeries(ctx context.Context, filter OvertimeFilter, series SeriesFilter) iter.Seq2[OvertimeSeriesPoint, error] {
+	dimensions, groupBy := seriesDimensions(series.By)
+	totals := querybuilder.New(`
+        SELECT
+            ` + dimensions + `,
+            ` + bucketExpr(series.Granularity, "sh.date") + ` AS bucket,
+            ` + overtimeHoursExpr + ` AS v0
+        ` + overtimeFrom)
+	overtimeWhere(totals, filter)
+	totals.GroupBy(append(groupBy, "bucket")...)
+
+	qb := seriesQuery(totals, 1, series.Granularity, filter.StartDate, filter.EndDate)
+	qb.Where(querybuilder.Range("series.t0", filter.MinOvertimeHours, filter.MaxOvertimeHours))
+
+	query, values := qb.Build()
+	return scanRows(ctx, s, query, values, func(row rowScanner, point *OvertimeSeriesPoint) error {
+		return scanSeriesPoint(row, series.Granularity, &point.SeriesPoint, &point.TotalOvertime)
+	})
+}
 
-	// Combine the WHERE clause conditions, this is safe as it just created a
-	// query string of the form
-	// "WHERE condition = $1 AND condition = $2", etc.
-	if len(conditions) > 0 {
-		query += " AND " + strings.Join(conditions, " AND ")
-	}
+// Handler for overtime analysis
+func GetOvertimeAnalysisReportHandler(store ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Collect the filters from URL
+		queryParams := r.URL.Query()
 
-	// Group by, some of these needed to be included
-	query += `
-  GROUP BY
-      s.name, r.name, d.name
-  `
+		// Required date range filter
+		startDate, endDate, err := requiredDateRange(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-	// Build the HAVING clause dynamically
-	var havingConditions []string
+		filter := OvertimeFilter{
+			StartDate:   startDate,
+			EndDate:     endDate,
+			Roles:       queryValues(queryParams, "role"),
+			Departments: queryValues(queryParams, "department"),
+		}
 
-	// Minimum overtime hours
-	minOvertimeStr := queryParams.Get("min_overtime_hours")
-	if minOvertimeStr != "" {
-		minOvertime, err := strconv.ParseFloat(minOvertimeStr, 64)
-		if err != nil {
+		// Minimum / maximum overtime hours
+		if filter.MinOvertimeHours, err = optionalFloat(queryParams, "min_overtime_hours"); err != nil {
 			http.Error(w, "Invalid minimum overtime hours", http.StatusBadRequest)
 			return
 		}
-		havingConditions = append(havingConditions, fmt.Sprintf("SUM(EXTRACT(EPOCH FROM o.duration)) / 3600 >= $%d", argCount))
-		values = append(values, minOvertime)
-		argCount++
-	}
-
-	// Maximum overtime hours
-	maxOvertimeStr := queryParams.Get("max_overtime_hours")
-	if maxOvertimeStr != "" {
-		maxOvertime, err := strconv.ParseFloat(maxOvertimeStr, 64)
-		if err != nil {
+		if filter.MaxOvertimeHours, err = optionalFloat(queryParams, "max_overtime_hours"); err != nil {
 			http.Error(w, "Invalid maximum overtime hours", http.StatusBadRequest)
 			return
 		}
-		havingConditions = append(havingConditions, fmt.Sprintf("SUM(EXTRACT(EPOCH FROM o.duration)) / 3600 <= $%d", argCount))
-		values = append(values, maxOvertime)
-		argCount++
-	}
-
-	// Combine the previous conditions
-	if len(havingConditions) > 0 {
-		query += " HAVING " + strings.Join(havingConditions, " AND ")
-	}
-
-	// Get results in descending order
-	query += " ORDER BY total_overtime_hours DESC"
 
-	// Log the final query (for debugging)
-	log.Println("Executing query:", query)
-	log.Println("With values:", values)
-
-	// Execute the query
-	rows, err := db.Query(query, values...)
-	if err != nil {
-		log.Printf("Error querying overtime analysis report: %v", err)
-		http.Error(w, "Failed to fetch overtime analysis report", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	// Process the results
-	var reports []OvertimeReport
-	for rows.Next() {
-		var report OvertimeReport
-		err := rows.Scan(
-			&report.StaffName,
-			&report.RoleName,
-			&report.DepartmentName,
-			&report.TotalOvertime,
-		)
+		// Optional comparison window or time series, not both
+		comparison, series, err := parseComparisonOrSeries(queryParams, startDate, endDate)
 		if err != nil {
-			log.Printf("Error scanning overtime analysis report row: %v", err)
-			http.Error(w, "Failed to process overtime analysis report", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		reports = append(reports, report)
-	}
 
-	if err := rows.Err(); err != nil {
-		log.Printf("Error iterating over overtime analysis report rows: %v", err)
-		http.Error(w, "Failed to retrieve overtime analysis reports", http.StatusInternalServerError)
-		return
+		info := reportInfo{
+			Title:      "overtime analysis report",
+			Slug:       "overtime",
+			StartDate:  &startDate,
+			EndDate:    &endDate,
+			Comparison: comparison,
+		}
+		if series != nil {
+			writeReport(w, r, info, store.OvertimeSeries(r.Context(), filter, *series))
+			return
+		}
+		if comparison == nil {
+			if filter.Paging, err = requestPaging[OvertimeReport](r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeReportRows(w, r, info, store.OvertimeAnalysis(r.Context(), filter))
+			return
+		}
+		previous := filter
+		previous.StartDate, previous.EndDate = comparison.StartDate, comparison.EndDate
+		writeReport(w, r, info, compareRows(
+			store.OvertimeAnalysis(r.Context(), filter).Rows,
+			store.OvertimeAnalysis(r.Context(), previous).Rows,
+			overtimeKey, compareOvertime,
+		))
 	}
-
-	// Set Content-Type header and encode as JSON
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(reports)
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"backend/querybuilder"
+)
+
+// Staffing cost of a department in a month next to its budget. Hours
+// without a rate (neither the staff member nor their role has one) aren't
+// priced, they are counted in unpriced_hours. Budget, variance and the
+// used percentage are null for months without a budget.
+type OvertimeCostReportItem struct {
+	DepartmentName       string   `json:"department_name"`
+	Month                string   `json:"month"`
+	RegularHours         float64  `json:"regular_hours" total:"sum"`
+	RegularCost          float64  `json:"regular_cost" total:"sum"`
+	OvertimeHours        float64  `json:"overtime_hours" total:"sum"`
+	OvertimeCost         float64  `json:"overtime_cost" total:"sum"`
+	TotalCost            float64  `json:"total_cost" total:"sum"`
+	UnpricedHours        float64  `json:"unpriced_hours" total:"sum"`
+	Budget               *float64 `json:"budget" total:"sum"`
+	Variance             *float64 `json:"variance" total:"sum"`
+	BudgetUsedPercentage *float64 `json:"budget_used_percentage"`
+}
+
+// Filters accepted by the overtime cost report
+type OvertimeCostFilter struct {
+	StartDate   time.Time
+	EndDate     time.Time
+	Roles       []string
+	Departments []string
+	// Sort and page, applied by the query
+	Paging reportPaging
+}
+
+// Hourly rate of an entry, the staff member's own before their role's
+const payRateExpr = "COALESCE(spr.hourly_rate, rpr.hourly_rate)"
+
+// Multiplier of an entry's shift: the largest of the night (crosses
+// midnight), weekend and holiday multipliers that apply, 1 when none does
+const payPremiumExpr = `GREATEST(
+                CASE WHEN st.end_time <= st.start_time THEN pm.night ELSE 1 END,
+                CASE WHEN EXTRACT(ISODOW FROM sh.date) >= 6 THEN pm.weekend ELSE 1 END,
+                CASE WHEN h.id IS NOT NULL THEN pm.holiday ELSE 1 END
+            )`
+
+// Fills in the budget comparison of a scanned row
+func (item *OvertimeCostReportItem) compareBudget() {
+	if item.Budget == nil {
+		return
+	}
+	variance := *item.Budget - item.TotalCost
+	item.Variance = &variance
+	if *item.Budget > 0 {
+		used := item.TotalCost / *item.Budget * 100
+		item.BudgetUsedPercentage = &used
+	}
+}
+
+func (s *PostgresReportStore) OvertimeCost(ctx context.Context, filter OvertimeCostFilter) ReportRows[OvertimeCostReportItem] {
+	// Every completed log and overtime entry priced on its own, then summed
+	// per department and month. Regular hours are the logged ones, overtime
+	// is recorded apart once the shift ends.
+	actual := querybuilder.New(`
+        SELECT
+            sa.department_id,
+            date_trunc('month', sh.date)::date AS month,
+            SUM(e.regular_hours) AS regular_hours,
+            SUM(e.regular_hours * ` + payRateExpr + ` * ` + payPremiumExpr + `) AS regular_cost,
+            SUM(e.overtime_hours) AS overtime_hours,
+            SUM(e.overtime_hours * ` + payRateExpr + ` * pm.overtime * ` + payPremiumExpr + `) AS overtime_cost,
+            SUM(e.regular_hours + e.overtime_hours) FILTER (WHERE ` + payRateExpr + ` IS NULL) AS unpriced_hours
+        FROM (
+            SELECT
+                sl.assignment_id,
+                EXTRACT(EPOCH FROM
+                    CASE
+                        WHEN sl.check_out >= sl.check_in THEN (sl.check_out - sl.check_in)
+                        ELSE ((sl.check_out + INTERVAL '1 day') - sl.check_in)
+                    END
+                ) / 3600 AS regular_hours,
+                0 AS overtime_hours
+            FROM
+                shift_logs sl
+            WHERE
+                sl.check_in IS NOT NULL AND sl.check_out IS NOT NULL
+            UNION ALL
+            SELECT
+                o.shift_assignment_id,
+                0,
+                EXTRACT(EPOCH FROM o.duration) / 3600
+            FROM
+                overtimes o
+        ) e
+        JOIN
+            shift_assignments sa ON e.assignment_id = sa.id
+        JOIN
+            staff s ON sa.staff_id = s.id
+        JOIN
+            roles r ON s.role_id = r.id
+        JOIN
+            departments d ON sa.department_id = d.id
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+        LEFT JOIN
+            staff_pay_rates spr ON spr.staff_id = s.id
+        LEFT JOIN
+            role_pay_rates rpr ON rpr.role_id = s.role_id
+        LEFT JOIN
+            holidays h ON h.date = sh.date
+        CROSS JOIN
+            pay_multipliers pm
+    `)
+	actual.Where(querybuilder.Between("sh.date", filter.StartDate, filter.EndDate))
+	actual.Where(querybuilder.In("r.name", filter.Roles))
+	actual.Where(querybuilder.In("d.name", filter.Departments))
+	actual.GroupBy("sa.department_id", "month")
+	actualQuery, values := actual.Build()
+
+	// Budgets of the months in the window join the costs, a budgeted month
+	// without any hours still shows up with a cost of 0
+	qb := querybuilder.New(fmt.Sprintf(`
+        WITH actual AS (
+            %s
+        )
+        SELECT
+            d.name AS department_name,
+            to_char(COALESCE(a.month, b.month), 'YYYY-MM') AS month,
+            COALESCE(a.regular_hours, 0) AS regular_hours,
+            COALESCE(a.regular_cost, 0) AS regular_cost,
+            COALESCE(a.overtime_hours, 0) AS overtime_hours,
+            COALESCE(a.overtime_cost, 0) AS overtime_cost,
+            COALESCE(a.unpriced_hours, 0) AS unpriced_hours,
+            b.amount AS budget
+        FROM
+            actual a
+        FULL JOIN
+            department_budgets b ON b.department_id = a.department_id AND b.month = a.month
+        JOIN
+            departments d ON d.id = COALESCE(a.department_id, b.department_id)
+    `, actualQuery), values...)
+	firstMonth := time.Date(filter.StartDate.Year(), filter.StartDate.Month(), 1, 0, 0, 0, 0, time.UTC)
+	qb.Where(querybuilder.Between("COALESCE(a.month, b.month)", firstMonth, filter.EndDate))
+	qb.Where(querybuilder.In("d.name", filter.Departments))
+
+	return scanPage(ctx, s, qb, filter.Paging,
+		[]string{"department_name", "month", "regular_hours", "regular_cost", "overtime_hours", "overtime_cost", "unpriced_hours", "budget"},
+		[]string{"department_name", "month"},
+		func(row rowScanner, item *OvertimeCostReportItem) error {
+			err := row.Scan(
+				&item.DepartmentName,
+				&item.Month,
+				&item.RegularHours,
+				&item.RegularCost,
+				&item.OvertimeHours,
+				&item.OvertimeCost,
+				&item.UnpricedHours,
+				&item.Budget,
+			)
+			item.TotalCost = item.RegularCost + item.OvertimeCost
+			item.compareBudget()
+			return err
+		})
+}
+
+// Handler for the overtime cost report
+func GetOvertimeCostReportHandler(store ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Collect the filters from URL
+		queryParams := r.URL.Query()
+
+		// Required date range filter
+		startDate, endDate, err := requiredDateRange(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := OvertimeCostFilter{
+			StartDate:   startDate,
+			EndDate:     endDate,
+			Roles:       queryValues(queryParams, "role"),
+			Departments: queryValues(queryParams, "department"),
+		}
+
+		if filter.Paging, err = requestPaging[OvertimeCostReportItem](r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeReportRows(w, r, reportInfo{
+			Title:     "overtime cost report",
+			Slug:      "overtime-cost",
+			StartDate: &startDate,
+			EndDate:   &endDate,
+		}, store.OvertimeCost(r.Context(), filter))
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"backend/querybuilder"
+)
+
+// Most overtime a single assignment may carry
+const maxOvertime = 4 * time.Hour
+
+var (
+	ErrOvertimeNotAllowed = errors.New("The staff member's role does not permit overtime")
+	ErrNotCheckedOut      = errors.New("Overtime can only be recorded once the shift is checked out")
+)
+
+// Returned when an overtime entry goes past the cap or past the time the
+// staff member actually stayed after the scheduled end
+type OvertimeLimitError struct {
+	Remaining time.Duration
+}
+
+func (e *OvertimeLimitError) Error() string {
+	return fmt.Sprintf("Only %d more minutes of overtime can be recorded for this shift", int(e.Remaining.Minutes()))
+}
+
+// A row of overtimes
+type OvertimeEntry struct {
+	ID           int `json:"id"`
+	AssignmentID int `json:"assignment_id"`
+	Minutes      int `json:"minutes"`
+}
+
+// Payload to record overtime on an assignment
+type OvertimeInput struct {
+	Minutes int `json:"minutes"`
+}
+
+func (in OvertimeInput) Validate() error {
+	if in.Minutes <= 0 {
+		return errors.New("minutes must be positive")
+	}
+	return nil
+}
+
+// Records overtime on a checked-out assignment. The role must allow
+// overtime, and the assignment's overtime can't exceed maxOvertime nor the
+// time between the scheduled end and the check-out.
+func (s *PostgresClockStore) RecordOvertime(ctx context.Context, assignmentID int, duration time.Duration) (OvertimeEntry, error) {
+	entry := OvertimeEntry{AssignmentID: assignmentID, Minutes: int(duration.Minutes())}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return entry, err
+	}
+	defer tx.Rollback()
+
+	// Locks the assignment, so concurrent entries can't both fit the cap
+	shiftLog, err := lockAssignmentLog(ctx, tx, assignmentID)
+	if err != nil {
+		return entry, err
+	}
+
+	var allowed bool
+	err = tx.QueryRowContext(ctx, `
+        SELECT r.overtime_allowed
+        FROM shift_assignments sa
+        JOIN staff s ON sa.staff_id = s.id
+        JOIN roles r ON s.role_id = r.id
+        WHERE sa.id = $1
+    `, assignmentID).Scan(&allowed)
+	if err != nil {
+		return entry, err
+	}
+	if !allowed {
+		return entry, ErrOvertimeNotAllowed
+	}
+	if shiftLog.CheckIn == nil || shiftLog.CheckOut == nil {
+		return entry, ErrNotCheckedOut
+	}
+
+	var recordedSeconds float64
+	err = tx.QueryRowContext(ctx, `
+        SELECT COALESCE(EXTRACT(EPOCH FROM SUM(duration)), 0)
+        FROM overtimes
+        WHERE shift_assignment_id = $1
+    `, assignmentID).Scan(&recordedSeconds)
+	if err != nil {
+		return entry, err
+	}
+
+	recorded := time.Duration(recordedSeconds * float64(time.Second))
+	remaining := remainingOvertime(*shiftLog.CheckIn, *shiftLog.CheckOut, shiftLog.ScheduledEnd, recorded)
+	if duration > remaining {
+		return entry, &OvertimeLimitError{Remaining: remaining}
+	}
+
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO overtimes (shift_assignment_id, duration)
+        VALUES ($1, make_interval(mins => $2))
+        RETURNING id
+    `, assignmentID, entry.Minutes).Scan(&entry.ID)
+	if err != nil {
+		return entry, err
+	}
+	if err := recordAudit(ctx, tx, AuditCreate, EntityOvertime, entry.ID, nil, entry); err != nil {
+		return entry, err
+	}
+	return entry, tx.Commit()
+}
+
+// Overtime still allowed on an assignment that already carries recorded:
+// the time stayed past the scheduled end, capped at maxOvertime, never
+// below 0
+func remainingOvertime(checkIn, checkOut, scheduledEnd time.Time, recorded time.Duration) time.Duration {
+	// Logs of overnight shifts may carry the check-out on the check-in's date
+	if checkOut.Before(checkIn) {
+		checkOut = checkOut.AddDate(0, 0, 1)
+	}
+	return max(min(maxOvertime, checkOut.Sub(scheduledEnd))-recorded, 0)
+}
+
+func RecordOvertimeHandler(store ClockStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid assignment id", http.StatusBadRequest)
+			return
+		}
+		var input OvertimeInput
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := input.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		entry, err := store.RecordOvertime(r.Context(), id, time.Duration(input.Minutes)*time.Minute)
+		var limitErr *OvertimeLimitError
+		switch {
+		case errors.Is(err, ErrOvertimeNotAllowed), errors.As(err, &limitErr):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case errors.Is(err, ErrNotCheckedOut):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			writeClockError(w, err)
+		default:
+			writeJSON(w, http.StatusCreated, entry)
+		}
+	}
+}
+
+// Rules an existing overtime row can break, from ?violation=
+const (
+	ViolationRoleNotAllowed  = "role_not_allowed"
+	ViolationNotPositive     = "not_positive"
+	ViolationExceedsCap      = "exceeds_cap"
+	ViolationNoCheckOut      = "no_check_out"
+	ViolationExceedsCheckOut = "exceeds_check_out"
+)
+
+// Every violation in the order they are listed on a row
+var overtimeViolations = []string{
+	ViolationRoleNotAllowed,
+	ViolationNotPositive,
+	ViolationExceedsCap,
+	ViolationNoCheckOut,
+	ViolationExceedsCheckOut,
+}
+
+// An overtime row breaking at least one of the rules RecordOvertime
+// enforces. The cap and the check-out apply to the assignment's total
+// overtime, so every row of an assignment over them is listed.
+type OvertimeViolation struct {
+	OvertimeID     int       `json:"overtime_id"`
+	AssignmentID   int       `json:"assignment_id"`
+	StaffName      string    `json:"staff_name"`
+	RoleName       string    `json:"role_name"`
+	DepartmentName string    `json:"department_name"`
+	Date           time.Time `json:"date"`
+	ShiftTime      string    `json:"shift_time"`
+	OvertimeHours  float64   `json:"overtime_hours" total:"sum"`
+	Violations     []string  `json:"violations"`
+}
+
+// Filters accepted by the overtime violations report, no violations
+// means any of them
+type OvertimeViolationFilter struct {
+	StartDate   time.Time
+	EndDate     time.Time
+	Roles       []string
+	Departments []string
+	Violations  []string
+	// Sort and page, applied by the query
+	Paging reportPaging
+}
+
+func (s *PostgresReportStore) OvertimeViolations(ctx context.Context, filter OvertimeViolationFilter) ReportRows[OvertimeViolation] {
+	// Each overtime row with its assignment's total and latest log, $1 is
+	// the cap in minutes. One flag column per violation, named after it.
+	const assignmentTotal = "SUM(o.duration) OVER (PARTITION BY o.shift_assignment_id)"
+	inner := querybuilder.New(`
+        SELECT
+            o.id AS overtime_id,
+            sa.id AS assignment_id,
+            s.name AS staff_name,
+            r.name AS role_name,
+            d.name AS department_name,
+            sh.date,
+            st.name AS shift_time,
+            EXTRACT(EPOCH FROM o.duration) / 3600 AS overtime_hours,
+            NOT r.overtime_allowed AS `+ViolationRoleNotAllowed+`,
+            o.duration <= INTERVAL '0' AS `+ViolationNotPositive+`,
+            `+assignmentTotal+` > make_interval(mins => $1) AS `+ViolationExceedsCap+`,
+            lg.check_out IS NULL AS `+ViolationNoCheckOut+`,
+            COALESCE(`+assignmentTotal+` > lg.check_out - `+scheduledEndExpr+`, FALSE) AS `+ViolationExceedsCheckOut+`
+        FROM
+            overtimes o
+        JOIN
+            shift_assignments sa ON o.shift_assignment_id = sa.id
+        JOIN
+            staff s ON sa.staff_id = s.id
+        JOIN
+            roles r ON s.role_id = r.id
+        JOIN
+            departments d ON sa.department_id = d.id
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+        LEFT JOIN LATERAL (
+            SELECT `+checkOutExpr+` AS check_out
+            FROM shift_logs sl
+            WHERE sl.assignment_id = sa.id
+            ORDER BY sl.id DESC
+            LIMIT 1
+        ) lg ON TRUE
+    `, int(maxOvertime.Minutes()))
+	inner.Where(querybuilder.Between("sh.date", filter.StartDate, filter.EndDate))
+	inner.Where(querybuilder.In("r.name", filter.Roles))
+	inner.Where(querybuilder.In("d.name", filter.Departments))
+	innerQuery, values := inner.Build()
+
+	violations := filter.Violations
+	if len(violations) == 0 {
+		violations = overtimeViolations
+	}
+	flags := make([]querybuilder.Clause, len(violations))
+	for i, violation := range violations {
+		flags[i] = querybuilder.Raw("v." + violation)
+	}
+
+	qb := querybuilder.New(`
+        SELECT
+            v.overtime_id,
+            v.assignment_id,
+            v.staff_name,
+            v.role_name,
+            v.department_name,
+            v.date,
+            v.shift_time,
+            v.overtime_hours,
+            `+strings.Join(prefixed("v.", overtimeViolations), ",\n            ")+`
+        FROM (
+            `+innerQuery+`
+        ) v
+    `, values...)
+	qb.Where(querybuilder.Or(flags...))
+
+	return scanPage(ctx, s, qb, filter.Paging,
+		[]string{"overtime_id", "assignment_id", "staff_name", "role_name", "department_name", "date", "shift_time", "overtime_hours"},
+		[]string{"v.date", "v.staff_name", "v.overtime_id"},
+		func(row rowScanner, report *OvertimeViolation) error {
+			broken := make([]bool, len(overtimeViolations))
+			dest := []interface{}{
+				&report.OvertimeID,
+				&report.AssignmentID,
+				&report.StaffName,
+				&report.RoleName,
+				&report.DepartmentName,
+				&report.Date,
+				&report.ShiftTime,
+				&report.OvertimeHours,
+			}
+			for i := range broken {
+				dest = append(dest, &broken[i])
+			}
+			if err := row.Scan(dest...); err != nil {
+				return err
+			}
+			report.Violations = []string{}
+			for i, violation := range overtimeViolations {
+				if broken[i] {
+					report.Violations = append(report.Violations, violation)
+				}
+			}
+			return nil
+		})
+}
+
+func prefixed(prefix string, names []string) []string {
+	out := make([]string, len(names))
+	for i, name := range names {
+		out[i] = prefix + name
+	}
+	return out
+}
+
+// Handler for the overtime data-quality report
+func GetOvertimeViolationsReportHandler(store ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Collect the filters from URL
+		queryParams := r.URL.Query()
+
+		// Required date range filter
+		startDate, endDate, err := requiredDateRange(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := OvertimeViolationFilter{
+			StartDate:   startDate,
+			EndDate:     endDate,
+			Roles:       queryValues(queryParams, "role"),
+			Departments: queryValues(queryParams, "department"),
+			Violations:  queryValues(queryParams, "violation"),
+		}
+		for _, violation := range filter.Violations {
+			if !slices.Contains(overtimeViolations, violation) {
+				http.Error(w, "violation must be one of "+strings.Join(overtimeViolations, ", "), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if filter.Paging, err = requestPaging[OvertimeViolation](r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeReportRows(w, r, reportInfo{
+			Title:     "overtime violations report",
+			Slug:      "overtime-violations",
+			StartDate: &startDate,
+			EndDate:   &endDate,
+		}, store.OvertimeViolations(r.Context(), filter))
+	}
+}
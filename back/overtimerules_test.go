@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRemainingOvertime(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 3, day, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name                            string
+		checkIn, checkOut, scheduledEnd time.Time
+		recorded                        time.Duration
+		want                            time.Duration
+	}{
+		{"stayed 90 minutes", at(4, 7, 0), at(4, 16, 30), at(4, 15, 0), 0, 90 * time.Minute},
+		{"part already recorded", at(4, 7, 0), at(4, 16, 30), at(4, 15, 0), time.Hour, 30 * time.Minute},
+		{"capped at the maximum", at(4, 7, 0), at(4, 21, 0), at(4, 15, 0), 0, maxOvertime},
+		{"cap less what's recorded", at(4, 7, 0), at(4, 21, 0), at(4, 15, 0), 3 * time.Hour, time.Hour},
+		{"left on time", at(4, 7, 0), at(4, 15, 0), at(4, 15, 0), 0, 0},
+		{"left early", at(4, 7, 0), at(4, 14, 0), at(4, 15, 0), 0, 0},
+		{"recorded past what was stayed", at(4, 7, 0), at(4, 16, 0), at(4, 15, 0), 2 * time.Hour, 0},
+		{"overnight check-out on the check-in's date", at(4, 23, 0), at(4, 8, 0), at(5, 7, 0), 0, time.Hour},
+		{"overnight check-out on the next date", at(4, 23, 0), at(5, 8, 0), at(5, 7, 0), 0, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remainingOvertime(tt.checkIn, tt.checkOut, tt.scheduledEnd, tt.recorded); got != tt.want {
+				t.Errorf("remainingOvertime = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOvertimeViolationsHandlerChecksViolation(t *testing.T) {
+	tests := []struct {
+		violation string
+		status    int
+	}{
+		{ViolationExceedsCap, http.StatusOK},
+		{ViolationNoCheckOut, http.StatusOK},
+		{"too_long", http.StatusBadRequest},
+		{"v.exceeds_cap", http.StatusBadRequest},
+		{"exceeds_cap OR TRUE", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		target := "/report?" + reportRange + "&violation=" + url.QueryEscape(tt.violation)
+		w := serveReport(t, GetOvertimeViolationsReportHandler, &MemoryReportStore{}, target)
+		if w.Code != tt.status {
+			t.Errorf("violation=%s: status = %d, want %d: %s", tt.violation, w.Code, tt.status, w.Body)
+		}
+	}
+}
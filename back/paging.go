@@ -0,0 +1,346 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/querybuilder"
+
+	"github.com/lib/pq"
+)
+
+// Default and largest page sizes of a report, bigger than the listings'
+// since reports are often read whole
+const (
+	defaultReportPageSize = 100
+	maxReportPageSize     = 1000
+)
+
+// Query parameters that page and sort a report rather than filter it
+var pagingParams = []string{"limit", "offset", "cursor", "sort"}
+
+// One sort key of ?sort=, "-" in front sorts descending
+type sortKey struct {
+	Field string
+	Desc  bool
+	index []int
+}
+
+func (k sortKey) String() string {
+	if k.Desc {
+		return "-" + k.Field
+	}
+	return k.Field
+}
+
+// How to page and sort a report. Paged is false for exports that didn't
+// ask for a page, they get every row. Without sort keys the rows keep the
+// order of the report's query.
+type reportPaging struct {
+	Limit  int
+	Offset int
+	Sort   []sortKey
+	Paged  bool
+}
+
+// A page of a report with what it was cut from. Filters are the query
+// parameters that narrowed the rows, after any scoping of the caller's
+// departments. NextCursor is null on the last page, Comparison is set on
+// compared reports.
+type ReportPage[T any] struct {
+	Rows       []T                 `json:"rows"`
+	Total      int                 `json:"total"`
+	Limit      int                 `json:"limit"`
+	Offset     int                 `json:"offset"`
+	Sort       []string            `json:"sort"`
+	Filters    map[string][]string `json:"filters"`
+	NextCursor *string             `json:"next_cursor"`
+	Comparison *ComparisonWindow   `json:"comparison,omitempty"`
+}
+
+// The opaque ?cursor= value: the offset of the next page and a
+// fingerprint of the filters and sort it belongs to
+type reportCursor struct {
+	Offset      int    `json:"o"`
+	Fingerprint string `json:"f"`
+}
+
+// Fingerprint of the request's filters and sort, so a cursor can't be
+// replayed against a different query
+func queryFingerprint(r *http.Request) string {
+	queryParams := url.Values{}
+	for key, values := range r.URL.Query() {
+		if key == "format" || (key != "sort" && slices.Contains(pagingParams, key)) {
+			continue
+		}
+		queryParams[key] = values
+	}
+	sum := sha256.Sum256([]byte(queryParams.Encode()))
+	return hex.EncodeToString(sum[:8])
+}
+
+func encodeCursor(r *http.Request, offset int) string {
+	data, _ := json.Marshal(reportCursor{Offset: offset, Fingerprint: queryFingerprint(r)})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(r *http.Request, raw string) (int, error) {
+	var cursor reportCursor
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil || cursor.Offset < 0 {
+		return 0, errors.New("Invalid cursor")
+	}
+	if cursor.Fingerprint != queryFingerprint(r) {
+		return 0, errors.New("Cursor does not match these filters and sort, start again without it")
+	}
+	return cursor.Offset, nil
+}
+
+// Whether a report field can be sorted on: scalars, times and pointers to
+// them. Lists (departments, roles) can't.
+func sortable(t reflect.Type) bool {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeFor[time.Time]() {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// Sortable JSON fields of a report row type, its sort whitelist
+func sortFields(t reflect.Type) map[string][]int {
+	fields := map[string][]int{}
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() || field.Anonymous || !sortable(field.Type) {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field.Index
+	}
+	return fields
+}
+
+// Parses limit, offset / cursor and sort for a report with rows of type t.
+// JSON responses are always paged, exports only when they ask.
+func parseReportPaging(r *http.Request, t reflect.Type, alwaysPaged bool) (reportPaging, error) {
+	queryParams := r.URL.Query()
+	paging := reportPaging{Limit: defaultReportPageSize, Paged: alwaysPaged}
+
+	if raw := queryParams.Get("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > maxReportPageSize {
+			return paging, fmt.Errorf("limit must be between 1 and %d", maxReportPageSize)
+		}
+		paging.Limit = v
+		paging.Paged = true
+	}
+	rawOffset, rawCursor := queryParams.Get("offset"), queryParams.Get("cursor")
+	switch {
+	case rawOffset != "" && rawCursor != "":
+		return paging, errors.New("Use either offset or cursor, not both")
+	case rawOffset != "":
+		v, err := strconv.Atoi(rawOffset)
+		if err != nil || v < 0 {
+			return paging, errors.New("offset must be a non-negative integer")
+		}
+		paging.Offset = v
+		paging.Paged = true
+	case rawCursor != "":
+		v, err := decodeCursor(r, rawCursor)
+		if err != nil {
+			return paging, err
+		}
+		paging.Offset = v
+		paging.Paged = true
+	}
+
+	fields := sortFields(t)
+	for _, raw := range queryValues(queryParams, "sort") {
+		for _, part := range strings.Split(raw, ",") {
+			part = strings.TrimSpace(part)
+			key := sortKey{Field: strings.TrimPrefix(part, "-"), Desc: strings.HasPrefix(part, "-")}
+			index, ok := fields[key.Field]
+			if !ok {
+				allowed := slices.Sorted(maps.Keys(fields))
+				return paging, fmt.Errorf("Cannot sort by %q, use one of %s", key.Field, strings.Join(allowed, ", "))
+			}
+			key.index = index
+			paging.Sort = append(paging.Sort, key)
+		}
+	}
+	return paging, nil
+}
+
+// Paging of a report request with rows of type T, for handlers that pass
+// it down to the store before writing the report
+func requestPaging[T any](r *http.Request) (reportPaging, error) {
+	format, err := reportFormat(r)
+	if err != nil {
+		return reportPaging{}, err
+	}
+	return parseReportPaging(r, reflect.TypeFor[T](), format == formatJSON)
+}
+
+// Adds the requested sort to a report query ahead of the report's own
+// order. Sort fields are JSON names, the query selects the columns it can
+// sort by (columns) under those names. False, and nothing added, when a
+// sort field isn't one of them.
+func sortQuery(qb *querybuilder.Builder, paging reportPaging, columns []string) bool {
+	for _, key := range paging.Sort {
+		if !slices.Contains(columns, key.Field) {
+			return false
+		}
+	}
+	for _, key := range paging.Sort {
+		if key.Desc {
+			qb.OrderBy(pq.QuoteIdentifier(key.Field) + " DESC")
+		} else {
+			qb.OrderBy(pq.QuoteIdentifier(key.Field))
+		}
+	}
+	return true
+}
+
+// Compares two sortable field values. Nil pointers sort after everything,
+// like NULLs in an ascending Postgres sort.
+func compareField(a, b reflect.Value) int {
+	for a.Kind() == reflect.Pointer {
+		switch {
+		case a.IsNil() && b.IsNil():
+			return 0
+		case a.IsNil():
+			return 1
+		case b.IsNil():
+			return -1
+		}
+		a, b = a.Elem(), b.Elem()
+	}
+	if t, ok := a.Interface().(time.Time); ok {
+		return t.Compare(b.Interface().(time.Time))
+	}
+	switch a.Kind() {
+	case reflect.String:
+		return cmp.Compare(strings.ToLower(a.String()), strings.ToLower(b.String()))
+	case reflect.Bool:
+		return cmp.Compare(boolRank(a.Bool()), boolRank(b.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp.Compare(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cmp.Compare(a.Uint(), b.Uint())
+	default:
+		return cmp.Compare(a.Float(), b.Float())
+	}
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Sorts rows by the requested keys. The sort is stable, ties keep the
+// order of the report's query.
+func sortRows[T any](paging reportPaging, rows []T) {
+	if len(paging.Sort) == 0 {
+		return
+	}
+	slices.SortStableFunc(rows, func(a, b T) int {
+		va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+		for _, key := range paging.Sort {
+			c := compareField(va.FieldByIndex(key.index), vb.FieldByIndex(key.index))
+			if key.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+}
+
+// Cuts the requested page out of the sorted rows of a whole report
+func cutPage[T any](paging reportPaging, rows []T) []T {
+	if !paging.Paged {
+		return rows
+	}
+	start := min(paging.Offset, len(rows))
+	end := min(start+paging.Limit, len(rows))
+	return rows[start:end:end]
+}
+
+// Sorts the rows of a whole report by the requested keys and cuts the
+// requested page
+func pageReport[T any](r *http.Request, paging reportPaging, rows []T) ReportPage[T] {
+	sortRows(paging, rows)
+	return newReportPage(r, paging, cutPage(paging, rows), len(rows))
+}
+
+// The envelope of a page of rows, total counts the rows of the whole report
+func newReportPage[T any](r *http.Request, paging reportPaging, rows []T, total int) ReportPage[T] {
+	page := ReportPage[T]{
+		Rows:    rows,
+		Total:   total,
+		Limit:   paging.Limit,
+		Offset:  paging.Offset,
+		Sort:    []string{},
+		Filters: reportFilters(r),
+	}
+	for _, key := range paging.Sort {
+		page.Sort = append(page.Sort, key.String())
+	}
+	if !paging.Paged {
+		page.Limit, page.Offset = len(rows), 0
+	}
+	if page.Rows == nil {
+		page.Rows = []T{}
+	}
+	if end := page.Offset + len(page.Rows); end < total {
+		cursor := encodeCursor(r, end)
+		page.NextCursor = &cursor
+	}
+	return page
+}
+
+// The filtering query parameters of a report request
+func reportFilters(r *http.Request) map[string][]string {
+	queryParams := r.URL.Query()
+	filters := map[string][]string{}
+	for key := range queryParams {
+		if key == "format" || slices.Contains(pagingParams, key) {
+			continue
+		}
+		if values := queryValues(queryParams, key); len(values) > 0 {
+			filters[key] = values
+		}
+	}
+	return filters
+}
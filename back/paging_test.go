@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"backend/querybuilder"
+)
+
+func TestSortQuery(t *testing.T) {
+	columns := []string{"staff_name", "department_name", "total_hours_worked"}
+	tests := []struct {
+		name  string
+		query string
+		ok    bool
+		sql   string
+	}{
+		{"no sort", "", true, "SELECT 1\nORDER BY staff_name"},
+		{"sorted", "sort=-total_hours_worked,department_name", true, "SELECT 1\nORDER BY \"total_hours_worked\" DESC, \"department_name\", staff_name"},
+		{"field the query can't sort by", "sort=staff_name,role_name", false, "SELECT 1\nORDER BY staff_name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paging, err := parseReportPaging(httptest.NewRequest(http.MethodGet, "/report?"+tt.query, nil), reflect.TypeFor[HoursWorkedReport](), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			qb := querybuilder.New("SELECT 1")
+			if ok := sortQuery(qb, paging, columns); ok != tt.ok {
+				t.Errorf("sortQuery = %v, want %v", ok, tt.ok)
+			}
+			qb.OrderBy("staff_name")
+			if sql, _ := qb.Build(); sql != tt.sql {
+				t.Errorf("sql =\n%s\nwant\n%s", sql, tt.sql)
+			}
+		})
+	}
+}
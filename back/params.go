@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Returns every non-empty value of a (possibly repeated) query parameter,
+// the frontend sends empty strings for unset selects.
+func queryValues(queryParams url.Values, key string) []string {
+	var values []string
+	for _, v := range queryParams[key] {
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Parses an optional float parameter, nil when it wasn't sent
+func optionalFloat(queryParams url.Values, key string) (*float64, error) {
+	raw := queryParams.Get(key)
+	if raw == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Parses an optional int parameter, nil when it wasn't sent
+func optionalInt(queryParams url.Values, key string) (*int, error) {
+	raw := queryParams.Get(key)
+	if raw == "" {
+		return nil, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Layout of the date parameters sent by the frontend
+const dateLayout = "2006-01-02"
+
+// Parses the start_date / end_date pair every report requires
+func requiredDateRange(queryParams url.Values) (time.Time, time.Time, error) {
+	startDate := queryParams.Get("start_date")
+	endDate := queryParams.Get("end_date")
+	if startDate == "" || endDate == "" {
+		return time.Time{}, time.Time{}, errors.New("Start date and end date are required")
+	}
+	start, err := time.Parse(dateLayout, startDate)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("Invalid start date")
+	}
+	end, err := time.Parse(dateLayout, endDate)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("Invalid end date")
+	}
+	return start, end, nil
+}
+
+// Parses an optional date parameter, nil when it wasn't sent
+func optionalDate(queryParams url.Values, key string) (*time.Time, error) {
+	raw := queryParams.Get(key)
+	if raw == "" {
+		return nil, nil
+	}
+	v, err := time.Parse(dateLayout, raw)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Default and largest page sizes for paginated endpoints
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// Parses the limit / offset pair of a paginated endpoint
+func parsePage(queryParams url.Values) (int, int, error) {
+	limit, offset := defaultPageSize, 0
+	if raw := queryParams.Get("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > maxPageSize {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		limit = v
+	}
+	if raw := queryParams.Get("offset"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+		offset = v
+	}
+	return limit, offset, nil
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/querybuilder"
+)
+
+// Hourly rate of a role
+type RolePayRate struct {
+	RoleID     int     `json:"role_id"`
+	RoleName   string  `json:"role_name"`
+	HourlyRate float64 `json:"hourly_rate"`
+}
+
+// Hourly rate of a staff member, replaces the rate of their role
+type StaffPayRate struct {
+	StaffID    int     `json:"staff_id"`
+	StaffName  string  `json:"staff_name"`
+	RoleName   string  `json:"role_name"`
+	HourlyRate float64 `json:"hourly_rate"`
+}
+
+// Multipliers of the hourly rate. Overtime applies to overtime hours, the
+// others to every hour of a shift crossing midnight, on a weekend or on a
+// holiday; a shift matching several gets the largest, they don't stack.
+type PayMultipliers struct {
+	Overtime float64 `json:"overtime"`
+	Night    float64 `json:"night"`
+	Weekend  float64 `json:"weekend"`
+	Holiday  float64 `json:"holiday"`
+}
+
+func (m PayMultipliers) Validate() error {
+	if m.Overtime < 1 || m.Night < 1 || m.Weekend < 1 || m.Holiday < 1 {
+		return errors.New("overtime, night, weekend and holiday multipliers must be at least 1")
+	}
+	return nil
+}
+
+// Every pay rule the overtime cost report prices hours with
+type PayRules struct {
+	RoleRates   []RolePayRate  `json:"role_rates"`
+	StaffRates  []StaffPayRate `json:"staff_rates"`
+	Multipliers PayMultipliers `json:"multipliers"`
+}
+
+// Payload to set a role or staff member's hourly rate
+type PayRateInput struct {
+	HourlyRate *float64 `json:"hourly_rate"`
+}
+
+func (in PayRateInput) Validate() error {
+	if in.HourlyRate == nil || *in.HourlyRate < 0 {
+		return errors.New("hourly_rate is required and can't be negative")
+	}
+	return nil
+}
+
+// A row of holidays
+type Holiday struct {
+	ID   int       `json:"id"`
+	Date time.Time `json:"date"`
+	Name string    `json:"name"`
+}
+
+// Payload to name a date as a holiday, a date that already is one is
+// renamed
+type HolidayInput struct {
+	Date string `json:"date"`
+	Name string `json:"name"`
+}
+
+// Trims the name and parses the date
+func (in *HolidayInput) Validate() (time.Time, error) {
+	in.Name = strings.TrimSpace(in.Name)
+	date, err := time.Parse(dateLayout, in.Date)
+	if err != nil {
+		return date, errors.New("date must be a YYYY-MM-DD date")
+	}
+	if in.Name == "" {
+		return date, errors.New("name is required")
+	}
+	return date, nil
+}
+
+// Staffing budget of a department for a month, e.g. 2024-03
+type DepartmentBudget struct {
+	ID             int     `json:"id"`
+	DepartmentID   int     `json:"department_id"`
+	DepartmentName string  `json:"department_name"`
+	Month          string  `json:"month"`
+	Amount         float64 `json:"amount"`
+}
+
+// Payload to set the budget of a department / month
+type DepartmentBudgetInput struct {
+	DepartmentID int      `json:"department_id"`
+	Month        string   `json:"month"`
+	Amount       *float64 `json:"amount"`
+}
+
+// Checks the input and returns the first day of its month
+func (in DepartmentBudgetInput) Validate() (time.Time, error) {
+	month, err := time.Parse("2006-01", in.Month)
+	if err != nil {
+		return month, errors.New("month must look like YYYY-MM")
+	}
+	if in.DepartmentID <= 0 {
+		return month, errors.New("department_id is required")
+	}
+	if in.Amount == nil || *in.Amount < 0 {
+		return month, errors.New("amount is required and can't be negative")
+	}
+	return month, nil
+}
+
+var ErrUnknownDepartment = errors.New("department_id does not match any department")
+
+// PayRuleStore manages rates, multipliers, holidays and budgets
+type PayRuleStore interface {
+	PayRules(ctx context.Context) (PayRules, error)
+	SetRolePayRate(ctx context.Context, roleID int, rate float64) (RolePayRate, error)
+	SetStaffPayRate(ctx context.Context, staffID int, rate float64) (StaffPayRate, error)
+	DeleteStaffPayRate(ctx context.Context, staffID int) error
+	SetPayMultipliers(ctx context.Context, multipliers PayMultipliers) (PayMultipliers, error)
+	ListHolidays(ctx context.Context, year *int) ([]Holiday, error)
+	SetHoliday(ctx context.Context, date time.Time, name string) (Holiday, error)
+	DeleteHoliday(ctx context.Context, id int) error
+	ListBudgets(ctx context.Context, departments []string) ([]DepartmentBudget, error)
+	SetBudget(ctx context.Context, departmentID int, month time.Time, amount float64) (DepartmentBudget, error)
+}
+
+type PostgresPayRuleStore struct {
+	db *sql.DB
+}
+
+func NewPostgresPayRuleStore(db *sql.DB) *PostgresPayRuleStore {
+	return &PostgresPayRuleStore{db: db}
+}
+
+const rolePayRateSelect = `
+        SELECT r.id, r.name, rpr.hourly_rate
+        FROM role_pay_rates rpr
+        JOIN roles r ON rpr.role_id = r.id
+    `
+
+const staffPayRateSelect = `
+        SELECT s.id, s.name, r.name, spr.hourly_rate
+        FROM staff_pay_rates spr
+        JOIN staff s ON spr.staff_id = s.id
+        JOIN roles r ON s.role_id = r.id
+    `
+
+const payMultipliersSelect = "SELECT overtime, night, weekend, holiday FROM pay_multipliers"
+
+const holidaySelect = "SELECT id, date, name FROM holidays"
+
+const departmentBudgetSelect = `
+        SELECT b.id, d.id, d.name, to_char(b.month, 'YYYY-MM'), b.amount
+        FROM department_budgets b
+        JOIN departments d ON b.department_id = d.id
+    `
+
+func scanRolePayRate(row rowScanner) (RolePayRate, error) {
+	var rate RolePayRate
+	err := row.Scan(&rate.RoleID, &rate.RoleName, &rate.HourlyRate)
+	return rate, err
+}
+
+func scanStaffPayRate(row rowScanner) (StaffPayRate, error) {
+	var rate StaffPayRate
+	err := row.Scan(&rate.StaffID, &rate.StaffName, &rate.RoleName, &rate.HourlyRate)
+	return rate, err
+}
+
+func scanPayMultipliers(row rowScanner) (PayMultipliers, error) {
+	var m PayMultipliers
+	err := row.Scan(&m.Overtime, &m.Night, &m.Weekend, &m.Holiday)
+	return m, err
+}
+
+func scanHoliday(row rowScanner) (Holiday, error) {
+	var h Holiday
+	err := row.Scan(&h.ID, &h.Date, &h.Name)
+	return h, err
+}
+
+func scanDepartmentBudget(row rowScanner) (DepartmentBudget, error) {
+	var b DepartmentBudget
+	err := row.Scan(&b.ID, &b.DepartmentID, &b.DepartmentName, &b.Month, &b.Amount)
+	return b, err
+}
+
+// Runs a listing query, scanning every row with scan
+func listRows[T any](ctx context.Context, q queryer, query string, values []interface{}, scan func(rowScanner) (T, error)) ([]T, error) {
+	rows, err := q.QueryContext(ctx, query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []T{}
+	for rows.Next() {
+		v, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, rows.Err()
+}
+
+// Scans the row an upsert is about to replace, nil when there is none
+func existingRow[T any](row rowScanner, scan func(rowScanner) (T, error)) (*T, error) {
+	v, err := scan(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (s *PostgresPayRuleStore) PayRules(ctx context.Context) (PayRules, error) {
+	var rules PayRules
+	var err error
+	if rules.RoleRates, err = listRows(ctx, s.db, rolePayRateSelect+" ORDER BY r.name", nil, scanRolePayRate); err != nil {
+		return rules, err
+	}
+	if rules.StaffRates, err = listRows(ctx, s.db, staffPayRateSelect+" ORDER BY s.name", nil, scanStaffPayRate); err != nil {
+		return rules, err
+	}
+	rules.Multipliers, err = scanPayMultipliers(s.db.QueryRowContext(ctx, payMultipliersSelect))
+	return rules, err
+}
+
+func (s *PostgresPayRuleStore) SetRolePayRate(ctx context.Context, roleID int, rate float64) (RolePayRate, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return RolePayRate{}, err
+	}
+	defer tx.Rollback()
+
+	before, err := existingRow(tx.QueryRowContext(ctx, rolePayRateSelect+" WHERE rpr.role_id = $1 FOR UPDATE OF rpr", roleID), scanRolePayRate)
+	if err != nil {
+		return RolePayRate{}, err
+	}
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO role_pay_rates (role_id, hourly_rate) VALUES ($1, $2)
+        ON CONFLICT (role_id) DO UPDATE SET hourly_rate = EXCLUDED.hourly_rate
+    `, roleID, rate)
+	if _, ok := pqViolation(err, "23503"); ok {
+		return RolePayRate{}, ErrNotFound
+	}
+	if err != nil {
+		return RolePayRate{}, err
+	}
+	after, err := scanRolePayRate(tx.QueryRowContext(ctx, rolePayRateSelect+" WHERE rpr.role_id = $1", roleID))
+	if err != nil {
+		return after, err
+	}
+	if err := recordUpsert(ctx, tx, EntityRolePayRate, roleID, before, after); err != nil {
+		return after, err
+	}
+	return after, tx.Commit()
+}
+
+func (s *PostgresPayRuleStore) SetStaffPayRate(ctx context.Context, staffID int, rate float64) (StaffPayRate, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return StaffPayRate{}, err
+	}
+	defer tx.Rollback()
+
+	before, err := existingRow(tx.QueryRowContext(ctx, staffPayRateSelect+" WHERE spr.staff_id = $1 FOR UPDATE OF spr", staffID), scanStaffPayRate)
+	if err != nil {
+		return StaffPayRate{}, err
+	}
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO staff_pay_rates (staff_id, hourly_rate) VALUES ($1, $2)
+        ON CONFLICT (staff_id) DO UPDATE SET hourly_rate = EXCLUDED.hourly_rate
+    `, staffID, rate)
+	if _, ok := pqViolation(err, "23503"); ok {
+		return StaffPayRate{}, ErrNotFound
+	}
+	if err != nil {
+		return StaffPayRate{}, err
+	}
+	after, err := scanStaffPayRate(tx.QueryRowContext(ctx, staffPayRateSelect+" WHERE spr.staff_id = $1", staffID))
+	if err != nil {
+		return after, err
+	}
+	if err := recordUpsert(ctx, tx, EntityStaffPayRate, staffID, before, after); err != nil {
+		return after, err
+	}
+	return after, tx.Commit()
+}
+
+// Removes a staff member's own rate, they go back to their role's
+func (s *PostgresPayRuleStore) DeleteStaffPayRate(ctx context.Context, staffID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := scanStaffPayRate(tx.QueryRowContext(ctx, staffPayRateSelect+" WHERE spr.staff_id = $1 FOR UPDATE OF spr", staffID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM staff_pay_rates WHERE staff_id = $1", staffID); err != nil {
+		return err
+	}
+	if err := recordAudit(ctx, tx, AuditDelete, EntityStaffPayRate, staffID, before, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Replaces the multipliers, pay_multipliers only ever has the row with id 1
+func (s *PostgresPayRuleStore) SetPayMultipliers(ctx context.Context, multipliers PayMultipliers) (PayMultipliers, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return PayMultipliers{}, err
+	}
+	defer tx.Rollback()
+
+	before, err := scanPayMultipliers(tx.QueryRowContext(ctx, payMultipliersSelect+" FOR UPDATE"))
+	if err != nil {
+		return PayMultipliers{}, err
+	}
+	after, err := scanPayMultipliers(tx.QueryRowContext(ctx, `
+        UPDATE pay_multipliers SET overtime = $1, night = $2, weekend = $3, holiday = $4
+        WHERE id = 1
+        RETURNING overtime, night, weekend, holiday
+    `, multipliers.Overtime, multipliers.Night, multipliers.Weekend, multipliers.Holiday))
+	if err != nil {
+		return after, err
+	}
+	if err := recordAudit(ctx, tx, AuditUpdate, EntityPayMultipliers, 1, before, after); err != nil {
+		return after, err
+	}
+	return after, tx.Commit()
+}
+
+func (s *PostgresPayRuleStore) ListHolidays(ctx context.Context, year *int) ([]Holiday, error) {
+	qb := querybuilder.New(holidaySelect)
+	if year != nil {
+		qb.Where(querybuilder.Expr("EXTRACT(YEAR FROM date) = %s", *year))
+	}
+	qb.OrderBy("date")
+	query, values := qb.Build()
+	return listRows(ctx, s.db, query, values, scanHoliday)
+}
+
+// Names a date as a holiday, renaming it when it already is one
+func (s *PostgresPayRuleStore) SetHoliday(ctx context.Context, date time.Time, name string) (Holiday, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Holiday{}, err
+	}
+	defer tx.Rollback()
+
+	before, err := existingRow(tx.QueryRowContext(ctx, holidaySelect+" WHERE date = $1 FOR UPDATE", date), scanHoliday)
+	if err != nil {
+		return Holiday{}, err
+	}
+	after, err := scanHoliday(tx.QueryRowContext(ctx, `
+        INSERT INTO holidays (date, name) VALUES ($1, $2)
+        ON CONFLICT (date) DO UPDATE SET name = EXCLUDED.name
+        RETURNING id, date, name
+    `, date, name))
+	if err != nil {
+		return after, err
+	}
+	if err := recordUpsert(ctx, tx, EntityHoliday, after.ID, before, after); err != nil {
+		return after, err
+	}
+	return after, tx.Commit()
+}
+
+func (s *PostgresPayRuleStore) DeleteHoliday(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := scanHoliday(tx.QueryRowContext(ctx, holidaySelect+" WHERE id = $1 FOR UPDATE", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM holidays WHERE id = $1", id); err != nil {
+		return err
+	}
+	if err := recordAudit(ctx, tx, AuditDelete, EntityHoliday, id, before, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresPayRuleStore) ListBudgets(ctx context.Context, departments []string) ([]DepartmentBudget, error) {
+	qb := querybuilder.New(departmentBudgetSelect)
+	qb.Where(querybuilder.In("d.name", departments))
+	qb.OrderBy("d.name", "b.month")
+	query, values := qb.Build()
+	return listRows(ctx, s.db, query, values, scanDepartmentBudget)
+}
+
+// Inserts the budget or replaces the amount of the existing one
+func (s *PostgresPayRuleStore) SetBudget(ctx context.Context, departmentID int, month time.Time, amount float64) (DepartmentBudget, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return DepartmentBudget{}, err
+	}
+	defer tx.Rollback()
+
+	before, err := existingRow(tx.QueryRowContext(ctx, departmentBudgetSelect+`
+        WHERE b.department_id = $1 AND b.month = $2
+        FOR UPDATE OF b
+    `, departmentID, month), scanDepartmentBudget)
+	if err != nil {
+		return DepartmentBudget{}, err
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO department_budgets (department_id, month, amount) VALUES ($1, $2, $3)
+        ON CONFLICT (department_id, month) DO UPDATE SET amount = EXCLUDED.amount
+        RETURNING id
+    `, departmentID, month, amount).Scan(&id)
+	if _, ok := pqViolation(err, "23503"); ok {
+		return DepartmentBudget{}, ErrUnknownDepartment
+	}
+	if err != nil {
+		return DepartmentBudget{}, err
+	}
+	after, err := scanDepartmentBudget(tx.QueryRowContext(ctx, departmentBudgetSelect+" WHERE b.id = $1", id))
+	if err != nil {
+		return after, err
+	}
+	if err := recordUpsert(ctx, tx, EntityDepartmentBudget, id, before, after); err != nil {
+		return after, err
+	}
+	return after, tx.Commit()
+}
+
+func GetPayRulesHandler(store PayRuleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules, err := store.PayRules(r.Context())
+		if err != nil {
+			log.Printf("Error fetching pay rules: %v", err)
+			http.Error(w, "Failed to fetch pay rules", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, rules)
+	}
+}
+
+// Reads the {id} and the rate of a PUT to a role or staff member's rate
+func payRateRequest(w http.ResponseWriter, r *http.Request, what string) (int, float64, bool) {
+	id, err := urlParamID(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid "+what+" id", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	var input PayRateInput
+	if err := decodeJSON(r, &input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	if err := input.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return id, *input.HourlyRate, true
+}
+
+func SetRolePayRateHandler(store PayRuleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, rate, ok := payRateRequest(w, r, "role")
+		if !ok {
+			return
+		}
+
+		payRate, err := store.SetRolePayRate(r.Context(), id, rate)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Role not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error saving role pay rate: %v", err)
+			http.Error(w, "Failed to save pay rate", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, payRate)
+	}
+}
+
+func SetStaffPayRateHandler(store PayRuleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, rate, ok := payRateRequest(w, r, "staff")
+		if !ok {
+			return
+		}
+
+		payRate, err := store.SetStaffPayRate(r.Context(), id, rate)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Staff member not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error saving staff pay rate: %v", err)
+			http.Error(w, "Failed to save pay rate", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, payRate)
+	}
+}
+
+func DeleteStaffPayRateHandler(store PayRuleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid staff id", http.StatusBadRequest)
+			return
+		}
+
+		err = store.DeleteStaffPayRate(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Staff member has no pay rate of their own", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error deleting staff pay rate: %v", err)
+			http.Error(w, "Failed to delete pay rate", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func SetPayMultipliersHandler(store PayRuleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input PayMultipliers
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := input.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		multipliers, err := store.SetPayMultipliers(r.Context(), input)
+		if err != nil {
+			log.Printf("Error saving pay multipliers: %v", err)
+			http.Error(w, "Failed to save pay multipliers", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, multipliers)
+	}
+}
+
+func ListHolidaysHandler(store PayRuleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		year, err := optionalInt(r.URL.Query(), "year")
+		if err != nil {
+			http.Error(w, "Invalid value for year", http.StatusBadRequest)
+			return
+		}
+
+		holidays, err := store.ListHolidays(r.Context(), year)
+		if err != nil {
+			log.Printf("Error listing holidays: %v", err)
+			http.Error(w, "Failed to fetch holidays", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, holidays)
+	}
+}
+
+func SetHolidayHandler(store PayRuleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input HolidayInput
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		date, err := input.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		holiday, err := store.SetHoliday(r.Context(), date, input.Name)
+		if err != nil {
+			log.Printf("Error saving holiday: %v", err)
+			http.Error(w, "Failed to save holiday", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, holiday)
+	}
+}
+
+func DeleteHolidayHandler(store PayRuleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid holiday id", http.StatusBadRequest)
+			return
+		}
+
+		err = store.DeleteHoliday(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Holiday not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error deleting holiday: %v", err)
+			http.Error(w, "Failed to delete holiday", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ListBudgetsHandler(store PayRuleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		budgets, err := store.ListBudgets(r.Context(), queryValues(r.URL.Query(), "department"))
+		if err != nil {
+			log.Printf("Error listing budgets: %v", err)
+			http.Error(w, "Failed to fetch budgets", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, budgets)
+	}
+}
+
+func SetBudgetHandler(store PayRuleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input DepartmentBudgetInput
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		month, err := input.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		budget, err := store.SetBudget(r.Context(), input.DepartmentID, month, *input.Amount)
+		if errors.Is(err, ErrUnknownDepartment) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			log.Printf("Error saving budget: %v", err)
+			http.Error(w, "Failed to save budget", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, budget)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page layout in points, A4 landscape so wide reports fit
+const (
+	pdfPageWidth    = 842.0
+	pdfPageHeight   = 595.0
+	pdfMargin       = 36.0
+	pdfFontSize     = 8.0
+	pdfRowHeight    = 13.0
+	pdfCellPadding  = 3.0
+	pdfTitleSize    = 16.0
+	pdfFooterHeight = 20.0
+)
+
+// Advance widths of Helvetica for ASCII 32-126, in thousandths of the font
+// size. The standard 14 fonts need no embedding, so their metrics are all
+// the renderer needs to lay out the table.
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// Helvetica-Bold runs about this much wider than the regular weight
+const pdfBoldFactor = 1.1
+
+// Width of s in points at the given size, characters outside ASCII are
+// counted as a digit
+func textWidth(s string, size float64) float64 {
+	total := 0
+	for _, r := range s {
+		if r >= 32 && r <= 126 {
+			total += helveticaWidths[r-32]
+		} else {
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// Cuts s with an ellipsis so it fits in width
+func fitText(s string, width, size float64) string {
+	if textWidth(s, size) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && textWidth(string(runes)+"...", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
+
+// Encodes s as a PDF string literal in WinAnsiEncoding, which matches
+// Latin-1 for the accented letters found in names
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r <= 126:
+			b.WriteRune(r)
+		case r >= 0xA0 && r <= 0xFF:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// Renders a report as a paginated PDF: title, applied filters and
+// generation time on the first page, the table with its header repeated on
+// every page, and the totals row and row count at the end. The layout needs
+// every row to size the columns, so unlike CSV / XLSX it is buffered until
+// Close.
+type pdfWriter struct {
+	w         io.Writer
+	title     string
+	filters   []string
+	generated time.Time
+	columns   []reportColumn
+	labels    []string
+	rows      [][]cell
+}
+
+func newPDFWriter(w io.Writer, title string, filters []string, columns []reportColumn) *pdfWriter {
+	return &pdfWriter{
+		w:         w,
+		title:     title,
+		filters:   filters,
+		generated: time.Now(),
+		columns:   columns,
+	}
+}
+
+func (p *pdfWriter) WriteHeader(labels []string) error {
+	p.labels = labels
+	return nil
+}
+
+func (p *pdfWriter) WriteRow(cells []cell) error {
+	p.rows = append(p.rows, cells)
+	return nil
+}
+
+func (p *pdfWriter) Flush() {}
+
+// Totals row: sums and averages of the columns tagged with total:"sum" or
+// total:"avg", empty for the rest but for a "Total" label in front. An
+// average is weighted by its weight column, each row counts once without.
+func (p *pdfWriter) totals() []cell {
+	totals := make([]cell, len(p.columns))
+	for i, c := range p.columns {
+		if c.Total == "" {
+			continue
+		}
+		weight := -1
+		if c.Total == "avg" {
+			weight = slices.IndexFunc(p.columns, func(w reportColumn) bool { return w.Name == c.Weight })
+		}
+		var sum, weights float64
+		for _, row := range p.rows {
+			v, _ := strconv.ParseFloat(row[i].Text, 64)
+			w := 1.0
+			if weight >= 0 {
+				w, _ = strconv.ParseFloat(row[weight].Text, 64)
+			}
+			sum += v * w
+			weights += w
+		}
+		if c.Total == "avg" {
+			if weights == 0 {
+				weights = 1
+			}
+			sum /= weights
+		}
+		totals[i] = formatNumber(sum)
+	}
+	if totals[0].Text == "" {
+		totals[0] = cell{Text: "Total"}
+	}
+	return totals
+}
+
+// Column widths proportional to their widest content, scaled to the page
+func (p *pdfWriter) columnWidths(rows [][]cell) []float64 {
+	widths := make([]float64, len(p.labels))
+	for i, label := range p.labels {
+		widths[i] = textWidth(label, pdfFontSize)*pdfBoldFactor + 2*pdfCellPadding
+	}
+	for _, row := range rows {
+		for i, c := range row {
+			// A single long value (a list of departments) shouldn't
+			// squeeze every other column
+			w := min(textWidth(c.Text, pdfFontSize)+2*pdfCellPadding, 200)
+			widths[i] = max(widths[i], w)
+		}
+	}
+	total := 0.0
+	for _, w := range widths {
+		total += w
+	}
+	available := pdfPageWidth - 2*pdfMargin
+	if total > available {
+		for i := range widths {
+			widths[i] *= available / total
+		}
+	}
+	return widths
+}
+
+func (p *pdfWriter) Close() error {
+	hasTotals := false
+	for _, c := range p.columns {
+		hasTotals = hasTotals || (c.Total != "" && len(p.rows) > 0)
+	}
+	rows := p.rows
+	if hasTotals {
+		rows = append(rows[:len(rows):len(rows)], p.totals())
+	}
+	widths := p.columnWidths(rows)
+
+	// Lay out the pages, the first one loses room to the title block
+	var pages []*bytes.Buffer
+	var page *bytes.Buffer
+	y := 0.0
+	newPage := func() {
+		page = &bytes.Buffer{}
+		pages = append(pages, page)
+		y = pdfPageHeight - pdfMargin
+		if len(pages) == 1 {
+			y = p.drawTitle(page, y)
+		}
+		y = p.drawRow(page, y, widths, labelCells(p.labels), true, false)
+	}
+	newPage()
+	for i, row := range rows {
+		if y-pdfRowHeight < pdfMargin+pdfFooterHeight {
+			newPage()
+		}
+		isTotal := hasTotals && i == len(rows)-1
+		y = p.drawRow(page, y, widths, row, isTotal, !isTotal && i%2 == 1)
+	}
+	if y-pdfRowHeight < pdfMargin+pdfFooterHeight {
+		newPage()
+	}
+	text(page, pdfMargin, y-pdfRowHeight+4, "F1", pdfFontSize, fmt.Sprintf("%d rows", len(p.rows)))
+
+	for i, page := range pages {
+		footer := fmt.Sprintf("Page %d of %d", i+1, len(pages))
+		text(page, pdfPageWidth-pdfMargin-textWidth(footer, pdfFontSize), pdfMargin, "F1", pdfFontSize, footer)
+		text(page, pdfMargin, pdfMargin, "F1", pdfFontSize, p.title+" - generated "+p.generated.Format("2006-01-02 15:04"))
+	}
+	return p.writeDocument(pages)
+}
+
+// Draws the title, filters and timestamp, returning the next free y
+func (p *pdfWriter) drawTitle(page *bytes.Buffer, y float64) float64 {
+	y -= pdfTitleSize
+	text(page, pdfMargin, y, "F2", pdfTitleSize, p.title)
+	y -= pdfRowHeight + 4
+	text(page, pdfMargin, y, "F1", pdfFontSize+1, "Generated "+p.generated.Format("2006-01-02 15:04 MST"))
+	filters := "No filters applied"
+	if len(p.filters) > 0 {
+		filters = "Filters: " + strings.Join(p.filters, "; ")
+	}
+	y -= pdfRowHeight
+	text(page, pdfMargin, y, "F1", pdfFontSize+1, fitText(filters, pdfPageWidth-2*pdfMargin, pdfFontSize+1))
+	return y - pdfRowHeight
+}
+
+// Draws a table row below y, returning the next free y. Numbers are right
+// aligned, bold rows (header, totals) get a rule underneath.
+func (p *pdfWriter) drawRow(page *bytes.Buffer, y float64, widths []float64, cells []cell, bold, shaded bool) float64 {
+	y -= pdfRowHeight
+	if shaded {
+		fmt.Fprintf(page, "0.94 g %.2f %.2f %.2f %.2f re f 0 g\n", pdfMargin, y, pdfPageWidth-2*pdfMargin, pdfRowHeight)
+	}
+	font, factor := "F1", 1.0
+	if bold {
+		font, factor = "F2", pdfBoldFactor
+		fmt.Fprintf(page, "0.5 w %.2f %.2f m %.2f %.2f l S\n", pdfMargin, y, pdfPageWidth-pdfMargin, y)
+	}
+	x := pdfMargin
+	for i, c := range cells {
+		room := (widths[i] - 2*pdfCellPadding) / factor
+		value := fitText(c.Text, room, pdfFontSize)
+		left := x + pdfCellPadding
+		if c.Numeric {
+			left = x + widths[i] - pdfCellPadding - textWidth(value, pdfFontSize)*factor
+		}
+		text(page, left, y+4, font, pdfFontSize, value)
+		x += widths[i]
+	}
+	return y
+}
+
+func labelCells(labels []string) []cell {
+	cells := make([]cell, len(labels))
+	for i, label := range labels {
+		cells[i] = cell{Text: label}
+	}
+	return cells
+}
+
+// Writes a line of text at x, y (baseline) in a font resource
+func text(page *bytes.Buffer, x, y float64, font string, size float64, s string) {
+	if s == "" {
+		return
+	}
+	fmt.Fprintf(page, "BT /%s %.1f Tf %.2f %.2f Td %s Tj ET\n", font, size, x, y, pdfString(s))
+}
+
+// Writes the objects, cross-reference table and trailer. Objects 1-4 are
+// the catalog, page tree and the two fonts, then a page and its content
+// stream for each page.
+func (p *pdfWriter) writeDocument(pages []*bytes.Buffer) error {
+	var doc bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, doc.Len())
+		fmt.Fprintf(&doc, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	doc.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %g %g] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := doc.Len()
+	fmt.Fprintf(&doc, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&doc, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&doc, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := p.w.Write(doc.Bytes())
+	return err
+}
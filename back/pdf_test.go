@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestPDFTotals(t *testing.T) {
+	p := newPDFWriter(io.Discard, "attendance report", nil, reportColumns(reflect.TypeFor[AttendanceReportItem]()))
+	rows := []AttendanceReportItem{
+		{StaffName: "Ana", ScheduledShifts: 10, LateArrivals: 1, AvgMinutesLate: 30},
+		{StaffName: "Ben", ScheduledShifts: 10, LateArrivals: 3, AvgMinutesLate: 10},
+		{StaffName: "Cruz", ScheduledShifts: 5},
+	}
+	for _, row := range rows {
+		p.WriteRow(rowCells(reflect.ValueOf(row), p.columns))
+	}
+
+	totals := map[string]string{}
+	for i, c := range p.totals() {
+		totals[p.columns[i].Name] = c.Text
+	}
+	// (1 * 30 + 3 * 10) / 4 late arrivals, not (30 + 10 + 0) / 3 rows
+	want := map[string]string{"staff_id": "Total", "scheduled_shifts": "25", "late_arrivals": "4", "avg_minutes_late": "15"}
+	for name, text := range want {
+		if totals[name] != text {
+			t.Errorf("%s total = %q, want %q", name, totals[name], text)
+		}
+	}
+
+	fairness := newPDFWriter(io.Discard, "on-call fairness report", nil, reportColumns(reflect.TypeFor[OnCallFairnessReportItem]()))
+	fairness.WriteRow(rowCells(reflect.ValueOf(OnCallFairnessReportItem{DepartmentName: "ER", Gini: 0.5}), fairness.columns))
+	for i, c := range fairness.totals() {
+		if name := fairness.columns[i].Name; (name == "gini" || name == "weekend_gini" || name == "night_gini") && c.Text != "" {
+			t.Errorf("%s total = %q, want none", name, c.Text)
+		}
+	}
+}
+
+func TestPDFTotalsWithoutRows(t *testing.T) {
+	p := newPDFWriter(io.Discard, "attendance report", nil, reportColumns(reflect.TypeFor[AttendanceReportItem]()))
+	for i, c := range p.totals() {
+		if p.columns[i].Name == "avg_minutes_late" && c.Text != "0" {
+			t.Errorf("avg_minutes_late total = %q, want 0", c.Text)
+		}
+	}
+}
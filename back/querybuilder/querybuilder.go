@@ -0,0 +1,217 @@
+// Package querybuilder assembles the dynamic report queries sent to
+// PostgreSQL. It owns placeholder numbering, IN-list expansion and the
+// WHERE / GROUP BY / HAVING / ORDER BY layout so every report emits the
+// clauses in a valid order with matching positional arguments.
+package querybuilder
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Args collects the positional arguments of a query and hands out the
+// matching $n placeholder for each one.
+type Args struct {
+	values []interface{}
+}
+
+// Add appends a value and returns its placeholder, e.g. "$3".
+func (a *Args) Add(v interface{}) string {
+	a.values = append(a.values, v)
+	return fmt.Sprintf("$%d", len(a.values))
+}
+
+// Values returns the arguments in placeholder order.
+func (a *Args) Values() []interface{} {
+	return a.values
+}
+
+// Clause renders one condition, registering its arguments on the given Args.
+// A Clause that renders to an empty string is dropped, this is how optional
+// filters (an empty IN list, a Range without bounds) disappear from the query.
+type Clause func(args *Args) string
+
+// Raw is a condition without arguments, e.g. "sl.check_in IS NOT NULL".
+func Raw(condition string) Clause {
+	return func(*Args) string {
+		return condition
+	}
+}
+
+// Expr is a free-form condition, each %s verb in format is replaced by the
+// placeholder of the matching value. Use it for conditions the typed clauses
+// can't express, e.g. overlapping date ranges.
+func Expr(format string, values ...interface{}) Clause {
+	return func(args *Args) string {
+		placeholders := make([]interface{}, len(values))
+		for i, v := range values {
+			placeholders[i] = args.Add(v)
+		}
+		return fmt.Sprintf(format, placeholders...)
+	}
+}
+
+// Eq renders "expr = $n".
+func Eq(expr string, value interface{}) Clause {
+	return func(args *Args) string {
+		return fmt.Sprintf("%s = %s", expr, args.Add(value))
+	}
+}
+
+// In renders "expr IN ($n, $n+1, ...)", an empty list renders nothing.
+func In[T any](expr string, values []T) Clause {
+	return func(args *Args) string {
+		if len(values) == 0 {
+			return ""
+		}
+		placeholders := make([]string, len(values))
+		for i, v := range values {
+			placeholders[i] = args.Add(v)
+		}
+		return fmt.Sprintf("%s IN (%s)", expr, strings.Join(placeholders, ", "))
+	}
+}
+
+// Between renders "expr BETWEEN $n AND $n+1".
+func Between(expr string, low, high interface{}) Clause {
+	return func(args *Args) string {
+		return fmt.Sprintf("%s BETWEEN %s AND %s", expr, args.Add(low), args.Add(high))
+	}
+}
+
+// Range renders "expr >= min", "expr <= max" or both, skipping nil bounds.
+// It is meant for the optional min_* / max_* report parameters.
+func Range[T any](expr string, min, max *T) Clause {
+	return func(args *Args) string {
+		var parts []string
+		if min != nil {
+			parts = append(parts, fmt.Sprintf("%s >= %s", expr, args.Add(*min)))
+		}
+		if max != nil {
+			parts = append(parts, fmt.Sprintf("%s <= %s", expr, args.Add(*max)))
+		}
+		return strings.Join(parts, " AND ")
+	}
+}
+
+// Or joins conditions with OR, dropping the empty ones.
+func Or(clauses ...Clause) Clause {
+	return func(args *Args) string {
+		return strings.Join(render(clauses, args), " OR ")
+	}
+}
+
+// Builder holds a base SELECT ... FROM ... JOIN statement (without WHERE)
+// and the clauses added to it. Clauses are rendered in the order they were
+// added, so the placeholders follow the same order.
+type Builder struct {
+	base     string
+	baseArgs []interface{}
+	where    []Clause
+	groupBy  []string
+	having   []Clause
+	orderBy  []string
+	limit    *int
+	offset   int
+}
+
+// New starts a query from its base statement. The base may use $1..$n for
+// values it needs itself (e.g. in the SELECT list), passed as args, the
+// clauses are numbered after them.
+func New(base string, args ...interface{}) *Builder {
+	return &Builder{base: base, baseArgs: args}
+}
+
+// newArgs seeds the arguments with the ones the base statement uses.
+func (b *Builder) newArgs() *Args {
+	return &Args{values: append([]interface{}(nil), b.baseArgs...)}
+}
+
+// Where ANDs a condition onto the WHERE clause.
+func (b *Builder) Where(c Clause) *Builder {
+	b.where = append(b.where, c)
+	return b
+}
+
+// GroupBy appends grouping expressions.
+func (b *Builder) GroupBy(exprs ...string) *Builder {
+	b.groupBy = append(b.groupBy, exprs...)
+	return b
+}
+
+// Having ANDs a condition onto the HAVING clause. It is always emitted after
+// GROUP BY no matter the order the methods are called in.
+func (b *Builder) Having(c Clause) *Builder {
+	b.having = append(b.having, c)
+	return b
+}
+
+// OrderBy appends ordering expressions, e.g. "total_hours_worked DESC".
+func (b *Builder) OrderBy(exprs ...string) *Builder {
+	b.orderBy = append(b.orderBy, exprs...)
+	return b
+}
+
+// Page restricts the result to limit rows starting at offset.
+func (b *Builder) Page(limit, offset int) *Builder {
+	b.limit = &limit
+	b.offset = offset
+	return b
+}
+
+// Build renders the statement and its positional arguments.
+func (b *Builder) Build() (string, []interface{}) {
+	args := b.newArgs()
+	sql := b.body(args)
+	if len(b.orderBy) > 0 {
+		sql += "\nORDER BY " + strings.Join(b.orderBy, ", ")
+	}
+	if b.limit != nil {
+		sql += fmt.Sprintf("\nLIMIT %s OFFSET %s", args.Add(*b.limit), args.Add(b.offset))
+	}
+	return sql, args.Values()
+}
+
+// Count renders a statement returning the number of rows Build would return
+// without its page, for the totals of paginated responses.
+func (b *Builder) Count() (string, []interface{}) {
+	args := b.newArgs()
+	return "SELECT COUNT(*) FROM (" + b.body(args) + "\n) AS counted", args.Values()
+}
+
+// body renders everything up to (not including) ORDER BY.
+func (b *Builder) body(args *Args) string {
+	var sb strings.Builder
+	sb.WriteString(strings.TrimRight(b.base, " \t\n"))
+
+	if conditions := render(b.where, args); len(conditions) > 0 {
+		sb.WriteString("\nWHERE ")
+		sb.WriteString(strings.Join(conditions, "\n  AND "))
+	}
+	if len(b.groupBy) > 0 {
+		sb.WriteString("\nGROUP BY ")
+		sb.WriteString(strings.Join(b.groupBy, ", "))
+	}
+	if conditions := render(b.having, args); len(conditions) > 0 {
+		sb.WriteString("\nHAVING ")
+		sb.WriteString(strings.Join(conditions, "\n  AND "))
+	}
+	return sb.String()
+}
+
+// render evaluates each clause, dropping the empty ones. Multi-part clauses
+// are parenthesised so they can't bleed into their neighbours.
+func render(clauses []Clause, args *Args) []string {
+	var out []string
+	for _, c := range clauses {
+		s := c(args)
+		if s == "" {
+			continue
+		}
+		if strings.Contains(s, " AND ") || strings.Contains(s, " OR ") {
+			s = "(" + s + ")"
+		}
+		out = append(out, s)
+	}
+	return out
+}
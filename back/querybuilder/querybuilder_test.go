@@ -0,0 +1,167 @@
+package querybuilder
+
+import (
+	"reflect"
+	"testing"
+)
+
+const base = "SELECT s.name FROM staff s"
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestClauses(t *testing.T) {
+	tests := []struct {
+		name   string
+		clause Clause
+		sql    string
+		args   []interface{}
+	}{
+		{"eq", Eq("s.id", 4), "s.id = $1", []interface{}{4}},
+		{"in", In("r.name", []string{"Doctor", "Nurse"}), "r.name IN ($1, $2)", []interface{}{"Doctor", "Nurse"}},
+		{"in empty", In("r.name", []string{}), "", nil},
+		{"in nil", In[string]("r.name", nil), "", nil},
+		{"between", Between("sh.date", "2024-01-01", "2024-01-31"), "sh.date BETWEEN $1 AND $2", []interface{}{"2024-01-01", "2024-01-31"}},
+		{"range both", Range("hours", intPtr(2), intPtr(8)), "hours >= $1 AND hours <= $2", []interface{}{2, 8}},
+		{"range min", Range("hours", intPtr(2), nil), "hours >= $1", []interface{}{2}},
+		{"range max", Range("hours", nil, intPtr(8)), "hours <= $1", []interface{}{8}},
+		{"range none", Range[int]("hours", nil, nil), "", nil},
+		{"or", Or(Eq("a", 1), Raw("b IS NULL")), "a = $1 OR b IS NULL", []interface{}{1}},
+		{"or drops empty", Or(In[int]("a", nil), Eq("b", 2)), "b = $1", []interface{}{2}},
+		{"expr", Expr("sd.start_date <= %s AND sd.end_date >= %s", "2024-01-31", "2024-01-01"), "sd.start_date <= $1 AND sd.end_date >= $2", []interface{}{"2024-01-31", "2024-01-01"}},
+		{"raw", Raw("sl.check_in IS NOT NULL"), "sl.check_in IS NOT NULL", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args Args
+			if sql := tt.clause(&args); sql != tt.sql {
+				t.Errorf("sql = %q, want %q", sql, tt.sql)
+			}
+			if !reflect.DeepEqual(args.Values(), tt.args) {
+				t.Errorf("args = %v, want %v", args.Values(), tt.args)
+			}
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func() *Builder
+		sql   string
+		args  []interface{}
+	}{
+		{
+			name:  "no clauses",
+			build: func() *Builder { return New(base + "\n    ") },
+			sql:   base,
+		},
+		{
+			name: "empty clauses are dropped",
+			build: func() *Builder {
+				return New(base).Where(In[string]("r.name", nil)).Where(Range[int]("s.id", nil, nil))
+			},
+			sql: base,
+		},
+		{
+			name: "where clauses are ANDed and multi-part ones parenthesised",
+			build: func() *Builder {
+				return New(base).
+					Where(Eq("s.active", true)).
+					Where(Between("sh.date", "2024-01-01", "2024-01-31")).
+					Where(Or(Eq("d.name", "ER"), Eq("d.name", "ICU")))
+			},
+			sql:  base + "\nWHERE s.active = $1\n  AND (sh.date BETWEEN $2 AND $3)\n  AND (d.name = $4 OR d.name = $5)",
+			args: []interface{}{true, "2024-01-01", "2024-01-31", "ER", "ICU"},
+		},
+		{
+			name: "placeholders continue after the base arguments",
+			build: func() *Builder {
+				return New("SELECT s.name, $1::date AS day FROM staff s", "2024-01-01").
+					Where(In("r.name", []string{"Doctor", "Nurse"})).
+					Where(Eq("s.id", 7))
+			},
+			sql:  "SELECT s.name, $1::date AS day FROM staff s\nWHERE r.name IN ($2, $3)\n  AND s.id = $4",
+			args: []interface{}{"2024-01-01", "Doctor", "Nurse", 7},
+		},
+		{
+			name: "where and having are numbered in order",
+			build: func() *Builder {
+				return New(base).
+					Where(In("d.name", []string{"ER"})).
+					GroupBy("s.name").
+					Having(Range("COUNT(*)", intPtr(2), intPtr(5)))
+			},
+			sql:  base + "\nWHERE d.name IN ($1)\nGROUP BY s.name\nHAVING (COUNT(*) >= $2 AND COUNT(*) <= $3)",
+			args: []interface{}{"ER", 2, 5},
+		},
+		{
+			// The shift preference handler used to add HAVING before the
+			// GROUP BY, which Postgres rejects
+			name: "group by comes before having whatever the call order",
+			build: func() *Builder {
+				return New(base).
+					Having(Range("COUNT(*)", intPtr(1), nil)).
+					Where(Eq("s.id", 3)).
+					GroupBy("s.name", "s.id").
+					OrderBy("s.name")
+			},
+			sql:  base + "\nWHERE s.id = $1\nGROUP BY s.name, s.id\nHAVING COUNT(*) >= $2\nORDER BY s.name",
+			args: []interface{}{3, 1},
+		},
+		{
+			name: "empty having is dropped",
+			build: func() *Builder {
+				return New(base).GroupBy("s.name").Having(Range[int]("COUNT(*)", nil, nil))
+			},
+			sql: base + "\nGROUP BY s.name",
+		},
+		{
+			name: "page is numbered last",
+			build: func() *Builder {
+				return New(base).Where(Eq("s.id", 3)).OrderBy("s.name DESC", "s.id").Page(50, 100)
+			},
+			sql:  base + "\nWHERE s.id = $1\nORDER BY s.name DESC, s.id\nLIMIT $2 OFFSET $3",
+			args: []interface{}{3, 50, 100},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args := tt.build().Build()
+			if sql != tt.sql {
+				t.Errorf("sql =\n%s\nwant\n%s", sql, tt.sql)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestCount(t *testing.T) {
+	qb := New("SELECT s.name, $1::date FROM staff s", "2024-01-01").
+		Where(In("r.name", []string{"Doctor"})).
+		GroupBy("s.name").
+		Having(Range("COUNT(*)", intPtr(2), nil)).
+		OrderBy("s.name").
+		Page(10, 20)
+
+	sql, args := qb.Count()
+	want := "SELECT COUNT(*) FROM (SELECT s.name, $1::date FROM staff s\nWHERE r.name IN ($2)\nGROUP BY s.name\nHAVING COUNT(*) >= $3\n) AS counted"
+	if sql != want {
+		t.Errorf("sql =\n%s\nwant\n%s", sql, want)
+	}
+	if wantArgs := []interface{}{"2024-01-01", "Doctor", 2}; !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("args = %v, want %v", args, wantArgs)
+	}
+
+	// Count must not disturb the numbering of a later Build
+	sql, args = qb.Build()
+	if want := "SELECT s.name, $1::date FROM staff s\nWHERE r.name IN ($2)\nGROUP BY s.name\nHAVING COUNT(*) >= $3\nORDER BY s.name\nLIMIT $4 OFFSET $5"; sql != want {
+		t.Errorf("sql =\n%s\nwant\n%s", sql, want)
+	}
+	if wantArgs := []interface{}{"2024-01-01", "Doctor", 2, 10, 20}; !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("args = %v, want %v", args, wantArgs)
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A statement sent to the recording driver
+type recordedQuery struct {
+	SQL  string
+	Args []interface{}
+}
+
+// database/sql driver that records the statements it's given, counts
+// return 0 and every other query no rows
+type recordingDriver struct {
+	queries *[]recordedQuery
+}
+
+func (d recordingDriver) Open(name string) (driver.Conn, error) {
+	return recordingConn(d), nil
+}
+
+type recordingConn struct {
+	queries *[]recordedQuery
+}
+
+func (c recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("recording driver: prepared statements aren't supported")
+}
+
+func (c recordingConn) Close() error {
+	return nil
+}
+
+func (c recordingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("recording driver: transactions aren't supported")
+}
+
+// Keeps the arguments as the report passed them
+func (c recordingConn) CheckNamedValue(*driver.NamedValue) error {
+	return nil
+}
+
+func (c recordingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	*c.queries = append(*c.queries, recordedQuery{SQL: query, Args: values})
+	if strings.HasPrefix(query, "SELECT COUNT(*)") {
+		return &countRows{}, nil
+	}
+	return noRows{}, nil
+}
+
+type noRows struct{}
+
+func (noRows) Columns() []string              { return nil }
+func (noRows) Close() error                   { return nil }
+func (noRows) Next(dest []driver.Value) error { return io.EOF }
+
+// A single count of 0
+type countRows struct {
+	done bool
+}
+
+func (*countRows) Columns() []string { return []string{"count"} }
+func (*countRows) Close() error      { return nil }
+
+func (r *countRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(0)
+	return nil
+}
+
+var recordedQueries []recordedQuery
+
+func init() {
+	sql.Register("recording", recordingDriver{queries: &recordedQueries})
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func date(s string) time.Time {
+	t, err := time.Parse(dateLayout, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Collapses whitespace so queries compare by their tokens, not their layout
+func normalizeSQL(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// The page query each ported report sends for a representative set of
+// filters, with its arguments in placeholder order. The count query is the
+// same without its order and page.
+var reportQueryCases = []struct {
+	name    string
+	handler func(ReportStore) http.HandlerFunc
+	target  string
+	sql     string
+	args    []interface{}
+}{
+	{
+		name:    "hours worked",
+		handler: GetHoursWorkedReportHandler,
+		target:  "/reports/work-hours?start_date=2024-01-01&end_date=2024-01-31&role=Doctor&role=Nurse&department=ER&min_hours=10&max_hours=50",
+		sql: `
+        SELECT
+            s.name AS staff_name,
+            r.name AS role_name,
+            d.name AS department_name,
+            SUM(EXTRACT(EPOCH FROM
+                CASE
+                    WHEN sl.check_out >= sl.check_in THEN (sl.check_out - sl.check_in)
+                    ELSE ((sl.check_out + INTERVAL '1 day') - sl.check_in)
+                END
+            )) / 3600 AS total_hours_worked
+
+        FROM
+            shift_logs sl
+        JOIN
+            shift_assignments sa ON sl.assignment_id = sa.id
+        JOIN
+            staff s ON sa.staff_id = s.id
+        JOIN
+            roles r ON s.role_id = r.id
+        JOIN
+            departments d ON sa.department_id = d.id
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+WHERE (sh.date BETWEEN $1 AND $2)
+  AND sl.check_in IS NOT NULL
+  AND sl.check_out IS NOT NULL
+  AND r.name IN ($3, $4)
+  AND d.name IN ($5)
+GROUP BY s.name, r.name, d.name
+HAVING (SUM(EXTRACT(EPOCH FROM
+                CASE
+                    WHEN sl.check_out >= sl.check_in THEN (sl.check_out - sl.check_in)
+                    ELSE ((sl.check_out + INTERVAL '1 day') - sl.check_in)
+                END
+            )) / 3600 >= $6 AND SUM(EXTRACT(EPOCH FROM
+                CASE
+                    WHEN sl.check_out >= sl.check_in THEN (sl.check_out - sl.check_in)
+                    ELSE ((sl.check_out + INTERVAL '1 day') - sl.check_in)
+                END
+            )) / 3600 <= $7)
+ORDER BY total_hours_worked DESC, staff_name, role_name, department_name
+LIMIT $8 OFFSET $9`,
+		args: []interface{}{date("2024-01-01"), date("2024-01-31"), "Doctor", "Nurse", "ER", 10.0, 50.0, 100, 0},
+	},
+	{
+		name:    "overtime",
+		handler: GetOvertimeAnalysisReportHandler,
+		target:  "/reports/overtime?start_date=2024-01-01&end_date=2024-01-31&role=Nurse&department=ER&department=ICU&min_overtime_hours=1",
+		sql: `
+        SELECT
+            s.name AS staff_name,
+            r.name AS role_name,
+            d.name AS department_name,
+            SUM(EXTRACT(EPOCH FROM o.duration)) / 3600 AS total_overtime
+
+        FROM
+            overtimes o
+        JOIN
+            shift_assignments sa ON o.shift_assignment_id = sa.id
+        JOIN
+            staff s ON sa.staff_id = s.id
+        JOIN
+            roles r ON s.role_id = r.id
+        JOIN
+            departments d ON sa.department_id = d.id
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+WHERE (sh.date BETWEEN $1 AND $2)
+  AND r.name IN ($3)
+  AND d.name IN ($4, $5)
+GROUP BY s.name, r.name, d.name
+HAVING SUM(EXTRACT(EPOCH FROM o.duration)) / 3600 >= $6
+ORDER BY total_overtime DESC, staff_name, role_name, department_name
+LIMIT $7 OFFSET $8`,
+		args: []interface{}{date("2024-01-01"), date("2024-01-31"), "Nurse", "ER", "ICU", 1.0, 100, 0},
+	},
+	{
+		name:    "on-call workload",
+		handler: GetStaffWorkloadAnalysisHandler,
+		target:  "/reports/oncall-analysis?start_date=2024-01-01&end_date=2024-01-31&department=ER&min_total_shifts=1&max_on_call_shifts=5&has_assignments=true",
+		sql: `
+        SELECT
+            s.id AS staff_id,
+            s.name AS staff_name,
+            r.name AS role_name,
+            a.departments,
+            COALESCE(a.total_shifts, 0) AS total_shifts_assigned,
+            COALESCE(a.on_call_shifts, 0) AS on_call_shifts_assigned,
+            CASE
+                WHEN a.total_shifts > 0 THEN CAST(a.on_call_shifts AS DECIMAL) / a.total_shifts * 100
+                ELSE 0
+            END AS on_call_percentage
+        FROM
+            staff s
+        JOIN
+            roles r ON s.role_id = r.id
+        LEFT JOIN (
+
+        SELECT
+            sa.staff_id,
+            STRING_AGG(DISTINCT d.name, ', ') AS departments,
+            COUNT(sa.id) AS total_shifts,
+            COUNT(CASE WHEN sa.shift_type = 'on-call' THEN sa.id ELSE NULL END) AS on_call_shifts
+        FROM
+            shift_assignments sa
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            departments d ON sa.department_id = d.id
+WHERE (sh.date BETWEEN $1 AND $2)
+  AND d.name IN ($3)
+GROUP BY sa.staff_id
+        ) a ON a.staff_id = s.id
+WHERE r.on_call_allowed
+  AND (a.staff_id IS NOT NULL OR (s.active AND EXISTS (
+                SELECT 1 FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = s.id
+                  AND sd.start_date <= $4
+                  AND (sd.end_date IS NULL OR sd.end_date >= $5)
+                  AND d.name IN ($6))))
+  AND COALESCE(a.total_shifts, 0) >= $7
+  AND COALESCE(a.on_call_shifts, 0) <= $8
+  AND a.staff_id IS NOT NULL
+ORDER BY on_call_percentage DESC, staff_name, staff_id
+LIMIT $9 OFFSET $10`,
+		args: []interface{}{date("2024-01-01"), date("2024-01-31"), "ER", date("2024-01-31"), date("2024-01-01"), "ER", 1, 5, 100, 0},
+	},
+	{
+		name:    "leave analysis",
+		handler: GetLeaveAnalysisReportHandler,
+		target:  "/reports/leave-analysis?start_date=2024-01-01&end_date=2024-01-31&status=approved&role=Nurse&min_duration=2&max_duration=10",
+		sql: `
+        SELECT
+            lr.id AS leave_request_id,
+            s.name AS staff_name,
+            r.name AS role_name,
+            ARRAY(
+                SELECT DISTINCT d.name
+                FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = lr.staff_id
+                  AND sd.start_date <= COALESCE(lr.end_date, CURRENT_DATE)
+                  AND (sd.end_date IS NULL OR sd.end_date >= lr.start_date)
+                ORDER BY d.name
+            ) AS departments,
+            lr.start_date,
+            lr.end_date,
+            lr.status,
+            GREATEST(w.last - w.first + 1, 0) AS duration_days,
+            (
+                SELECT COUNT(*)
+                FROM generate_series(w.first, w.last, INTERVAL '1 day') AS days(day)
+                WHERE EXTRACT(ISODOW FROM days.day) < 6
+                  AND NOT EXISTS (SELECT 1 FROM holidays h WHERE h.date = days.day::date)
+            ) AS working_days
+        FROM
+            leave_requests lr
+        JOIN
+            staff s ON lr.staff_id = s.id
+        JOIN
+            roles r ON s.role_id = r.id
+        CROSS JOIN LATERAL (
+            SELECT
+                GREATEST(lr.start_date, $1::date) AS first,
+                LEAST(COALESCE(lr.end_date, CURRENT_DATE), $2::date) AS last
+        ) w
+WHERE lr.start_date <= $2
+  AND (lr.end_date IS NULL OR lr.end_date >= $1)
+  AND lr.status IN ($3)
+  AND r.name IN ($4)
+  AND (GREATEST(w.last - w.first + 1, 0) >= $5 AND GREATEST(w.last - w.first + 1, 0) <= $6)
+ORDER BY lr.start_date, lr.id
+LIMIT $7 OFFSET $8`,
+		args: []interface{}{ptr(date("2024-01-01")), ptr(date("2024-01-31")), "approved", "Nurse", 2, 10, 100, 0},
+	},
+	{
+		name:    "staff preference",
+		handler: GetStaffPreferenceAnalysisReportHandler,
+		target:  "/reports/shift-preference?start_date=2024-01-01&end_date=2024-01-31&department=ER&preferred_shift_time=Morning&assigned_shift_time=Morning&assigned_shift_time=Overnight&has_assignments=true",
+		sql: `
+        WITH counted AS (
+
+        SELECT
+            sa.staff_id,
+            sh.shift_time_id,
+            COUNT(*) AS assignments
+        FROM
+            shift_assignments sa
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+        JOIN
+            departments d ON sa.department_id = d.id
+WHERE (sh.date BETWEEN $1 AND $2)
+  AND d.name IN ($3)
+  AND st.name IN ($4, $5)
+GROUP BY sa.staff_id, sh.shift_time_id
+        )
+        SELECT
+            s.id AS staff_id,
+            s.name AS staff_name,
+            r.name AS role_name,
+            (
+                SELECT STRING_AGG(DISTINCT d.name, ', ')
+                FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = s.id
+                  AND sd.start_date <= $2
+                  AND (sd.end_date IS NULL OR sd.end_date >= $1)
+            ) AS departments,
+            COALESCE(t.total, 0) AS total_assignments_count,
+            COALESCE(t.preferred, 0) AS preferred_shift_assignments_count,
+            CASE
+                WHEN t.total > 0 THEN CAST(COALESCE(t.preferred, 0) AS DECIMAL) / t.total
+                ELSE 0
+            END AS preference_fulfillment_rate,
+            ARRAY(SELECT st.name
+                FROM (SELECT DISTINCT shift_time_id FROM staff_shift_preferences WHERE staff_id = s.id) p
+                JOIN shift_times st ON p.shift_time_id = st.id
+                LEFT JOIN counted c ON c.staff_id = s.id AND c.shift_time_id = p.shift_time_id ORDER BY st.start_time) AS preferred_shift_times,
+            ARRAY(SELECT COALESCE(c.assignments, 0)
+                FROM (SELECT DISTINCT shift_time_id FROM staff_shift_preferences WHERE staff_id = s.id) p
+                JOIN shift_times st ON p.shift_time_id = st.id
+                LEFT JOIN counted c ON c.staff_id = s.id AND c.shift_time_id = p.shift_time_id ORDER BY st.start_time) AS preferred_assignments
+        FROM
+            staff s
+        JOIN
+            roles r ON s.role_id = r.id
+        LEFT JOIN LATERAL (
+            SELECT
+                SUM(c.assignments) AS total,
+                SUM(c.assignments) FILTER (WHERE c.shift_time_id IN (
+                    SELECT ssp.shift_time_id FROM staff_shift_preferences ssp WHERE ssp.staff_id = s.id
+                )) AS preferred
+            FROM
+                counted c
+            WHERE
+                c.staff_id = s.id
+        ) t ON TRUE
+WHERE (EXISTS (
+                SELECT 1 FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = s.id
+                  AND sd.start_date <= $2
+                  AND (sd.end_date IS NULL OR sd.end_date >= $1)
+                  AND d.name IN ($6)))
+  AND (EXISTS (
+                SELECT 1 FROM staff_shift_preferences ssp
+                JOIN shift_times st ON ssp.shift_time_id = st.id
+                WHERE ssp.staff_id = s.id
+                  AND st.name IN ($7)))
+  AND t.total > 0
+ORDER BY preference_fulfillment_rate DESC, staff_name, staff_id
+LIMIT $8 OFFSET $9`,
+		args: []interface{}{date("2024-01-01"), date("2024-01-31"), "ER", "Morning", "Overnight", "ER", "Morning", 100, 0},
+	},
+	{
+		name:    "monthly shifts",
+		handler: GetMonthlyShiftsHandler,
+		target:  "/reports/monthly-shifts?start_date=2024-01-01&end_date=2024-06-30&role=Doctor&shift_type=on-call&shift_time=Morning",
+		sql: `
+        SELECT
+            EXTRACT(YEAR FROM sh.date) AS assignment_year,
+            EXTRACT(MONTH FROM sh.date) AS assignment_month,
+            TO_CHAR(sh.date, 'YYYY-MM') AS assignment_month_year,
+            COUNT(sa.id) AS total_shifts
+        FROM
+            shift_assignments sa
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        LEFT JOIN -- Keep LEFT JOINs for potential filtering
+            staff s ON sa.staff_id = s.id
+        LEFT JOIN
+            roles r ON s.role_id = r.id
+        LEFT JOIN
+            departments d ON sa.department_id = d.id
+        LEFT JOIN
+            shift_times st ON sh.shift_time_id = st.id
+WHERE (sh.date BETWEEN $1 AND $2)
+  AND r.name IN ($3)
+  AND sa.shift_type IN ($4)
+  AND st.name IN ($5)
+GROUP BY EXTRACT(YEAR FROM sh.date), EXTRACT(MONTH FROM sh.date), TO_CHAR(sh.date, 'YYYY-MM')
+ORDER BY assignment_year, assignment_month
+LIMIT $6 OFFSET $7`,
+		args: []interface{}{date("2024-01-01"), date("2024-06-30"), "Doctor", "on-call", "Morning", 100, 0},
+	},
+}
+
+func TestReportQueries(t *testing.T) {
+	recordingDB, err := sql.Open("recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recordingDB.Close()
+	store := NewPostgresReportStore(recordingDB)
+
+	for _, tt := range reportQueryCases {
+		t.Run(tt.name, func(t *testing.T) {
+			recordedQueries = nil
+			w := httptest.NewRecorder()
+			tt.handler(store).ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			if len(recordedQueries) != 2 {
+				t.Fatalf("sent %d queries, want the page and the count", len(recordedQueries))
+			}
+			got := recordedQueries[0]
+			if normalizeSQL(got.SQL) != normalizeSQL(tt.sql) {
+				t.Errorf("query:\n%s\nwant:\n%s", got.SQL, tt.sql)
+			}
+			if !reflect.DeepEqual(got.Args, tt.args) {
+				t.Errorf("args = %#v, want %#v", got.Args, tt.args)
+			}
+
+			count := recordedQueries[1]
+			unordered, _, _ := strings.Cut(tt.sql, "\nORDER BY ")
+			if want := "SELECT COUNT(*) FROM (" + unordered + "\n) AS counted"; normalizeSQL(count.SQL) != normalizeSQL(want) {
+				t.Errorf("count query:\n%s\nwant:\n%s", count.SQL, want)
+			}
+			if want := tt.args[:len(tt.args)-2]; !reflect.DeepEqual(count.Args, want) {
+				t.Errorf("count args = %#v, want %#v", count.Args, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Runs a report handler against store and returns the response
+func serveReport(t *testing.T, handler func(ReportStore) http.HandlerFunc, store ReportStore, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(store).ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+// Decodes a ReportPage keeping the rows raw
+func decodePage(t *testing.T, w *httptest.ResponseRecorder) ReportPage[json.RawMessage] {
+	t.Helper()
+	var page ReportPage[json.RawMessage]
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return page
+}
+
+const reportRange = "start_date=2024-01-01&end_date=2024-01-31"
+
+// Every row report with two canned rows, query gets both and filtered
+// only one
+var reportCases = []struct {
+	name     string
+	handler  func(ReportStore) http.HandlerFunc
+	store    MemoryReportStore
+	query    string
+	filtered string
+}{
+	{
+		name:    "hours worked",
+		handler: GetHoursWorkedReportHandler,
+		store: MemoryReportStore{HoursWorkedRows: []HoursWorkedReport{
+			{StaffName: "Ana", RoleName: "Doctor", DepartmentName: "ER", TotalHoursWorked: 40},
+			{StaffName: "Ben", RoleName: "Nurse", DepartmentName: "ER", TotalHoursWorked: 32},
+		}},
+		query:    reportRange,
+		filtered: reportRange + "&role=Nurse",
+	},
+	{
+		name:    "overtime",
+		handler: GetOvertimeAnalysisReportHandler,
+		store: MemoryReportStore{OvertimeRows: []OvertimeReport{
+			{StaffName: "Ana", RoleName: "Doctor", DepartmentName: "ER", TotalOvertime: 4},
+			{StaffName: "Ben", RoleName: "Nurse", DepartmentName: "ICU", TotalOvertime: 2},
+		}},
+		query:    reportRange,
+		filtered: reportRange + "&department=ICU",
+	},
+	{
+		name:    "overtime cost",
+		handler: GetOvertimeCostReportHandler,
+		store: MemoryReportStore{OvertimeCostRows: []OvertimeCostReportItem{
+			{DepartmentName: "ER", Month: "2024-01", TotalCost: 1200},
+			{DepartmentName: "ICU", Month: "2024-01", TotalCost: 800},
+		}},
+		query:    reportRange,
+		filtered: reportRange + "&department=ER",
+	},
+	{
+		name:    "overtime violations",
+		handler: GetOvertimeViolationsReportHandler,
+		store: MemoryReportStore{OvertimeViolationRows: []OvertimeViolation{
+			{OvertimeID: 1, StaffName: "Ana", RoleName: "Doctor", DepartmentName: "ER", Violations: []string{"weekly_cap"}},
+			{OvertimeID: 2, StaffName: "Ben", RoleName: "Nurse", DepartmentName: "ER", Violations: []string{"weekly_cap"}},
+		}},
+		query:    reportRange,
+		filtered: reportRange + "&role=Doctor",
+	},
+	{
+		name:    "staff workload",
+		handler: GetStaffWorkloadAnalysisHandler,
+		store: MemoryReportStore{StaffWorkloadRows: []StaffWorkloadReportItem{
+			{StaffID: 1, StaffName: "Ana", RoleName: "Doctor", Departments: ptr("ER, ICU"), TotalShiftsAssigned: 5},
+			{StaffID: 2, StaffName: "Ben", RoleName: "Doctor", Departments: ptr("ER"), TotalShiftsAssigned: 3},
+		}},
+		query:    reportRange,
+		filtered: reportRange + "&department=ICU",
+	},
+	{
+		name:    "on-call fairness",
+		handler: GetOnCallFairnessReportHandler,
+		store: MemoryReportStore{OnCallFairnessRows: []OnCallFairnessReportItem{
+			{DepartmentName: "ER", EligibleStaff: 4},
+			{DepartmentName: "ICU", EligibleStaff: 3},
+		}},
+		query:    reportRange,
+		filtered: reportRange + "&department=ICU",
+	},
+	{
+		name:    "leave analysis",
+		handler: GetLeaveAnalysisReportHandler,
+		store: MemoryReportStore{LeaveAnalysisRows: []LeaveAnalysisReportItem{
+			{LeaveRequestID: 1, StaffName: "Ana", RoleName: "Doctor", Departments: []string{"ER", "ICU"}, StartDate: date("2024-01-03"), Status: "Approved"},
+			{LeaveRequestID: 2, StaffName: "Ben", RoleName: "Nurse", Departments: []string{"ER"}, StartDate: date("2024-01-10"), Status: "Pending"},
+		}},
+		query:    "",
+		filtered: "department=ICU",
+	},
+	{
+		name:    "shift preference",
+		handler: GetStaffPreferenceAnalysisReportHandler,
+		store: MemoryReportStore{StaffPreferenceRows: []StaffPreferenceReport{
+			{StaffID: 1, StaffName: "Ana", RoleName: "Doctor", Departments: ptr("ER")},
+			{StaffID: 2, StaffName: "Ben", RoleName: "Nurse", Departments: ptr("ER, ICU")},
+		}},
+		query:    reportRange,
+		filtered: reportRange + "&department=ICU",
+	},
+	{
+		name:    "monthly shifts",
+		handler: GetMonthlyShiftsHandler,
+		store: MemoryReportStore{MonthlyShiftsRows: []MonthlyShiftAssignmentItem{
+			{AssignmentYear: 2024, AssignmentMonth: 1, AssignmentMonthYear: "2024-01", TotalShifts: 20},
+			{AssignmentYear: 2024, AssignmentMonth: 2, AssignmentMonthYear: "2024-02", TotalShifts: 18},
+		}},
+		query:    "start_date=2024-01-01&end_date=2024-02-29",
+		filtered: "start_date=2024-02-01&end_date=2024-02-29",
+	},
+	{
+		name:    "attendance",
+		handler: GetAttendanceReportHandler,
+		store: MemoryReportStore{AttendanceRows: []AttendanceReportItem{
+			{StaffID: 1, StaffName: "Ana", RoleName: "Doctor", DepartmentName: "ER"},
+			{StaffID: 2, StaffName: "Ben", RoleName: "Nurse", DepartmentName: "ICU"},
+		}},
+		query:    reportRange,
+		filtered: reportRange + "&department=ER",
+	},
+	{
+		name:    "fatigue",
+		handler: GetFatigueReportHandler,
+		store: MemoryReportStore{FatigueRows: []FatigueReportItem{
+			{AssignmentID: 1, StaffName: "Ana", RoleName: "Doctor", DepartmentName: "ER"},
+			{AssignmentID: 2, StaffName: "Ben", RoleName: "Nurse", DepartmentName: "ICU"},
+		}},
+		query:    reportRange,
+		filtered: reportRange + "&role=Nurse",
+	},
+}
+
+func TestReportHandlers(t *testing.T) {
+	for _, tt := range reportCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveReport(t, tt.handler, &tt.store, "/report?"+tt.query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			if page := decodePage(t, w); page.Total != 2 || len(page.Rows) != 2 {
+				t.Errorf("got %d rows of %d, want 2 of 2", len(page.Rows), page.Total)
+			}
+
+			w = serveReport(t, tt.handler, &tt.store, "/report?"+tt.filtered)
+			if w.Code != http.StatusOK {
+				t.Fatalf("filtered status = %d, want 200: %s", w.Code, w.Body)
+			}
+			page := decodePage(t, w)
+			if page.Total != 1 || len(page.Rows) != 1 {
+				t.Errorf("%s: got %d rows of %d, want 1 of 1", tt.filtered, len(page.Rows), page.Total)
+			}
+
+			failing := tt.store
+			failing.Err = errors.New("connection refused")
+			w = serveReport(t, tt.handler, &failing, "/report?"+tt.query)
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("status with a failing store = %d, want 500", w.Code)
+			}
+		})
+	}
+}
+
+func TestReportHandlerRejectsMissingRange(t *testing.T) {
+	w := serveReport(t, GetHoursWorkedReportHandler, &MemoryReportStore{}, "/report?start_date=2024-01-01")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
+
+func TestCoverageReportHandler(t *testing.T) {
+	store := &MemoryReportStore{CoverageReport: CoverageReport{
+		Gaps: []CoverageGap{
+			{ShiftID: 1, Date: date("2024-01-02"), ShiftTime: "Day", DepartmentName: "ER", Required: 3, Assigned: 2, Shortfall: 1},
+			{ShiftID: 2, Date: date("2024-01-02"), ShiftTime: "Night", DepartmentName: "ER", Required: 2, Assigned: 0, Shortfall: 2},
+			{ShiftID: 2, Date: date("2024-01-02"), ShiftTime: "Night", DepartmentName: "ICU", Required: 1, Assigned: 0, Shortfall: 1},
+			{ShiftID: 3, Date: date("2024-01-03"), ShiftTime: "Day", DepartmentName: "ICU", Required: 2, Assigned: 1, Shortfall: 1},
+		},
+		Heatmap: []CoverageHeatmapCell{
+			{Weekday: "Tuesday", WeekdayNumber: 2, ShiftTime: "Day", UnderstaffedShifts: 1, TotalShortfall: 1, AverageShortfall: 1},
+			{Weekday: "Tuesday", WeekdayNumber: 2, ShiftTime: "Night", UnderstaffedShifts: 2, TotalShortfall: 3, AverageShortfall: 1.5},
+			{Weekday: "Wednesday", WeekdayNumber: 3, ShiftTime: "Day", UnderstaffedShifts: 1, TotalShortfall: 1, AverageShortfall: 1},
+		},
+	}}
+
+	type coveragePage struct {
+		Rows    []CoverageGap         `json:"rows"`
+		Total   int                   `json:"total"`
+		Heatmap []CoverageHeatmapCell `json:"heatmap"`
+	}
+	serveCoverage := func(query string) coveragePage {
+		t.Helper()
+		w := serveReport(t, GetCoverageReportHandler, store, "/report?"+reportRange+query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+		}
+		var page coveragePage
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return page
+	}
+
+	page := serveCoverage("&shift_time=Night")
+	if page.Total != 2 || len(page.Rows) != 2 || page.Rows[0].ShiftID != 2 || page.Rows[1].ShiftID != 2 {
+		t.Errorf("gaps = %+v, want shift 2 only", page.Rows)
+	}
+	if len(page.Heatmap) != 1 || page.Heatmap[0].ShiftTime != "Night" {
+		t.Errorf("heatmap = %+v, want the Night cell only", page.Heatmap)
+	}
+
+	// The heat-map only counts the department's gaps
+	page = serveCoverage("&department=ER")
+	if page.Total != 2 {
+		t.Errorf("gaps = %+v, want ER's 2", page.Rows)
+	}
+	wantHeatmap := []CoverageHeatmapCell{
+		{Weekday: "Tuesday", WeekdayNumber: 2, ShiftTime: "Day", UnderstaffedShifts: 1, TotalShortfall: 1, AverageShortfall: 1},
+		{Weekday: "Tuesday", WeekdayNumber: 2, ShiftTime: "Night", UnderstaffedShifts: 1, TotalShortfall: 2, AverageShortfall: 2},
+	}
+	if !reflect.DeepEqual(page.Heatmap, wantHeatmap) {
+		t.Errorf("heatmap = %+v, want %+v", page.Heatmap, wantHeatmap)
+	}
+
+	store.Err = errors.New("connection refused")
+	if w := serveReport(t, GetCoverageReportHandler, store, "/report?"+reportRange); w.Code != http.StatusInternalServerError {
+		t.Errorf("status with a failing store = %d, want 500", w.Code)
+	}
+}
+
+func TestReportSeries(t *testing.T) {
+	store := &MemoryReportStore{HoursWorkedSeriesRows: []HoursWorkedSeriesPoint{
+		{SeriesPoint: SeriesPoint{StaffName: "Ana", RoleName: "Doctor", DepartmentName: "ER", Period: "2024-W01"}, TotalHoursWorked: 24},
+		{SeriesPoint: SeriesPoint{StaffName: "Ana", RoleName: "Doctor", DepartmentName: "ER", Period: "2024-W02"}, TotalHoursWorked: 16},
+		{SeriesPoint: SeriesPoint{StaffName: "Ben", RoleName: "Nurse", DepartmentName: "ICU", Period: "2024-W01"}, TotalHoursWorked: 36},
+	}}
+
+	w := serveReport(t, GetHoursWorkedReportHandler, store, "/report?"+reportRange+"&granularity=week&department=ER")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var page ReportPage[HoursWorkedSeriesPoint]
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if page.Total != 2 {
+		t.Fatalf("got %d points, want Ana's 2", page.Total)
+	}
+	for _, point := range page.Rows {
+		if point.StaffName != "Ana" {
+			t.Errorf("point of %s passed the department filter", point.StaffName)
+		}
+	}
+
+	store.Err = errors.New("connection refused")
+	if w := serveReport(t, GetHoursWorkedReportHandler, store, "/report?"+reportRange+"&granularity=week"); w.Code != http.StatusInternalServerError {
+		t.Errorf("status with a failing store = %d, want 500", w.Code)
+	}
+}
+
+func TestReportComparison(t *testing.T) {
+	// The memory store doesn't filter hours worked by date, both windows
+	// get the same rows
+	store := &MemoryReportStore{HoursWorkedRows: []HoursWorkedReport{
+		{StaffName: "Ana", RoleName: "Doctor", DepartmentName: "ER", TotalHoursWorked: 40},
+	}}
+
+	w := serveReport(t, GetHoursWorkedReportHandler, store, "/report?"+reportRange+"&compare_to=previous_period")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var page ReportPage[HoursWorkedComparison]
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if page.Comparison == nil || !page.Comparison.EndDate.Equal(date("2023-12-31")) || !page.Comparison.StartDate.Equal(date("2023-12-01")) {
+		t.Errorf("comparison = %+v, want 2023-12-01 to 2023-12-31", page.Comparison)
+	}
+	if len(page.Rows) != 1 || page.Rows[0].Presence != PresenceBoth || page.Rows[0].DeltaHours != 0 {
+		t.Errorf("rows = %+v, want Ana in both windows with no delta", page.Rows)
+	}
+
+	store.Err = errors.New("connection refused")
+	if w := serveReport(t, GetHoursWorkedReportHandler, store, "/report?"+reportRange+"&compare_to=previous_period"); w.Code != http.StatusInternalServerError {
+		t.Errorf("status with a failing store = %d, want 500", w.Code)
+	}
+}
+
+func TestReportStorePaging(t *testing.T) {
+	store := &MemoryReportStore{HoursWorkedRows: []HoursWorkedReport{
+		{StaffName: "Ana", RoleName: "Doctor", DepartmentName: "ER", TotalHoursWorked: 40},
+		{StaffName: "Ben", RoleName: "Nurse", DepartmentName: "ER", TotalHoursWorked: 32},
+		{StaffName: "Cal", RoleName: "Nurse", DepartmentName: "ICU", TotalHoursWorked: 36},
+	}}
+
+	w := serveReport(t, GetHoursWorkedReportHandler, store, "/report?"+reportRange+"&sort=-total_hours_worked&limit=2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var page ReportPage[HoursWorkedReport]
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if page.Total != 3 || len(page.Rows) != 2 || page.Rows[0].StaffName != "Ana" || page.Rows[1].StaffName != "Cal" {
+		t.Fatalf("got %+v of %d, want Ana and Cal of 3", page.Rows, page.Total)
+	}
+	if page.NextCursor == nil {
+		t.Fatal("next_cursor is null before the last page")
+	}
+
+	w = serveReport(t, GetHoursWorkedReportHandler, store, "/report?"+reportRange+"&sort=-total_hours_worked&limit=2&cursor="+*page.NextCursor)
+	page = ReportPage[HoursWorkedReport]{}
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if page.Offset != 2 || len(page.Rows) != 1 || page.Rows[0].StaffName != "Ben" || page.NextCursor != nil {
+		t.Errorf("last page = %+v at %d, want Ben at 2 with no next cursor", page.Rows, page.Offset)
+	}
+
+	w = serveReport(t, GetHoursWorkedReportHandler, store, "/report?"+reportRange+"&sort=staff_name&format=csv")
+	if want := "Staff Name"; w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), want) {
+		t.Fatalf("export = %d %q", w.Code, w.Body)
+	}
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 4 ||
+		!strings.HasPrefix(lines[1], "Ana,") || !strings.HasPrefix(lines[3], "Cal,") {
+		t.Errorf("export lines = %q, want every row by name", lines)
+	}
+}
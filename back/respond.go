@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// Returned by stores when the requested row doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// Encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Decodes a JSON request body, rejecting unknown fields so typos in the
+// payload don't pass silently
+func decodeJSON(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// Reads a numeric id from the route, e.g. {id} in /staff/{id}
+func urlParamID(r *http.Request, key string) (int, error) {
+	return strconv.Atoi(chi.URLParam(r, key))
+}
+
+// Returns the violated constraint when err is a Postgres error with the
+// given SQLSTATE code, e.g. 23505 for unique violations
+func pqViolation(err error, code pq.ErrorCode) (string, bool) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == code {
+		return pqErr.Constraint, true
+	}
+	return "", false
+}
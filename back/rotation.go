@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"backend/scheduler"
+
+	"github.com/lib/pq"
+)
+
+// Rolling window used when the request doesn't set one
+const defaultRotationWindowDays = 28
+
+// Payload of POST /schedules/on-call-rotation
+type RotationRequest struct {
+	StartDate     string `json:"start_date"`
+	EndDate       string `json:"end_date"`
+	DepartmentIDs []int  `json:"department_ids"`
+	// Shift times that carry an on-call, every one when empty
+	ShiftTimeIDs []int    `json:"shift_time_ids"`
+	Headcount    int      `json:"headcount"`
+	WindowDays   *int     `json:"window_days"`
+	MinRestHours *float64 `json:"min_rest_hours"`
+	// Defaults to true, the rotation is only written when explicitly false
+	DryRun *bool `json:"dry_run"`
+}
+
+// Parsed and validated RotationRequest
+type RotationParams struct {
+	StartDate     time.Time
+	EndDate       time.Time
+	DepartmentIDs []int
+	ShiftTimeIDs  []int
+	Headcount     int
+	WindowDays    int
+	MinRest       time.Duration
+	DryRun        bool
+}
+
+func (in RotationRequest) Validate() (RotationParams, error) {
+	params := RotationParams{
+		DepartmentIDs: in.DepartmentIDs,
+		ShiftTimeIDs:  in.ShiftTimeIDs,
+		Headcount:     in.Headcount,
+		WindowDays:    defaultRotationWindowDays,
+		DryRun:        in.DryRun == nil || *in.DryRun,
+	}
+
+	var err error
+	if params.StartDate, params.EndDate, err = scheduleRange(in.StartDate, in.EndDate); err != nil {
+		return params, err
+	}
+	if params.MinRest, err = minRest(in.MinRestHours); err != nil {
+		return params, err
+	}
+	if len(in.DepartmentIDs) == 0 {
+		return params, errors.New("At least one department_id is required")
+	}
+	if params.Headcount == 0 {
+		params.Headcount = 1
+	}
+	if params.Headcount < 0 {
+		return params, errors.New("headcount must be positive")
+	}
+	if in.WindowDays != nil {
+		if *in.WindowDays <= 0 || *in.WindowDays > 365 {
+			return params, errors.New("window_days must be between 1 and 365")
+		}
+		params.WindowDays = *in.WindowDays
+	}
+	return params, nil
+}
+
+// One line of the proposed (or written) rotation with the reason behind
+// it. Load is the staff member's on-call load over the window before the
+// shift, Eligible how many colleagues could have taken it.
+type RotationPick struct {
+	ScheduledAssignment
+	Load     scheduler.OnCallLoad `json:"load"`
+	Eligible int                  `json:"eligible"`
+	Reason   string               `json:"reason"`
+}
+
+type RotationResponse struct {
+	DryRun     bool                  `json:"dry_run"`
+	WindowDays int                   `json:"window_days"`
+	Picks      []RotationPick        `json:"picks"`
+	Shortfalls []scheduler.Shortfall `json:"shortfalls"`
+}
+
+// Loads what Rotate needs: the on-call shifts of the range and the
+// assignments of the window before it as history
+func (s *PostgresScheduleStore) LoadRotationInput(ctx context.Context, params RotationParams) (scheduler.RotationInput, error) {
+	rotation := scheduler.RotationInput{
+		Departments: params.DepartmentIDs,
+		Headcount:   params.Headcount,
+		MinRest:     params.MinRest,
+		Window:      time.Duration(params.WindowDays) * 24 * time.Hour,
+	}
+
+	var known int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM departments WHERE id = ANY($1)", pq.Array(params.DepartmentIDs)).Scan(&known)
+	if err != nil {
+		return rotation, err
+	}
+	if known != len(slices.Compact(slices.Sorted(slices.Values(params.DepartmentIDs)))) {
+		return rotation, ErrUnknownDepartment
+	}
+
+	// A day more than the window, it is measured from each shift's start
+	in, err := s.loadInput(ctx, params.StartDate, params.EndDate, params.StartDate.AddDate(0, 0, -params.WindowDays-1))
+	if err != nil {
+		return rotation, err
+	}
+	for _, shift := range in.Shifts {
+		if len(params.ShiftTimeIDs) == 0 || slices.Contains(params.ShiftTimeIDs, shift.ShiftTimeID) {
+			rotation.Shifts = append(rotation.Shifts, shift)
+		}
+	}
+	rotation.Staff, rotation.Memberships, rotation.Leaves, rotation.Existing = in.Staff, in.Memberships, in.Leaves, in.Existing
+	return rotation, nil
+}
+
+func GenerateRotationHandler(store ScheduleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request RotationRequest
+		if err := decodeJSON(r, &request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		params, err := request.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		input, err := store.LoadRotationInput(r.Context(), params)
+		if errors.Is(err, ErrUnknownDepartment) {
+			http.Error(w, "department_ids has an id that does not match any department", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading rotation input: %v", err)
+			http.Error(w, "Failed to load scheduling data", http.StatusInternalServerError)
+			return
+		}
+
+		result := scheduler.Rotate(input)
+		names := make(map[int]string, len(input.Staff))
+		for _, s := range input.Staff {
+			names[s.ID] = s.Name
+		}
+
+		response := RotationResponse{
+			DryRun:     params.DryRun,
+			WindowDays: params.WindowDays,
+			Picks:      make([]RotationPick, len(result.Picks)),
+			Shortfalls: result.Shortfalls,
+		}
+		if response.Shortfalls == nil {
+			response.Shortfalls = []scheduler.Shortfall{}
+		}
+		assignments := make([]scheduler.Assignment, len(result.Picks))
+		for i, pick := range result.Picks {
+			assignments[i] = pick.Assignment
+			response.Picks[i] = RotationPick{
+				ScheduledAssignment: scheduledAssignment(pick.Assignment, names[pick.Assignment.StaffID]),
+				Load:                pick.Load,
+				Eligible:            pick.Eligible,
+				Reason:              pick.Reason,
+			}
+		}
+
+		if params.DryRun {
+			writeJSON(w, http.StatusOK, response)
+			return
+		}
+
+		// CommitSchedule writes in order, so written lines up with the picks
+		written, err := store.CommitSchedule(r.Context(), assignments)
+		if err != nil {
+			writeCommitScheduleError(w, err)
+			return
+		}
+		for i := range written {
+			written[i].StaffName = names[written[i].StaffID]
+			response.Picks[i].ScheduledAssignment = written[i]
+		}
+		writeJSON(w, http.StatusCreated, response)
+	}
+}
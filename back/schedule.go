@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"backend/scheduler"
+
+	"github.com/lib/pq"
+)
+
+// Rest between shifts used when the request doesn't set one
+const defaultMinRestHours = 11
+
+// Longest range a single generation may cover
+const maxScheduleDays = 92
+
+// Payload of POST /schedules/generate
+type ScheduleRequest struct {
+	StartDate    string             `json:"start_date"`
+	EndDate      string             `json:"end_date"`
+	Targets      []scheduler.Target `json:"targets"`
+	MinRestHours *float64           `json:"min_rest_hours"`
+	// Defaults to true, the roster is only written when explicitly false
+	DryRun *bool `json:"dry_run"`
+}
+
+// Parsed and validated ScheduleRequest
+type ScheduleParams struct {
+	StartDate time.Time
+	EndDate   time.Time
+	Targets   []scheduler.Target
+	MinRest   time.Duration
+	DryRun    bool
+}
+
+func (in ScheduleRequest) Validate() (ScheduleParams, error) {
+	params := ScheduleParams{DryRun: in.DryRun == nil || *in.DryRun}
+
+	var err error
+	if params.StartDate, params.EndDate, err = scheduleRange(in.StartDate, in.EndDate); err != nil {
+		return params, err
+	}
+
+	if len(in.Targets) == 0 {
+		return params, errors.New("At least one coverage target is required")
+	}
+	for i, t := range in.Targets {
+		if t.DepartmentID <= 0 || t.RoleID <= 0 || t.ShiftTimeID < 0 || t.Headcount <= 0 {
+			return params, fmt.Errorf("targets[%d] needs department_id, role_id and a positive headcount", i)
+		}
+		if t.ShiftType == "" {
+			in.Targets[i].ShiftType = scheduler.Regular
+		} else if t.ShiftType != scheduler.Regular && t.ShiftType != scheduler.OnCall {
+			return params, fmt.Errorf("targets[%d].shift_type must be regular or on-call", i)
+		}
+	}
+	params.Targets = in.Targets
+
+	params.MinRest, err = minRest(in.MinRestHours)
+	return params, err
+}
+
+// Parses the range a generation covers
+func scheduleRange(startText, endText string) (time.Time, time.Time, error) {
+	start, err := time.Parse(dateLayout, startText)
+	if err != nil {
+		return start, start, errors.New("start_date must be a YYYY-MM-DD date")
+	}
+	end, err := time.Parse(dateLayout, endText)
+	if err != nil {
+		return start, end, errors.New("end_date must be a YYYY-MM-DD date")
+	}
+	if end.Before(start) {
+		return start, end, errors.New("end_date cannot be before start_date")
+	}
+	if end.Sub(start) > maxScheduleDays*24*time.Hour {
+		return start, end, fmt.Errorf("A schedule can cover at most %d days", maxScheduleDays)
+	}
+	return start, end, nil
+}
+
+// Rest between shifts from min_rest_hours, defaultMinRestHours when unset
+func minRest(hours *float64) (time.Duration, error) {
+	rest := float64(defaultMinRestHours)
+	if hours != nil {
+		if *hours < 0 {
+			return 0, errors.New("min_rest_hours cannot be negative")
+		}
+		rest = *hours
+	}
+	return time.Duration(rest * float64(time.Hour)), nil
+}
+
+// One line of the proposed (or written) roster
+type ScheduledAssignment struct {
+	AssignmentID   *int      `json:"assignment_id"`
+	ShiftID        *int      `json:"shift_id"`
+	Date           time.Time `json:"date"`
+	ShiftTimeID    int       `json:"shift_time_id"`
+	ShiftTime      string    `json:"shift_time"`
+	DepartmentID   int       `json:"department_id"`
+	StaffID        int       `json:"staff_id"`
+	StaffName      string    `json:"staff_name"`
+	ShiftType      string    `json:"shift_type"`
+	PreferredShift bool      `json:"preferred_shift"`
+}
+
+type ScheduleResponse struct {
+	DryRun      bool                  `json:"dry_run"`
+	Assignments []ScheduledAssignment `json:"assignments"`
+	Shortfalls  []scheduler.Shortfall `json:"shortfalls"`
+	Score       scheduler.Score       `json:"score"`
+}
+
+// ScheduleStore loads what the scheduler needs and writes its output
+type ScheduleStore interface {
+	LoadScheduleInput(ctx context.Context, params ScheduleParams) (scheduler.Input, error)
+	LoadRotationInput(ctx context.Context, params RotationParams) (scheduler.RotationInput, error)
+	CommitSchedule(ctx context.Context, assignments []scheduler.Assignment) ([]ScheduledAssignment, error)
+}
+
+type PostgresScheduleStore struct {
+	db *sql.DB
+}
+
+func NewPostgresScheduleStore(db *sql.DB) *PostgresScheduleStore {
+	return &PostgresScheduleStore{db: db}
+}
+
+func (s *PostgresScheduleStore) LoadScheduleInput(ctx context.Context, params ScheduleParams) (scheduler.Input, error) {
+	// Existing assignments from the day before, so the rest rule holds
+	// across the start of the range
+	in, err := s.loadInput(ctx, params.StartDate, params.EndDate, params.StartDate.AddDate(0, 0, -1))
+	in.Targets, in.MinRest = params.Targets, params.MinRest
+	return in, err
+}
+
+// Loads the shifts, staff, memberships and leaves of a range, and the
+// existing assignments from since to the day after the range
+func (s *PostgresScheduleStore) loadInput(ctx context.Context, start, end, since time.Time) (scheduler.Input, error) {
+	var in scheduler.Input
+
+	// Every shift time on every day of the range, with the shifts row id
+	// when it already exists
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT
+            st.id,
+            st.name,
+            st.start_time::text,
+            st.end_time::text,
+            days.day::date,
+            sh.id
+        FROM
+            shift_times st
+        CROSS JOIN
+            generate_series($1::date, $2::date, INTERVAL '1 day') AS days(day)
+        LEFT JOIN
+            shifts sh ON sh.shift_time_id = st.id AND sh.date = days.day::date
+        ORDER BY
+            days.day, st.start_time
+    `, start, end)
+	if err != nil {
+		return in, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var shift scheduler.Shift
+		var startTime, endTime string
+		var id sql.NullInt64
+		if err := rows.Scan(&shift.ShiftTimeID, &shift.ShiftTimeName, &startTime, &endTime, &shift.Date, &id); err != nil {
+			return in, err
+		}
+		shift.ID = int(id.Int64)
+		if shift.Start, shift.End, err = shiftWindow(shift.Date, startTime, endTime); err != nil {
+			return in, err
+		}
+		in.Shifts = append(in.Shifts, shift)
+	}
+	if err := rows.Err(); err != nil {
+		return in, err
+	}
+
+	// Active staff with their role rules and preferred shift times
+	rows, err = s.db.QueryContext(ctx, `
+        SELECT
+            s.id,
+            s.name,
+            r.id,
+            r.on_call_allowed,
+            ARRAY(SELECT ssp.shift_time_id FROM staff_shift_preferences ssp WHERE ssp.staff_id = s.id)
+        FROM
+            staff s
+        JOIN
+            roles r ON s.role_id = r.id
+        WHERE
+            s.active
+    `)
+	if err != nil {
+		return in, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var staff scheduler.Staff
+		var preferences pq.Int64Array
+		if err := rows.Scan(&staff.ID, &staff.Name, &staff.RoleID, &staff.OnCallAllowed, &preferences); err != nil {
+			return in, err
+		}
+		staff.Preferences = make(map[int]float64, len(preferences))
+		for _, shiftTimeID := range preferences {
+			staff.Preferences[int(shiftTimeID)] = 1
+		}
+		in.Staff = append(in.Staff, staff)
+	}
+	if err := rows.Err(); err != nil {
+		return in, err
+	}
+
+	// Department memberships overlapping the range
+	rows, err = s.db.QueryContext(ctx, `
+        SELECT staff_id, department_id, start_date, end_date
+        FROM staff_departments
+        WHERE start_date <= $2 AND (end_date IS NULL OR end_date >= $1)
+    `, start, end)
+	if err != nil {
+		return in, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m scheduler.Membership
+		var end sql.NullTime
+		if err := rows.Scan(&m.StaffID, &m.DepartmentID, &m.Start, &end); err != nil {
+			return in, err
+		}
+		if end.Valid {
+			m.End = &end.Time
+		}
+		in.Memberships = append(in.Memberships, m)
+	}
+	if err := rows.Err(); err != nil {
+		return in, err
+	}
+
+	// Approved leaves overlapping the range
+	rows, err = s.db.QueryContext(ctx, `
+        SELECT staff_id, start_date, end_date
+        FROM leave_requests
+        WHERE status = 'approved' AND start_date <= $2 AND (end_date IS NULL OR end_date >= $1)
+    `, start, end)
+	if err != nil {
+		return in, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var l scheduler.Leave
+		var end sql.NullTime
+		if err := rows.Scan(&l.StaffID, &l.Start, &end); err != nil {
+			return in, err
+		}
+		if end.Valid {
+			l.End = &end.Time
+		}
+		in.Leaves = append(in.Leaves, l)
+	}
+	if err := rows.Err(); err != nil {
+		return in, err
+	}
+
+	// Existing assignments, up to the day after so the rest rule holds
+	// across the end of the range
+	rows, err = s.db.QueryContext(ctx, `
+        SELECT
+            sh.id,
+            st.id,
+            st.name,
+            st.start_time::text,
+            st.end_time::text,
+            sh.date,
+            sa.department_id,
+            sa.staff_id,
+            s.role_id,
+            sa.shift_type
+        FROM
+            shift_assignments sa
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+        JOIN
+            staff s ON sa.staff_id = s.id
+        WHERE
+            sh.date BETWEEN $1 AND $2::date + 1
+    `, since, end)
+	if err != nil {
+		return in, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a scheduler.Assignment
+		var startTime, endTime string
+		err := rows.Scan(
+			&a.Shift.ID,
+			&a.Shift.ShiftTimeID,
+			&a.Shift.ShiftTimeName,
+			&startTime,
+			&endTime,
+			&a.Shift.Date,
+			&a.DepartmentID,
+			&a.StaffID,
+			&a.RoleID,
+			&a.ShiftType,
+		)
+		if err != nil {
+			return in, err
+		}
+		if a.Shift.Start, a.Shift.End, err = shiftWindow(a.Shift.Date, startTime, endTime); err != nil {
+			return in, err
+		}
+		in.Existing = append(in.Existing, a)
+	}
+	return in, rows.Err()
+}
+
+// Writes the roster in one transaction, creating missing shifts rows. The
+// leave and on-call triggers still run on every insert, any violation
+// rolls the whole roster back.
+func (s *PostgresScheduleStore) CommitSchedule(ctx context.Context, assignments []scheduler.Assignment) ([]ScheduledAssignment, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	written := make([]ScheduledAssignment, 0, len(assignments))
+	for _, a := range assignments {
+		shiftID := a.Shift.ID
+		if shiftID == 0 {
+			err := tx.QueryRowContext(ctx, `
+                INSERT INTO shifts (shift_time_id, date)
+                VALUES ($1, $2)
+                ON CONFLICT (shift_time_id, date) DO UPDATE SET date = EXCLUDED.date
+                RETURNING id
+            `, a.Shift.ShiftTimeID, a.Shift.Date).Scan(&shiftID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var assignmentID int
+		err := tx.QueryRowContext(ctx, `
+            INSERT INTO shift_assignments (shift_id, department_id, staff_id, shift_type)
+            VALUES ($1, $2, $3, $4)
+            RETURNING id
+        `, shiftID, a.DepartmentID, a.StaffID, a.ShiftType).Scan(&assignmentID)
+		if err != nil {
+			return nil, err
+		}
+
+		line := scheduledAssignment(a, "")
+		line.ShiftID = &shiftID
+		line.AssignmentID = &assignmentID
+		if err := recordAudit(ctx, tx, AuditCreate, EntityShiftAssignment, assignmentID, nil, line); err != nil {
+			return nil, err
+		}
+		written = append(written, line)
+	}
+	return written, tx.Commit()
+}
+
+func scheduledAssignment(a scheduler.Assignment, staffName string) ScheduledAssignment {
+	line := ScheduledAssignment{
+		Date:           a.Shift.Date,
+		ShiftTimeID:    a.Shift.ShiftTimeID,
+		ShiftTime:      a.Shift.ShiftTimeName,
+		DepartmentID:   a.DepartmentID,
+		StaffID:        a.StaffID,
+		StaffName:      staffName,
+		ShiftType:      a.ShiftType,
+		PreferredShift: a.Preference > 0,
+	}
+	if a.Shift.ID != 0 {
+		line.ShiftID = &a.Shift.ID
+	}
+	return line
+}
+
+func GenerateScheduleHandler(store ScheduleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request ScheduleRequest
+		if err := decodeJSON(r, &request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		params, err := request.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		input, err := store.LoadScheduleInput(r.Context(), params)
+		if err != nil {
+			log.Printf("Error loading schedule input: %v", err)
+			http.Error(w, "Failed to load scheduling data", http.StatusInternalServerError)
+			return
+		}
+
+		result := scheduler.Generate(input)
+		names := make(map[int]string, len(input.Staff))
+		for _, s := range input.Staff {
+			names[s.ID] = s.Name
+		}
+
+		response := ScheduleResponse{
+			DryRun:      params.DryRun,
+			Assignments: make([]ScheduledAssignment, 0, len(result.Assignments)),
+			Shortfalls:  result.Shortfalls,
+			Score:       result.Score,
+		}
+		if response.Shortfalls == nil {
+			response.Shortfalls = []scheduler.Shortfall{}
+		}
+
+		if params.DryRun {
+			for _, a := range result.Assignments {
+				response.Assignments = append(response.Assignments, scheduledAssignment(a, names[a.StaffID]))
+			}
+			writeJSON(w, http.StatusOK, response)
+			return
+		}
+
+		written, err := store.CommitSchedule(r.Context(), result.Assignments)
+		if err != nil {
+			writeCommitScheduleError(w, err)
+			return
+		}
+		for i := range written {
+			written[i].StaffName = names[written[i].StaffID]
+		}
+		response.Assignments = written
+		writeJSON(w, http.StatusCreated, response)
+	}
+}
+
+// Reports a failed CommitSchedule. A trigger or the unique constraint
+// firing is most likely a concurrent change between loading and writing.
+func writeCommitScheduleError(w http.ResponseWriter, err error) {
+	if _, ok := pqViolation(err, "P0001"); ok {
+		http.Error(w, "Schedule rejected by the database: "+err.Error(), http.StatusConflict)
+		return
+	}
+	if _, ok := pqViolation(err, "23505"); ok {
+		http.Error(w, "Schedule conflicts with assignments created meanwhile, generate it again", http.StatusConflict)
+		return
+	}
+	log.Printf("Error committing schedule: %v", err)
+	http.Error(w, "Failed to write schedule", http.StatusInternalServerError)
+}
@@ -0,0 +1,260 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Rolling window used when RotationInput.Window is 0
+const DefaultRotationWindow = 28 * 24 * time.Hour
+
+type RotationInput struct {
+	// On-call shifts to cover, each one in every department
+	Shifts      []Shift
+	Departments []int
+	// On-call staff needed per department and shift
+	Headcount   int
+	Staff       []Staff
+	Memberships []Membership
+	Leaves      []Leave
+	// Assignments already in the database from Window before the first
+	// shift on. Their on-call ones are the history the rotation balances,
+	// all of them block their staff for the rest period.
+	Existing []Assignment
+	MinRest  time.Duration
+	// How far back on-call load counts when ranking candidates
+	Window time.Duration
+}
+
+// On-call load of a staff member over the rolling window before a shift
+type OnCallLoad struct {
+	Total      int        `json:"total"`
+	Weekends   int        `json:"weekends"`
+	Nights     int        `json:"nights"`
+	LastOnCall *time.Time `json:"last_on_call"`
+}
+
+// A proposed on-call assignment and why its staff member got it. Load is
+// theirs at the time of the pick, Eligible counts who could have taken it.
+type Pick struct {
+	Assignment Assignment
+	Load       OnCallLoad
+	Eligible   int
+	Reason     string
+}
+
+type RotationResult struct {
+	Picks      []Pick
+	Shortfalls []Shortfall
+}
+
+// Rotate cycles on-call allowed staff through the on-call shifts of each
+// department, chronologically. Among the eligible candidates (member of
+// the department that day, not on approved leave, not already on the
+// shift, rest respected) the pick is whoever has the fewest on-calls of
+// the slot's kind (weekend, night) in the rolling window, then the fewest
+// on-calls overall, then the longest time since their last one, then the
+// lowest staff id. Picks count towards later load, so a run spreads
+// weekends and nights as it goes. Existing on-call assignments count
+// towards the headcount.
+func Rotate(in RotationInput) RotationResult {
+	if in.Window == 0 {
+		in.Window = DefaultRotationWindow
+	}
+	if in.Headcount == 0 {
+		in.Headcount = 1
+	}
+	rules := Input{Memberships: in.Memberships, Leaves: in.Leaves, MinRest: in.MinRest}
+
+	shifts := append([]Shift(nil), in.Shifts...)
+	sort.Slice(shifts, func(i, j int) bool {
+		if !shifts[i].Start.Equal(shifts[j].Start) {
+			return shifts[i].Start.Before(shifts[j].Start)
+		}
+		return shifts[i].ShiftTimeID < shifts[j].ShiftTimeID
+	})
+
+	staff := append([]Staff(nil), in.Staff...)
+	sort.Slice(staff, func(i, j int) bool { return staff[i].ID < staff[j].ID })
+
+	busy := make(map[int][]Assignment)
+	for _, a := range in.Existing {
+		busy[a.StaffID] = append(busy[a.StaffID], a)
+	}
+
+	var result RotationResult
+	for _, shift := range shifts {
+		for _, departmentID := range in.Departments {
+			target := Target{DepartmentID: departmentID, Headcount: in.Headcount, ShiftType: OnCall}
+			filled := 0
+			for _, a := range in.Existing {
+				if sameShift(a.Shift, shift) && a.DepartmentID == departmentID && a.ShiftType == OnCall {
+					filled++
+				}
+			}
+
+			var rejections map[string]int
+			for filled < in.Headcount {
+				rejections = make(map[string]int)
+				var candidates []rotationCandidate
+				for _, s := range staff {
+					if !s.OnCallAllowed {
+						rejections[RejectOnCall]++
+						continue
+					}
+					// The role is whatever the candidate has, the rotation
+					// doesn't care
+					target.RoleID = s.RoleID
+					if reason := rules.reject(s, shift, target, busy[s.ID]); reason != "" {
+						rejections[reason]++
+						continue
+					}
+					candidates = append(candidates, rotationCandidate{staff: s, load: windowLoad(busy[s.ID], shift, in.Window)})
+				}
+				if len(candidates) == 0 {
+					break
+				}
+
+				sort.Slice(candidates, func(i, j int) bool {
+					return candidates[i].less(candidates[j], shift)
+				})
+				chosen := candidates[0]
+				a := Assignment{
+					Shift:        shift,
+					DepartmentID: departmentID,
+					StaffID:      chosen.staff.ID,
+					RoleID:       chosen.staff.RoleID,
+					ShiftType:    OnCall,
+					Preference:   chosen.staff.Preferences[shift.ShiftTimeID],
+				}
+				result.Picks = append(result.Picks, Pick{
+					Assignment: a,
+					Load:       chosen.load,
+					Eligible:   len(candidates),
+					Reason:     explainPick(candidates, shift, in.Window),
+				})
+				busy[chosen.staff.ID] = append(busy[chosen.staff.ID], a)
+				filled++
+			}
+
+			if filled < in.Headcount {
+				result.Shortfalls = append(result.Shortfalls, Shortfall{
+					Date:          shift.Date,
+					ShiftTimeID:   shift.ShiftTimeID,
+					ShiftTimeName: shift.ShiftTimeName,
+					DepartmentID:  departmentID,
+					ShiftType:     OnCall,
+					Required:      in.Headcount,
+					Filled:        filled,
+					Rejections:    rejections,
+				})
+			}
+		}
+	}
+	return result
+}
+
+// Whether a shift falls on a Saturday or Sunday
+func IsWeekend(shift Shift) bool {
+	day := shift.Date.Weekday()
+	return day == time.Saturday || day == time.Sunday
+}
+
+// Whether a shift crosses midnight
+func IsNight(shift Shift) bool {
+	y1, m1, d1 := shift.Start.Date()
+	y2, m2, d2 := shift.End.Date()
+	return y1 != y2 || m1 != m2 || d1 != d2
+}
+
+// On-call assignments among busy in the window ending at shift
+func windowLoad(busy []Assignment, shift Shift, window time.Duration) OnCallLoad {
+	var load OnCallLoad
+	from := shift.Start.Add(-window)
+	for _, a := range busy {
+		if a.ShiftType != OnCall || a.Shift.Start.Before(from) || !a.Shift.Start.Before(shift.Start) {
+			continue
+		}
+		load.Total++
+		if IsWeekend(a.Shift) {
+			load.Weekends++
+		}
+		if IsNight(a.Shift) {
+			load.Nights++
+		}
+		if load.LastOnCall == nil || a.Shift.Date.After(*load.LastOnCall) {
+			date := a.Shift.Date
+			load.LastOnCall = &date
+		}
+	}
+	return load
+}
+
+type rotationCandidate struct {
+	staff Staff
+	load  OnCallLoad
+}
+
+// On-calls of the same kind as shift, weekend and night ones for a
+// weekend night
+func (c rotationCandidate) kindLoad(shift Shift) int {
+	n := 0
+	if IsWeekend(shift) {
+		n += c.load.Weekends
+	}
+	if IsNight(shift) {
+		n += c.load.Nights
+	}
+	return n
+}
+
+// Rotation order, see Rotate. Returns which rule decided it, "" on the
+// staff id tiebreak.
+func (c rotationCandidate) compare(other rotationCandidate, shift Shift) (int, string) {
+	if a, b := c.kindLoad(shift), other.kindLoad(shift); a != b {
+		return a - b, "kind"
+	}
+	if c.load.Total != other.load.Total {
+		return c.load.Total - other.load.Total, "total"
+	}
+	// Equal totals, so either both have a last on-call or neither does
+	if c.load.LastOnCall != nil && !c.load.LastOnCall.Equal(*other.load.LastOnCall) {
+		if c.load.LastOnCall.Before(*other.load.LastOnCall) {
+			return -1, "last"
+		}
+		return 1, "last"
+	}
+	return c.staff.ID - other.staff.ID, ""
+}
+
+func (c rotationCandidate) less(other rotationCandidate, shift Shift) bool {
+	order, _ := c.compare(other, shift)
+	return order < 0
+}
+
+// Explains why candidates[0] beat the runner-up, candidates are sorted
+func explainPick(candidates []rotationCandidate, shift Shift, window time.Duration) string {
+	if len(candidates) == 1 {
+		return "only eligible candidate"
+	}
+	chosen := candidates[0]
+	days := int(window.Hours() / 24)
+	_, rule := chosen.compare(candidates[1], shift)
+	switch rule {
+	case "kind":
+		kind := "weekend"
+		switch {
+		case IsWeekend(shift) && IsNight(shift):
+			kind = "weekend and night"
+		case IsNight(shift):
+			kind = "night"
+		}
+		return fmt.Sprintf("fewest %s on-calls in the last %d days (%d) among %d eligible", kind, days, chosen.kindLoad(shift), len(candidates))
+	case "total":
+		return fmt.Sprintf("fewest on-calls in the last %d days (%d) among %d eligible", days, chosen.load.Total, len(candidates))
+	case "last":
+		return "tied on load, longest since their last on-call (" + chosen.load.LastOnCall.Format("2006-01-02") + ")"
+	}
+	return "tied on load and last on-call, lowest staff id"
+}
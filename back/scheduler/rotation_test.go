@@ -0,0 +1,180 @@
+package scheduler
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func onCallStaff(id int) Staff {
+	return Staff{ID: id, RoleID: 1, OnCallAllowed: true}
+}
+
+// A past on-call of staffID, in department 2 so it doesn't fill the
+// slots under test
+func onCallOn(staffID int, shift Shift) Assignment {
+	return Assignment{Shift: shift, DepartmentID: 2, StaffID: staffID, RoleID: 1, ShiftType: OnCall}
+}
+
+// Staff ids of the picks, in rotation order
+func picked(result RotationResult) []int {
+	ids := []int{}
+	for _, p := range result.Picks {
+		ids = append(ids, p.Assignment.StaffID)
+	}
+	return ids
+}
+
+func TestRotateOrdering(t *testing.T) {
+	// day0 + 12 is a Saturday, day0 + 10 a Thursday
+	saturday := dayShift(12)
+	thursday := dayShift(10)
+	thursdayNight := shiftOn(10, 2, 22, 8)
+
+	tests := []struct {
+		name     string
+		shifts   []Shift
+		staff    []Staff
+		existing []Assignment
+		want     []int
+		reason   string
+	}{
+		{
+			name:     "fewest weekend on-calls before fewest overall",
+			shifts:   []Shift{saturday},
+			staff:    []Staff{onCallStaff(1), onCallStaff(2)},
+			existing: []Assignment{onCallOn(1, dayShift(6)), onCallOn(2, dayShift(2)), onCallOn(2, dayShift(3))},
+			want:     []int{2},
+			reason:   "fewest weekend on-calls",
+		},
+		{
+			name:     "fewest night on-calls before fewest overall",
+			shifts:   []Shift{thursdayNight},
+			staff:    []Staff{onCallStaff(1), onCallStaff(2)},
+			existing: []Assignment{onCallOn(1, shiftOn(3, 2, 22, 8)), onCallOn(2, dayShift(2)), onCallOn(2, dayShift(4))},
+			want:     []int{2},
+			reason:   "fewest night on-calls",
+		},
+		{
+			name:     "fewest on-calls when the kind ties",
+			shifts:   []Shift{thursday},
+			staff:    []Staff{onCallStaff(1), onCallStaff(2)},
+			existing: []Assignment{onCallOn(1, dayShift(2)), onCallOn(1, dayShift(4)), onCallOn(2, dayShift(3))},
+			want:     []int{2},
+			reason:   "fewest on-calls",
+		},
+		{
+			name:     "longest since the last on-call when the load ties",
+			shifts:   []Shift{thursday},
+			staff:    []Staff{onCallStaff(1), onCallStaff(2)},
+			existing: []Assignment{onCallOn(1, dayShift(8)), onCallOn(2, dayShift(3))},
+			want:     []int{2},
+			reason:   "longest since their last on-call",
+		},
+		{
+			name:   "lowest staff id when everything ties",
+			shifts: []Shift{thursday},
+			staff:  []Staff{onCallStaff(3), onCallStaff(2)},
+			want:   []int{2},
+			reason: "lowest staff id",
+		},
+		{
+			name:     "on-calls before the window don't count",
+			shifts:   []Shift{thursday},
+			staff:    []Staff{onCallStaff(1), onCallStaff(2)},
+			existing: []Assignment{onCallOn(1, dayShift(-30)), onCallOn(1, dayShift(-29)), onCallOn(2, dayShift(3))},
+			want:     []int{1},
+			reason:   "fewest on-calls",
+		},
+		{
+			name:   "picks count towards later load",
+			shifts: []Shift{dayShift(1), dayShift(2), dayShift(3)},
+			staff:  []Staff{onCallStaff(1), onCallStaff(2)},
+			want:   []int{1, 2, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := RotationInput{
+				Shifts:      tt.shifts,
+				Departments: []int{1},
+				Staff:       tt.staff,
+				Existing:    tt.existing,
+			}
+			for _, s := range tt.staff {
+				in.Memberships = append(in.Memberships, members(s.ID)...)
+			}
+			result := Rotate(in)
+			if got := picked(result); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("picked %v, want %v", got, tt.want)
+			}
+			if tt.reason != "" && !strings.Contains(result.Picks[0].Reason, tt.reason) {
+				t.Errorf("reason = %q, want it to mention %q", result.Picks[0].Reason, tt.reason)
+			}
+			if len(result.Shortfalls) != 0 {
+				t.Errorf("unexpected shortfalls %+v", result.Shortfalls)
+			}
+		})
+	}
+}
+
+func TestRotateRejectsBusyStaff(t *testing.T) {
+	shift := dayShift(0)
+
+	t.Run("already on the shift", func(t *testing.T) {
+		result := Rotate(RotationInput{
+			Shifts:      []Shift{shift},
+			Departments: []int{1},
+			Staff:       []Staff{onCallStaff(1), onCallStaff(2)},
+			Memberships: members(1, 2),
+			Existing:    []Assignment{{Shift: shift, DepartmentID: 2, StaffID: 1, RoleID: 1, ShiftType: Regular}},
+		})
+		if got := picked(result); !reflect.DeepEqual(got, []int{2}) {
+			t.Errorf("picked %v, want staff member 2", got)
+		}
+		if result.Picks[0].Eligible != 1 {
+			t.Errorf("eligible = %d, want 1", result.Picks[0].Eligible)
+		}
+	})
+
+	t.Run("picked for another department", func(t *testing.T) {
+		result := Rotate(RotationInput{
+			Shifts:      []Shift{shift},
+			Departments: []int{1, 2},
+			Staff:       []Staff{onCallStaff(1)},
+			Memberships: []Membership{
+				{StaffID: 1, DepartmentID: 1, Start: day0.AddDate(0, -1, 0)},
+				{StaffID: 1, DepartmentID: 2, Start: day0.AddDate(0, -1, 0)},
+			},
+		})
+		if got := picked(result); !reflect.DeepEqual(got, []int{1}) || result.Picks[0].Assignment.DepartmentID != 1 {
+			t.Errorf("picks = %+v, want staff member 1 in department 1", result.Picks)
+		}
+		if len(result.Shortfalls) != 1 {
+			t.Fatalf("got %d shortfalls, want 1", len(result.Shortfalls))
+		}
+		shortfall := result.Shortfalls[0]
+		want := map[string]int{RejectAssigned: 1}
+		if shortfall.DepartmentID != 2 || !reflect.DeepEqual(shortfall.Rejections, want) {
+			t.Errorf("shortfall = %+v, want department 2 rejected as already assigned", shortfall)
+		}
+	})
+
+	t.Run("too little rest", func(t *testing.T) {
+		result := Rotate(RotationInput{
+			Shifts:      []Shift{shift},
+			Departments: []int{1},
+			Staff:       []Staff{onCallStaff(1)},
+			Memberships: members(1),
+			MinRest:     11 * time.Hour,
+			Existing:    []Assignment{{Shift: shiftOn(-1, 2, 22, 8), DepartmentID: 2, StaffID: 1, RoleID: 1, ShiftType: Regular}},
+		})
+		if len(result.Picks) != 0 {
+			t.Errorf("picked %v, want nobody", picked(result))
+		}
+		if len(result.Shortfalls) != 1 || !reflect.DeepEqual(result.Shortfalls[0].Rejections, map[string]int{RejectRest: 1}) {
+			t.Errorf("shortfalls = %+v, want one rejected for %s", result.Shortfalls, RejectRest)
+		}
+	})
+}
@@ -0,0 +1,353 @@
+// Package scheduler builds shift rosters. It is a pure function of its
+// Input: the caller loads staff, memberships, leaves and existing
+// assignments from the database, the scheduler proposes new assignments
+// and scores them. Nothing here talks to Postgres, so a proposal can be
+// inspected (dry-run) before it is written.
+package scheduler
+
+import (
+	"sort"
+	"time"
+)
+
+// Shift types, mirror the CHECK on shift_assignments.shift_type
+const (
+	Regular = "regular"
+	OnCall  = "on-call"
+)
+
+// Default weight of the load balancing term, see Input.FairnessWeight
+const DefaultFairnessWeight = 0.25
+
+// A concrete shift: a shift time on a date. ID is 0 when the shifts row
+// doesn't exist yet, the caller creates it when committing.
+type Shift struct {
+	ID            int
+	ShiftTimeID   int
+	ShiftTimeName string
+	Date          time.Time
+	Start         time.Time
+	End           time.Time
+}
+
+// A schedulable staff member. Preferences maps shift_time_id to a weight,
+// staff_shift_preferences rows all weigh 1 today.
+type Staff struct {
+	ID            int
+	Name          string
+	RoleID        int
+	OnCallAllowed bool
+	Preferences   map[int]float64
+}
+
+// A staff_departments row, End nil means open ended
+type Membership struct {
+	StaffID      int
+	DepartmentID int
+	Start        time.Time
+	End          *time.Time
+}
+
+// An approved leave, End nil means indefinite
+type Leave struct {
+	StaffID int
+	Start   time.Time
+	End     *time.Time
+}
+
+// Required headcount of a role in a department. ShiftTimeID 0 applies the
+// target to every shift time.
+type Target struct {
+	DepartmentID int    `json:"department_id"`
+	ShiftTimeID  int    `json:"shift_time_id"`
+	RoleID       int    `json:"role_id"`
+	Headcount    int    `json:"headcount"`
+	ShiftType    string `json:"shift_type"`
+}
+
+// A staff member working a shift in a department, existing or proposed
+type Assignment struct {
+	Shift        Shift
+	DepartmentID int
+	StaffID      int
+	RoleID       int
+	ShiftType    string
+	// Weight of the staff member's preference for the shift time, 0 when
+	// it wasn't one of their preferences
+	Preference float64
+}
+
+type Input struct {
+	Shifts      []Shift
+	Staff       []Staff
+	Memberships []Membership
+	Leaves      []Leave
+	Targets     []Target
+	// Assignments already in the database, they count towards the targets
+	// and block their staff for the rest period
+	Existing []Assignment
+	// Minimum time between the end of one shift and the start of the next
+	// for the same person
+	MinRest time.Duration
+	// How much each assignment already given to a candidate counts against
+	// them, trading preference fulfilment for an even spread of shifts
+	FairnessWeight float64
+}
+
+// A slot that couldn't be filled and why candidates were turned down
+type Shortfall struct {
+	Date          time.Time      `json:"date"`
+	ShiftTimeID   int            `json:"shift_time_id"`
+	ShiftTimeName string         `json:"shift_time_name"`
+	DepartmentID  int            `json:"department_id"`
+	RoleID        int            `json:"role_id"`
+	ShiftType     string         `json:"shift_type"`
+	Required      int            `json:"required"`
+	Filled        int            `json:"filled"`
+	Rejections    map[string]int `json:"rejections"`
+}
+
+// Per-person outcome of a run
+type StaffLoad struct {
+	StaffID           int    `json:"staff_id"`
+	StaffName         string `json:"staff_name"`
+	Assignments       int    `json:"assignments"`
+	PreferenceMatches int    `json:"preference_matches"`
+}
+
+// Score breakdown of a proposal
+type Score struct {
+	SlotsRequired     int         `json:"slots_required"`
+	SlotsFilled       int         `json:"slots_filled"`
+	SlotsUnfilled     int         `json:"slots_unfilled"`
+	PreferenceMatches int         `json:"preference_matches"`
+	PreferenceRate    float64     `json:"preference_rate"`
+	PreferenceScore   float64     `json:"preference_score"`
+	Staff             []StaffLoad `json:"staff"`
+}
+
+type Result struct {
+	Assignments []Assignment
+	Shortfalls  []Shortfall
+	Score       Score
+}
+
+// Reasons a candidate is rejected for a slot
+const (
+	RejectRole       = "role"
+	RejectMembership = "membership"
+	RejectLeave      = "leave"
+	RejectAssigned   = "already_assigned"
+	RejectRest       = "rest"
+	RejectOnCall     = "on_call_not_allowed"
+)
+
+// An open position: a target applied to one shift
+type slot struct {
+	shift      Shift
+	target     Target
+	filled     int
+	rejections map[string]int
+}
+
+// Generate fills the targets in two chronological passes. The first only
+// considers candidates who prefer the slot's shift time, so a preferred
+// shift isn't lost to a rest conflict with a shift they didn't care about;
+// the second fills what is left with anyone eligible. Within a pass the
+// candidate with the best preference - FairnessWeight * load score wins,
+// ties going to the lowest staff id so runs are reproducible. The greedy
+// passes don't guarantee the global optimum but never break a hard rule.
+func Generate(in Input) Result {
+	if in.FairnessWeight == 0 {
+		in.FairnessWeight = DefaultFairnessWeight
+	}
+
+	shifts := append([]Shift(nil), in.Shifts...)
+	sort.Slice(shifts, func(i, j int) bool {
+		if !shifts[i].Start.Equal(shifts[j].Start) {
+			return shifts[i].Start.Before(shifts[j].Start)
+		}
+		return shifts[i].ShiftTimeID < shifts[j].ShiftTimeID
+	})
+
+	staff := append([]Staff(nil), in.Staff...)
+	sort.Slice(staff, func(i, j int) bool { return staff[i].ID < staff[j].ID })
+
+	busy := make(map[int][]Assignment)
+	for _, a := range in.Existing {
+		busy[a.StaffID] = append(busy[a.StaffID], a)
+	}
+	load := make(map[int]int)
+
+	var result Result
+
+	// Open positions, existing assignments count towards their target
+	var slots []*slot
+	for _, shift := range shifts {
+		for _, target := range in.Targets {
+			if target.ShiftTimeID != 0 && target.ShiftTimeID != shift.ShiftTimeID {
+				continue
+			}
+			if target.ShiftType == "" {
+				target.ShiftType = Regular
+			}
+			sl := &slot{shift: shift, target: target, rejections: make(map[string]int)}
+			for _, a := range in.Existing {
+				if sameShift(a.Shift, shift) && a.DepartmentID == target.DepartmentID &&
+					a.RoleID == target.RoleID && a.ShiftType == target.ShiftType {
+					sl.filled++
+				}
+			}
+			result.Score.SlotsRequired += max(target.Headcount-sl.filled, 0)
+			slots = append(slots, sl)
+		}
+	}
+
+	for _, preferredOnly := range []bool{true, false} {
+		for _, sl := range slots {
+			for sl.filled < sl.target.Headcount {
+				// Only the round that fails to find anyone is reported
+				if !preferredOnly {
+					sl.rejections = make(map[string]int)
+				}
+				best, bestScore := -1, 0.0
+				for i, s := range staff {
+					preference := s.Preferences[sl.shift.ShiftTimeID]
+					if preferredOnly && preference <= 0 {
+						continue
+					}
+					reason := in.reject(s, sl.shift, sl.target, busy[s.ID])
+					if reason != "" {
+						if !preferredOnly {
+							sl.rejections[reason]++
+						}
+						continue
+					}
+					score := preference - in.FairnessWeight*float64(load[s.ID])
+					if best == -1 || score > bestScore {
+						best, bestScore = i, score
+					}
+				}
+				if best == -1 {
+					break
+				}
+
+				chosen := staff[best]
+				a := Assignment{
+					Shift:        sl.shift,
+					DepartmentID: sl.target.DepartmentID,
+					StaffID:      chosen.ID,
+					RoleID:       chosen.RoleID,
+					ShiftType:    sl.target.ShiftType,
+					Preference:   chosen.Preferences[sl.shift.ShiftTimeID],
+				}
+				result.Assignments = append(result.Assignments, a)
+				busy[chosen.ID] = append(busy[chosen.ID], a)
+				load[chosen.ID]++
+				sl.filled++
+				result.Score.SlotsFilled++
+			}
+		}
+	}
+
+	for _, sl := range slots {
+		if sl.filled < sl.target.Headcount {
+			result.Shortfalls = append(result.Shortfalls, Shortfall{
+				Date:          sl.shift.Date,
+				ShiftTimeID:   sl.shift.ShiftTimeID,
+				ShiftTimeName: sl.shift.ShiftTimeName,
+				DepartmentID:  sl.target.DepartmentID,
+				RoleID:        sl.target.RoleID,
+				ShiftType:     sl.target.ShiftType,
+				Required:      sl.target.Headcount,
+				Filled:        sl.filled,
+				Rejections:    sl.rejections,
+			})
+		}
+	}
+
+	// Assignments come out of the passes in pass order, report them in
+	// roster order
+	sort.SliceStable(result.Assignments, func(i, j int) bool {
+		return result.Assignments[i].Shift.Start.Before(result.Assignments[j].Shift.Start)
+	})
+
+	result.Score.SlotsUnfilled = result.Score.SlotsRequired - result.Score.SlotsFilled
+	result.Score.Staff = []StaffLoad{}
+	for _, s := range staff {
+		if load[s.ID] > 0 {
+			result.Score.Staff = append(result.Score.Staff, StaffLoad{StaffID: s.ID, StaffName: s.Name})
+		}
+	}
+	perStaff := make(map[int]*StaffLoad)
+	for i := range result.Score.Staff {
+		perStaff[result.Score.Staff[i].StaffID] = &result.Score.Staff[i]
+	}
+	for _, a := range result.Assignments {
+		sl := perStaff[a.StaffID]
+		sl.Assignments++
+		if a.Preference > 0 {
+			sl.PreferenceMatches++
+			result.Score.PreferenceMatches++
+			result.Score.PreferenceScore += a.Preference
+		}
+	}
+	if len(result.Assignments) > 0 {
+		result.Score.PreferenceRate = float64(result.Score.PreferenceMatches) / float64(len(result.Assignments))
+	}
+	return result
+}
+
+// Returns why s can't take the slot, or "" when they can
+func (in *Input) reject(s Staff, shift Shift, target Target, busy []Assignment) string {
+	if s.RoleID != target.RoleID {
+		return RejectRole
+	}
+	if target.ShiftType == OnCall && !s.OnCallAllowed {
+		return RejectOnCall
+	}
+	if !in.isMember(s.ID, target.DepartmentID, shift.Date) {
+		return RejectMembership
+	}
+	if in.onLeave(s.ID, shift.Date) {
+		return RejectLeave
+	}
+	for _, a := range busy {
+		if sameShift(a.Shift, shift) {
+			return RejectAssigned
+		}
+		// Gap between the two shifts, in whichever order they come
+		if shift.Start.Before(a.Shift.End.Add(in.MinRest)) && a.Shift.Start.Before(shift.End.Add(in.MinRest)) {
+			return RejectRest
+		}
+	}
+	return ""
+}
+
+func (in *Input) isMember(staffID, departmentID int, date time.Time) bool {
+	for _, m := range in.Memberships {
+		if m.StaffID == staffID && m.DepartmentID == departmentID && within(date, m.Start, m.End) {
+			return true
+		}
+	}
+	return false
+}
+
+func (in *Input) onLeave(staffID int, date time.Time) bool {
+	for _, l := range in.Leaves {
+		if l.StaffID == staffID && within(date, l.Start, l.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether date falls in [start, end], end nil meaning open ended
+func within(date, start time.Time, end *time.Time) bool {
+	return !date.Before(start) && (end == nil || !date.After(*end))
+}
+
+// Shifts are unique per shift time and date, new shifts have no ID yet
+func sameShift(a, b Shift) bool {
+	return a.ShiftTimeID == b.ShiftTimeID && a.Date.Equal(b.Date)
+}
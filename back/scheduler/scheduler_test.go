@@ -0,0 +1,371 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Monday
+var day0 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// A shift of shift time id on day0 + day, from hour for hours
+func shiftOn(day, id, hour, hours int) Shift {
+	date := day0.AddDate(0, 0, day)
+	start := date.Add(time.Duration(hour) * time.Hour)
+	return Shift{ShiftTimeID: id, Date: date, Start: start, End: start.Add(time.Duration(hours) * time.Hour)}
+}
+
+func dayShift(day int) Shift {
+	return shiftOn(day, 1, 8, 8)
+}
+
+func dayPtr(day int) *time.Time {
+	t := day0.AddDate(0, 0, day)
+	return &t
+}
+
+// Members of department 1 since before day0
+func members(ids ...int) []Membership {
+	var out []Membership
+	for _, id := range ids {
+		out = append(out, Membership{StaffID: id, DepartmentID: 1, Start: day0.AddDate(0, -1, 0)})
+	}
+	return out
+}
+
+func nurse(id int, preferences map[int]float64) Staff {
+	return Staff{ID: id, RoleID: 1, Preferences: preferences}
+}
+
+// Staff ids of the assignments, in roster order
+func assigned(result Result) []int {
+	ids := []int{}
+	for _, a := range result.Assignments {
+		ids = append(ids, a.StaffID)
+	}
+	return ids
+}
+
+func TestGenerateConstraints(t *testing.T) {
+	dayTarget := []Target{{DepartmentID: 1, RoleID: 1, Headcount: 1}}
+
+	tests := []struct {
+		name   string
+		input  Input
+		want   []int
+		reject string
+	}{
+		{
+			name:  "eligible staff member is assigned",
+			input: Input{Staff: []Staff{nurse(1, nil)}, Memberships: members(1)},
+			want:  []int{1},
+		},
+		{
+			name:   "other role",
+			input:  Input{Staff: []Staff{{ID: 1, RoleID: 2}}, Memberships: members(1)},
+			reject: RejectRole,
+		},
+		{
+			name:   "not a member of the department",
+			input:  Input{Staff: []Staff{nurse(1, nil)}},
+			reject: RejectMembership,
+		},
+		{
+			name: "membership ended before the shift",
+			input: Input{Staff: []Staff{nurse(1, nil)}, Memberships: []Membership{
+				{StaffID: 1, DepartmentID: 1, Start: day0.AddDate(0, -1, 0), End: dayPtr(-1)},
+			}},
+			reject: RejectMembership,
+		},
+		{
+			name: "membership of another department",
+			input: Input{Staff: []Staff{nurse(1, nil)}, Memberships: []Membership{
+				{StaffID: 1, DepartmentID: 2, Start: day0.AddDate(0, -1, 0)},
+			}},
+			reject: RejectMembership,
+		},
+		{
+			name: "membership starting on the day",
+			input: Input{Staff: []Staff{nurse(1, nil)}, Memberships: []Membership{
+				{StaffID: 1, DepartmentID: 1, Start: day0, End: dayPtr(0)},
+			}},
+			want: []int{1},
+		},
+		{
+			name: "on leave",
+			input: Input{Staff: []Staff{nurse(1, nil)}, Memberships: members(1), Leaves: []Leave{
+				{StaffID: 1, Start: day0.AddDate(0, 0, -2), End: dayPtr(0)},
+			}},
+			reject: RejectLeave,
+		},
+		{
+			name: "on indefinite leave",
+			input: Input{Staff: []Staff{nurse(1, nil)}, Memberships: members(1), Leaves: []Leave{
+				{StaffID: 1, Start: day0.AddDate(0, 0, -2)},
+			}},
+			reject: RejectLeave,
+		},
+		{
+			name: "leave ended the day before",
+			input: Input{Staff: []Staff{nurse(1, nil)}, Memberships: members(1), Leaves: []Leave{
+				{StaffID: 1, Start: day0.AddDate(0, 0, -2), End: dayPtr(-1)},
+			}},
+			want: []int{1},
+		},
+		{
+			name: "already on the shift in another department",
+			input: Input{Staff: []Staff{nurse(1, nil)}, Memberships: members(1), Existing: []Assignment{
+				{Shift: dayShift(0), DepartmentID: 2, StaffID: 1, RoleID: 1, ShiftType: Regular},
+			}},
+			reject: RejectAssigned,
+		},
+		{
+			name: "too little rest after a night shift",
+			input: Input{Staff: []Staff{nurse(1, nil)}, Memberships: members(1), MinRest: 11 * time.Hour, Existing: []Assignment{
+				{Shift: shiftOn(-1, 2, 22, 8), DepartmentID: 2, StaffID: 1, RoleID: 1, ShiftType: Regular},
+			}},
+			reject: RejectRest,
+		},
+		{
+			name: "too little rest before the next shift",
+			input: Input{Staff: []Staff{nurse(1, nil)}, Memberships: members(1), MinRest: 11 * time.Hour, Existing: []Assignment{
+				{Shift: shiftOn(1, 1, 2, 8), DepartmentID: 2, StaffID: 1, RoleID: 1, ShiftType: Regular},
+			}},
+			reject: RejectRest,
+		},
+		{
+			name: "enough rest",
+			input: Input{Staff: []Staff{nurse(1, nil)}, Memberships: members(1), MinRest: 11 * time.Hour, Existing: []Assignment{
+				{Shift: shiftOn(-1, 1, 8, 8), DepartmentID: 2, StaffID: 1, RoleID: 1, ShiftType: Regular},
+			}},
+			want: []int{1},
+		},
+		{
+			name: "back to back without a rest rule",
+			input: Input{Staff: []Staff{nurse(1, nil)}, Memberships: members(1), Existing: []Assignment{
+				{Shift: shiftOn(0, 2, 0, 8), DepartmentID: 2, StaffID: 1, RoleID: 1, ShiftType: Regular},
+			}},
+			want: []int{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := tt.input
+			in.Shifts = []Shift{dayShift(0)}
+			in.Targets = dayTarget
+			result := Generate(in)
+
+			if tt.reject == "" {
+				if got := assigned(result); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("assigned %v, want %v", got, tt.want)
+				}
+				if len(result.Shortfalls) != 0 {
+					t.Errorf("unexpected shortfalls %+v", result.Shortfalls)
+				}
+				return
+			}
+			if len(result.Assignments) != 0 {
+				t.Errorf("assigned %v, want nobody", assigned(result))
+			}
+			if len(result.Shortfalls) != 1 {
+				t.Fatalf("got %d shortfalls, want 1", len(result.Shortfalls))
+			}
+			want := map[string]int{tt.reject: 1}
+			if got := result.Shortfalls[0].Rejections; !reflect.DeepEqual(got, want) {
+				t.Errorf("rejections = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestGenerateOnCall(t *testing.T) {
+	in := Input{
+		Shifts:      []Shift{dayShift(0)},
+		Staff:       []Staff{nurse(1, nil), {ID: 2, RoleID: 1, OnCallAllowed: true}},
+		Memberships: members(1, 2),
+		Targets:     []Target{{DepartmentID: 1, RoleID: 1, Headcount: 1, ShiftType: OnCall}},
+	}
+	result := Generate(in)
+	if got := assigned(result); !reflect.DeepEqual(got, []int{2}) {
+		t.Fatalf("assigned %v, want the on-call allowed staff member 2", got)
+	}
+	if result.Assignments[0].ShiftType != OnCall {
+		t.Errorf("shift type = %q, want %q", result.Assignments[0].ShiftType, OnCall)
+	}
+
+	in.Staff = in.Staff[:1]
+	result = Generate(in)
+	if len(result.Shortfalls) != 1 || result.Shortfalls[0].Rejections[RejectOnCall] != 1 {
+		t.Errorf("shortfalls = %+v, want one rejected for %s", result.Shortfalls, RejectOnCall)
+	}
+}
+
+func TestGenerateOneShiftPerSlot(t *testing.T) {
+	result := Generate(Input{
+		Shifts:      []Shift{dayShift(0)},
+		Staff:       []Staff{nurse(1, nil)},
+		Memberships: members(1),
+		Targets:     []Target{{DepartmentID: 1, RoleID: 1, Headcount: 2}},
+	})
+	if got := assigned(result); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("assigned %v, want staff member 1 once", got)
+	}
+	if len(result.Shortfalls) != 1 {
+		t.Fatalf("got %d shortfalls, want 1", len(result.Shortfalls))
+	}
+	shortfall := result.Shortfalls[0]
+	if shortfall.Required != 2 || shortfall.Filled != 1 || shortfall.Rejections[RejectAssigned] != 1 {
+		t.Errorf("shortfall = %+v, want 1 of 2 filled, rejected as already assigned", shortfall)
+	}
+}
+
+func TestGenerateCountsExisting(t *testing.T) {
+	result := Generate(Input{
+		Shifts:      []Shift{dayShift(0)},
+		Staff:       []Staff{nurse(1, nil), nurse(2, nil)},
+		Memberships: members(1, 2),
+		Targets:     []Target{{DepartmentID: 1, RoleID: 1, Headcount: 1}},
+		Existing:    []Assignment{{Shift: dayShift(0), DepartmentID: 1, StaffID: 2, RoleID: 1, ShiftType: Regular}},
+	})
+	if len(result.Assignments) != 0 || len(result.Shortfalls) != 0 {
+		t.Errorf("assigned %v with shortfalls %+v, want the existing assignment to fill the slot", assigned(result), result.Shortfalls)
+	}
+	if result.Score.SlotsRequired != 0 {
+		t.Errorf("slots required = %d, want 0", result.Score.SlotsRequired)
+	}
+}
+
+func TestGenerateTargetShiftTime(t *testing.T) {
+	result := Generate(Input{
+		Shifts:      []Shift{dayShift(0), shiftOn(0, 2, 20, 10)},
+		Staff:       []Staff{nurse(1, nil)},
+		Memberships: members(1),
+		Targets:     []Target{{DepartmentID: 1, ShiftTimeID: 2, RoleID: 1, Headcount: 1}},
+	})
+	if len(result.Assignments) != 1 || result.Assignments[0].Shift.ShiftTimeID != 2 {
+		t.Errorf("assignments = %+v, want only shift time 2", result.Assignments)
+	}
+}
+
+func TestGenerateOrdering(t *testing.T) {
+	preferDay := map[int]float64{1: 1}
+	tests := []struct {
+		name  string
+		input Input
+		want  []int
+	}{
+		{
+			name: "ties go to the lowest staff id",
+			input: Input{
+				Shifts: []Shift{dayShift(0)},
+				Staff:  []Staff{nurse(3, nil), nurse(2, nil)},
+			},
+			want: []int{2},
+		},
+		{
+			name: "preferred candidates first",
+			input: Input{
+				Shifts: []Shift{dayShift(0)},
+				Staff:  []Staff{nurse(1, nil), nurse(2, preferDay)},
+			},
+			want: []int{2},
+		},
+		{
+			name: "load spreads equal preferences",
+			input: Input{
+				Shifts: []Shift{dayShift(0), dayShift(1), dayShift(2), dayShift(3)},
+				Staff:  []Staff{nurse(1, preferDay), nurse(2, preferDay)},
+			},
+			want: []int{1, 2, 1, 2},
+		},
+		{
+			// 1 - 0.25 * load only drops below 0.5 after three shifts
+			name: "default fairness weight favours the stronger preference",
+			input: Input{
+				Shifts: []Shift{dayShift(0), dayShift(1), dayShift(2), dayShift(3)},
+				Staff:  []Staff{nurse(1, map[int]float64{1: 1}), nurse(2, map[int]float64{1: 0.5})},
+			},
+			want: []int{1, 1, 1, 2},
+		},
+		{
+			name: "a heavier fairness weight alternates sooner",
+			input: Input{
+				Shifts:         []Shift{dayShift(0), dayShift(1), dayShift(2), dayShift(3)},
+				Staff:          []Staff{nurse(1, map[int]float64{1: 1}), nurse(2, map[int]float64{1: 0.5})},
+				FairnessWeight: 1,
+			},
+			want: []int{1, 2, 1, 2},
+		},
+		{
+			name: "shifts are filled chronologically whatever the input order",
+			input: Input{
+				Shifts: []Shift{dayShift(1), dayShift(0)},
+				Staff:  []Staff{nurse(1, preferDay), nurse(2, preferDay)},
+			},
+			want: []int{1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := tt.input
+			for _, s := range in.Staff {
+				in.Memberships = append(in.Memberships, members(s.ID)...)
+			}
+			in.Targets = []Target{{DepartmentID: 1, RoleID: 1, Headcount: 1}}
+			result := Generate(in)
+			if got := assigned(result); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("assigned %v, want %v", got, tt.want)
+			}
+			for i, a := range result.Assignments {
+				if !a.Shift.Date.Equal(day0.AddDate(0, 0, i)) {
+					t.Errorf("assignment %d is on %s, want roster order", i, a.Shift.Date.Format("2006-01-02"))
+				}
+			}
+		})
+	}
+}
+
+// The day shift comes first, but staff member 1 only wants the night one
+// and can't work both with 11 hours rest. The preferred pass gives them the
+// night before the second pass looks at the day.
+func TestGeneratePreferredPassKeepsPreferredShift(t *testing.T) {
+	night := shiftOn(0, 2, 20, 10)
+	result := Generate(Input{
+		Shifts:      []Shift{dayShift(0), night},
+		Staff:       []Staff{nurse(1, map[int]float64{2: 1})},
+		Memberships: members(1),
+		Targets:     []Target{{DepartmentID: 1, RoleID: 1, Headcount: 1}},
+		MinRest:     11 * time.Hour,
+	})
+	if len(result.Assignments) != 1 || result.Assignments[0].Shift.ShiftTimeID != 2 {
+		t.Fatalf("assignments = %+v, want the night shift only", result.Assignments)
+	}
+	if len(result.Shortfalls) != 1 || result.Shortfalls[0].ShiftTimeID != 1 || result.Shortfalls[0].Rejections[RejectRest] != 1 {
+		t.Errorf("shortfalls = %+v, want the day shift rejected for rest", result.Shortfalls)
+	}
+}
+
+func TestGenerateScore(t *testing.T) {
+	result := Generate(Input{
+		Shifts:      []Shift{dayShift(0), dayShift(1), dayShift(2)},
+		Staff:       []Staff{nurse(1, map[int]float64{1: 1}), nurse(2, nil), nurse(3, nil)},
+		Memberships: members(1, 2, 3),
+		Targets:     []Target{{DepartmentID: 1, RoleID: 1, Headcount: 2}},
+		Leaves:      []Leave{{StaffID: 3, Start: day0}},
+	})
+	want := Score{
+		SlotsRequired:     6,
+		SlotsFilled:       6,
+		PreferenceMatches: 3,
+		PreferenceRate:    0.5,
+		PreferenceScore:   3,
+		Staff: []StaffLoad{
+			{StaffID: 1, Assignments: 3, PreferenceMatches: 3},
+			{StaffID: 2, Assignments: 3},
+		},
+	}
+	if !reflect.DeepEqual(result.Score, want) {
+		t.Errorf("score = %+v, want %+v", result.Score, want)
+	}
+}
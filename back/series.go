@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"backend/querybuilder"
+)
+
+// Bucket sizes of a time series, from ?granularity=
+const (
+	GranularityDay     = "day"
+	GranularityWeek    = "week"
+	GranularityMonth   = "month"
+	GranularityQuarter = "quarter"
+)
+
+// date_trunc field and generate_series step of each granularity. Weeks are
+// ISO weeks, starting on Monday.
+var granularities = map[string]struct{ trunc, step string }{
+	GranularityDay:     {"day", "1 day"},
+	GranularityWeek:    {"week", "1 week"},
+	GranularityMonth:   {"month", "1 month"},
+	GranularityQuarter: {"quarter", "3 months"},
+}
+
+// What each series is for, from ?series_by=
+const (
+	SeriesByStaff      = "staff"
+	SeriesByDepartment = "department"
+	SeriesByRole       = "role"
+)
+
+// How to bucket a report into series
+type SeriesFilter struct {
+	Granularity string
+	By          string
+}
+
+// A bucket of a series. The series is one staff member in one department,
+// one department or one role; the dimensions it isn't split by are empty
+// (0 for the staff id). Period labels the bucket, e.g. 2024-03-05,
+// 2024-W10, 2024-03 or 2024-Q1.
+type SeriesPoint struct {
+	StaffID        int       `json:"staff_id"`
+	StaffName      string    `json:"staff_name"`
+	RoleName       string    `json:"role_name"`
+	DepartmentName string    `json:"department_name"`
+	Period         string    `json:"period"`
+	PeriodStart    time.Time `json:"period_start"`
+}
+
+// Parses granularity / series_by, nil when the report isn't bucketed
+func parseSeries(queryParams url.Values) (*SeriesFilter, error) {
+	series := &SeriesFilter{Granularity: queryParams.Get("granularity"), By: queryParams.Get("series_by")}
+	if series.Granularity == "" {
+		if series.By != "" {
+			return nil, errors.New("series_by needs a granularity")
+		}
+		return nil, nil
+	}
+	if _, ok := granularities[series.Granularity]; !ok {
+		return nil, errors.New("granularity must be day, week, month or quarter")
+	}
+	switch series.By {
+	case "":
+		series.By = SeriesByStaff
+	case SeriesByStaff, SeriesByDepartment, SeriesByRole:
+	default:
+		return nil, errors.New("series_by must be staff, department or role")
+	}
+	return series, nil
+}
+
+// The comparison and series modes of a report exclude each other
+func parseComparisonOrSeries(queryParams url.Values, start, end time.Time) (*ComparisonWindow, *SeriesFilter, error) {
+	comparison, err := parseComparison(queryParams, start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	series, err := parseSeries(queryParams)
+	if err != nil {
+		return nil, nil, err
+	}
+	if comparison != nil && series != nil {
+		return nil, nil, errors.New("compare_to and granularity can't be combined")
+	}
+	return comparison, series, nil
+}
+
+func bucketLabel(granularity string, start time.Time) string {
+	switch granularity {
+	case GranularityWeek:
+		year, week := start.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case GranularityMonth:
+		return start.Format("2006-01")
+	case GranularityQuarter:
+		return fmt.Sprintf("%d-Q%d", start.Year(), (int(start.Month())-1)/3+1)
+	default:
+		return start.Format(dateLayout)
+	}
+}
+
+// Select list of the series dimensions for a totals query over staff s,
+// roles r and departments d, and the columns to group it by
+func seriesDimensions(by string) (string, []string) {
+	switch by {
+	case SeriesByDepartment:
+		return "0 AS staff_id, '' AS staff_name, '' AS role_name, d.name AS department_name", []string{"d.name"}
+	case SeriesByRole:
+		return "0 AS staff_id, '' AS staff_name, r.name AS role_name, '' AS department_name", []string{"r.name"}
+	default:
+		return "s.id AS staff_id, s.name AS staff_name, r.name AS role_name, d.name AS department_name", []string{"s.id", "s.name", "r.name", "d.name"}
+	}
+}
+
+// Expression of the bucket a shift date falls in
+func bucketExpr(granularity, column string) string {
+	return fmt.Sprintf("date_trunc('%s', %s::timestamp)::date", granularities[granularity].trunc, column)
+}
+
+// Expands a totals query into zero-filled series. totals selects the
+// dimensions of seriesDimensions, the bucket (bucketExpr) and then the
+// metrics as v0, v1, ..., one row per bucket that has data. The result
+// holds every bucket between start and end (generate_series) for every
+// series with data in any of them, metrics of the empty buckets are 0.
+// The sums of each series over the window are series.t0, series.t1, ...
+// for range filters.
+func seriesQuery(totals *querybuilder.Builder, metrics int, granularity string, start, end time.Time) *querybuilder.Builder {
+	query, values := totals.Build()
+	g := granularities[granularity]
+
+	sums := make([]string, metrics)
+	selected := make([]string, metrics)
+	for i := range metrics {
+		sums[i] = fmt.Sprintf("SUM(v%d) AS t%d", i, i)
+		selected[i] = fmt.Sprintf("COALESCE(totals.v%d, 0)", i)
+	}
+
+	startArg, endArg := len(values)+1, len(values)+2
+	base := fmt.Sprintf(`
+        WITH totals AS (
+            %s
+        ),
+        series AS (
+            SELECT staff_id, staff_name, role_name, department_name, %s
+            FROM totals
+            GROUP BY staff_id, staff_name, role_name, department_name
+        ),
+        buckets AS (
+            SELECT generate_series(
+                date_trunc('%s', $%d::date::timestamp),
+                date_trunc('%s', $%d::date::timestamp),
+                INTERVAL '%s'
+            )::date AS bucket
+        )
+        SELECT
+            series.staff_id,
+            series.staff_name,
+            series.role_name,
+            series.department_name,
+            buckets.bucket,
+            %s
+        FROM
+            series
+        CROSS JOIN
+            buckets
+        LEFT JOIN
+            totals ON totals.staff_id = series.staff_id
+            AND totals.staff_name = series.staff_name
+            AND totals.role_name = series.role_name
+            AND totals.department_name = series.department_name
+            AND totals.bucket = buckets.bucket
+    `, query, strings.Join(sums, ", "), g.trunc, startArg, g.trunc, endArg, g.step, strings.Join(selected, ", "))
+
+	qb := querybuilder.New(base, append(values, start.Format(dateLayout), end.Format(dateLayout))...)
+	qb.OrderBy("series.staff_name", "series.department_name", "series.role_name", "series.staff_id", "buckets.bucket")
+	return qb
+}
+
+// Scans the dimensions and bucket of a series row, metrics go in dest
+func scanSeriesPoint(row rowScanner, granularity string, point *SeriesPoint, dest ...interface{}) error {
+	err := row.Scan(append([]interface{}{
+		&point.StaffID,
+		&point.StaffName,
+		&point.RoleName,
+		&point.DepartmentName,
+		&point.PeriodStart,
+	}, dest...)...)
+	point.Period = bucketLabel(granularity, point.PeriodStart)
+	return err
+}
@@ -0,0 +1,878 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"backend/querybuilder"
+
+	"github.com/lib/pq"
+)
+
+// Statuses of a shift offer, mirror the CHECK on shift_offers.status
+const (
+	OfferOpen      = "open"
+	OfferClaimed   = "claimed"
+	OfferApproved  = "approved"
+	OfferRejected  = "rejected"
+	OfferCancelled = "cancelled"
+)
+
+// Allowed status changes. A claim waits for a scheduler; approved, rejected
+// and cancelled offers are final.
+var offerTransitions = map[string][]string{
+	OfferOpen:    {OfferClaimed, OfferCancelled},
+	OfferClaimed: {OfferApproved, OfferRejected, OfferCancelled},
+}
+
+// Returned when a change doesn't follow offerTransitions
+type OfferTransitionError struct {
+	From string
+	To   string
+}
+
+func (e *OfferTransitionError) Error() string {
+	return fmt.Sprintf("Cannot move a shift offer from %s to %s", e.From, e.To)
+}
+
+func checkOfferTransition(from, to string) error {
+	if !slices.Contains(offerTransitions[from], to) {
+		return &OfferTransitionError{From: from, To: to}
+	}
+	return nil
+}
+
+var (
+	ErrUnknownAssignment = errors.New("assignment_id does not match any assignment")
+	ErrNotOwnAssignment  = errors.New("Only the staff member working a shift can offer or trade it")
+	ErrNotOfferOwner     = errors.New("Only the staff member who made the offer can cancel it")
+	ErrOwnOffer          = errors.New("A staff member can't claim their own offer")
+	ErrShiftStarted      = errors.New("The shift has already started")
+	ErrLiveOffer         = errors.New("The shift is already part of an open or claimed offer")
+	ErrOfferStale        = errors.New("The assignments changed since the offer was claimed")
+)
+
+// Returned when a staff member can't take a shift, with every rule they
+// break
+type IneligibleError struct {
+	StaffName string
+	Reasons   []string
+}
+
+func (e *IneligibleError) Error() string {
+	return fmt.Sprintf("%s can't take this shift: %s", e.StaffName, strings.Join(e.Reasons, "; "))
+}
+
+// A shift as offered, or as given in return for a swap
+type OfferedShift struct {
+	AssignmentID   int       `json:"assignment_id"`
+	Date           time.Time `json:"date"`
+	ShiftTime      string    `json:"shift_time"`
+	DepartmentName string    `json:"department_name"`
+	ShiftType      string    `json:"shift_type"`
+}
+
+// A row of shift_offers. SwapShift is the claimant's shift going to the
+// offerer, null for a plain give-away.
+type ShiftOffer struct {
+	ID            int           `json:"id"`
+	Status        string        `json:"status"`
+	Shift         OfferedShift  `json:"shift"`
+	RoleName      string        `json:"role_name"`
+	OfferedByID   int           `json:"offered_by_id"`
+	OfferedByName string        `json:"offered_by_name"`
+	Note          string        `json:"note"`
+	ClaimedByID   *int          `json:"claimed_by_id"`
+	ClaimedByName *string       `json:"claimed_by_name"`
+	SwapShift     *OfferedShift `json:"swap_shift"`
+	CreatedAt     time.Time     `json:"created_at"`
+	ClaimedAt     *time.Time    `json:"claimed_at"`
+	DecidedAt     *time.Time    `json:"decided_at"`
+}
+
+// Payload to offer one of your shifts
+type ShiftOfferInput struct {
+	AssignmentID int    `json:"assignment_id"`
+	Note         string `json:"note"`
+}
+
+func (in *ShiftOfferInput) Validate() error {
+	in.Note = strings.TrimSpace(in.Note)
+	if in.AssignmentID <= 0 {
+		return errors.New("assignment_id is required")
+	}
+	return nil
+}
+
+// Payload to claim an offer. StaffID defaults to the caller, only managers
+// claim for someone else; SwapAssignmentID turns the claim into a swap.
+type ShiftClaimInput struct {
+	StaffID          int  `json:"staff_id"`
+	SwapAssignmentID *int `json:"swap_assignment_id"`
+}
+
+// Filters for the offer listing. StaffID limits it to what a staff member
+// may see: their offers and claims, and the open offers of their role.
+type ShiftOfferFilter struct {
+	Statuses    []string
+	Departments []string
+	StaffID     *int
+}
+
+// ShiftOfferStore runs the shift marketplace. Assignments only change when
+// a scheduler approves a claim.
+type ShiftOfferStore interface {
+	ListOffers(ctx context.Context, filter ShiftOfferFilter) ([]ShiftOffer, error)
+	CreateOffer(ctx context.Context, input ShiftOfferInput, staffID *int) (ShiftOffer, error)
+	ClaimOffer(ctx context.Context, id, staffID int, swapAssignmentID *int) (ShiftOffer, error)
+	CancelOffer(ctx context.Context, id int, staffID *int) (ShiftOffer, error)
+	DecideOffer(ctx context.Context, id int, status string) (ShiftOffer, error)
+}
+
+type PostgresShiftOfferStore struct {
+	db *sql.DB
+}
+
+func NewPostgresShiftOfferStore(db *sql.DB) *PostgresShiftOfferStore {
+	return &PostgresShiftOfferStore{db: db}
+}
+
+// Offer with both shifts, the swap side is all nulls for give-aways
+const shiftOfferSelect = `
+        SELECT
+            so.id,
+            so.status,
+            sa.id,
+            sh.date,
+            st.name,
+            d.name,
+            sa.shift_type,
+            r.name,
+            so.offered_by,
+            o.name,
+            so.note,
+            so.claimed_by,
+            c.name,
+            xa.id,
+            xsh.date,
+            xst.name,
+            xd.name,
+            xa.shift_type,
+            so.created_at,
+            so.claimed_at,
+            so.decided_at
+        FROM
+            shift_offers so
+        JOIN
+            shift_assignments sa ON so.assignment_id = sa.id
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+        JOIN
+            departments d ON sa.department_id = d.id
+        JOIN
+            staff o ON so.offered_by = o.id
+        JOIN
+            roles r ON o.role_id = r.id
+        LEFT JOIN
+            staff c ON so.claimed_by = c.id
+        LEFT JOIN
+            (shift_assignments xa
+            JOIN shifts xsh ON xa.shift_id = xsh.id
+            JOIN shift_times xst ON xsh.shift_time_id = xst.id
+            JOIN departments xd ON xa.department_id = xd.id)
+            ON so.swap_assignment_id = xa.id
+    `
+
+func scanShiftOffer(row rowScanner) (ShiftOffer, error) {
+	var offer ShiftOffer
+	var claimedBy, swapID sql.NullInt64
+	var claimedByName, swapShiftTime, swapDepartment, swapType sql.NullString
+	var swapDate, claimedAt, decidedAt sql.NullTime
+	err := row.Scan(
+		&offer.ID,
+		&offer.Status,
+		&offer.Shift.AssignmentID,
+		&offer.Shift.Date,
+		&offer.Shift.ShiftTime,
+		&offer.Shift.DepartmentName,
+		&offer.Shift.ShiftType,
+		&offer.RoleName,
+		&offer.OfferedByID,
+		&offer.OfferedByName,
+		&offer.Note,
+		&claimedBy,
+		&claimedByName,
+		&swapID,
+		&swapDate,
+		&swapShiftTime,
+		&swapDepartment,
+		&swapType,
+		&offer.CreatedAt,
+		&claimedAt,
+		&decidedAt,
+	)
+	if claimedBy.Valid {
+		id := int(claimedBy.Int64)
+		offer.ClaimedByID = &id
+		offer.ClaimedByName = &claimedByName.String
+	}
+	if swapID.Valid {
+		offer.SwapShift = &OfferedShift{
+			AssignmentID:   int(swapID.Int64),
+			Date:           swapDate.Time,
+			ShiftTime:      swapShiftTime.String,
+			DepartmentName: swapDepartment.String,
+			ShiftType:      swapType.String,
+		}
+	}
+	if claimedAt.Valid {
+		offer.ClaimedAt = &claimedAt.Time
+	}
+	if decidedAt.Valid {
+		offer.DecidedAt = &decidedAt.Time
+	}
+	return offer, err
+}
+
+func getShiftOffer(ctx context.Context, q queryer, id int) (ShiftOffer, error) {
+	offer, err := scanShiftOffer(q.QueryRowContext(ctx, shiftOfferSelect+" WHERE so.id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return offer, ErrNotFound
+	}
+	return offer, err
+}
+
+// Locks an offer so concurrent claims and decisions are serialised
+func lockShiftOffer(ctx context.Context, tx *sql.Tx, id int) (ShiftOffer, error) {
+	if _, err := tx.ExecContext(ctx, "SELECT 1 FROM shift_offers WHERE id = $1 FOR UPDATE", id); err != nil {
+		return ShiftOffer{}, err
+	}
+	return getShiftOffer(ctx, tx, id)
+}
+
+// Applies set to an offer and records the change under action
+func updateShiftOffer(ctx context.Context, tx *sql.Tx, before ShiftOffer, action, set string, args ...interface{}) (ShiftOffer, error) {
+	_, err := tx.ExecContext(ctx, "UPDATE shift_offers SET "+set+" WHERE id = $1", append([]interface{}{before.ID}, args...)...)
+	if _, ok := pqViolation(err, "23505"); ok {
+		return before, ErrLiveOffer
+	}
+	if err != nil {
+		return before, err
+	}
+	after, err := getShiftOffer(ctx, tx, before.ID)
+	if err != nil {
+		return after, err
+	}
+	return after, recordAudit(ctx, tx, action, EntityShiftOffer, before.ID, before, after)
+}
+
+// Staff member working an assignment
+func assignmentOwner(ctx context.Context, q queryer, assignmentID int) (int, error) {
+	var staffID int
+	err := q.QueryRowContext(ctx, "SELECT staff_id FROM shift_assignments WHERE id = $1", assignmentID).Scan(&staffID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUnknownAssignment
+	}
+	return staffID, err
+}
+
+// Checks that staffID may take over assignmentID: the shift hasn't
+// started, and they are active, have the same role as its current owner,
+// belong to its department that day, aren't on approved leave, don't
+// already work that shift and keep the scheduler's rest between shifts.
+// leaving is a shift of theirs going away in the same change (the other
+// half of a swap), it doesn't count for the rest.
+func checkEligibility(ctx context.Context, q queryer, assignmentID, staffID int, leaving *int) error {
+	var name, startTime, endTime string
+	var date time.Time
+	var facts eligibilityFacts
+	err := q.QueryRowContext(ctx, `
+        SELECT
+            c.name,
+            c.active,
+            c.role_id = o.role_id,
+            EXISTS (
+                SELECT 1 FROM staff_departments sd
+                WHERE sd.staff_id = c.id
+                  AND sd.department_id = sa.department_id
+                  AND sd.start_date <= sh.date
+                  AND (sd.end_date IS NULL OR sd.end_date >= sh.date)
+            ),
+            EXISTS (
+                SELECT 1 FROM leave_requests lr
+                WHERE lr.staff_id = c.id
+                  AND lr.status = 'approved'
+                  AND lr.start_date <= sh.date
+                  AND (lr.end_date IS NULL OR lr.end_date >= sh.date)
+            ),
+            EXISTS (
+                SELECT 1 FROM shift_assignments x
+                WHERE x.staff_id = c.id AND x.shift_id = sa.shift_id
+            ),
+            sh.date,
+            st.start_time::text,
+            st.end_time::text
+        FROM
+            shift_assignments sa
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+        JOIN
+            staff o ON sa.staff_id = o.id
+        JOIN
+            staff c ON c.id = $2
+        WHERE
+            sa.id = $1
+    `, assignmentID, staffID).Scan(&name, &facts.active, &facts.sameRole, &facts.member, &facts.onLeave, &facts.assigned, &date, &startTime, &endTime)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := assignmentOwner(ctx, q, assignmentID); err != nil {
+			return err
+		}
+		return ErrUnknownStaff
+	}
+	if err != nil {
+		return err
+	}
+	facts.start, facts.end, err = shiftWindow(date, startTime, endTime)
+	if err != nil {
+		return err
+	}
+
+	// Their other shifts around that day, for the rest period
+	rows, err := q.QueryContext(ctx, `
+        SELECT sa.id, sh.date, st.start_time::text, st.end_time::text
+        FROM shift_assignments sa
+        JOIN shifts sh ON sa.shift_id = sh.id
+        JOIN shift_times st ON sh.shift_time_id = st.id
+        WHERE sa.staff_id = $1
+          AND sh.date BETWEEN $2::date - 2 AND $2::date + 2
+    `, staffID, date)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var others []scheduledShift
+	for rows.Next() {
+		var other scheduledShift
+		var otherDate time.Time
+		var otherStart, otherEnd string
+		if err := rows.Scan(&other.AssignmentID, &otherDate, &otherStart, &otherEnd); err != nil {
+			return err
+		}
+		if other.Start, other.End, err = shiftWindow(otherDate, otherStart, otherEnd); err != nil {
+			return err
+		}
+		others = append(others, other)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	facts.shortRest = breaksRest(facts.start, facts.end, others, leaving, defaultMinRestHours*time.Hour)
+
+	if reasons := facts.reasons(time.Now()); len(reasons) > 0 {
+		return &IneligibleError{StaffName: name, Reasons: reasons}
+	}
+	return nil
+}
+
+// What checkEligibility learns about a candidate and the shift they'd take
+type eligibilityFacts struct {
+	start, end time.Time
+	active     bool
+	sameRole   bool
+	member     bool
+	onLeave    bool
+	assigned   bool
+	shortRest  bool
+}
+
+// Every rule the candidate breaks, in the order they're reported
+func (f eligibilityFacts) reasons(now time.Time) []string {
+	var reasons []string
+	if !f.start.After(now) {
+		reasons = append(reasons, "the shift has already started")
+	}
+	if !f.active {
+		reasons = append(reasons, "is inactive")
+	}
+	if !f.sameRole {
+		reasons = append(reasons, "has a different role")
+	}
+	if !f.member {
+		reasons = append(reasons, "doesn't belong to the shift's department that day")
+	}
+	if f.onLeave {
+		reasons = append(reasons, "is on approved leave that day")
+	}
+	if f.assigned {
+		reasons = append(reasons, "already works that shift")
+	}
+	if f.shortRest {
+		reasons = append(reasons, fmt.Sprintf("would rest less than %d hours between shifts", defaultMinRestHours))
+	}
+	return reasons
+}
+
+// One of the candidate's assignments, as a wall-clock window
+type scheduledShift struct {
+	AssignmentID int
+	Start, End   time.Time
+}
+
+// Whether taking the start-end shift leaves less than minRest between it
+// and any of others. leaving is skipped, the same shift is reported as
+// already worked instead.
+func breaksRest(start, end time.Time, others []scheduledShift, leaving *int, minRest time.Duration) bool {
+	for _, other := range others {
+		if leaving != nil && other.AssignmentID == *leaving {
+			continue
+		}
+		if other.Start.Equal(start) && other.End.Equal(end) {
+			continue
+		}
+		if start.Before(other.End.Add(minRest)) && other.Start.Before(end.Add(minRest)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *PostgresShiftOfferStore) ListOffers(ctx context.Context, filter ShiftOfferFilter) ([]ShiftOffer, error) {
+	qb := querybuilder.New(shiftOfferSelect)
+	qb.Where(querybuilder.In("so.status", filter.Statuses))
+	qb.Where(querybuilder.In("d.name", filter.Departments))
+	if filter.StaffID != nil {
+		qb.Where(querybuilder.Or(
+			querybuilder.Eq("so.offered_by", *filter.StaffID),
+			querybuilder.Eq("so.claimed_by", *filter.StaffID),
+			querybuilder.Expr("so.status = 'open' AND o.role_id = (SELECT role_id FROM staff WHERE id = %s)", *filter.StaffID),
+		))
+	}
+	qb.OrderBy("sh.date", "st.start_time", "so.id")
+
+	query, values := qb.Build()
+	return listRows(ctx, s.db, query, values, scanShiftOffer)
+}
+
+// Opens an offer for an assignment that hasn't started. staffID, when set,
+// must be the assignment's owner (staff users offer only their shifts).
+func (s *PostgresShiftOfferStore) CreateOffer(ctx context.Context, input ShiftOfferInput, staffID *int) (ShiftOffer, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ShiftOffer{}, err
+	}
+	defer tx.Rollback()
+
+	shiftLog, err := lockAssignmentLog(ctx, tx, input.AssignmentID)
+	if errors.Is(err, ErrNotFound) {
+		return ShiftOffer{}, ErrUnknownAssignment
+	}
+	if err != nil {
+		return ShiftOffer{}, err
+	}
+	owner, err := assignmentOwner(ctx, tx, input.AssignmentID)
+	if err != nil {
+		return ShiftOffer{}, err
+	}
+	if staffID != nil && *staffID != owner {
+		return ShiftOffer{}, ErrNotOwnAssignment
+	}
+	if !shiftLog.ScheduledStart.After(time.Now()) {
+		return ShiftOffer{}, ErrShiftStarted
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO shift_offers (assignment_id, offered_by, note)
+        VALUES ($1, $2, $3)
+        RETURNING id
+    `, input.AssignmentID, owner, input.Note).Scan(&id)
+	if _, ok := pqViolation(err, "23505"); ok {
+		return ShiftOffer{}, ErrLiveOffer
+	}
+	if err != nil {
+		return ShiftOffer{}, err
+	}
+	offer, err := getShiftOffer(ctx, tx, id)
+	if err != nil {
+		return offer, err
+	}
+	if err := recordAudit(ctx, tx, AuditCreate, EntityShiftOffer, id, nil, offer); err != nil {
+		return offer, err
+	}
+	return offer, tx.Commit()
+}
+
+// Claims an open offer for staffID, optionally giving swapAssignmentID in
+// return. Both sides must be eligible for the shift they'd get.
+func (s *PostgresShiftOfferStore) ClaimOffer(ctx context.Context, id, staffID int, swapAssignmentID *int) (ShiftOffer, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ShiftOffer{}, err
+	}
+	defer tx.Rollback()
+
+	offer, err := lockShiftOffer(ctx, tx, id)
+	if err != nil {
+		return offer, err
+	}
+	if err := checkOfferTransition(offer.Status, OfferClaimed); err != nil {
+		return offer, err
+	}
+	if staffID == offer.OfferedByID {
+		return offer, ErrOwnOffer
+	}
+	if swapAssignmentID != nil {
+		owner, err := assignmentOwner(ctx, tx, *swapAssignmentID)
+		if err != nil {
+			return offer, err
+		}
+		if owner != staffID {
+			return offer, ErrNotOwnAssignment
+		}
+	}
+	if err := checkTrade(ctx, tx, offer.Shift.AssignmentID, offer.OfferedByID, staffID, swapAssignmentID); err != nil {
+		return offer, err
+	}
+
+	offer, err = updateShiftOffer(ctx, tx, offer, AuditClaim,
+		"status = 'claimed', claimed_by = $2, swap_assignment_id = $3, claimed_at = now()",
+		staffID, swapAssignmentID)
+	if err != nil {
+		return offer, err
+	}
+	return offer, tx.Commit()
+}
+
+// Eligibility of both sides of a trade: the claimant for the offered
+// shift and, in a swap, the offerer for the shift given in return
+func checkTrade(ctx context.Context, q queryer, assignmentID, offeredBy, claimedBy int, swapAssignmentID *int) error {
+	if err := checkEligibility(ctx, q, assignmentID, claimedBy, swapAssignmentID); err != nil {
+		return err
+	}
+	if swapAssignmentID == nil {
+		return nil
+	}
+	return checkEligibility(ctx, q, *swapAssignmentID, offeredBy, &assignmentID)
+}
+
+// Withdraws an open or claimed offer. staffID, when set, must be the
+// offerer.
+func (s *PostgresShiftOfferStore) CancelOffer(ctx context.Context, id int, staffID *int) (ShiftOffer, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ShiftOffer{}, err
+	}
+	defer tx.Rollback()
+
+	offer, err := lockShiftOffer(ctx, tx, id)
+	if err != nil {
+		return offer, err
+	}
+	if staffID != nil && *staffID != offer.OfferedByID {
+		return offer, ErrNotOfferOwner
+	}
+	if err := checkOfferTransition(offer.Status, OfferCancelled); err != nil {
+		return offer, err
+	}
+	offer, err = updateShiftOffer(ctx, tx, offer, AuditCancel, "status = 'cancelled', decided_at = now()")
+	if err != nil {
+		return offer, err
+	}
+	return offer, tx.Commit()
+}
+
+// Snapshot of a reassigned shift for the audit trail
+type shiftReassignment struct {
+	AssignmentID int `json:"assignment_id"`
+	StaffID      int `json:"staff_id"`
+}
+
+// Approves or rejects a claim. Approving re-checks everything under lock
+// and moves the assignments in the same transaction, so the leave and
+// on-call triggers see the final owners and any violation rolls it all
+// back. Other live offers of the traded shifts are cancelled.
+func (s *PostgresShiftOfferStore) DecideOffer(ctx context.Context, id int, status string) (ShiftOffer, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ShiftOffer{}, err
+	}
+	defer tx.Rollback()
+
+	offer, err := lockShiftOffer(ctx, tx, id)
+	if err != nil {
+		return offer, err
+	}
+	if err := checkOfferTransition(offer.Status, status); err != nil {
+		return offer, err
+	}
+	action := AuditDeny
+	if status == OfferApproved {
+		action = AuditApprove
+		if err := reassignOffer(ctx, tx, offer); err != nil {
+			return offer, err
+		}
+	}
+	offer, err = updateShiftOffer(ctx, tx, offer, action, "status = $2, decided_at = now()", status)
+	if err != nil {
+		return offer, err
+	}
+	return offer, tx.Commit()
+}
+
+// An assignment changing hands in an approved trade
+type shiftMove struct {
+	assignmentID int
+	from         int
+	to           int
+}
+
+func reassignOffer(ctx context.Context, tx *sql.Tx, offer ShiftOffer) error {
+	moves := []shiftMove{{offer.Shift.AssignmentID, offer.OfferedByID, *offer.ClaimedByID}}
+	var swapID *int
+	if offer.SwapShift != nil {
+		swapID = &offer.SwapShift.AssignmentID
+		moves = append(moves, shiftMove{*swapID, *offer.ClaimedByID, offer.OfferedByID})
+	}
+
+	// Lock in id order so two approvals touching the same shifts can't
+	// deadlock
+	slices.SortFunc(moves, func(a, b shiftMove) int {
+		return a.assignmentID - b.assignmentID
+	})
+	for _, move := range moves {
+		shiftLog, err := lockAssignmentLog(ctx, tx, move.assignmentID)
+		if err != nil {
+			return err
+		}
+		if !shiftLog.ScheduledStart.After(time.Now()) {
+			return ErrShiftStarted
+		}
+		owner, err := assignmentOwner(ctx, tx, move.assignmentID)
+		if err != nil {
+			return err
+		}
+		if owner != move.from {
+			return ErrOfferStale
+		}
+	}
+	if err := checkTrade(ctx, tx, offer.Shift.AssignmentID, offer.OfferedByID, *offer.ClaimedByID, swapID); err != nil {
+		return err
+	}
+
+	traded := make([]int, len(moves))
+	for i, move := range moves {
+		if _, err := tx.ExecContext(ctx, "UPDATE shift_assignments SET staff_id = $1 WHERE id = $2", move.to, move.assignmentID); err != nil {
+			return err
+		}
+		err := recordAudit(ctx, tx, AuditUpdate, EntityShiftAssignment, move.assignmentID,
+			shiftReassignment{move.assignmentID, move.from}, shiftReassignment{move.assignmentID, move.to})
+		if err != nil {
+			return err
+		}
+		traded[i] = move.assignmentID
+	}
+
+	// The traded shifts changed hands, offers made by their old owners
+	// no longer hold
+	rows, err := tx.QueryContext(ctx, `
+        SELECT id FROM shift_offers
+        WHERE id <> $1
+          AND status IN ('open', 'claimed')
+          AND (assignment_id = ANY($2) OR swap_assignment_id = ANY($2))
+        FOR UPDATE
+    `, offer.ID, pq.Array(traded))
+	if err != nil {
+		return err
+	}
+	stale, err := scanIDs(rows)
+	if err != nil {
+		return err
+	}
+	for _, staleID := range stale {
+		before, err := getShiftOffer(ctx, tx, staleID)
+		if err != nil {
+			return err
+		}
+		if _, err := updateShiftOffer(ctx, tx, before, AuditCancel, "status = 'cancelled', decided_at = now()"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads a single int column, closing rows
+func scanIDs(rows *sql.Rows) ([]int, error) {
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Maps marketplace errors to status codes
+func writeShiftOfferError(w http.ResponseWriter, err error) {
+	var transitionErr *OfferTransitionError
+	var ineligibleErr *IneligibleError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "Shift offer not found", http.StatusNotFound)
+	case errors.Is(err, ErrNotOwnAssignment), errors.Is(err, ErrNotOfferOwner):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.As(err, &transitionErr), errors.Is(err, ErrShiftStarted),
+		errors.Is(err, ErrLiveOffer), errors.Is(err, ErrOfferStale):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.As(err, &ineligibleErr), errors.Is(err, ErrOwnOffer),
+		errors.Is(err, ErrUnknownAssignment), errors.Is(err, ErrUnknownStaff):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		// The leave and on-call triggers have the last word on the move
+		if _, ok := pqViolation(err, "P0001"); ok {
+			http.Error(w, "Trade rejected by the database: "+err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Error processing shift offer: %v", err)
+		http.Error(w, "Failed to process shift offer", http.StatusInternalServerError)
+	}
+}
+
+// The caller's staff id when they may only act as themselves, only admins
+// and schedulers trade shifts on behalf of others
+func staffScope(claims Claims) *int {
+	if claims.Role == RoleAdmin || claims.Role == RoleScheduler {
+		return nil
+	}
+	if claims.StaffID == nil {
+		return new(int) // no staff row, matches nobody
+	}
+	return claims.StaffID
+}
+
+func ListShiftOffersHandler(store ShiftOfferStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queryParams := r.URL.Query()
+		filter := ShiftOfferFilter{
+			Statuses:    queryValues(queryParams, "status"),
+			Departments: queryValues(queryParams, "department"),
+		}
+		// Department heads see their departments' offers, ScopeDepartments
+		// already narrowed ?department=
+		if claims := claimsFrom(r.Context()); claims.Role != RoleDepartmentHead {
+			filter.StaffID = staffScope(claims)
+		}
+
+		offers, err := store.ListOffers(r.Context(), filter)
+		if err != nil {
+			writeShiftOfferError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, offers)
+	}
+}
+
+func CreateShiftOfferHandler(store ShiftOfferStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input ShiftOfferInput
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := input.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		offer, err := store.CreateOffer(r.Context(), input, staffScope(claimsFrom(r.Context())))
+		if err != nil {
+			writeShiftOfferError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, offer)
+	}
+}
+
+func ClaimShiftOfferHandler(store ShiftOfferStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid shift offer id", http.StatusBadRequest)
+			return
+		}
+		var input ShiftClaimInput
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Staff claim for themselves, managers name who takes the shift
+		claims := claimsFrom(r.Context())
+		if input.StaffID == 0 && claims.StaffID != nil {
+			input.StaffID = *claims.StaffID
+		}
+		if input.StaffID <= 0 {
+			http.Error(w, "staff_id is required", http.StatusBadRequest)
+			return
+		}
+		if staffScope(claims) != nil && !claims.isStaff(input.StaffID) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		offer, err := store.ClaimOffer(r.Context(), id, input.StaffID, input.SwapAssignmentID)
+		if err != nil {
+			writeShiftOfferError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, offer)
+	}
+}
+
+func CancelShiftOfferHandler(store ShiftOfferStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid shift offer id", http.StatusBadRequest)
+			return
+		}
+
+		offer, err := store.CancelOffer(r.Context(), id, staffScope(claimsFrom(r.Context())))
+		if err != nil {
+			writeShiftOfferError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, offer)
+	}
+}
+
+// Builds the approve / reject handlers, they only differ in the target status
+func DecideShiftOfferHandler(store ShiftOfferStore, status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid shift offer id", http.StatusBadRequest)
+			return
+		}
+
+		offer, err := store.DecideOffer(r.Context(), id, status)
+		if err != nil {
+			writeShiftOfferError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, offer)
+	}
+}
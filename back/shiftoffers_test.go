@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckOfferTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		allowed  bool
+	}{
+		{OfferOpen, OfferClaimed, true},
+		{OfferOpen, OfferCancelled, true},
+		{OfferClaimed, OfferApproved, true},
+		{OfferClaimed, OfferRejected, true},
+		{OfferClaimed, OfferCancelled, true},
+		{OfferOpen, OfferApproved, false},
+		{OfferOpen, OfferRejected, false},
+		{OfferClaimed, OfferOpen, false},
+		{OfferApproved, OfferCancelled, false},
+		{OfferRejected, OfferClaimed, false},
+		{OfferCancelled, OfferOpen, false},
+	}
+	for _, tt := range tests {
+		err := checkOfferTransition(tt.from, tt.to)
+		if tt.allowed && err != nil {
+			t.Errorf("%s -> %s: %v, want allowed", tt.from, tt.to, err)
+		}
+		var transitionErr *OfferTransitionError
+		if !tt.allowed && !errors.As(err, &transitionErr) {
+			t.Errorf("%s -> %s: %v, want an OfferTransitionError", tt.from, tt.to, err)
+		}
+	}
+}
+
+func TestEligibilityReasons(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.Local)
+	eligible := eligibilityFacts{
+		start:    now.Add(24 * time.Hour),
+		end:      now.Add(32 * time.Hour),
+		active:   true,
+		sameRole: true,
+		member:   true,
+	}
+	if reasons := eligible.reasons(now); reasons != nil {
+		t.Errorf("eligible candidate: reasons = %q, want none", reasons)
+	}
+
+	started := eligible
+	started.start = now
+	if reasons := started.reasons(now); !reflect.DeepEqual(reasons, []string{"the shift has already started"}) {
+		t.Errorf("shift starting now: reasons = %q", reasons)
+	}
+
+	all := eligibilityFacts{start: now.Add(-time.Hour), end: now.Add(7 * time.Hour), onLeave: true, assigned: true, shortRest: true}
+	want := []string{
+		"the shift has already started",
+		"is inactive",
+		"has a different role",
+		"doesn't belong to the shift's department that day",
+		"is on approved leave that day",
+		"already works that shift",
+		"would rest less than 11 hours between shifts",
+	}
+	reasons := all.reasons(now)
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("every rule broken: reasons = %q, want %q", reasons, want)
+	}
+	err := &IneligibleError{StaffName: "Ana", Reasons: reasons[1:3]}
+	if got := err.Error(); got != "Ana can't take this shift: is inactive; has a different role" {
+		t.Errorf("Error() = %q", got)
+	}
+}
+
+func TestBreaksRest(t *testing.T) {
+	window := func(d, start, end string) (time.Time, time.Time) {
+		s, e, err := shiftWindow(date(d), start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, e
+	}
+	shift := func(id int, d, start, end string) scheduledShift {
+		s, e := window(d, start, end)
+		return scheduledShift{AssignmentID: id, Start: s, End: e}
+	}
+	minRest := defaultMinRestHours * time.Hour
+
+	// The shift being taken, a morning 07:00-15:00
+	start, end := window("2024-03-05", "07:00:00", "15:00:00")
+	leaving := 2
+
+	tests := []struct {
+		name    string
+		others  []scheduledShift
+		leaving *int
+		breaks  bool
+	}{
+		{"no other shifts", nil, nil, false},
+		{"overnight the night before ends 07:00", []scheduledShift{shift(1, "2024-03-04", "23:00:00", "07:00:00")}, nil, true},
+		{"afternoon the day before, 8h rest", []scheduledShift{shift(1, "2024-03-04", "15:00:00", "23:00:00")}, nil, true},
+		{"rest exactly 11h after", []scheduledShift{shift(1, "2024-03-06", "02:00:00", "06:00:00")}, nil, false},
+		{"rest an hour short after", []scheduledShift{shift(1, "2024-03-06", "01:00:00", "06:00:00")}, nil, true},
+		{"same morning the day after", []scheduledShift{shift(1, "2024-03-06", "07:00:00", "15:00:00")}, nil, false},
+		{"same shift, reported as already worked", []scheduledShift{shift(1, "2024-03-05", "07:00:00", "15:00:00")}, nil, false},
+		{"swap gives away the clashing shift", []scheduledShift{shift(2, "2024-03-04", "23:00:00", "07:00:00")}, &leaving, false},
+		{"swap gives away another shift", []scheduledShift{shift(2, "2024-03-06", "07:00:00", "15:00:00"), shift(3, "2024-03-04", "23:00:00", "07:00:00")}, &leaving, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := breaksRest(start, end, tt.others, tt.leaving, minRest); got != tt.breaks {
+				t.Errorf("breaksRest = %v, want %v", got, tt.breaks)
+			}
+		})
+	}
+}
@@ -1,205 +1,228 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"backend/querybuilder"
+
+	"github.com/lib/pq"
 )
 
 // Struct to hold Staff Preference Report
 type StaffPreferenceReport struct {
-	StaffID                        int     `json:"staff_id"`
-	StaffName                      string  `json:"staff_name"`
-	RoleName                       string  `json:"role_name"`
-	Departments                    *string `json:"departments"`
-	PreferredShiftTimes            *string `json:"preferred_shift_times"`
-	TotalAssignmentsCount          int     `json:"total_assignments_count"`
-	PreferredShiftAssignmentsCount int     `json:"preferred_shift_assignments_count"`
-	PreferenceFulfillmentRate      float64 `json:"preference_fulfillment_rate"`
+	StaffID                        int                     `json:"staff_id"`
+	StaffName                      string                  `json:"staff_name"`
+	RoleName                       string                  `json:"role_name"`
+	Departments                    *string                 `json:"departments"`
+	PreferredShiftTimes            *string                 `json:"preferred_shift_times"`
+	TotalAssignmentsCount          int                     `json:"total_assignments_count" total:"sum"`
+	PreferredShiftAssignmentsCount int                     `json:"preferred_shift_assignments_count" total:"sum"`
+	PreferenceFulfillmentRate      float64                 `json:"preference_fulfillment_rate"`
+	Preferences                    []PreferenceFulfillment `json:"preferences"`
+}
+
+// Assignments of a staff member on one of their preferred shift times,
+// the rate is their share of all the staff member's assignments
+type PreferenceFulfillment struct {
+	ShiftTime   string  `json:"shift_time"`
+	Assignments int     `json:"assignments"`
+	Rate        float64 `json:"rate"`
+}
+
+// e.g. "Night 3 (0.50)", for the exported preference list
+func (p PreferenceFulfillment) String() string {
+	return fmt.Sprintf("%s %d (%.2f)", p.ShiftTime, p.Assignments, p.Rate)
 }
 
-func GetStaffPreferenceAnalysisReportHandler(w http.ResponseWriter, r *http.Request) {
-	query := `
+// Filters accepted by the staff preference report. Preferred shift times
+// keep staff preferring any of them, assigned shift times narrow the
+// assignments counted.
+type StaffPreferenceFilter struct {
+	StartDate           time.Time
+	EndDate             time.Time
+	Roles               []string
+	Departments         []string
+	PreferredShiftTimes []string
+	AssignedShiftTimes  []string
+	HasAssignments      bool
+	// Sort and page, applied by the query
+	Paging reportPaging
+}
+
+func (s *PostgresReportStore) StaffPreference(ctx context.Context, filter StaffPreferenceFilter) ReportRows[StaffPreferenceReport] {
+	// Assignments per staff member and shift time, counted on their own so
+	// preferences and departments can't multiply them. $1 and $2 are the
+	// window, the outer query reuses them.
+	counted := querybuilder.New(`
+        SELECT
+            sa.staff_id,
+            sh.shift_time_id,
+            COUNT(*) AS assignments
+        FROM
+            shift_assignments sa
+        JOIN
+            shifts sh ON sa.shift_id = sh.id
+        JOIN
+            shift_times st ON sh.shift_time_id = st.id
+        JOIN
+            departments d ON sa.department_id = d.id
+    `, filter.StartDate, filter.EndDate)
+	counted.Where(querybuilder.Raw("sh.date BETWEEN $1 AND $2"))
+	counted.Where(querybuilder.In("d.name", filter.Departments))
+	counted.Where(querybuilder.In("st.name", filter.AssignedShiftTimes))
+	counted.GroupBy("sa.staff_id", "sh.shift_time_id")
+	countedQuery, values := counted.Build()
+
+	// One row per staff member with their totals, and their preferences in
+	// shift start order with the counts in a parallel array
+	const preferences = `
+                FROM (SELECT DISTINCT shift_time_id FROM staff_shift_preferences WHERE staff_id = s.id) p
+                JOIN shift_times st ON p.shift_time_id = st.id
+                LEFT JOIN counted c ON c.staff_id = s.id AND c.shift_time_id = p.shift_time_id`
+	qb := querybuilder.New(fmt.Sprintf(`
+        WITH counted AS (
+            %s
+        )
         SELECT
             s.id AS staff_id,
             s.name AS staff_name,
             r.name AS role_name,
-            STRING_AGG(DISTINCT d.name, ', ') AS departments,
-            STRING_AGG(DISTINCT st_pref.name, ', ') AS preferred_shift_times,
-            COUNT(sa.id) AS total_assignments_count,
-            COUNT(CASE WHEN ssp.shift_time_id = sh.shift_time_id THEN sa.id ELSE NULL END) AS preferred_shift_assignments_count,
+            (
+                SELECT STRING_AGG(DISTINCT d.name, ', ')
+                FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = s.id
+                  AND sd.start_date <= $2
+                  AND (sd.end_date IS NULL OR sd.end_date >= $1)
+            ) AS departments,
+            COALESCE(t.total, 0) AS total_assignments_count,
+            COALESCE(t.preferred, 0) AS preferred_shift_assignments_count,
             CASE
-                WHEN COUNT(sa.id) > 0 THEN CAST(COUNT(CASE WHEN ssp.shift_time_id = sh.shift_time_id THEN sa.id ELSE NULL END) AS DECIMAL) / COUNT(sa.id)
+                WHEN t.total > 0 THEN CAST(COALESCE(t.preferred, 0) AS DECIMAL) / t.total
                 ELSE 0
-            END AS preference_fulfillment_rate
+            END AS preference_fulfillment_rate,
+            ARRAY(SELECT st.name%s ORDER BY st.start_time) AS preferred_shift_times,
+            ARRAY(SELECT COALESCE(c.assignments, 0)%s ORDER BY st.start_time) AS preferred_assignments
         FROM
             staff s
         JOIN
             roles r ON s.role_id = r.id
-        LEFT JOIN
-            staff_departments sd ON s.id = sd.staff_id
-        LEFT JOIN
-            departments d ON sd.department_id = d.id
-        LEFT JOIN
-            shift_assignments sa ON s.id = sa.staff_id
-        LEFT JOIN
-            shifts sh ON sa.shift_id = sh.id
-        LEFT JOIN
-            staff_shift_preferences ssp ON s.id = ssp.staff_id
-        LEFT JOIN
-            shift_times st_pref ON ssp.shift_time_id = st_pref.id
-				WHERE
-						sh.date BETWEEN $1 AND $2
-    `
-
-	// Collect the filters from the URL query parameters
-	queryParams := r.URL.Query()
-
-	// Build the WHERE and HAVING clauses dynamically
-	var conditions []string
-	var havingConditions []string
-	var values []interface{}
-	argCount := 3 // Parameter counter for parameterized queries
-
-	// Required date range filter
-	startDate := queryParams.Get("start_date")
-	endDate := queryParams.Get("end_date")
-
-	if startDate == "" || endDate == "" {
-		http.Error(w, "Start date and end date are required", http.StatusBadRequest)
-		return
-	}
-
-	values = append(values, startDate, endDate)
-
-	// Role filter, builds query & increments argCount
-	role := queryParams.Get("role")
-	if role != "" {
-		conditions = append(conditions, fmt.Sprintf("r.name = $%d", argCount))
-		values = append(values, role)
-		argCount++
-	}
-
-	// Department filter, builds query & increments argCount
-	department := queryParams.Get("department")
-	if department != "" {
-		conditions = append(conditions, fmt.Sprintf("d.name = $%d", argCount))
-		values = append(values, department)
-		argCount++
-	}
-
-	// Shift times, was planned to be multiple but ended as single param
-	preferredShifts := queryParams["preferred_shift_time"]
-	if len(preferredShifts) > 0 {
-		placeholders := make([]string, len(preferredShifts))
-		for i := range preferredShifts {
-			placeholders[i] = fmt.Sprintf("$%d", argCount+i)
-		}
-		conditions = append(conditions, fmt.Sprintf("st_pref.name IN (%s)", strings.Join(placeholders, ", ")))
-		for _, shift := range preferredShifts {
-			values = append(values, shift)
-		}
-		argCount += len(preferredShifts)
-	}
-
-	// Assigned shift, was planned to be multiple but ended as single param
-	assignedShifts := queryParams["assigned_shift_time"]
-	if len(assignedShifts) > 0 {
-		placeholders := make([]string, len(assignedShifts))
-		for i := range assignedShifts {
-			placeholders[i] = fmt.Sprintf("$%d", argCount+i)
-		}
-		conditions = append(conditions, fmt.Sprintf("(sh.shift_time_id IS NULL OR sh.shift_time_id IN (SELECT id FROM shift_times WHERE name IN (%s)))", strings.Join(placeholders, ", ")))
-		for _, shift := range assignedShifts {
-			values = append(values, shift)
-		}
-		argCount += len(assignedShifts)
+        LEFT JOIN LATERAL (
+            SELECT
+                SUM(c.assignments) AS total,
+                SUM(c.assignments) FILTER (WHERE c.shift_time_id IN (
+                    SELECT ssp.shift_time_id FROM staff_shift_preferences ssp WHERE ssp.staff_id = s.id
+                )) AS preferred
+            FROM
+                counted c
+            WHERE
+                c.staff_id = s.id
+        ) t ON TRUE
+    `, countedQuery, preferences, preferences), values...)
+
+	qb.Where(querybuilder.In("r.name", filter.Roles))
+	if len(filter.Departments) > 0 {
+		qb.Where(func(args *querybuilder.Args) string {
+			return `EXISTS (
+                SELECT 1 FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = s.id
+                  AND sd.start_date <= $2
+                  AND (sd.end_date IS NULL OR sd.end_date >= $1)
+                  AND ` + querybuilder.In("d.name", filter.Departments)(args) + `)`
+		})
 	}
-
-	if len(conditions) > 0 {
-		query += " AND " + strings.Join(conditions, " AND ")
-	}
-
-	hasAssignments := queryParams.Get("has_assignments")
-	if strings.ToLower(hasAssignments) == "true" {
-		havingConditions = append(havingConditions, "COUNT(sa.id) > 0")
+	if len(filter.PreferredShiftTimes) > 0 {
+		qb.Where(func(args *querybuilder.Args) string {
+			return `EXISTS (
+                SELECT 1 FROM staff_shift_preferences ssp
+                JOIN shift_times st ON ssp.shift_time_id = st.id
+                WHERE ssp.staff_id = s.id
+                  AND ` + querybuilder.In("st.name", filter.PreferredShiftTimes)(args) + `)`
+		})
 	}
-
-	// Combine the HAVING clause conditions
-	if len(havingConditions) > 0 {
-		query += " HAVING " + strings.Join(havingConditions, " AND ")
+	if filter.HasAssignments {
+		qb.Where(querybuilder.Raw("t.total > 0"))
 	}
 
-	// Add GROUP BY
-	query += `
-    GROUP BY
-        s.id, s.name, r.name
-    `
-
-	// Add ORDER BY
-	query += " ORDER BY preference_fulfillment_rate DESC"
+	return scanPage(ctx, s, qb, filter.Paging,
+		[]string{"staff_id", "staff_name", "role_name", "departments", "total_assignments_count", "preferred_shift_assignments_count", "preference_fulfillment_rate"},
+		[]string{"preference_fulfillment_rate DESC", "staff_name", "staff_id"},
+		func(row rowScanner, report *StaffPreferenceReport) error {
+			var departments sql.NullString
+			var shiftTimes pq.StringArray
+			var assignments pq.Int64Array
+
+			err := row.Scan(
+				&report.StaffID,
+				&report.StaffName,
+				&report.RoleName,
+				&departments,
+				&report.TotalAssignmentsCount,
+				&report.PreferredShiftAssignmentsCount,
+				&report.PreferenceFulfillmentRate,
+				&shiftTimes,
+				&assignments,
+			)
+			if err != nil {
+				return err
+			}
+			if departments.Valid {
+				report.Departments = &departments.String
+			}
+			if len(shiftTimes) > 0 {
+				joined := strings.Join(shiftTimes, ", ")
+				report.PreferredShiftTimes = &joined
+			}
+
+			report.Preferences = make([]PreferenceFulfillment, len(shiftTimes))
+			for i, shiftTime := range shiftTimes {
+				preference := PreferenceFulfillment{ShiftTime: shiftTime, Assignments: int(assignments[i])}
+				if report.TotalAssignmentsCount > 0 {
+					preference.Rate = float64(preference.Assignments) / float64(report.TotalAssignmentsCount)
+				}
+				report.Preferences[i] = preference
+			}
+			return nil
+		})
+}
 
-	log.Println("Executing query:", query)
-	log.Println("With values:", values)
+func GetStaffPreferenceAnalysisReportHandler(store ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Collect the filters from the URL query parameters
+		queryParams := r.URL.Query()
 
-	// Execute the query
-	rows, err := db.Query(query, values...)
-	if err != nil {
-		log.Printf("Error querying staff preference analysis report: %v", err)
-		http.Error(w, "Failed to fetch staff preference analysis report", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	// Process the results
-	var reports []StaffPreferenceReport
-	for rows.Next() {
-		var report StaffPreferenceReport
-		var departments sql.NullString
-		var preferredShiftTimes sql.NullString
-
-		err := rows.Scan(
-			&report.StaffID,
-			&report.StaffName,
-			&report.RoleName,
-			&departments,
-			&preferredShiftTimes,
-			&report.TotalAssignmentsCount,
-			&report.PreferredShiftAssignmentsCount,
-			&report.PreferenceFulfillmentRate,
-		)
+		// Required date range filter
+		startDate, endDate, err := requiredDateRange(queryParams)
 		if err != nil {
-			log.Printf("Error scanning staff preference report row: %v", err)
-			http.Error(w, "Failed to process report data", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if departments.Valid {
-			report.Departments = &departments.String
-		} else {
-			report.Departments = nil
-		}
-		if preferredShiftTimes.Valid {
-			report.PreferredShiftTimes = &preferredShiftTimes.String
-		} else {
-			report.PreferredShiftTimes = nil
+		filter := StaffPreferenceFilter{
+			StartDate:           startDate,
+			EndDate:             endDate,
+			Roles:               queryValues(queryParams, "role"),
+			Departments:         queryValues(queryParams, "department"),
+			PreferredShiftTimes: queryValues(queryParams, "preferred_shift_time"),
+			AssignedShiftTimes:  queryValues(queryParams, "assigned_shift_time"),
+			HasAssignments:      strings.ToLower(queryParams.Get("has_assignments")) == "true",
 		}
 
-		reports = append(reports, report)
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Printf("Error iterating over staff preference report rows: %v", err)
-		http.Error(w, "Failed to retrieve staff preference reports", http.StatusInternalServerError)
-		return
+		if filter.Paging, err = requestPaging[StaffPreferenceReport](r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeReportRows(w, r, reportInfo{
+			Title:     "staff preference analysis report",
+			Slug:      "shift-preference",
+			StartDate: &startDate,
+			EndDate:   &endDate,
+		}, store.StaffPreference(r.Context(), filter))
 	}
-
-	// Set Content-Type header and encode as JSON
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(reports)
 }
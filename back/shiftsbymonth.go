@@ -1,13 +1,11 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
+	"context"
 	"net/http"
-	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"backend/querybuilder"
 )
 
 // Struct for Monthly Shift Assignments Report Data
@@ -15,13 +13,24 @@ type MonthlyShiftAssignmentItem struct {
 	AssignmentYear      int    `json:"assignment_year"`
 	AssignmentMonth     int    `json:"assignment_month"`
 	AssignmentMonthYear string `json:"assignment_month_year"` // YYYY-MM format for plotting
-	TotalShifts         int    `json:"total_shifts"`
+	TotalShifts         int    `json:"total_shifts" total:"sum"`
 }
 
-// Handler for Monthly Shift Assignments Report
-func GetMonthlyShiftsHandler(w http.ResponseWriter, r *http.Request) {
+// Filters accepted by the monthly shifts report
+type MonthlyShiftsFilter struct {
+	StartDate   time.Time
+	EndDate     time.Time
+	Roles       []string
+	Departments []string
+	ShiftTypes  []string
+	ShiftTimes  []string
+	// Sort and page, applied by the query
+	Paging reportPaging
+}
+
+func (s *PostgresReportStore) MonthlyShifts(ctx context.Context, filter MonthlyShiftsFilter) ReportRows[MonthlyShiftAssignmentItem] {
 	// Build the query to aggregate shifts by month
-	query := `
+	qb := querybuilder.New(`
         SELECT
             EXTRACT(YEAR FROM sh.date) AS assignment_year,
             EXTRACT(MONTH FROM sh.date) AS assignment_month,
@@ -39,121 +48,66 @@ func GetMonthlyShiftsHandler(w http.ResponseWriter, r *http.Request) {
             departments d ON sa.department_id = d.id
         LEFT JOIN
             shift_times st ON sh.shift_time_id = st.id
-        WHERE
-            sh.date BETWEEN $1 AND $2
-    `
-
-	// Collect the filters from URL
-	queryParams := r.URL.Query()
-
-	// Build the WHERE clause dynamically
-	var conditions []string
-	var values []interface{}
-	argCount := 3 // Used to dynamically build queries
-
-	// Required date filter
-	startDate := queryParams.Get("start_date")
-	endDate := queryParams.Get("end_date")
-
-	if startDate == "" || endDate == "" {
-		http.Error(w, "Start date and end date are required", http.StatusBadRequest)
-		return
-	}
-
-	// Add the mandatory date range condition
-	values = append(values, startDate, endDate)
-	// Role filter, builds query & increments argCount
-	role := queryParams.Get("role")
-	if role != "" {
-		conditions = append(conditions, fmt.Sprintf("r.name = $%d", argCount))
-		values = append(values, role)
-		argCount++
-	}
+    `)
+
+	qb.Where(querybuilder.Between("sh.date", filter.StartDate, filter.EndDate))
+	qb.Where(querybuilder.In("r.name", filter.Roles))
+	qb.Where(querybuilder.In("d.name", filter.Departments))
+
+	// Optional Shift Type / Shift Time Filters (Planned to be multi-select but dropped)
+	qb.Where(querybuilder.In("sa.shift_type", filter.ShiftTypes))
+	qb.Where(querybuilder.In("st.name", filter.ShiftTimes))
+
+	qb.GroupBy(
+		"EXTRACT(YEAR FROM sh.date)",
+		"EXTRACT(MONTH FROM sh.date)",
+		"TO_CHAR(sh.date, 'YYYY-MM')",
+	)
+
+	return scanPage(ctx, s, qb, filter.Paging,
+		[]string{"assignment_year", "assignment_month", "assignment_month_year", "total_shifts"},
+		[]string{"assignment_year", "assignment_month"},
+		func(row rowScanner, report *MonthlyShiftAssignmentItem) error {
+			return row.Scan(
+				&report.AssignmentYear,
+				&report.AssignmentMonth,
+				&report.AssignmentMonthYear,
+				&report.TotalShifts,
+			)
+		})
+}
 
-	// Department filter, builds query & increments argCount
-	department := queryParams.Get("department")
-	if department != "" {
-		conditions = append(conditions, fmt.Sprintf("d.name = $%d", argCount))
-		values = append(values, department)
-		argCount++
-	}
+// Handler for Monthly Shift Assignments Report
+func GetMonthlyShiftsHandler(store ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Collect the filters from URL
+		queryParams := r.URL.Query()
 
-	// Optional Shift Type Filter (Planned to be multi-select but dropped)
-	shiftTypes := queryParams["shift_type"]
-	if len(shiftTypes) > 0 {
-		placeholders := make([]string, len(shiftTypes))
-		for i := range shiftTypes {
-			placeholders[i] = fmt.Sprintf("$%d", argCount+i)
-		}
-		conditions = append(conditions, fmt.Sprintf("sa.shift_type IN (%s)", strings.Join(placeholders, ", ")))
-		for _, sType := range shiftTypes {
-			values = append(values, sType)
+		// Required date filter
+		startDate, endDate, err := requiredDateRange(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		argCount += len(shiftTypes)
-	}
 
-	// Optional Shift Time Filter (Planned to be multi-select but dropped)
-	shiftTimes := queryParams["shift_time"]
-	if len(shiftTimes) > 0 {
-		placeholders := make([]string, len(shiftTimes))
-		for i := range shiftTimes {
-			placeholders[i] = fmt.Sprintf("$%d", argCount+i)
+		filter := MonthlyShiftsFilter{
+			StartDate:   startDate,
+			EndDate:     endDate,
+			Roles:       queryValues(queryParams, "role"),
+			Departments: queryValues(queryParams, "department"),
+			ShiftTypes:  queryValues(queryParams, "shift_type"),
+			ShiftTimes:  queryValues(queryParams, "shift_time"),
 		}
-		conditions = append(conditions, fmt.Sprintf("st.name IN (%s)", strings.Join(placeholders, ", ")))
-		for _, sTime := range shiftTimes {
-			values = append(values, sTime)
-		}
-		argCount += len(shiftTimes)
-	}
-
-	// Combine the WHERE clause conditions
-	if len(conditions) > 0 {
-		query += " AND " + strings.Join(conditions, " AND ")
-	}
-
-	query += `
-        GROUP BY
-            EXTRACT(YEAR FROM sh.date),
-            EXTRACT(MONTH FROM sh.date),
-            TO_CHAR(sh.date, 'YYYY-MM')
-    `
-
-	query += " ORDER BY assignment_year, assignment_month"
 
-	log.Println("Executing query:", query)
-	log.Println("With values:", values)
-
-	rows, err := db.Query(query, values...)
-	if err != nil {
-		log.Printf("Error querying monthly shift assignments report: %v", err)
-		http.Error(w, "Failed to fetch monthly shift assignments report", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var reports []MonthlyShiftAssignmentItem
-	for rows.Next() {
-		var report MonthlyShiftAssignmentItem
-		err := rows.Scan(
-			&report.AssignmentYear,
-			&report.AssignmentMonth,
-			&report.AssignmentMonthYear,
-			&report.TotalShifts,
-		)
-		if err != nil {
-			log.Printf("Error scanning monthly shift assignments report row: %v", err)
-			http.Error(w, "Failed to process monthly shift assignments report data", http.StatusInternalServerError)
+		if filter.Paging, err = requestPaging[MonthlyShiftAssignmentItem](r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		reports = append(reports, report)
+		writeReportRows(w, r, reportInfo{
+			Title:     "monthly shift assignments report",
+			Slug:      "monthly-shifts",
+			StartDate: &startDate,
+			EndDate:   &endDate,
+		}, store.MonthlyShifts(r.Context(), filter))
 	}
-
-	if err := rows.Err(); err != nil {
-		log.Printf("Error iterating over monthly shift assignments report rows: %v", err)
-		http.Error(w, "Failed to retrieve all monthly shift assignments reports", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(reports)
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Layout of TIME columns selected as text (st.start_time::text), the driver
+// would otherwise hand them back as a time.Time on year 0
+const timeOfDayLayout = "15:04:05"
+
+// Scheduled start and end of a shift on a given date. shift_times only
+// stores times of day, a shift whose end isn't after its start (Overnight,
+// Long Night) finishes the next day.
+func shiftWindow(date time.Time, startTime, endTime string) (time.Time, time.Time, error) {
+	start, err := atTimeOfDay(date, startTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, err := atTimeOfDay(date, endTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !end.After(start) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end, nil
+}
+
+// Combines a DATE with a TIME of day in the server's time zone, which is
+// the one shift_logs timestamps are written in
+func atTimeOfDay(date time.Time, timeOfDay string) (time.Time, error) {
+	t, err := time.Parse(timeOfDayLayout, timeOfDay)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time of day %q: %w", timeOfDay, err)
+	}
+	y, m, d := date.Date()
+	return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
+}
+
+// The driver returns TIMESTAMP (without time zone) columns as UTC, this
+// puts the same wall clock back in the server's time zone so they compare
+// correctly with shiftWindow
+func localWallClock(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local)
+}
+
+// SQL equivalents of shiftWindow, for queries joining shifts sh and
+// shift_times st
+const (
+	scheduledStartExpr = "(sh.date + st.start_time)"
+	scheduledEndExpr   = "(sh.date + st.end_time + CASE WHEN st.end_time <= st.start_time THEN INTERVAL '1 day' ELSE INTERVAL '0' END)"
+	// Logs of overnight shifts may carry the check-out on the check-in's
+	// date, the same wraparound the hours worked report applies
+	checkOutExpr = "(CASE WHEN sl.check_out < sl.check_in THEN sl.check_out + INTERVAL '1 day' ELSE sl.check_out END)"
+)
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"backend/querybuilder"
+
+	"github.com/lib/pq"
+)
+
+// Errors surfaced to the client when a staff write breaks a rule of the
+// staff table
+var (
+	ErrDuplicateEmail = errors.New("A staff member with this email already exists")
+	ErrDuplicatePhone = errors.New("A staff member with this phone already exists")
+	ErrUnknownRole    = errors.New("role_id does not match any role")
+)
+
+// A person working for the hospital
+type StaffMember struct {
+	ID          int               `json:"id"`
+	Name        string            `json:"name"`
+	Email       string            `json:"email"`
+	Phone       string            `json:"phone"`
+	RoleID      int               `json:"role_id"`
+	RoleName    string            `json:"role_name"`
+	Active      bool              `json:"active"`
+	Departments []StaffDepartment `json:"departments"`
+}
+
+// A department the staff member can currently be assigned to
+type StaffDepartment struct {
+	DepartmentID   int        `json:"department_id"`
+	DepartmentName string     `json:"department_name"`
+	StartDate      time.Time  `json:"start_date"`
+	EndDate        *time.Time `json:"end_date"`
+}
+
+// Payload to create or update a staff member
+type StaffInput struct {
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+	Phone  string `json:"phone"`
+	RoleID int    `json:"role_id"`
+}
+
+// Trims the input and checks the fields the database can't
+func (in *StaffInput) Validate() error {
+	in.Name = strings.TrimSpace(in.Name)
+	in.Email = strings.TrimSpace(in.Email)
+	in.Phone = strings.TrimSpace(in.Phone)
+
+	if in.Name == "" {
+		return errors.New("name is required")
+	}
+	if _, err := mail.ParseAddress(in.Email); err != nil {
+		return errors.New("email is not a valid address")
+	}
+	if in.Phone == "" {
+		return errors.New("phone is required")
+	}
+	if in.RoleID <= 0 {
+		return errors.New("role_id is required")
+	}
+	return nil
+}
+
+// Filters for the staff listing
+type StaffListFilter struct {
+	Search string
+	Roles  []string
+	// Departments the staff members currently belong to
+	Departments     []string
+	IncludeInactive bool
+	Limit           int
+	Offset          int
+}
+
+// One page of the staff listing
+type StaffPage struct {
+	Staff  []StaffMember `json:"staff"`
+	Total  int           `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+}
+
+// StaffStore manages the staff table
+type StaffStore interface {
+	ListStaff(ctx context.Context, filter StaffListFilter) (StaffPage, error)
+	GetStaff(ctx context.Context, id int) (StaffMember, error)
+	CreateStaff(ctx context.Context, input StaffInput) (StaffMember, error)
+	UpdateStaff(ctx context.Context, id int, input StaffInput) (StaffMember, error)
+	DeactivateStaff(ctx context.Context, id int) (StaffMember, error)
+}
+
+type PostgresStaffStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStaffStore(db *sql.DB) *PostgresStaffStore {
+	return &PostgresStaffStore{db: db}
+}
+
+// Escapes the LIKE wildcards of a search so "_" or "%" match literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+const staffSelect = `
+        SELECT
+            s.id,
+            s.name,
+            s.email,
+            s.phone,
+            s.role_id,
+            r.name AS role_name,
+            s.active
+        FROM
+            staff s
+        JOIN
+            roles r ON s.role_id = r.id
+    `
+
+func (s *PostgresStaffStore) ListStaff(ctx context.Context, filter StaffListFilter) (StaffPage, error) {
+	page := StaffPage{Staff: []StaffMember{}, Limit: filter.Limit, Offset: filter.Offset}
+
+	qb := querybuilder.New(staffSelect)
+	if filter.Search != "" {
+		pattern := "%" + escapeLike(filter.Search) + "%"
+		qb.Where(querybuilder.Expr(`s.name ILIKE %[1]s ESCAPE '\' OR s.email ILIKE %[1]s ESCAPE '\' OR s.phone ILIKE %[1]s ESCAPE '\'`, pattern))
+	}
+	qb.Where(querybuilder.In("r.name", filter.Roles))
+	if len(filter.Departments) > 0 {
+		qb.Where(func(args *querybuilder.Args) string {
+			return `EXISTS (
+                SELECT 1 FROM staff_departments sd
+                JOIN departments d ON sd.department_id = d.id
+                WHERE sd.staff_id = s.id
+                  AND sd.start_date <= CURRENT_DATE
+                  AND (sd.end_date IS NULL OR sd.end_date >= CURRENT_DATE)
+                  AND ` + querybuilder.In("d.name", filter.Departments)(args) + `)`
+		})
+	}
+	if !filter.IncludeInactive {
+		qb.Where(querybuilder.Raw("s.active"))
+	}
+
+	countQuery, countValues := qb.Count()
+	if err := s.db.QueryRowContext(ctx, countQuery, countValues...).Scan(&page.Total); err != nil {
+		return page, err
+	}
+
+	qb.OrderBy("s.name", "s.id")
+	qb.Page(filter.Limit, filter.Offset)
+	query, values := qb.Build()
+	rows, err := s.db.QueryContext(ctx, query, values...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		member, err := scanStaff(rows)
+		if err != nil {
+			return page, err
+		}
+		page.Staff = append(page.Staff, member)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+
+	return page, loadDepartments(ctx, s.db, page.Staff)
+}
+
+func (s *PostgresStaffStore) GetStaff(ctx context.Context, id int) (StaffMember, error) {
+	return getStaff(ctx, s.db, id)
+}
+
+func (s *PostgresStaffStore) CreateStaff(ctx context.Context, input StaffInput) (StaffMember, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return StaffMember{}, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO staff (name, email, phone, role_id)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id
+    `, input.Name, input.Email, input.Phone, input.RoleID).Scan(&id)
+	if err != nil {
+		return StaffMember{}, staffWriteError(err)
+	}
+	member, err := getStaff(ctx, tx, id)
+	if err != nil {
+		return member, err
+	}
+	if err := recordAudit(ctx, tx, AuditCreate, EntityStaff, id, nil, member); err != nil {
+		return member, err
+	}
+	return member, tx.Commit()
+}
+
+func (s *PostgresStaffStore) UpdateStaff(ctx context.Context, id int, input StaffInput) (StaffMember, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return StaffMember{}, err
+	}
+	defer tx.Rollback()
+
+	before, err := lockStaff(ctx, tx, id)
+	if err != nil {
+		return before, err
+	}
+	_, err = tx.ExecContext(ctx, `
+        UPDATE staff
+        SET name = $1, email = $2, phone = $3, role_id = $4
+        WHERE id = $5
+    `, input.Name, input.Email, input.Phone, input.RoleID, id)
+	if err != nil {
+		return StaffMember{}, staffWriteError(err)
+	}
+	member, err := getStaff(ctx, tx, id)
+	if err != nil {
+		return member, err
+	}
+	if err := recordAudit(ctx, tx, AuditUpdate, EntityStaff, id, before, member); err != nil {
+		return member, err
+	}
+	return member, tx.Commit()
+}
+
+// Staff are never deleted, their assignments and logs feed the reports
+func (s *PostgresStaffStore) DeactivateStaff(ctx context.Context, id int) (StaffMember, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return StaffMember{}, err
+	}
+	defer tx.Rollback()
+
+	before, err := lockStaff(ctx, tx, id)
+	if err != nil {
+		return before, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE staff SET active = FALSE WHERE id = $1", id); err != nil {
+		return StaffMember{}, err
+	}
+	member, err := getStaff(ctx, tx, id)
+	if err != nil {
+		return member, err
+	}
+	if err := recordAudit(ctx, tx, AuditDeactivate, EntityStaff, id, before, member); err != nil {
+		return member, err
+	}
+	return member, tx.Commit()
+}
+
+func getStaff(ctx context.Context, q queryer, id int) (StaffMember, error) {
+	member, err := scanStaff(q.QueryRowContext(ctx, staffSelect+" WHERE s.id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return member, ErrNotFound
+	}
+	if err != nil {
+		return member, err
+	}
+
+	members := []StaffMember{member}
+	err = loadDepartments(ctx, q, members)
+	return members[0], err
+}
+
+// Locks the staff row and returns it as it was before the change, for the
+// audit trail
+func lockStaff(ctx context.Context, tx *sql.Tx, id int) (StaffMember, error) {
+	var locked int
+	err := tx.QueryRowContext(ctx, "SELECT id FROM staff WHERE id = $1 FOR UPDATE", id).Scan(&locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StaffMember{}, ErrNotFound
+	}
+	if err != nil {
+		return StaffMember{}, err
+	}
+	return getStaff(ctx, tx, id)
+}
+
+// Fills in the departments each member currently belongs to
+func loadDepartments(ctx context.Context, q queryer, members []StaffMember) error {
+	if len(members) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(members))
+	byID := make(map[int]*StaffMember, len(members))
+	for i := range members {
+		ids[i] = int64(members[i].ID)
+		members[i].Departments = []StaffDepartment{}
+		byID[members[i].ID] = &members[i]
+	}
+
+	rows, err := q.QueryContext(ctx, `
+        SELECT
+            sd.staff_id,
+            d.id,
+            d.name,
+            sd.start_date,
+            sd.end_date
+        FROM
+            staff_departments sd
+        JOIN
+            departments d ON sd.department_id = d.id
+        WHERE
+            sd.staff_id = ANY($1)
+            AND sd.start_date <= CURRENT_DATE
+            AND (sd.end_date IS NULL OR sd.end_date >= CURRENT_DATE)
+        ORDER BY
+            d.name
+    `, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var staffID int
+		var department StaffDepartment
+		var endDate sql.NullTime
+		if err := rows.Scan(&staffID, &department.DepartmentID, &department.DepartmentName, &department.StartDate, &endDate); err != nil {
+			return err
+		}
+		if endDate.Valid {
+			department.EndDate = &endDate.Time
+		}
+		member := byID[staffID]
+		member.Departments = append(member.Departments, department)
+	}
+	return rows.Err()
+}
+
+func scanStaff(row rowScanner) (StaffMember, error) {
+	var member StaffMember
+	err := row.Scan(
+		&member.ID,
+		&member.Name,
+		&member.Email,
+		&member.Phone,
+		&member.RoleID,
+		&member.RoleName,
+		&member.Active,
+	)
+	return member, err
+}
+
+// Translates constraint violations into the friendly staff errors
+func staffWriteError(err error) error {
+	if constraint, ok := pqViolation(err, "23505"); ok {
+		switch constraint {
+		case "staff_email_key":
+			return ErrDuplicateEmail
+		case "staff_phone_key":
+			return ErrDuplicatePhone
+		}
+	}
+	if _, ok := pqViolation(err, "23503"); ok {
+		return ErrUnknownRole
+	}
+	return err
+}
+
+// Maps store errors to status codes, shared by the staff handlers
+func writeStaffError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "Staff member not found", http.StatusNotFound)
+	case errors.Is(err, ErrDuplicateEmail), errors.Is(err, ErrDuplicatePhone):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrUnknownRole):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		log.Printf("Error writing staff: %v", err)
+		http.Error(w, "Failed to process staff request", http.StatusInternalServerError)
+	}
+}
+
+func ListStaffHandler(store StaffStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queryParams := r.URL.Query()
+
+		limit, offset, err := parsePage(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		page, err := store.ListStaff(r.Context(), StaffListFilter{
+			Search:          strings.TrimSpace(queryParams.Get("search")),
+			Roles:           queryValues(queryParams, "role"),
+			Departments:     queryValues(queryParams, "department"),
+			IncludeInactive: strings.ToLower(queryParams.Get("include_inactive")) == "true",
+			Limit:           limit,
+			Offset:          offset,
+		})
+		if err != nil {
+			log.Printf("Error listing staff: %v", err)
+			http.Error(w, "Failed to fetch staff", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, page)
+	}
+}
+
+func GetStaffHandler(store StaffStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid staff id", http.StatusBadRequest)
+			return
+		}
+
+		member, err := store.GetStaff(r.Context(), id)
+		if err != nil {
+			writeStaffError(w, err)
+			return
+		}
+
+		// Department heads only read their own record and their
+		// departments' staff
+		claims := claimsFrom(r.Context())
+		if scope := claims.departmentScope(); scope != nil && !claims.isStaff(id) &&
+			!slices.ContainsFunc(member.Departments, func(d StaffDepartment) bool {
+				return slices.Contains(scope, d.DepartmentName)
+			}) {
+			http.Error(w, ErrOutsideDepartments.Error(), http.StatusForbidden)
+			return
+		}
+		writeJSON(w, http.StatusOK, member)
+	}
+}
+
+func CreateStaffHandler(store StaffStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input StaffInput
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := input.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		member, err := store.CreateStaff(r.Context(), input)
+		if err != nil {
+			writeStaffError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, member)
+	}
+}
+
+func UpdateStaffHandler(store StaffStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid staff id", http.StatusBadRequest)
+			return
+		}
+
+		var input StaffInput
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := input.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		member, err := store.UpdateStaff(r.Context(), id, input)
+		if err != nil {
+			writeStaffError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, member)
+	}
+}
+
+func DeactivateStaffHandler(store StaffStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid staff id", http.StatusBadRequest)
+			return
+		}
+
+		member, err := store.DeactivateStaff(r.Context(), id)
+		if err != nil {
+			writeStaffError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, member)
+	}
+}
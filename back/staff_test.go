@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestEscapeLike(t *testing.T) {
+	tests := map[string]string{
+		"ana":        "ana",
+		"_":          `\_`,
+		"50%":        `50\%`,
+		`back\slash`: `back\\slash`,
+		`a_b%c\`:     `a\_b\%c\\`,
+	}
+	for in, want := range tests {
+		if got := escapeLike(in); got != want {
+			t.Errorf("escapeLike(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// Staff store that only answers GetStaff
+type fakeStaffStore struct {
+	StaffStore
+	members map[int]StaffMember
+}
+
+func (f fakeStaffStore) GetStaff(ctx context.Context, id int) (StaffMember, error) {
+	member, ok := f.members[id]
+	if !ok {
+		return member, ErrNotFound
+	}
+	return member, nil
+}
+
+func TestGetStaffHandlerScopesDepartmentHeads(t *testing.T) {
+	store := fakeStaffStore{members: map[int]StaffMember{
+		1: {ID: 1, Departments: []StaffDepartment{{DepartmentID: 1, DepartmentName: "ER"}}},
+		2: {ID: 2, Departments: []StaffDepartment{{DepartmentID: 2, DepartmentName: "ICU"}}},
+		3: {ID: 3},
+	}}
+	headStaffID := 3
+	head := Claims{Role: RoleDepartmentHead, StaffID: &headStaffID, Departments: []UserDepartment{{ID: 1, Name: "ER"}}}
+	scheduler := Claims{Role: RoleScheduler}
+
+	tests := []struct {
+		name   string
+		claims Claims
+		id     string
+		status int
+	}{
+		{"head, own department", head, "1", http.StatusOK},
+		{"head, other department", head, "2", http.StatusForbidden},
+		{"head, own record", head, "3", http.StatusOK},
+		{"scheduler, any department", scheduler, "2", http.StatusOK},
+		{"unknown member", head, "9", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes := chi.NewRouter()
+			routes.Get("/staff/{id}", GetStaffHandler(store))
+			req := httptest.NewRequest(http.MethodGet, "/staff/"+tt.id, nil)
+			req = req.WithContext(context.WithValue(req.Context(), claimsKey{}, tt.claims))
+			rec := httptest.NewRecorder()
+			routes.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
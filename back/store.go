@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"iter"
+	"log"
+
+	"backend/querybuilder"
+)
+
+// ReportStore runs the reports, one method per report. Handlers only parse
+// the request into a filter and encode the result, so they can be exercised
+// against MemoryReportStore without a database. Reports yield their rows as
+// they are read so exports can stream them, see scanRows. Reports with a
+// Paging filter sort and page their rows in the query and count the whole
+// report, see ReportRows; the others are read whole and paged by the
+// handler.
+type ReportStore interface {
+	HoursWorked(ctx context.Context, filter HoursWorkedFilter) ReportRows[HoursWorkedReport]
+	HoursWorkedSeries(ctx context.Context, filter HoursWorkedFilter, series SeriesFilter) iter.Seq2[HoursWorkedSeriesPoint, error]
+	OvertimeAnalysis(ctx context.Context, filter OvertimeFilter) ReportRows[OvertimeReport]
+	OvertimeSeries(ctx context.Context, filter OvertimeFilter, series SeriesFilter) iter.Seq2[OvertimeSeriesPoint, error]
+	OvertimeCost(ctx context.Context, filter OvertimeCostFilter) ReportRows[OvertimeCostReportItem]
+	OvertimeViolations(ctx context.Context, filter OvertimeViolationFilter) ReportRows[OvertimeViolation]
+	StaffWorkload(ctx context.Context, filter StaffWorkloadFilter) ReportRows[StaffWorkloadReportItem]
+	StaffWorkloadSeries(ctx context.Context, filter StaffWorkloadFilter, series SeriesFilter) iter.Seq2[StaffWorkloadSeriesPoint, error]
+	OnCallFairness(ctx context.Context, filter OnCallFairnessFilter) iter.Seq2[OnCallFairnessReportItem, error]
+	LeaveAnalysis(ctx context.Context, filter LeaveAnalysisFilter) ReportRows[LeaveAnalysisReportItem]
+	StaffPreference(ctx context.Context, filter StaffPreferenceFilter) ReportRows[StaffPreferenceReport]
+	MonthlyShifts(ctx context.Context, filter MonthlyShiftsFilter) ReportRows[MonthlyShiftAssignmentItem]
+	Attendance(ctx context.Context, filter AttendanceFilter) ReportRows[AttendanceReportItem]
+	Coverage(ctx context.Context, filter CoverageFilter) (CoverageReport, error)
+	Fatigue(ctx context.Context, filter FatigueFilter) iter.Seq2[FatigueReportItem, error]
+}
+
+// PostgresReportStore is the ReportStore backed by the hospital database,
+// the queries themselves live next to each report's handler.
+type PostgresReportStore struct {
+	db *sql.DB
+}
+
+func NewPostgresReportStore(db *sql.DB) *PostgresReportStore {
+	return &PostgresReportStore{db: db}
+}
+
+// Runs a built query, logging it first (for debugging)
+func (s *PostgresReportStore) query(ctx context.Context, query string, values []interface{}) (*sql.Rows, error) {
+	log.Println("Executing query:", query)
+	log.Println("With values:", values)
+	return s.db.QueryContext(ctx, query, values...)
+}
+
+// Runs a built count query
+func (s *PostgresReportStore) count(ctx context.Context, query string, values []interface{}) (int, error) {
+	log.Println("Executing query:", query)
+	log.Println("With values:", values)
+	var total int
+	err := s.db.QueryRowContext(ctx, query, values...).Scan(&total)
+	return total, err
+}
+
+// Runs a built query and yields each row through scan. Nothing runs until
+// the sequence is ranged over, the cursor is closed when the loop ends and
+// a failure is yielded as the last element.
+func scanRows[T any](ctx context.Context, s *PostgresReportStore, query string, values []interface{}, scan func(row rowScanner, report *T) error) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var report T
+		rows, err := s.query(ctx, query, values)
+		if err != nil {
+			yield(report, err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var report T
+			if err := scan(rows, &report); err != nil {
+				yield(report, err)
+				return
+			}
+			if !yield(report, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(report, err)
+		}
+	}
+}
+
+// The rows of a report as the store read them. When the store sorted and
+// paged them as the filter asked, Total counts the rows of the whole
+// report. When it is nil the rows are the whole report in its own order,
+// for the handler to sort and page.
+type ReportRows[T any] struct {
+	Rows  iter.Seq2[T, error]
+	Total func() (int, error)
+}
+
+// Sorts and pages a report query in SQL and counts the whole report. The
+// requested sort goes ahead of the report's own order; when it is on a
+// field the query can't sort by (see sortQuery) the whole report is read
+// instead.
+func scanPage[T any](ctx context.Context, s *PostgresReportStore, qb *querybuilder.Builder, paging reportPaging, columns []string, order []string, scan func(row rowScanner, report *T) error) ReportRows[T] {
+	if !sortQuery(qb, paging, columns) {
+		qb.OrderBy(order...)
+		query, values := qb.Build()
+		return ReportRows[T]{Rows: scanRows(ctx, s, query, values, scan)}
+	}
+
+	qb.OrderBy(order...)
+	countQuery, countValues := qb.Count()
+	if paging.Paged {
+		qb.Page(paging.Limit, paging.Offset)
+	}
+	query, values := qb.Build()
+	return ReportRows[T]{
+		Rows: scanRows(ctx, s, query, values, scan),
+		Total: func() (int, error) {
+			return s.count(ctx, countQuery, countValues)
+		},
+	}
+}
+
+// Yields rows already in memory, or just err when it isn't nil
+func sliceRows[T any](reports []T, err error) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		if err != nil {
+			var report T
+			yield(report, err)
+			return
+		}
+		for _, report := range reports {
+			if !yield(report, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Reads a whole report, for the responses that need every row before
+// writing the first. No rows is a nil slice.
+func collectRows[T any](rows iter.Seq2[T, error]) ([]T, error) {
+	var reports []T
+	for report, err := range rows {
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// Anything that can run queries, *sql.DB or *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Anything with a Scan method, *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Both implementations must keep up with the interface
+var (
+	_ ReportStore = (*PostgresReportStore)(nil)
+	_ ReportStore = (*MemoryReportStore)(nil)
+)
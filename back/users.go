@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Shortest password accepted for a new login
+const minPasswordLen = 8
+
+var (
+	ErrDuplicateUser     = errors.New("A user with this email already exists")
+	ErrUnknownUserLink   = errors.New("staff_id or department_ids do not match existing rows")
+	ErrNotDepartmentHead = errors.New("Only department heads run departments")
+)
+
+// Payload to create a login
+type UserInput struct {
+	Email         string `json:"email"`
+	Password      string `json:"password"`
+	Role          string `json:"role"`
+	StaffID       *int   `json:"staff_id"`
+	DepartmentIDs []int  `json:"department_ids"`
+}
+
+// Trims the input and checks the fields the database can't
+func (in *UserInput) Validate() error {
+	in.Email = strings.TrimSpace(in.Email)
+
+	if _, err := mail.ParseAddress(in.Email); err != nil {
+		return errors.New("email is not a valid address")
+	}
+	if len(in.Password) < minPasswordLen {
+		return errors.New("password must be at least 8 characters")
+	}
+	if !slices.Contains([]string{RoleAdmin, RoleDepartmentHead, RoleScheduler, RoleStaff}, in.Role) {
+		return errors.New("role must be admin, department_head, scheduler or staff")
+	}
+	if in.Role == RoleStaff && in.StaffID == nil {
+		return errors.New("staff_id is required for staff users")
+	}
+	if in.Role != RoleDepartmentHead && len(in.DepartmentIDs) > 0 {
+		return ErrNotDepartmentHead
+	}
+	return nil
+}
+
+// Payload to replace the departments a head runs
+type UserDepartmentsInput struct {
+	DepartmentIDs []int `json:"department_ids"`
+}
+
+// UserStore manages the logins of the application
+type UserStore interface {
+	ListUsers(ctx context.Context) ([]User, error)
+	CreateUser(ctx context.Context, input UserInput) (User, error)
+	// Replaces the departments of a department head
+	SetUserDepartments(ctx context.Context, id int, departmentIDs []int) (User, error)
+}
+
+type PostgresUserStore struct {
+	db *sql.DB
+}
+
+func NewPostgresUserStore(db *sql.DB) *PostgresUserStore {
+	return &PostgresUserStore{db: db}
+}
+
+// User plus the departments it runs, never the password hash
+const userSelect = `
+        SELECT
+            u.id,
+            u.email,
+            u.role,
+            u.staff_id,
+            COALESCE(ARRAY_AGG(d.id ORDER BY d.name) FILTER (WHERE d.id IS NOT NULL), '{}'),
+            COALESCE(ARRAY_AGG(d.name ORDER BY d.name) FILTER (WHERE d.id IS NOT NULL), '{}')
+        FROM
+            users u
+        LEFT JOIN
+            user_departments ud ON ud.user_id = u.id
+        LEFT JOIN
+            departments d ON ud.department_id = d.id
+    `
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var staffID sql.NullInt64
+	var departmentIDs pq.Int64Array
+	var departmentNames pq.StringArray
+	if err := row.Scan(&user.ID, &user.Email, &user.Role, &staffID, &departmentIDs, &departmentNames); err != nil {
+		return user, err
+	}
+	if staffID.Valid {
+		id := int(staffID.Int64)
+		user.StaffID = &id
+	}
+	user.Departments = []UserDepartment{}
+	for i, id := range departmentIDs {
+		user.Departments = append(user.Departments, UserDepartment{ID: int(id), Name: departmentNames[i]})
+	}
+	return user, nil
+}
+
+func getUser(ctx context.Context, q queryer, id int) (User, error) {
+	user, err := scanUser(q.QueryRowContext(ctx, userSelect+" WHERE u.id = $1 GROUP BY u.id", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (s *PostgresUserStore) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, userSelect+" GROUP BY u.id ORDER BY u.email")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *PostgresUserStore) CreateUser(ctx context.Context, input UserInput) (User, error) {
+	hash, err := hashPassword(input.Password)
+	if err != nil {
+		return User{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO users (email, password_hash, role, staff_id)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id
+    `, input.Email, hash, input.Role, input.StaffID).Scan(&id)
+	if err != nil {
+		return User{}, userWriteError(err)
+	}
+	if err := insertUserDepartments(ctx, tx, id, input.DepartmentIDs); err != nil {
+		return User{}, err
+	}
+
+	user, err := getUser(ctx, tx, id)
+	if err != nil {
+		return user, err
+	}
+	if err := recordAudit(ctx, tx, AuditCreate, EntityUser, id, nil, user); err != nil {
+		return user, err
+	}
+	return user, tx.Commit()
+}
+
+func (s *PostgresUserStore) SetUserDepartments(ctx context.Context, id int, departmentIDs []int) (User, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	// Lock the user so concurrent edits of its departments are serialised
+	var role string
+	err = tx.QueryRowContext(ctx, "SELECT role FROM users WHERE id = $1 FOR UPDATE", id).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if role != RoleDepartmentHead {
+		return User{}, ErrNotDepartmentHead
+	}
+	before, err := getUser(ctx, tx, id)
+	if err != nil {
+		return before, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_departments WHERE user_id = $1", id); err != nil {
+		return User{}, err
+	}
+	if err := insertUserDepartments(ctx, tx, id, departmentIDs); err != nil {
+		return User{}, err
+	}
+
+	user, err := getUser(ctx, tx, id)
+	if err != nil {
+		return user, err
+	}
+	if err := recordAudit(ctx, tx, AuditUpdate, EntityUser, id, before, user); err != nil {
+		return user, err
+	}
+	return user, tx.Commit()
+}
+
+func insertUserDepartments(ctx context.Context, tx *sql.Tx, userID int, departmentIDs []int) error {
+	if len(departmentIDs) == 0 {
+		return nil
+	}
+	ids := make(pq.Int64Array, len(departmentIDs))
+	for i, id := range departmentIDs {
+		ids[i] = int64(id)
+	}
+	_, err := tx.ExecContext(ctx, `
+        INSERT INTO user_departments (user_id, department_id)
+        SELECT $1, UNNEST($2::int[])
+        ON CONFLICT DO NOTHING
+    `, userID, ids)
+	return userWriteError(err)
+}
+
+// Maps constraint violations of the users tables to the errors above
+func userWriteError(err error) error {
+	if constraint, ok := pqViolation(err, "23505"); ok && constraint == "users_email_key" {
+		return ErrDuplicateUser
+	}
+	if _, ok := pqViolation(err, "23503"); ok {
+		return ErrUnknownUserLink
+	}
+	return err
+}
+
+// Maps store errors to status codes, shared by the user handlers
+func writeUserError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	case errors.Is(err, ErrDuplicateUser):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrUnknownUserLink), errors.Is(err, ErrNotDepartmentHead):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		log.Printf("Error writing user: %v", err)
+		http.Error(w, "Failed to process user request", http.StatusInternalServerError)
+	}
+}
+
+func ListUsersHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, err := store.ListUsers(r.Context())
+		if err != nil {
+			writeUserError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, users)
+	}
+}
+
+func CreateUserHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input UserInput
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := input.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := store.CreateUser(r.Context(), input)
+		if err != nil {
+			writeUserError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, user)
+	}
+}
+
+// Department heads pick up the change on their next login, the departments
+// of a session are fixed in its token
+func SetUserDepartmentsHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := urlParamID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+		var input UserDepartmentsInput
+		if err := decodeJSON(r, &input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		user, err := store.SetUserDepartments(r.Context(), id, input.DepartmentIDs)
+		if err != nil {
+			writeUserError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, user)
+	}
+}
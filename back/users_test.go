@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestUserInputValidate(t *testing.T) {
+	staffID := 4
+	tests := []struct {
+		name  string
+		input UserInput
+		valid bool
+	}{
+		{"scheduler", UserInput{Email: " sched@example.com ", Password: "long enough", Role: RoleScheduler}, true},
+		{"head with departments", UserInput{Email: "head@example.com", Password: "long enough", Role: RoleDepartmentHead, DepartmentIDs: []int{1, 2}}, true},
+		{"staff with staff id", UserInput{Email: "nurse@example.com", Password: "long enough", Role: RoleStaff, StaffID: &staffID}, true},
+		{"bad email", UserInput{Email: "nurse", Password: "long enough", Role: RoleScheduler}, false},
+		{"short password", UserInput{Email: "sched@example.com", Password: "short", Role: RoleScheduler}, false},
+		{"unknown role", UserInput{Email: "sched@example.com", Password: "long enough", Role: "owner"}, false},
+		{"staff without staff id", UserInput{Email: "nurse@example.com", Password: "long enough", Role: RoleStaff}, false},
+		{"departments for a scheduler", UserInput{Email: "sched@example.com", Password: "long enough", Role: RoleScheduler, DepartmentIDs: []int{1}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.input.Validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
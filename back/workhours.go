@@ -1,15 +1,12 @@
 package main
 
 import (
-	_ "database/sql"
-	"encoding/json"
-	"fmt"
-	"log"
+	"context"
+	"iter"
 	"net/http"
-	"strconv"
-	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"backend/querybuilder"
 )
 
 // Struct to hold each report row
@@ -17,22 +14,72 @@ type HoursWorkedReport struct {
 	StaffName        string  `json:"staff_name"`
 	RoleName         string  `json:"role_name"`
 	DepartmentName   string  `json:"department_name"`
-	TotalHoursWorked float64 `json:"total_hours_worked"`
+	TotalHoursWorked float64 `json:"total_hours_worked" total:"sum"`
 }
 
-func GetHoursWorkedReportHandler(w http.ResponseWriter, r *http.Request) {
-	// Build the base query
-	query := `
-        SELECT
-            s.name AS staff_name,
-            r.name AS role_name,
-            d.name AS department_name,
-            SUM(EXTRACT(EPOCH FROM
+// An hours worked row next to the same staff member, role and department
+// in the comparison window, hours are 0 in the window they are missing from
+type HoursWorkedComparison struct {
+	StaffName       string   `json:"staff_name"`
+	RoleName        string   `json:"role_name"`
+	DepartmentName  string   `json:"department_name"`
+	CurrentHours    float64  `json:"current_hours" total:"sum"`
+	PreviousHours   float64  `json:"previous_hours" total:"sum"`
+	DeltaHours      float64  `json:"delta_hours" total:"sum"`
+	DeltaPercentage *float64 `json:"delta_percentage"`
+	Presence        string   `json:"presence"`
+}
+
+// A bucket of an hours worked series
+type HoursWorkedSeriesPoint struct {
+	SeriesPoint
+	TotalHoursWorked float64 `json:"total_hours_worked" total:"sum"`
+}
+
+func hoursWorkedKey(row HoursWorkedReport) string {
+	return row.StaffName + "\x00" + row.RoleName + "\x00" + row.DepartmentName
+}
+
+func compareHoursWorked(current, previous *HoursWorkedReport) HoursWorkedComparison {
+	row := HoursWorkedComparison{Presence: presence(current, previous)}
+	for _, r := range []*HoursWorkedReport{previous, current} {
+		if r != nil {
+			row.StaffName, row.RoleName, row.DepartmentName = r.StaffName, r.RoleName, r.DepartmentName
+		}
+	}
+	if current != nil {
+		row.CurrentHours = current.TotalHoursWorked
+	}
+	if previous != nil {
+		row.PreviousHours = previous.TotalHoursWorked
+	}
+	row.DeltaHours = row.CurrentHours - row.PreviousHours
+	row.DeltaPercentage = percentageDelta(row.CurrentHours, row.PreviousHours)
+	return row
+}
+
+// Filters accepted by the hours worked report
+type HoursWorkedFilter struct {
+	StartDate   time.Time
+	EndDate     time.Time
+	Roles       []string
+	Departments []string
+	MinHours    *float64
+	MaxHours    *float64
+	// Sort and page, applied by the query
+	Paging reportPaging
+}
+
+// Hours of a single log, overnight shifts wrap past midnight
+const hoursWorkedExpr = `SUM(EXTRACT(EPOCH FROM
                 CASE
                     WHEN sl.check_out >= sl.check_in THEN (sl.check_out - sl.check_in)
                     ELSE ((sl.check_out + INTERVAL '1 day') - sl.check_in)
                 END
-            )) / 3600 AS total_hours_worked
+            )) / 3600`
+
+// Completed logs with their assignment, staff member and shift
+const hoursWorkedFrom = `
         FROM
             shift_logs sl
         JOIN
@@ -45,133 +92,125 @@ func GetHoursWorkedReportHandler(w http.ResponseWriter, r *http.Request) {
             departments d ON sa.department_id = d.id
         JOIN
             shifts sh ON sa.shift_id = sh.id
-        WHERE
-            sh.date BETWEEN $1 AND $2
-            AND sl.check_in IS NOT NULL
-            AND sl.check_out IS NOT NULL
     `
 
-	// Collect the filters from the URL
-	queryParams := r.URL.Query()
-
-	// Build the WHERE clause dynamically
-	var conditions []string
-	var values []interface{}
-	argCount := 3 // Parameter counter for parameterized queries
-
-	// Required date range filter
-	startDate := queryParams.Get("start_date")
-	endDate := queryParams.Get("end_date")
+func hoursWorkedWhere(qb *querybuilder.Builder, filter HoursWorkedFilter) {
+	qb.Where(querybuilder.Between("sh.date", filter.StartDate, filter.EndDate))
+	qb.Where(querybuilder.Raw("sl.check_in IS NOT NULL"))
+	qb.Where(querybuilder.Raw("sl.check_out IS NOT NULL"))
+	qb.Where(querybuilder.In("r.name", filter.Roles))
+	qb.Where(querybuilder.In("d.name", filter.Departments))
+}
 
-	if startDate == "" || endDate == "" {
-		http.Error(w, "Start date and end date are required", http.StatusBadRequest)
-		return
-	}
-	values = append(values, startDate, endDate)
-
-	// Role filter, builds query & increments argCount
-	role := queryParams.Get("role")
-	if role != "" {
-		conditions = append(conditions, fmt.Sprintf("r.name = $%d", argCount))
-		values = append(values, role)
-		argCount++
-	}
+func (s *PostgresReportStore) HoursWorked(ctx context.Context, filter HoursWorkedFilter) ReportRows[HoursWorkedReport] {
+	// Build the base query, filters are added by the query builder
+	qb := querybuilder.New(`
+        SELECT
+            s.name AS staff_name,
+            r.name AS role_name,
+            d.name AS department_name,
+            ` + hoursWorkedExpr + ` AS total_hours_worked
+        ` + hoursWorkedFrom)
+
+	hoursWorkedWhere(qb, filter)
+	qb.GroupBy("s.name", "r.name", "d.name")
+	qb.Having(querybuilder.Range(hoursWorkedExpr, filter.MinHours, filter.MaxHours))
+
+	return scanPage(ctx, s, qb, filter.Paging,
+		[]string{"staff_name", "role_name", "department_name", "total_hours_worked"},
+		[]string{"total_hours_worked DESC", "staff_name", "role_name", "department_name"},
+		func(row rowScanner, report *HoursWorkedReport) error {
+			return row.Scan(
+				&report.StaffName,
+				&report.RoleName,
+				&report.DepartmentName,
+				&report.TotalHoursWorked,
+			)
+		})
+}
 
-	// Department filter, builds query & increments argCount
-	department := queryParams.Get("department")
-	if department != "" {
-		conditions = append(conditions, fmt.Sprintf("d.name = $%d", argCount))
-		values = append(values, department)
-		argCount++
-	}
+// Hours worked per bucket, min / max hours apply to each series' total
+func (s *PostgresReportStore) HoursWorkedSeries(ctx context.Context, filter HoursWorkedFilter, series SeriesFilter) iter.Seq2[HoursWorkedSeriesPoint, error] {
+	dimensions, groupBy := seriesDimensions(series.By)
+	totals := querybuilder.New(`
+        SELECT
+            ` + dimensions + `,
+            ` + bucketExpr(series.Granularity, "sh.date") + ` AS bucket,
+            ` + hoursWorkedExpr + ` AS v0
+        ` + hoursWorkedFrom)
+	hoursWorkedWhere(totals, filter)
+	totals.GroupBy(append(groupBy, "bucket")...)
+
+	qb := seriesQuery(totals, 1, series.Granularity, filter.StartDate, filter.EndDate)
+	qb.Where(querybuilder.Range("series.t0", filter.MinHours, filter.MaxHours))
+
+	query, values := qb.Build()
+	return scanRows(ctx, s, query, values, func(row rowScanner, point *HoursWorkedSeriesPoint) error {
+		return scanSeriesPoint(row, series.Granularity, &point.SeriesPoint, &point.TotalHoursWorked)
+	})
+}
 
-	// Combine the WHERE clauses, they're built with placeholders
-	// so it's safe to concatenate them
-	if len(conditions) > 0 {
-		query += " AND " + strings.Join(conditions, " AND ")
-	}
+func GetHoursWorkedReportHandler(store ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Collect the filters from the URL
+		queryParams := r.URL.Query()
 
-	// Add the GROUP BY clause
-	query += `
-    GROUP BY
-        s.name, r.name, d.name
-    `
+		// Required date range filter
+		startDate, endDate, err := requiredDateRange(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-	// Build the HAVING clause dynamically
-	var havingConditions []string
+		filter := HoursWorkedFilter{
+			StartDate:   startDate,
+			EndDate:     endDate,
+			Roles:       queryValues(queryParams, "role"),
+			Departments: queryValues(queryParams, "department"),
+		}
 
-	// Minimum hours worked filter
-	minHoursParam := queryParams.Get("min_hours")
-	if minHoursParam != "" {
-		minHours, err := strconv.ParseFloat(minHoursParam, 64)
-		if err != nil {
+		// Minimum / maximum hours worked filters
+		if filter.MinHours, err = optionalFloat(queryParams, "min_hours"); err != nil {
 			http.Error(w, "Invalid value for min_hours", http.StatusBadRequest)
 			return
 		}
-		havingConditions = append(havingConditions, fmt.Sprintf("SUM(EXTRACT(EPOCH FROM CASE WHEN sl.check_out >= sl.check_in THEN (sl.check_out - sl.check_in) ELSE ((sl.check_out + INTERVAL '1 day') - sl.check_in) END)) / 3600 >= $%d", argCount))
-		values = append(values, minHours)
-		argCount++
-	}
-
-	// Maximum hours worked filter
-	maxHoursParam := queryParams.Get("max_hours")
-	if maxHoursParam != "" {
-		maxHours, err := strconv.ParseFloat(maxHoursParam, 64)
-		if err != nil {
+		if filter.MaxHours, err = optionalFloat(queryParams, "max_hours"); err != nil {
 			http.Error(w, "Invalid value for max_hours", http.StatusBadRequest)
 			return
 		}
-		havingConditions = append(havingConditions, fmt.Sprintf("SUM(EXTRACT(EPOCH FROM CASE WHEN sl.check_out >= sl.check_in THEN (sl.check_out - sl.check_in) ELSE ((sl.check_out + INTERVAL '1 day') - sl.check_in) END)) / 3600 <= $%d", argCount))
-		values = append(values, maxHours)
-		argCount++
-	}
-
-	// Combine the HAVING clause conditions
-	if len(havingConditions) > 0 {
-		query += " HAVING " + strings.Join(havingConditions, " AND ")
-	}
-
-	// Order by
-	query += " ORDER BY total_hours_worked DESC"
 
-	// Log the final query (for debugging)
-	log.Println("Executing query:", query)
-	log.Println("With values:", values)
-
-	// Execute the query
-	rows, err := db.Query(query, values...)
-	if err != nil {
-		log.Printf("Error querying hours worked report: %v", err)
-		http.Error(w, "Failed to fetch hours worked report", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	// Process the results
-	var reports []HoursWorkedReport
-	for rows.Next() {
-		var report HoursWorkedReport
-		err := rows.Scan(
-			&report.StaffName,
-			&report.RoleName,
-			&report.DepartmentName,
-			&report.TotalHoursWorked,
-		)
+		// Optional comparison window or time series, not both
+		comparison, series, err := parseComparisonOrSeries(queryParams, startDate, endDate)
 		if err != nil {
-			log.Printf("Error scanning hours worked report row: %v", err)
-			http.Error(w, "Failed to process hours worked report", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		reports = append(reports, report)
-	}
 
-	if err := rows.Err(); err != nil {
-		log.Printf("Error iterating over hours worked report rows: %v", err)
-		http.Error(w, "Failed to retrieve hours worked reports", http.StatusInternalServerError)
-		return
+		info := reportInfo{
+			Title:      "hours worked report",
+			Slug:       "work-hours",
+			StartDate:  &startDate,
+			EndDate:    &endDate,
+			Comparison: comparison,
+		}
+		if series != nil {
+			writeReport(w, r, info, store.HoursWorkedSeries(r.Context(), filter, *series))
+			return
+		}
+		if comparison == nil {
+			if filter.Paging, err = requestPaging[HoursWorkedReport](r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeReportRows(w, r, info, store.HoursWorked(r.Context(), filter))
+			return
+		}
+		previous := filter
+		previous.StartDate, previous.EndDate = comparison.StartDate, comparison.EndDate
+		writeReport(w, r, info, compareRows(
+			store.HoursWorked(r.Context(), filter).Rows,
+			store.HoursWorked(r.Context(), previous).Rows,
+			hoursWorkedKey, compareHoursWorked,
+		))
 	}
-
-	// Set Content-Type header and encode as JSON
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(reports)
 }
@@ -0,0 +1,48 @@
+const API_BASE_URL = 'http://localhost:8080/auth';
+const SESSION_KEY = 'session';
+
+// The session returned by POST /auth/login: { token, expires_at, user }
+export const getSession = () => {
+  const session = JSON.parse(localStorage.getItem(SESSION_KEY) || 'null');
+  if (session && new Date(session.expires_at) <= new Date()) {
+    localStorage.removeItem(SESSION_KEY);
+    return null;
+  }
+  return session;
+};
+
+export const isLoggedIn = () => getSession() !== null;
+
+export const login = async (email, password) => {
+  const response = await fetch(`${API_BASE_URL}/login`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ email, password }),
+  });
+  if (!response.ok) {
+    const errorBody = await response.text();
+    throw new Error(errorBody.trim() || response.statusText);
+  }
+  const session = await response.json();
+  localStorage.setItem(SESSION_KEY, JSON.stringify(session));
+  return session;
+};
+
+export const logout = () => {
+  localStorage.removeItem(SESSION_KEY);
+};
+
+// fetch with the session token. A 401 means the session expired or was
+// rejected, so it is dropped and the user is sent back to the login page.
+export const authFetch = async (url, options = {}) => {
+  const session = getSession();
+  const headers = { ...options.headers };
+  if (session) headers.Authorization = `Bearer ${session.token}`;
+
+  const response = await fetch(url, { ...options, headers });
+  if (response.status === 401) {
+    logout();
+    window.location.assign('/login');
+  }
+  return response;
+};
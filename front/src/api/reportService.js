@@ -1,3 +1,5 @@
+import { authFetch } from './auth';
+
 const API_BASE_URL = 'http://localhost:8080/reports'; // Your backend URL
 
 
@@ -7,7 +9,7 @@ export const fetchMonthlyShiftAssignmentsReport = async (startDate, endDate, fil
     end_date: endDate,
     ...filters,
   });
-  const response = await fetch(`${API_BASE_URL}/monthly-shifts?${params.toString()}`); // Assuming endpoint is /reports/monthly-shifts
+  const response = await authFetch(`${API_BASE_URL}/monthly-shifts?${params.toString()}`); // Assuming endpoint is /reports/monthly-shifts
 
   if (!response.ok) {
     const errorBody = await response.text();
@@ -21,7 +23,7 @@ export const fetchLeaveAnalysisReport = async (startDate, endDate, filters = {})
     end_date: endDate,
     ...filters,
   });
-  const response = await fetch(`${API_BASE_URL}/leave-analysis?${params.toString()}`);
+  const response = await authFetch(`${API_BASE_URL}/leave-analysis?${params.toString()}`);
   if (!response.ok) {
     throw new Error(`Error fetching leave analysis report: ${response.statusText}`);
   }
@@ -34,7 +36,7 @@ export const fetchStaffWorkloadReport = async (startDate, endDate, filters = {})
     end_date: endDate,
     ...filters,
   });
-  const response = await fetch(`${API_BASE_URL}/oncall-analysis?${params.toString()}`);
+  const response = await authFetch(`${API_BASE_URL}/oncall-analysis?${params.toString()}`);
   if (!response.ok) {
     throw new Error(`Error fetching staff workload report: ${response.statusText}`);
   }
@@ -47,7 +49,7 @@ export const fetchOvertimeReport = async (startDate, endDate, filters = {}) => {
     end_date: endDate,
     ...filters,
   });
-  const response = await fetch(`${API_BASE_URL}/overtime?${params.toString()}`);
+  const response = await authFetch(`${API_BASE_URL}/overtime?${params.toString()}`);
   if (!response.ok) {
     throw new Error(`Error fetching overtime report: ${response.statusText}`);
   }
@@ -60,7 +62,7 @@ export const fetchStaffPreferenceReport = async (startDate, endDate, filters = {
     end_date: endDate,
     ...filters,
   });
-  const response = await fetch(`${API_BASE_URL}/shift-preference?${params.toString()}`);
+  const response = await authFetch(`${API_BASE_URL}/shift-preference?${params.toString()}`);
   if (!response.ok) {
     throw new Error(`Error fetching staff preference report: ${response.statusText}`);
   }
@@ -73,9 +75,22 @@ export const fetchHoursWorkedReport = async (startDate, endDate, filters = {}) =
     end_date: endDate,
     ...filters,
   });
-  const response = await fetch(`${API_BASE_URL}/work-hours?${params.toString()}`);
+  const response = await authFetch(`${API_BASE_URL}/work-hours?${params.toString()}`);
   if (!response.ok) {
     throw new Error(`Error fetching hours worked report: ${response.statusText}`);
   }
   return response.json();
 };
+
+// Reports return one page of rows at a time, this follows next_cursor to
+// collect every row of a report (for the exports)
+export const fetchAllRows = async (fetchReport, startDate, endDate, filters = {}) => {
+  const rows = [];
+  let page = await fetchReport(startDate, endDate, { ...filters, limit: 1000 });
+  rows.push(...page.rows);
+  while (page.next_cursor) {
+    page = await fetchReport(startDate, endDate, { ...filters, limit: 1000, cursor: page.next_cursor });
+    rows.push(...page.rows);
+  }
+  return rows;
+};
@@ -5,11 +5,20 @@ import StaffWorkloadReport from '../views/StaffWorkloadReport.vue';
 import StaffPreferenceReport from '../views/StaffPreferenceReport.vue';
 import LeaveAnalysisReport from '../views/LeaveAnalysisReport.vue';
 import WorkByMonth from '../views/WorkByMonth.vue'
+import LoginView from '../views/LoginView.vue';
+import { isLoggedIn } from '../api/auth';
+
 const routes = [
   {
     path: '/',
     redirect: '/reports/work-hours'
   },
+  {
+    path: '/login',
+    name: 'Login',
+    component: LoginView,
+    meta: { public: true }
+  },
   {
     path: '/reports/work-hours',
     name: 'WorkHoursReport',
@@ -47,4 +56,11 @@ const router = createRouter({
   routes,
 });
 
+// Every page but the login needs a session, the API answers 401 otherwise
+router.beforeEach((to) => {
+  if (!to.meta.public && !isLoggedIn()) {
+    return { name: 'Login', query: { redirect: to.fullPath } };
+  }
+});
+
 export default router;